@@ -1,6 +1,11 @@
 package cmd
 
 import (
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/404LifeFound/es-snapshot-restore/internal/approval"
+	"github.com/404LifeFound/es-snapshot-restore/internal/audit"
+	"github.com/404LifeFound/es-snapshot-restore/internal/auth"
+	"github.com/404LifeFound/es-snapshot-restore/internal/budget"
 	"github.com/404LifeFound/es-snapshot-restore/internal/cache"
 	"github.com/404LifeFound/es-snapshot-restore/internal/controller/controller"
 	"github.com/404LifeFound/es-snapshot-restore/internal/cron"
@@ -8,6 +13,13 @@ import (
 	"github.com/404LifeFound/es-snapshot-restore/internal/elastic"
 	"github.com/404LifeFound/es-snapshot-restore/internal/http"
 	"github.com/404LifeFound/es-snapshot-restore/internal/k8s"
+	"github.com/404LifeFound/es-snapshot-restore/internal/notify"
+	"github.com/404LifeFound/es-snapshot-restore/internal/policy"
+	"github.com/404LifeFound/es-snapshot-restore/internal/pool"
+	"github.com/404LifeFound/es-snapshot-restore/internal/preflight"
+	"github.com/404LifeFound/es-snapshot-restore/internal/provisioner"
+	"github.com/404LifeFound/es-snapshot-restore/internal/throttle"
+	"github.com/404LifeFound/es-snapshot-restore/internal/worker"
 	"github.com/ipfans/fxlogger"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
@@ -23,19 +35,28 @@ func NewServerCmd() *cobra.Command {
 			app := fx.New(
 				fx.Provide(
 					cache.NewCache,
+					cache.NewBroker,
+					auth.NewAuthenticator,
+					policy.NewEngine,
+					approval.NewApprovals,
+					audit.NewAuditor,
+					notify.NewNotifier,
 					http.NewGinEngine,
 					db.NewDB,
 					elastic.NewDefaultESConfig,
 					elastic.NewES,
 					cron.NewCron,
-					k8s.NewClient,
-					controller.NewManager,
-					controller.NewRestoreReconcilerCtrl,
+					provisioner.NewProvisioner,
+					budget.NewBudget,
+					pool.NewPool,
+					preflight.NewChecker,
+					throttle.NewManager,
+					worker.NewWorker,
 				),
+				KubeModule(),
 				fx.Invoke(
 					http.RegisterHandler,
 					cron.RegisterJobs,
-					controller.RunManager,
 				),
 				fx.WithLogger(fxlogger.WithZerolog(log.Logger)),
 			)
@@ -49,6 +70,10 @@ func NewServerCmd() *cobra.Command {
 	flags.String("http-host", "127.0.0.1", "http host")
 	flags.Int("http-port", 8080, "http port")
 	flags.Bool("http-releasemode", false, "run http server on release mode")
+	flags.String("http-tlscert", "", "tls cert file, set with http-tlskey to serve https")
+	flags.String("http-tlskey", "", "tls key file")
+	flags.String("http-clientca", "", "ca file verifying the client certs of the https requests")
+	flags.StringSlice("http-trustedproxies", []string{}, "ips or cidrs of the proxies whose X-Forwarded-For header gives the client ip")
 
 	// flags for kibana
 	flags.String("kibana-host", "127.0.0.1", "kibana host")
@@ -69,6 +94,8 @@ func NewServerCmd() *cobra.Command {
 
 	// flags for cronjob
 	flags.String("cron-schedule", "0 */10 * * * *", "cron job schedule")
+	flags.Int("cron-statuslimit", 20, "max snapshots to read status from per cron run")
+	flags.Int("cron-statusinterval", 1000, "interval between snapshot status requests,unit is millisecond")
 
 	//flags for es
 	flags.String("es-restorekey", "restore", "restore attr key")
@@ -90,10 +117,129 @@ func NewServerCmd() *cobra.Command {
 	flags.Int("es-interval", 10, "check restore process interval,unit is secend")
 	flags.StringToString("es-labels", map[string]string{}, "es labels")
 	flags.StringToString("es-annotations", map[string]string{}, "es annotations")
-	flags.StringToString("es-tolerations", map[string]string{}, "es tolerations")
+	flags.String("es-isolation", "nodeset", "restore isolation, nodeset or cluster")
+	flags.String("es-antiaffinity", "required", "restore pod anti affinity, required, preferred or none")
+	flags.Int32("es-antiaffinityweight", 100, "weight of preferred restore pod anti affinity")
+	flags.String("es-zonekey", "topology.kubernetes.io/zone", "node label key used to pin restore pods to zones")
+	flags.StringSlice("es-zones", []string{}, "zones the restore pods are pinned to")
+
+	//flags for restore node sizing, size unit is GB
+	flags.Float64("sizing-maxdiskpernode", 500, "max disk size of one restore node")
+	flags.Float64("sizing-highwatermark", 0.85, "disk high watermark ratio the restore node must stay below")
+	flags.Float64("sizing-dataratio", 30, "GB of data served by 1 GB of memory")
+	flags.Float64("sizing-minmemory", 2, "min memory of one restore node")
+	flags.Float64("sizing-maxmemory", 64, "max memory of one restore node")
+	flags.Float64("sizing-heapratio", 0.5, "ratio of memory used as jvm heap")
+	flags.Float64("sizing-maxheap", 31, "max jvm heap of one restore node")
+	flags.Float64("sizing-memorypercpu", 4, "GB of memory per cpu")
+	flags.Float64("sizing-maxcpu", 16, "max cpu of one restore node")
+	flags.Int("sizing-maxshardspernode", 1000, "max shards of one restore node")
+
+	//flags for restore capacity provisioner
+	flags.String("provisioner-type", "eck", "eck to add restore nodes through ECK, or static to restore into a pre-existing node pool")
+	flags.String("provisioner-staticattrvalue", "restore", "value of the restore node attribute of the static node pool")
+
+	//flags for restore node pool
+	flags.Bool("pool-enabled", true, "reuse warm restore nodes with enough free disk across tasks")
+	flags.Bool("pool-reclaim", false, "delete the restored indices of idle restore nodes and tear them down")
+	flags.Int("pool-idletimeout", 60, "minutes an idle restore node is kept before it is reclaimed")
+	flags.Int("pool-taskttl", 0, "minutes a restored task holds its restore node once finished, 0 until it is released")
+	flags.String("pool-schedule", "0 */5 * * * *", "cron schedule to reclaim idle restore nodes")
+
+	//flags for preflight checks
+	flags.Bool("preflight-enabled", true, "check the cluster can accept a RestoreTask before provisioning it")
+
+	//flags for pausing restores
+	flags.String("pause-recoveryrate", "1kb", "indices.recovery.max_bytes_per_sec while a restore is paused by throttling")
+
+	//flags for recovery bandwidth while restores run, empty or 0 leaves the setting alone
+	flags.String("throttle-maxbytespersec", "", "indices.recovery.max_bytes_per_sec while restores run")
+	flags.Int("throttle-concurrentrecoveries", 0, "cluster.routing.allocation.node_concurrent_recoveries while restores run")
+	flags.String("throttle-restorebytespersec", "", "max_restore_bytes_per_sec of the snapshot repository while restores run")
+
+	//flags for retry policy of failed restores
+	flags.Int("retry-maxattempts", 3, "attempts to restore an index, 1 disables retries")
+	flags.Int("retry-backoff", 30, "seconds before the second attempt")
+	flags.Int("retry-maxbackoff", 600, "max seconds between two attempts")
+	flags.Float64("retry-multiplier", 2, "backoff multiplier between two attempts")
+	flags.Float64("retry-jitter", 0.1, "fraction of the backoff added at random")
+	flags.IntSlice("retry-statuscodes", []int{429, 502, 503, 504}, "retryable http status of the restore request")
+	flags.StringSlice("retry-reasons", []string{"concurrent_snapshot_execution_exception", "snapshot_in_progress_exception"}, "retryable Elasticsearch error types of the restore request")
+	flags.Bool("retry-partialfailure", true, "retry a restore whose shards failed to recover")
+	flags.Bool("retry-timeout", true, "retry a restore which timed out")
+
+	//flags for restore capacity budget, 0 is unlimited, size unit is GB
+	flags.Bool("budget-enabled", false, "enforce the restore capacity budget")
+	flags.Float64("budget-limit-diskgb", 0, "total disk of all restore nodes")
+	flags.Float64("budget-limit-cpu", 0, "total cpu of all restore nodes")
+	flags.Float64("budget-limit-memorygb", 0, "total memory of all restore nodes")
+	flags.Int("budget-retryinterval", 30, "seconds between two admissions of a task queued on an exhausted budget or a full restore queue")
+
+	//flags for api authentication, the tokens, principals and teams are set in the config file
+	flags.Bool("auth-enabled", false, "authenticate the api requests and check the role of the caller")
+	flags.String("auth-defaultrole", "viewer", "role of an authenticated caller without one")
+	flags.String("auth-jwt-jwksfile", "", "jwks file verifying the jwt bearer tokens")
+	flags.String("auth-jwt-jwksurl", "", "jwks url verifying the jwt bearer tokens")
+	flags.String("auth-jwt-issuer", "", "expected issuer of the jwt bearer tokens, empty to skip the check")
+	flags.String("auth-jwt-audience", "", "expected audience of the jwt bearer tokens, empty to skip the check")
+	flags.String("auth-jwt-roleclaim", "role", "jwt claim holding the role, or roles, of the caller")
+	flags.String("auth-jwt-teamclaim", "team", "jwt claim holding the team of the caller")
+	flags.Int("auth-jwt-refreshinterval", 60, "minutes between two reloads of the jwks")
+
+	//flags for restore admission policies, the rules are set in the config file
+	flags.Bool("policy-enabled", false, "admit the restores with the policy rules")
+	flags.String("policy-default", "allow", "effect when no policy rule matches, allow, deny or require_approval")
+	flags.Int("policy-webhookport", 0, "port of the RestoreTask validating webhook, 0 disables it")
+	flags.String("policy-webhookcertdir", "", "directory of the tls.crt and tls.key of the RestoreTask validating webhook")
+
+	//flags for approvals of the restores requiring one
+	flags.Int("approval-ttl", 1440, "minutes a restore waits for its approval before it is canceled")
+	flags.String("approval-schedule", "0 */5 * * * *", "cron schedule to cancel the restores whose approval expired")
+	flags.Bool("approval-selfapproval", false, "let the requester of a restore approve it")
+
+	//flags for task notifications, the channels are set in the config file
+	flags.Bool("notify-enabled", false, "notify the requesters of the task lifecycle events")
+	flags.Int("notify-expirywarning", 30, "minutes before an idle restore node is reclaimed its requesters are warned")
+	flags.Int("notify-maxattempts", 5, "max deliveries of a notification")
+	flags.Int("notify-backoff", 30, "seconds before the second delivery of a notification, doubled after each attempt")
+	flags.Int("notify-timeout", 10, "seconds a delivery may take")
+	flags.String("notify-schedule", "*/30 * * * * *", "cron schedule to retry the notifications and warn of expiring restores")
+	flags.String("notify-smtp-host", "", "smtp server of the email channels")
+	flags.Int("notify-smtp-port", 587, "smtp port")
+	flags.String("notify-smtp-username", "", "smtp username, empty sends without authentication")
+	flags.String("notify-smtp-password", "", "smtp password")
+	flags.String("notify-smtp-from", "", "sender of the emails")
+
+	//flags for idempotent requests
+	flags.Int("idempotency-retention", 1440, "minutes the response of a request with an Idempotency-Key is replayed to its retries")
+	flags.String("idempotency-schedule", "0 */10 * * * *", "cron schedule to delete the expired idempotency keys")
 
 	//flags for kubernetes
-	flags.String("kube-config", "~/.kube/config", "kubeconfig file path")
+	flags.Bool("kube-enabled", true, "run the kubernetes client and the RestoreTask controller")
+	flags.String("kube-config", "", "kubeconfig file path, empty to use the in cluster config or KUBECONFIG and ~/.kube/config")
+	flags.String("kube-context", "", "kubeconfig context, empty to use the current context")
 
 	return serverCmd
 }
+
+// KubeModule provides the kubernetes client and runs the RestoreTask controller when kube.enabled is set
+func KubeModule() fx.Option {
+	if !config.GlobalConfig.Kube.Enabled {
+		log.Info().Msg("kubernetes is disabled, RestoreTask controller will not run")
+		return fx.Options()
+	}
+
+	return fx.Module("kube",
+		fx.Provide(
+			k8s.NewRestConfig,
+			k8s.NewScheme,
+			k8s.NewClient,
+			controller.NewManager,
+			controller.NewRestoreReconcilerCtrl,
+		),
+		fx.Invoke(
+			controller.SetupRestoreTaskWebhook,
+			controller.RunManager,
+		),
+	)
+}
@@ -25,6 +25,20 @@ type Config struct {
 	Redis      Redis  `koanf:"redis" json:"redis" yaml:"redis"`
 	Cron       Cron   `koanf:"cron" json:"cron" yaml:"cron"`
 	Kube       Kube   `koanf:"kube" json:"kube" yaml:"kube"`
+	Sizing     Sizing `koanf:"sizing" json:"sizing" yaml:"sizing"`
+
+	Provisioner Provisioner `koanf:"provisioner" json:"provisioner" yaml:"provisioner"`
+	Pool        Pool        `koanf:"pool" json:"pool" yaml:"pool"`
+	Budget      Budget      `koanf:"budget" json:"budget" yaml:"budget"`
+	Preflight   Preflight   `koanf:"preflight" json:"preflight" yaml:"preflight"`
+	Pause       Pause       `koanf:"pause" json:"pause" yaml:"pause"`
+	Retry       Retry       `koanf:"retry" json:"retry" yaml:"retry"`
+	Throttle    Throttle    `koanf:"throttle" json:"throttle" yaml:"throttle"`
+	Auth        Auth        `koanf:"auth" json:"auth" yaml:"auth"`
+	Policy      Policy      `koanf:"policy" json:"policy" yaml:"policy"`
+	Approval    Approval    `koanf:"approval" json:"approval" yaml:"approval"`
+	Notify      Notify      `koanf:"notify" json:"notify" yaml:"notify"`
+	Idempotency Idempotency `koanf:"idempotency" json:"idempotency" yaml:"idempotency"`
 }
 
 type Conf struct {
@@ -39,6 +53,13 @@ type Http struct {
 	Host        string `koanf:"host" yaml:"host" json:"host"`
 	Port        int    `koanf:"port" yaml:"port" json:"port"`
 	ReleaseMode bool   `koanf:"releaseMode" yaml:"releaseMode" json:"releaseMode"`
+	// TLSCert and TLSKey serve https instead of http
+	TLSCert string `koanf:"tlscert" yaml:"tls_cert" json:"tls_cert"`
+	TLSKey  string `koanf:"tlskey" yaml:"tls_key" json:"tls_key"`
+	// ClientCA verifies the client certs of the https requests, their common name authenticates the caller
+	ClientCA string `koanf:"clientca" yaml:"client_ca" json:"client_ca"`
+	// TrustedProxies are the proxies whose X-Forwarded-For header gives the client ip, none when empty
+	TrustedProxies []string `koanf:"trustedproxies" yaml:"trusted_proxies" json:"trusted_proxies"`
 }
 
 type ES struct {
@@ -61,7 +82,7 @@ type ES struct {
 	Labels         map[string]string `koanf:"labels" yaml:"labels" json:"labels"`
 	Annotations    map[string]string `koanf:"annotations" yaml:"annotations" json:"annotations"`
 	NodeAffinity   v1.NodeAffinity   `koanf:"nodeaffinity" yaml:"nodeAffinity" json:"nodeAffinity"`
-	Tolerations    map[string]string `koanf:"tolerations" yaml:"tolerations" json:"tolerations"`
+	Tolerations    []v1.Toleration   `koanf:"tolerations" yaml:"tolerations" json:"tolerations"`
 	ContainerName  string            `koanf:"containername" yaml:"container_name" json:"container_name"`
 	TopologyKey    string            `koanf:"topologykey" yaml:"topology_key" json:"topology_key"`
 	DiskMinSize    float64           `koanf:"diskminsize" yaml:"disk_min_size" json:"disk_min_size"`
@@ -70,6 +91,16 @@ type ES struct {
 	MaxTasks       int               `koanf:"maxtasks" yaml:"max_tasks" json:"max_tasks"`
 	Timeout        int               `koanf:"timeout" yaml:"timeout" json:"timeout"`
 	Interval       int               `koanf:"interval" yaml:"interval" json:"interval"`
+
+	// Isolation is nodeset to add restore nodes to the production Elasticsearch, or cluster to restore into a standalone one
+	Isolation string `koanf:"isolation" yaml:"isolation" json:"isolation"`
+
+	// AntiAffinity is one of required, preferred or none
+	AntiAffinity              string                        `koanf:"antiaffinity" yaml:"anti_affinity" json:"anti_affinity"`
+	AntiAffinityWeight        int32                         `koanf:"antiaffinityweight" yaml:"anti_affinity_weight" json:"anti_affinity_weight"`
+	TopologySpreadConstraints []v1.TopologySpreadConstraint `koanf:"topologyspreadconstraints" yaml:"topologySpreadConstraints" json:"topologySpreadConstraints"`
+	ZoneKey                   string                        `koanf:"zonekey" yaml:"zone_key" json:"zone_key"`
+	Zones                     []string                      `koanf:"zones" yaml:"zones" json:"zones"`
 }
 
 type Kibana struct {
@@ -93,9 +124,211 @@ type Redis struct {
 }
 
 type Cron struct {
-	Schedule string `koanf:"schedule" yaml:"schedule" json:"schedule"`
+	Schedule       string `koanf:"schedule" yaml:"schedule" json:"schedule"`
+	StatusLimit    int    `koanf:"statuslimit" yaml:"status_limit" json:"status_limit"`
+	StatusInterval int    `koanf:"statusinterval" yaml:"status_interval" json:"status_interval"`
 }
 
 type Kube struct {
-	Config string `koanf:"config" yaml:"config" json:"config"`
+	// Enabled runs the Kubernetes client and the RestoreTask controller, without it only the static provisioner works
+	Enabled bool   `koanf:"enabled" yaml:"enabled" json:"enabled"`
+	Config  string `koanf:"config" yaml:"config" json:"config"`
+	Context string `koanf:"context" yaml:"context" json:"context"`
+}
+
+type Sizing struct {
+	MaxDiskPerNode   float64 `koanf:"maxdiskpernode" yaml:"max_disk_per_node" json:"max_disk_per_node"`
+	HighWatermark    float64 `koanf:"highwatermark" yaml:"high_watermark" json:"high_watermark"`
+	DataRatio        float64 `koanf:"dataratio" yaml:"data_ratio" json:"data_ratio"`
+	MinMemory        float64 `koanf:"minmemory" yaml:"min_memory" json:"min_memory"`
+	MaxMemory        float64 `koanf:"maxmemory" yaml:"max_memory" json:"max_memory"`
+	HeapRatio        float64 `koanf:"heapratio" yaml:"heap_ratio" json:"heap_ratio"`
+	MaxHeap          float64 `koanf:"maxheap" yaml:"max_heap" json:"max_heap"`
+	MemoryPerCPU     float64 `koanf:"memorypercpu" yaml:"memory_per_cpu" json:"memory_per_cpu"`
+	MaxCPU           float64 `koanf:"maxcpu" yaml:"max_cpu" json:"max_cpu"`
+	MaxShardsPerNode int     `koanf:"maxshardspernode" yaml:"max_shards_per_node" json:"max_shards_per_node"`
+}
+
+type Provisioner struct {
+	// Type is eck to add restore capacity through ECK, or static to restore into a pre-existing pool of nodes
+	Type string `koanf:"type" yaml:"type" json:"type"`
+	// StaticAttrValue is the value of the es.restorekey node attribute of the static node pool
+	StaticAttrValue string `koanf:"staticattrvalue" yaml:"static_attr_value" json:"static_attr_value"`
+}
+
+type Pool struct {
+	// Enabled places new tasks on a warm restore node with enough free disk instead of adding one per task
+	Enabled bool `koanf:"enabled" yaml:"enabled" json:"enabled"`
+	// Reclaim deletes the restored indices of the restore nodes idle for idletimeout minutes and tears them down, a
+	// node holding a restored task neither released nor past taskttl isn't idle
+	Reclaim bool `koanf:"reclaim" yaml:"reclaim" json:"reclaim"`
+	// IdleTimeout is the minutes a restore node without task is kept before it is reclaimed
+	IdleTimeout int `koanf:"idletimeout" yaml:"idle_timeout" json:"idle_timeout"`
+	// TaskTTL is the minutes a restored task holds its restore node once finished, 0 holds it until it is released
+	TaskTTL  int    `koanf:"taskttl" yaml:"task_ttl" json:"task_ttl"`
+	Schedule string `koanf:"schedule" yaml:"schedule" json:"schedule"`
+}
+
+type Budget struct {
+	Enabled bool `koanf:"enabled" yaml:"enabled" json:"enabled"`
+	// Limit bounds all the restore nodes of the cluster
+	Limit Quota `koanf:"limit" yaml:"limit" json:"limit"`
+	// Teams bounds the restore nodes of a team, the team of a RestoreTask is its namespace unless labeled
+	Teams map[string]Quota `koanf:"teams" yaml:"teams" json:"teams"`
+	// RetryInterval is the seconds between two admissions of a task queued on an exhausted budget or a full restore
+	// queue
+	RetryInterval int `koanf:"retryinterval" yaml:"retry_interval" json:"retry_interval"`
+}
+
+// Quota of restore capacity, a zero field is unlimited, size unit is GB
+type Quota struct {
+	DiskGB   float64 `koanf:"diskgb" yaml:"disk_gb" json:"disk_gb"`
+	CPU      float64 `koanf:"cpu" yaml:"cpu" json:"cpu"`
+	MemoryGB float64 `koanf:"memorygb" yaml:"memory_gb" json:"memory_gb"`
+}
+
+type Preflight struct {
+	// Enabled makes the RestoreTask controller fail a task whose preflight checks fail before provisioning it
+	Enabled bool `koanf:"enabled" yaml:"enabled" json:"enabled"`
+}
+
+type Pause struct {
+	// RecoveryRate is the indices.recovery.max_bytes_per_sec set while a restore is paused by throttling, 0 would
+	// be unlimited
+	RecoveryRate string `koanf:"recoveryrate" yaml:"recovery_rate" json:"recovery_rate"`
+}
+
+// Retry is the policy of restoring an index again after a failed attempt, the backoff before attempt n is
+// Backoff * Multiplier^(n-2) seconds plus up to Jitter of it at random, up to MaxBackoff
+type Retry struct {
+	MaxAttempts int     `koanf:"maxattempts" yaml:"max_attempts" json:"max_attempts"`
+	Backoff     int     `koanf:"backoff" yaml:"backoff" json:"backoff"`
+	MaxBackoff  int     `koanf:"maxbackoff" yaml:"max_backoff" json:"max_backoff"`
+	Multiplier  float64 `koanf:"multiplier" yaml:"multiplier" json:"multiplier"`
+	// Jitter is the fraction of the backoff added at random, so the tasks failing together don't retry together
+	Jitter float64 `koanf:"jitter" yaml:"jitter" json:"jitter"`
+	// StatusCodes are the retryable http status of the restore request
+	StatusCodes []int `koanf:"statuscodes" yaml:"status_codes" json:"status_codes"`
+	// Reasons are the retryable Elasticsearch error types of the restore request
+	Reasons []string `koanf:"reasons" yaml:"reasons" json:"reasons"`
+	// PartialFailure retries a restore whose shards failed to recover
+	PartialFailure bool `koanf:"partialfailure" yaml:"partial_failure" json:"partial_failure"`
+	// Timeout retries a restore not finished after es.timeout minutes
+	Timeout bool `koanf:"timeout" yaml:"timeout" json:"timeout"`
+}
+
+// Throttle is the recovery bandwidth of a restore not setting its own, empty or 0 leaves the setting alone
+type Throttle struct {
+	MaxBytesPerSec       string `koanf:"maxbytespersec" yaml:"max_bytes_per_sec" json:"max_bytes_per_sec"`
+	ConcurrentRecoveries int    `koanf:"concurrentrecoveries" yaml:"concurrent_recoveries" json:"concurrent_recoveries"`
+	RestoreBytesPerSec   string `koanf:"restorebytespersec" yaml:"restore_bytes_per_sec" json:"restore_bytes_per_sec"`
+}
+
+type Auth struct {
+	// Enabled authenticates the api requests and checks the role of the caller, without it every caller is admin
+	Enabled bool `koanf:"enabled" yaml:"enabled" json:"enabled"`
+	// DefaultRole is the role of an authenticated caller neither a principal nor a jwt claim gives one
+	DefaultRole string `koanf:"defaultrole" yaml:"default_role" json:"default_role"`
+	// Tokens are the static api tokens, sent as bearer tokens
+	Tokens []Principal `koanf:"tokens" yaml:"tokens" json:"tokens"`
+	// Principals are the jwt subjects and the common names of the client certs with their role, team and indices
+	Principals []Principal `koanf:"principals" yaml:"principals" json:"principals"`
+	// Teams are the index patterns the members of a team may restore
+	Teams map[string][]string `koanf:"teams" yaml:"teams" json:"teams"`
+	JWT   JWT                 `koanf:"jwt" yaml:"jwt" json:"jwt"`
+}
+
+// Principal is a caller, Role is one of viewer, requester, operator or admin and Indices are the index patterns it
+// may restore on top of the ones of its team
+type Principal struct {
+	Subject string   `koanf:"subject" yaml:"subject" json:"subject"`
+	Token   string   `koanf:"token" yaml:"token" json:"token"`
+	Role    string   `koanf:"role" yaml:"role" json:"role"`
+	Team    string   `koanf:"team" yaml:"team" json:"team"`
+	Indices []string `koanf:"indices" yaml:"indices" json:"indices"`
+}
+
+// JWT verifies the OIDC bearer tokens with the keys of JWKSFile or JWKSURL, reloaded every RefreshInterval minutes
+type JWT struct {
+	JWKSFile        string `koanf:"jwksfile" yaml:"jwks_file" json:"jwks_file"`
+	JWKSURL         string `koanf:"jwksurl" yaml:"jwks_url" json:"jwks_url"`
+	Issuer          string `koanf:"issuer" yaml:"issuer" json:"issuer"`
+	Audience        string `koanf:"audience" yaml:"audience" json:"audience"`
+	RoleClaim       string `koanf:"roleclaim" yaml:"role_claim" json:"role_claim"`
+	TeamClaim       string `koanf:"teamclaim" yaml:"team_claim" json:"team_claim"`
+	RefreshInterval int    `koanf:"refreshinterval" yaml:"refresh_interval" json:"refresh_interval"`
+}
+
+// Policy admits the restores with the first rule whose expression is true, Default decides when none is
+type Policy struct {
+	Enabled bool `koanf:"enabled" yaml:"enabled" json:"enabled"`
+	// Default is allow, deny or require_approval
+	Default string       `koanf:"default" yaml:"default" json:"default"`
+	Rules   []PolicyRule `koanf:"rules" yaml:"rules" json:"rules"`
+	// WebhookPort serves the validating webhook of the RestoreTasks on the controller manager, 0 disables it
+	WebhookPort    int    `koanf:"webhookport" yaml:"webhook_port" json:"webhook_port"`
+	WebhookCertDir string `koanf:"webhookcertdir" yaml:"webhook_cert_dir" json:"webhook_cert_dir"`
+}
+
+type PolicyRule struct {
+	Name string `koanf:"name" yaml:"name" json:"name"`
+	// Expression is a CEL expression over request, identity, plan, usage and now
+	Expression string `koanf:"expression" yaml:"expression" json:"expression"`
+	// Effect is allow, deny or require_approval
+	Effect string `koanf:"effect" yaml:"effect" json:"effect"`
+	// Reason is returned to the user when the rule decides
+	Reason string `koanf:"reason" yaml:"reason" json:"reason"`
+}
+
+// Approval is how the restores a policy rule requires an approval for wait for it, an unapproved one is canceled
+// after TTL minutes
+type Approval struct {
+	TTL      int    `koanf:"ttl" yaml:"ttl" json:"ttl"`
+	Schedule string `koanf:"schedule" yaml:"schedule" json:"schedule"`
+	// SelfApproval lets the requester of a restore approve it
+	SelfApproval bool `koanf:"selfapproval" yaml:"self_approval" json:"self_approval"`
+}
+
+// Notify sends the lifecycle events of the tasks to the channels, a requester narrows the events and channels it
+// receives with its subscription
+type Notify struct {
+	Enabled  bool            `koanf:"enabled" yaml:"enabled" json:"enabled"`
+	Channels []NotifyChannel `koanf:"channels" yaml:"channels" json:"channels"`
+	// ExpiryWarning is the minutes before an idle restore node is reclaimed its requesters are warned
+	ExpiryWarning int `koanf:"expirywarning" yaml:"expiry_warning" json:"expiry_warning"`
+	// MaxAttempts bounds the deliveries of a notification, the backoff before attempt n is Backoff * 2^(n-2) seconds
+	MaxAttempts int `koanf:"maxattempts" yaml:"max_attempts" json:"max_attempts"`
+	Backoff     int `koanf:"backoff" yaml:"backoff" json:"backoff"`
+	// Timeout is the seconds a delivery may take
+	Timeout  int    `koanf:"timeout" yaml:"timeout" json:"timeout"`
+	Schedule string `koanf:"schedule" yaml:"schedule" json:"schedule"`
+	SMTP     SMTP   `koanf:"smtp" yaml:"smtp" json:"smtp"`
+}
+
+// NotifyChannel is where the events are sent, Type is webhook, slack, teams or email
+type NotifyChannel struct {
+	Name string `koanf:"name" yaml:"name" json:"name"`
+	Type string `koanf:"type" yaml:"type" json:"type"`
+	URL  string `koanf:"url" yaml:"url" json:"url"`
+	// Secret signs the body of the webhook requests with HMAC-SHA256
+	Secret string `koanf:"secret" yaml:"secret" json:"secret"`
+	// To are the email recipients on top of the email of the requester subscription
+	To []string `koanf:"to" yaml:"to" json:"to"`
+	// Events are the events sent to the channel, empty for all of them
+	Events []string `koanf:"events" yaml:"events" json:"events"`
+}
+
+type SMTP struct {
+	Host     string `koanf:"host" yaml:"host" json:"host"`
+	Port     int    `koanf:"port" yaml:"port" json:"port"`
+	Username string `koanf:"username" yaml:"username" json:"username"`
+	Password string `koanf:"password" yaml:"password" json:"password"`
+	From     string `koanf:"from" yaml:"from" json:"from"`
+}
+
+// Idempotency keeps the response of a request sent with an Idempotency-Key header for Retention minutes, a retry
+// with the same key is replied with it
+type Idempotency struct {
+	Retention int    `koanf:"retention" yaml:"retention" json:"retention"`
+	Schedule  string `koanf:"schedule" yaml:"schedule" json:"schedule"`
 }
@@ -0,0 +1,255 @@
+package approval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/404LifeFound/es-snapshot-restore/internal/cache"
+	restorev1 "github.com/404LifeFound/es-snapshot-restore/internal/controller/api/v1"
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/404LifeFound/es-snapshot-restore/internal/k8s"
+	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
+	"github.com/rs/zerolog/log"
+	"go.uber.org/fx"
+	"gorm.io/gorm"
+	runtimeclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	// ErrNotFound is returned when a task has no approval
+	ErrNotFound = errors.New("approval not found")
+	// ErrDecided is returned when the approval of a task was already decided or expired
+	ErrDecided = errors.New("approval already decided")
+	// ErrSelfApproval is returned when the requester of a restore approves it without approval.selfapproval
+	ErrSelfApproval = errors.New("the requester of a restore may not approve it")
+)
+
+type Status string
+
+const (
+	StatusPending  Status = "PENDING"
+	StatusApproved Status = "APPROVED"
+	StatusRejected Status = "REJECTED"
+	StatusExpired  Status = "EXPIRED"
+)
+
+type Params struct {
+	fx.In
+
+	DB     *gorm.DB
+	Events *cache.Broker
+	// K8SClient is only provided when kube.enabled is set
+	K8SClient *k8s.Client `optional:"true"`
+}
+
+// Approvals records the approvals the restores required by a policy rule wait for, and holds their tasks in
+// AWAITING_APPROVAL until one is decided
+type Approvals struct {
+	DBClient  *gorm.DB
+	K8Sclient *k8s.Client
+	Events    *cache.Broker
+}
+
+func NewApprovals(p Params) *Approvals {
+	a := &Approvals{
+		DBClient: p.DB,
+		Events:   p.Events,
+	}
+	if p.K8SClient != nil {
+		a.K8Sclient = p.K8SClient
+	}
+	return a
+}
+
+// Request records the pending approval of the task of approval, expiring after approval.ttl minutes
+func (a *Approvals) Request(approval db.Approval) (db.Approval, error) {
+	approval.Status = string(StatusPending)
+	approval.ExpiresAt = time.Now().Add(time.Duration(config.GlobalConfig.Approval.TTL) * time.Minute)
+	records := []db.Approval{approval}
+	if err := db.CreateRecords(a.DBClient, &records); err != nil {
+		return approval, err
+	}
+	approval = records[0]
+
+	log.Info().Msgf("task id %s of %s awaits an approval until %s: %s", approval.TaskID, approval.Requester, approval.ExpiresAt.Format(time.RFC3339), approval.Reason)
+	a.Events.Publish(context.Background(), cache.Event{
+		TaskID:  approval.TaskID,
+		Type:    cache.EventStatus,
+		Status:  string(utils.TaskAwaitingApproval),
+		Message: approval.Reason,
+	})
+	return approval, nil
+}
+
+// Get returns the approval of the task task_id
+func (a *Approvals) Get(task_id string) (db.Approval, error) {
+	approvals, err := db.QueryAll[db.Approval](a.DBClient, "", 1, "task_id = ?", task_id)
+	if err != nil {
+		return db.Approval{}, err
+	}
+	if len(approvals) == 0 {
+		return db.Approval{}, fmt.Errorf("%w for task id %s", ErrNotFound, task_id)
+	}
+	return approvals[0], nil
+}
+
+// Approve approves the restore of the task task_id. Its RestoreTasks are released to the controller, a task
+// without RestoreTask is left to the caller, which starts the restore of approval.Request.
+func (a *Approvals) Approve(ctx context.Context, task_id, approver, comment string) (db.Approval, error) {
+	approval, err := a.decide(task_id, approver, comment, StatusApproved)
+	if err != nil {
+		return approval, err
+	}
+	if approval.Request != nil {
+		return approval, nil
+	}
+
+	if err := a.DBClient.Model(&db.Task{}).
+		Where("task_id = ? AND status = ?", task_id, string(utils.TaskAwaitingApproval)).
+		Updates(map[string]any{
+			"Status":    string(utils.TaskPending),
+			"StartedAt": time.Now(),
+		}).Error; err != nil {
+		log.Error().Err(err).Msgf("failed to update status of approved task id %s", task_id)
+		return approval, err
+	}
+	a.Events.Publish(ctx, cache.Event{TaskID: task_id, Type: cache.EventStatus, Status: string(utils.TaskPending), Message: fmt.Sprintf("approved by %s", approver)})
+
+	return approval, a.patchRestoreTasks(ctx, task_id, restorev1.ApprovalApproved)
+}
+
+// Reject rejects the restore of the task task_id, which is canceled
+func (a *Approvals) Reject(ctx context.Context, task_id, approver, comment string) (db.Approval, error) {
+	approval, err := a.decide(task_id, approver, comment, StatusRejected)
+	if err != nil {
+		return approval, err
+	}
+
+	reason := fmt.Sprintf("rejected by %s", approver)
+	if comment != "" {
+		reason = fmt.Sprintf("%s: %s", reason, comment)
+	}
+	return approval, a.cancel(ctx, task_id, reason)
+}
+
+// Expire cancels the restores whose approval wasn't decided before it expired
+func (a *Approvals) Expire(ctx context.Context) error {
+	expired, err := db.QueryAll[db.Approval](a.DBClient, "expires_at", 0, "status = ? AND expires_at < ?", string(StatusPending), time.Now())
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, approval := range expired {
+		result := a.DBClient.Model(&db.Approval{}).
+			Where("task_id = ? AND status = ?", approval.TaskID, string(StatusPending)).
+			Updates(map[string]any{
+				"Status":    string(StatusExpired),
+				"DecidedAt": time.Now(),
+			})
+		if result.Error != nil {
+			errs = append(errs, result.Error)
+			continue
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+
+		log.Info().Msgf("approval of task id %s expired", approval.TaskID)
+		if err := a.cancel(ctx, approval.TaskID, fmt.Sprintf("approval expired at %s", approval.ExpiresAt.Format(time.RFC3339))); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// decide records status as the decision of approver on the pending approval of the task task_id, once
+func (a *Approvals) decide(task_id, approver, comment string, status Status) (db.Approval, error) {
+	approval, err := a.Get(task_id)
+	if err != nil {
+		return approval, err
+	}
+	if approval.Status != string(StatusPending) || time.Now().After(approval.ExpiresAt) {
+		return approval, fmt.Errorf("%w, the approval of task id %s is %s", ErrDecided, task_id, approvalStatus(approval))
+	}
+	if status == StatusApproved && approver == approval.Requester && !config.GlobalConfig.Approval.SelfApproval {
+		return approval, ErrSelfApproval
+	}
+
+	now := time.Now()
+	result := a.DBClient.Model(&db.Approval{}).
+		Where("task_id = ? AND status = ?", task_id, string(StatusPending)).
+		Updates(map[string]any{
+			"Status":    string(status),
+			"Approver":  approver,
+			"Comment":   comment,
+			"DecidedAt": now,
+		})
+	if result.Error != nil {
+		return approval, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return approval, fmt.Errorf("%w, the approval of task id %s was decided meanwhile", ErrDecided, task_id)
+	}
+
+	log.Info().Msgf("restore of task id %s is %s by %s", task_id, status, approver)
+	approval.Status = string(status)
+	approval.Approver = approver
+	approval.Comment = comment
+	approval.DecidedAt = &now
+	return approval, nil
+}
+
+// cancel cancels the tasks of task_id awaiting an approval with reason
+func (a *Approvals) cancel(ctx context.Context, task_id, reason string) error {
+	if err := a.DBClient.Model(&db.Task{}).
+		Where("task_id = ? AND status = ?", task_id, string(utils.TaskAwaitingApproval)).
+		Updates(map[string]any{
+			"Status":       string(utils.TaskCanceled),
+			"ErrorMessage": utils.PtrToAny(reason),
+			"FinishedAt":   time.Now(),
+		}).Error; err != nil {
+		log.Error().Err(err).Msgf("failed to cancel task id %s", task_id)
+		return err
+	}
+	a.Events.Publish(ctx, cache.Event{TaskID: task_id, Type: cache.EventStatus, Status: string(utils.TaskCanceled), Message: reason})
+
+	return a.patchRestoreTasks(ctx, task_id, restorev1.ApprovalRejected)
+}
+
+// patchRestoreTasks sets the approval of the pending RestoreTasks of task_id, none when kubernetes is disabled. A
+// RestoreTask without approval is pending too, its approval was dropped by a CRD missing the field.
+func (a *Approvals) patchRestoreTasks(ctx context.Context, task_id string, state restorev1.ApprovalState) error {
+	if a.K8Sclient == nil {
+		return nil
+	}
+
+	var list restorev1.RestoreTaskList
+	if err := a.K8Sclient.List(ctx, &list, runtimeclient.InNamespace(config.GlobalConfig.ES.Namespace)); err != nil {
+		return err
+	}
+	for i := range list.Items {
+		restore_task := &list.Items[i]
+		if restore_task.Spec.TaskId != task_id || (restore_task.Spec.Approval != restorev1.ApprovalPending && restore_task.Spec.Approval != "") {
+			continue
+		}
+		original := restore_task.DeepCopy()
+		restore_task.Spec.Approval = state
+		if err := a.K8Sclient.Patch(ctx, restore_task, runtimeclient.MergeFrom(original)); err != nil {
+			log.Error().Err(err).Msgf("failed to set approval of RestoreTask %s to %s", restore_task.Name, state)
+			return err
+		}
+	}
+	return nil
+}
+
+// approvalStatus is the status of approval, a pending one past its expiry is expired already
+func approvalStatus(approval db.Approval) string {
+	if approval.Status == string(StatusPending) && time.Now().After(approval.ExpiresAt) {
+		return string(StatusExpired)
+	}
+	return approval.Status
+}
@@ -0,0 +1,30 @@
+package approval
+
+import (
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+)
+
+func TestApproval(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "Approval Suite")
+}
+
+// newTestDB opens a sqlite db of the approvals and their tasks, removed after the spec
+func newTestDB() *gorm.DB {
+	db_client, err := gorm.Open(sqlite.Open(filepath.Join(GinkgoT().TempDir(), "approval.db")), &gorm.Config{
+		Logger: logger.Discard,
+	})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(db_client.AutoMigrate(&db.Approval{}, &db.Task{})).To(Succeed())
+	return db_client
+}
@@ -0,0 +1,172 @@
+package approval
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.uber.org/fx/fxtest"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	runtimeclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/404LifeFound/es-snapshot-restore/internal/cache"
+	restorev1 "github.com/404LifeFound/es-snapshot-restore/internal/controller/api/v1"
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/404LifeFound/es-snapshot-restore/internal/k8s"
+	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
+)
+
+var _ = Describe("Approvals", func() {
+	var a *Approvals
+
+	BeforeEach(func() {
+		saved := config.GlobalConfig
+		DeferCleanup(func() { config.GlobalConfig = saved })
+		config.GlobalConfig.ES.Namespace = "es"
+		config.GlobalConfig.Approval = config.Approval{TTL: 60}
+
+		scheme := runtime.NewScheme()
+		Expect(restorev1.AddToScheme(scheme)).To(Succeed())
+		k8s_client := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			&restorev1.RestoreTask{
+				ObjectMeta: metav1.ObjectMeta{Name: "restore-logs", Namespace: "es"},
+				Spec:       restorev1.RestoreTaskSpec{TaskId: "task", Approval: restorev1.ApprovalPending},
+			},
+			&restorev1.RestoreTask{
+				ObjectMeta: metav1.ObjectMeta{Name: "restore-other", Namespace: "es"},
+				Spec:       restorev1.RestoreTaskSpec{TaskId: "other", Approval: restorev1.ApprovalPending},
+			},
+		).Build()
+
+		a = NewApprovals(Params{
+			DB:        newTestDB(),
+			Events:    cache.NewBroker(fxtest.NewLifecycle(GinkgoT())),
+			K8SClient: &k8s.Client{Client: k8s_client},
+		})
+		Expect(db.CreateRecords(a.DBClient, &[]db.Task{
+			{TaskID: "task", Index: "logs", Status: string(utils.TaskAwaitingApproval)},
+			{TaskID: "task", Index: "metrics", Status: string(utils.TaskAwaitingApproval)},
+			{TaskID: "other", Index: "logs", Status: string(utils.TaskAwaitingApproval)},
+		})).To(Succeed())
+
+		approval, err := a.Request(db.Approval{TaskID: "task", Requester: "alice", Reason: "restore of a pii index"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(approval.Status).To(Equal(string(StatusPending)))
+		Expect(approval.ExpiresAt).To(BeTemporally("~", time.Now().Add(time.Hour), time.Second))
+	})
+
+	statuses := func(task_id string) []string {
+		tasks, err := db.QueryAll[db.Task](a.DBClient, "id", 0, "task_id = ?", task_id)
+		Expect(err).NotTo(HaveOccurred())
+		var statuses []string
+		for _, t := range tasks {
+			statuses = append(statuses, t.Status)
+		}
+		return statuses
+	}
+
+	approvalOf := func(name string) restorev1.ApprovalState {
+		var restore_task restorev1.RestoreTask
+		Expect(a.K8Sclient.Get(context.Background(), runtimeclient.ObjectKey{Namespace: "es", Name: name}, &restore_task)).To(Succeed())
+		return restore_task.Spec.Approval
+	}
+
+	DescribeTable("decide",
+		func(self_approval bool, approver string, status Status, expected error) {
+			config.GlobalConfig.Approval.SelfApproval = self_approval
+			approval, err := a.decide("task", approver, "ok", status)
+			if expected != nil {
+				Expect(err).To(MatchError(expected))
+				recorded, err := a.Get("task")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(recorded.Status).To(Equal(string(StatusPending)))
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(approval.Status).To(Equal(string(status)))
+			Expect(approval.Approver).To(Equal(approver))
+			Expect(approval.DecidedAt).NotTo(BeNil())
+
+			recorded, err := a.Get("task")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recorded.Status).To(Equal(string(status)))
+			Expect(recorded.Comment).To(Equal("ok"))
+		},
+		Entry("approves by another user", false, "bob", StatusApproved, nil),
+		Entry("rejects by another user", false, "bob", StatusRejected, nil),
+		Entry("refuses the approval of the requester", false, "alice", StatusApproved, ErrSelfApproval),
+		Entry("approves by the requester with approval.selfapproval", true, "alice", StatusApproved, nil),
+		Entry("rejects by the requester", false, "alice", StatusRejected, nil),
+	)
+
+	It("decides an approval once", func() {
+		_, err := a.decide("task", "bob", "", StatusApproved)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = a.decide("task", "carol", "", StatusRejected)
+		Expect(err).To(MatchError(ErrDecided))
+	})
+
+	It("doesn't decide an approval past its expiry", func() {
+		Expect(a.DBClient.Model(&db.Approval{}).Where("task_id = ?", "task").Update("ExpiresAt", time.Now().Add(-time.Minute)).Error).To(Succeed())
+		_, err := a.decide("task", "bob", "", StatusApproved)
+		Expect(err).To(MatchError(ErrDecided))
+		Expect(err).To(MatchError(ContainSubstring(string(StatusExpired))))
+	})
+
+	It("doesn't find the approval of a task without one", func() {
+		_, err := a.decide("other", "bob", "", StatusApproved)
+		Expect(err).To(MatchError(ErrNotFound))
+	})
+
+	It("releases the tasks of an approved restore to the controller", func() {
+		_, err := a.Approve(context.Background(), "task", "bob", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(statuses("task")).To(Equal([]string{string(utils.TaskPending), string(utils.TaskPending)}))
+		Expect(statuses("other")).To(Equal([]string{string(utils.TaskAwaitingApproval)}))
+		Expect(approvalOf("restore-logs")).To(Equal(restorev1.ApprovalApproved))
+		Expect(approvalOf("restore-other")).To(Equal(restorev1.ApprovalPending))
+	})
+
+	It("leaves the restore of an approved request to the caller", func() {
+		request := `{"index": ["logs"]}`
+		Expect(a.DBClient.Model(&db.Approval{}).Where("task_id = ?", "task").Update("Request", request).Error).To(Succeed())
+		approval, err := a.Approve(context.Background(), "task", "bob", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(approval.Request).To(HaveValue(Equal(request)))
+		Expect(statuses("task")).To(Equal([]string{string(utils.TaskAwaitingApproval), string(utils.TaskAwaitingApproval)}))
+		Expect(approvalOf("restore-logs")).To(Equal(restorev1.ApprovalPending))
+	})
+
+	It("cancels the tasks of a rejected restore", func() {
+		_, err := a.Reject(context.Background(), "task", "bob", "not needed")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(statuses("task")).To(Equal([]string{string(utils.TaskCanceled), string(utils.TaskCanceled)}))
+		tasks, err := db.QueryAll[db.Task](a.DBClient, "id", 1, "task_id = ?", "task")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tasks[0].ErrorMessage).To(HaveValue(Equal("rejected by bob: not needed")))
+		Expect(approvalOf("restore-logs")).To(Equal(restorev1.ApprovalRejected))
+	})
+
+	It("cancels the restores whose approval expired", func() {
+		_, err := a.Request(db.Approval{TaskID: "other", Requester: "alice"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(a.DBClient.Model(&db.Approval{}).Where("task_id = ?", "task").Update("ExpiresAt", time.Now().Add(-time.Minute)).Error).To(Succeed())
+
+		Expect(a.Expire(context.Background())).To(Succeed())
+
+		expired, err := a.Get("task")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(expired.Status).To(Equal(string(StatusExpired)))
+		Expect(statuses("task")).To(Equal([]string{string(utils.TaskCanceled), string(utils.TaskCanceled)}))
+		Expect(approvalOf("restore-logs")).To(Equal(restorev1.ApprovalRejected))
+
+		pending, err := a.Get("other")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pending.Status).To(Equal(string(StatusPending)))
+		Expect(statuses("other")).To(Equal([]string{string(utils.TaskAwaitingApproval)}))
+	})
+})
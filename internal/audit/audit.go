@@ -0,0 +1,169 @@
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+type Outcome string
+
+const (
+	OutcomeSuccess Outcome = "success"
+	OutcomeFailure Outcome = "failure"
+	OutcomeDenied  Outcome = "denied"
+)
+
+// Source is which part of the service acted
+type Source string
+
+const (
+	SourceHTTP       Source = "http"
+	SourceController Source = "controller"
+	SourceCron       Source = "cron"
+)
+
+// Entry is an action to record, Actor is the caller of a http request or the component acting on its own
+type Entry struct {
+	Actor       string
+	Source      Source
+	Action      string
+	Target      string
+	PayloadHash string
+	Outcome     Outcome
+	Status      int
+	Message     string
+	SourceIP    string
+}
+
+// Auditor appends the mutating actions to the audit log, each entry is hash chained to the one before it
+type Auditor struct {
+	DBClient *gorm.DB
+	mu       sync.Mutex
+}
+
+func NewAuditor(db_client *gorm.DB) *Auditor {
+	return &Auditor{DBClient: db_client}
+}
+
+// Record appends entry to the audit log. The entry is chained to the last one, an entry appended meanwhile by
+// another instance takes its place in the chain so this one is chained again.
+func (a *Auditor) Record(entry Entry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 5; attempt++ {
+		var last []db.AuditEntry
+		last, err = db.QueryAll[db.AuditEntry](a.DBClient, "id DESC", 1)
+		if err != nil {
+			break
+		}
+
+		record := db.AuditEntry{
+			CreatedAt:   time.Now().UTC().Truncate(time.Millisecond),
+			Actor:       entry.Actor,
+			Source:      string(entry.Source),
+			Action:      entry.Action,
+			Target:      entry.Target,
+			PayloadHash: entry.PayloadHash,
+			Outcome:     string(entry.Outcome),
+			Status:      entry.Status,
+			Message:     entry.Message,
+			SourceIP:    entry.SourceIP,
+		}
+		if len(last) > 0 {
+			record.PrevHash = last[0].Hash
+		}
+		record.Hash = Hash(record)
+
+		// the uniq prev_hash rejects a second entry chained to the same one
+		if err = db.CreateRecords(a.DBClient, &[]db.AuditEntry{record}); err == nil {
+			return
+		}
+	}
+	log.Error().Err(err).Msgf("failed to audit %s of %s by %s", entry.Action, entry.Target, entry.Actor)
+}
+
+// Hash is the sha256 of entry and the hash of the entry before it
+func Hash(entry db.AuditEntry) string {
+	b, _ := json.Marshal([]any{
+		entry.PrevHash,
+		entry.CreatedAt.UTC().Format(time.RFC3339Nano),
+		entry.Actor,
+		entry.Source,
+		entry.Action,
+		entry.Target,
+		entry.PayloadHash,
+		entry.Outcome,
+		entry.Status,
+		entry.Message,
+		entry.SourceIP,
+	})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// PayloadHash is the sha256 of a request body, empty for an empty one
+func PayloadHash(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Verification is the result of walking the hash chain of the audit log
+type Verification struct {
+	Entries int  `json:"entries"`
+	Valid   bool `json:"valid"`
+	// BrokenAt is the id of the first entry altered, or chained to an entry altered or deleted
+	BrokenAt *uint  `json:"broken_at,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	LastHash string `json:"last_hash,omitempty"`
+}
+
+// Verify recomputes the hash chain of the audit log from its first entry
+func (a *Auditor) Verify(ctx context.Context) (Verification, error) {
+	v := Verification{Valid: true}
+	var after uint
+	prev := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return v, err
+		}
+		entries, err := db.QueryAll[db.AuditEntry](a.DBClient, "id", 500, "id > ?", after)
+		if err != nil {
+			return v, err
+		}
+		if len(entries) == 0 {
+			return v, nil
+		}
+
+		for _, entry := range entries {
+			v.Entries++
+			switch {
+			case entry.PrevHash != prev:
+				v.Reason = fmt.Sprintf("entry %d is chained to %q instead of %q, an entry before it was altered or deleted", entry.ID, entry.PrevHash, prev)
+			case Hash(entry) != entry.Hash:
+				v.Reason = fmt.Sprintf("hash of entry %d doesn't match its content, it was altered", entry.ID)
+			}
+			if v.Reason != "" {
+				v.Valid = false
+				v.BrokenAt = &entry.ID
+				return v, nil
+			}
+			prev = entry.Hash
+			v.LastHash = entry.Hash
+			after = entry.ID
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package audit_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+)
+
+func TestAudit(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "Audit Suite")
+}
+
+// newTestDB opens a sqlite db of the audit log, removed after the spec
+func newTestDB() *gorm.DB {
+	db_client, err := gorm.Open(sqlite.Open(filepath.Join(GinkgoT().TempDir(), "audit.db")), &gorm.Config{
+		Logger: logger.Discard,
+	})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(db_client.AutoMigrate(&db.AuditEntry{})).To(Succeed())
+	return db_client
+}
@@ -0,0 +1,100 @@
+package audit_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gorm.io/gorm"
+
+	"github.com/404LifeFound/es-snapshot-restore/internal/audit"
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+)
+
+var _ = Describe("Audit", func() {
+	DescribeTable("Hash",
+		func(alter func(entry *db.AuditEntry), changed bool) {
+			entry := db.AuditEntry{
+				CreatedAt:   time.Date(2026, 10, 19, 8, 30, 0, 0, time.UTC),
+				Actor:       "alice",
+				Source:      string(audit.SourceHTTP),
+				Action:      "POST /api/v1/restore",
+				Target:      "task-1",
+				PayloadHash: audit.PayloadHash([]byte(`{"name":["logs-*"]}`)),
+				Outcome:     string(audit.OutcomeSuccess),
+				Status:      200,
+				Message:     "",
+				SourceIP:    "10.0.0.1",
+				PrevHash:    "prev",
+			}
+			hash := audit.Hash(entry)
+			alter(&entry)
+			if changed {
+				Expect(audit.Hash(entry)).NotTo(Equal(hash))
+			} else {
+				Expect(audit.Hash(entry)).To(Equal(hash))
+			}
+		},
+		Entry("is stable for the same entry", func(e *db.AuditEntry) {}, false),
+		Entry("ignores the id", func(e *db.AuditEntry) { e.ID = 7 }, false),
+		Entry("ignores the time zone of the time", func(e *db.AuditEntry) { e.CreatedAt = e.CreatedAt.In(time.FixedZone("UTC+8", 8*3600)) }, false),
+		Entry("covers the previous hash", func(e *db.AuditEntry) { e.PrevHash = "other" }, true),
+		Entry("covers the time", func(e *db.AuditEntry) { e.CreatedAt = e.CreatedAt.Add(time.Millisecond) }, true),
+		Entry("covers the actor", func(e *db.AuditEntry) { e.Actor = "mallory" }, true),
+		Entry("covers the source", func(e *db.AuditEntry) { e.Source = string(audit.SourceCron) }, true),
+		Entry("covers the action", func(e *db.AuditEntry) { e.Action = "DELETE /api/v1/tasks/task-1" }, true),
+		Entry("covers the target", func(e *db.AuditEntry) { e.Target = "task-2" }, true),
+		Entry("covers the payload hash", func(e *db.AuditEntry) { e.PayloadHash = audit.PayloadHash([]byte(`{}`)) }, true),
+		Entry("covers the outcome", func(e *db.AuditEntry) { e.Outcome = string(audit.OutcomeDenied) }, true),
+		Entry("covers the status", func(e *db.AuditEntry) { e.Status = 403 }, true),
+		Entry("covers the message", func(e *db.AuditEntry) { e.Message = "denied" }, true),
+		Entry("covers the source ip", func(e *db.AuditEntry) { e.SourceIP = "10.0.0.2" }, true),
+	)
+
+	DescribeTable("Verify",
+		func(tamper func(db_client *gorm.DB), valid bool, broken_at uint, reason string) {
+			a := audit.NewAuditor(newTestDB())
+			for _, target := range []string{"task-1", "task-2", "task-3"} {
+				a.Record(audit.Entry{Actor: "alice", Source: audit.SourceHTTP, Action: "POST /api/v1/restore", Target: target, Outcome: audit.OutcomeSuccess, Status: 200})
+			}
+			entries, err := db.QueryAll[db.AuditEntry](a.DBClient, "id", 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(HaveLen(3))
+
+			tamper(a.DBClient)
+
+			v, err := a.Verify(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(v.Valid).To(Equal(valid))
+			if valid {
+				Expect(v.Entries).To(Equal(3))
+				Expect(v.BrokenAt).To(BeNil())
+				Expect(v.LastHash).To(Equal(entries[2].Hash))
+				return
+			}
+			Expect(v.BrokenAt).To(HaveValue(Equal(broken_at)))
+			Expect(v.Reason).To(ContainSubstring(reason))
+		},
+		Entry("passes an untouched log", func(db_client *gorm.DB) {}, true, uint(0), ""),
+		Entry("detects an altered entry", func(db_client *gorm.DB) {
+			Expect(db_client.Model(&db.AuditEntry{}).Where("id = ?", 2).Update("target", "task-9").Error).To(Succeed())
+		}, false, uint(2), "doesn't match its content"),
+		Entry("detects an altered outcome", func(db_client *gorm.DB) {
+			Expect(db_client.Model(&db.AuditEntry{}).Where("id = ?", 1).Update("outcome", string(audit.OutcomeFailure)).Error).To(Succeed())
+		}, false, uint(1), "doesn't match its content"),
+		Entry("detects an altered entry hashed again at the entry after it", func(db_client *gorm.DB) {
+			var entry db.AuditEntry
+			Expect(db_client.First(&entry, 2).Error).To(Succeed())
+			entry.Target = "task-9"
+			entry.Hash = audit.Hash(entry)
+			Expect(db_client.Save(&entry).Error).To(Succeed())
+		}, false, uint(3), "altered or deleted"),
+		Entry("detects a deleted entry at the entry after it", func(db_client *gorm.DB) {
+			Expect(db_client.Delete(&db.AuditEntry{}, 2).Error).To(Succeed())
+		}, false, uint(3), "altered or deleted"),
+		Entry("detects a deleted first entry", func(db_client *gorm.DB) {
+			Expect(db_client.Delete(&db.AuditEntry{}, 1).Error).To(Succeed())
+		}, false, uint(2), "altered or deleted"),
+	)
+})
@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/rs/zerolog/log"
+	"go.uber.org/fx"
+)
+
+// ErrUnauthenticated is returned when the credentials of a request are invalid
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// Role of a caller, each role may do what the lower ones do
+type Role string
+
+const (
+	// RoleViewer reads the indices, the plans, the tasks and the budget
+	RoleViewer Role = "viewer"
+	// RoleRequester restores the indices it is granted and steers its own tasks
+	RoleRequester Role = "requester"
+	// RoleOperator steers every task and manages the restore nodes
+	RoleOperator Role = "operator"
+	// RoleAdmin restores every index
+	RoleAdmin Role = "admin"
+)
+
+var roleRank = map[Role]int{
+	RoleViewer:    1,
+	RoleRequester: 2,
+	RoleOperator:  3,
+	RoleAdmin:     4,
+}
+
+func ParseRole(s string) (Role, error) {
+	r := Role(strings.ToLower(strings.TrimSpace(s)))
+	if _, ok := roleRank[r]; !ok {
+		return "", fmt.Errorf("invalid role %s, should be one of viewer, requester, operator or admin", s)
+	}
+	return r, nil
+}
+
+// Identity is the authenticated caller of a request
+type Identity struct {
+	// Subject is empty for the anonymous caller of a server without authentication
+	Subject string `json:"subject"`
+	// Method is token, jwt, mtls or none
+	Method string `json:"method"`
+	Role   Role   `json:"role"`
+	Team   string `json:"team,omitempty"`
+	// Indices are the index patterns the caller may restore, with the ones of its team
+	Indices []string `json:"indices,omitempty"`
+
+	patterns []*regexp.Regexp
+}
+
+// Anonymous is the caller of every request when the authentication is disabled
+var Anonymous = &Identity{Method: "none", Role: RoleAdmin}
+
+// Allows reports whether the caller has role, or a higher one
+func (i *Identity) Allows(role Role) bool {
+	return roleRank[i.Role] >= roleRank[role]
+}
+
+// CanRestore reports whether the caller may restore index, an admin may restore every index
+func (i *Identity) CanRestore(index string) bool {
+	if i.Allows(RoleAdmin) {
+		return true
+	}
+	for _, p := range i.patterns {
+		if p.MatchString(index) {
+			return true
+		}
+	}
+	return false
+}
+
+// indexPattern compiles an index pattern where * matches any characters
+func indexPattern(pattern string) *regexp.Regexp {
+	return regexp.MustCompile("^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$")
+}
+
+// Authenticator authenticates the api requests with a static token, a jwt or a client cert
+type Authenticator struct {
+	enabled     bool
+	defaultRole Role
+	tokens      []config.Principal
+	principals  map[string]config.Principal // by subject
+	teams       map[string][]string
+	jwks        *keySet // nil without jwt authentication
+}
+
+func NewAuthenticator(lc fx.Lifecycle) (*Authenticator, error) {
+	cfg := config.GlobalConfig.Auth
+	a := &Authenticator{
+		enabled:    cfg.Enabled,
+		tokens:     cfg.Tokens,
+		principals: make(map[string]config.Principal),
+		teams:      cfg.Teams,
+	}
+	if !a.enabled {
+		log.Warn().Msg("api authentication is disabled, every caller is admin")
+		return a, nil
+	}
+
+	role, err := ParseRole(cfg.DefaultRole)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth.defaultrole: %w", err)
+	}
+	a.defaultRole = role
+
+	for _, p := range append(append([]config.Principal{}, cfg.Tokens...), cfg.Principals...) {
+		if p.Role == "" {
+			continue
+		}
+		if _, err := ParseRole(p.Role); err != nil {
+			return nil, fmt.Errorf("invalid role of principal %s: %w", p.Subject, err)
+		}
+	}
+	for _, p := range cfg.Principals {
+		a.principals[p.Subject] = p
+	}
+
+	if cfg.JWT.JWKSFile != "" || cfg.JWT.JWKSURL != "" {
+		a.jwks = newKeySet(lc, cfg.JWT)
+	}
+
+	log.Info().Msgf("api authentication is enabled with %d tokens, %d principals, jwt %t, mtls %t", len(cfg.Tokens), len(cfg.Principals), a.jwks != nil, config.GlobalConfig.Http.ClientCA != "")
+	return a, nil
+}
+
+// Enabled reports whether the requests are authenticated
+func (a *Authenticator) Enabled() bool {
+	return a.enabled
+}
+
+// Authenticate returns the caller of r, nil when r has no credentials. A bearer token is either a static token or
+// a jwt, without one the common name of a verified client cert is the subject.
+func (a *Authenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if !a.enabled {
+		return Anonymous, nil
+	}
+
+	if header := r.Header.Get("Authorization"); header != "" {
+		token, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok {
+			return nil, fmt.Errorf("%w: only bearer tokens are supported", ErrUnauthenticated)
+		}
+		for _, p := range a.tokens {
+			if p.Token != "" && subtle.ConstantTimeCompare([]byte(p.Token), []byte(token)) == 1 {
+				return a.identity(p.Subject, "token", p, "", ""), nil
+			}
+		}
+		if a.jwks == nil {
+			return nil, fmt.Errorf("%w: unknown token", ErrUnauthenticated)
+		}
+		claims, err := a.jwks.verify(token)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrUnauthenticated, err.Error())
+		}
+		return a.identity(claims.Subject, "jwt", a.principals[claims.Subject], claims.Role, claims.Team), nil
+	}
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		subject := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		return a.identity(subject, "mtls", a.principals[subject], "", ""), nil
+	}
+	return nil, nil
+}
+
+// identity is the caller subject, the role and team of its principal take precedence over the ones of its
+// credentials
+func (a *Authenticator) identity(subject, method string, p config.Principal, role Role, team string) *Identity {
+	if r, err := ParseRole(p.Role); err == nil {
+		role = r
+	}
+	if role == "" {
+		role = a.defaultRole
+	}
+	if p.Team != "" {
+		team = p.Team
+	}
+
+	i := &Identity{
+		Subject: subject,
+		Method:  method,
+		Role:    role,
+		Team:    team,
+		Indices: append(append([]string{}, p.Indices...), a.teams[team]...),
+	}
+	for _, pattern := range i.Indices {
+		i.patterns = append(i.patterns, indexPattern(pattern))
+	}
+	return i
+}
@@ -0,0 +1,260 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.uber.org/fx/fxtest"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+)
+
+const (
+	issuer   = "https://idp.example.com"
+	audience = "es-snapshot-restore"
+)
+
+// sign serializes the claims as a jwt signed by key with alg
+func sign(key any, alg jose.SignatureAlgorithm, claims ...any) string {
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: alg, Key: jose.JSONWebKey{Key: key, KeyID: "restore-key"}},
+		(&jose.SignerOptions{}).WithType("JWT"),
+	)
+	Expect(err).NotTo(HaveOccurred())
+
+	builder := jwt.Signed(signer)
+	for _, c := range claims {
+		builder = builder.Claims(c)
+	}
+	token, err := builder.Serialize()
+	Expect(err).NotTo(HaveOccurred())
+	return token
+}
+
+// claims are the standard claims of a jwt of subject valid for a minute
+func claims(subject string) jwt.Claims {
+	return jwt.Claims{
+		Subject:  subject,
+		Issuer:   issuer,
+		Audience: jwt.Audience{audience},
+		IssuedAt: jwt.NewNumericDate(time.Now()),
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}
+}
+
+var _ = Describe("Authenticator", func() {
+	var a *Authenticator
+	var key, other *ecdsa.PrivateKey
+
+	BeforeEach(func() {
+		saved := config.GlobalConfig
+		DeferCleanup(func() { config.GlobalConfig = saved })
+
+		var err error
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		other, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+
+		jwks, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "restore-key", Algorithm: string(jose.ES256), Use: "sig"},
+		}})
+		Expect(err).NotTo(HaveOccurred())
+		jwks_file := filepath.Join(GinkgoT().TempDir(), "jwks.json")
+		Expect(os.WriteFile(jwks_file, jwks, 0o600)).To(Succeed())
+
+		config.GlobalConfig.Auth = config.Auth{
+			Enabled:     true,
+			DefaultRole: "viewer",
+			Tokens: []config.Principal{
+				{Subject: "ci", Token: "ci-token", Role: "operator"},
+			},
+			Principals: []config.Principal{
+				{Subject: "bob", Role: "admin"},
+				{Subject: "carol", Team: "search", Indices: []string{"metrics-*"}},
+			},
+			Teams: map[string][]string{
+				"search": {"search-*"},
+				"logs":   {"logs-*"},
+			},
+			JWT: config.JWT{JWKSFile: jwks_file, Issuer: issuer, Audience: audience},
+		}
+
+		lc := fxtest.NewLifecycle(GinkgoT())
+		a, err = NewAuthenticator(lc)
+		Expect(err).NotTo(HaveOccurred())
+		lc.RequireStart()
+		DeferCleanup(lc.RequireStop)
+	})
+
+	DescribeTable("verifies a jwt",
+		func(token func() string, expected *Identity, reason string) {
+			r, err := http.NewRequest(http.MethodGet, "/api/v1/tasks", nil)
+			Expect(err).NotTo(HaveOccurred())
+			r.Header.Set("Authorization", "Bearer "+token())
+
+			identity, err := a.Authenticate(r)
+			if expected == nil {
+				Expect(err).To(MatchError(ErrUnauthenticated))
+				Expect(err).To(MatchError(ContainSubstring(reason)))
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(identity.Subject).To(Equal(expected.Subject))
+			Expect(identity.Method).To(Equal("jwt"))
+			Expect(identity.Role).To(Equal(expected.Role))
+			Expect(identity.Team).To(Equal(expected.Team))
+			Expect(identity.Indices).To(ConsistOf(expected.Indices))
+		},
+		Entry("with its role and team claims", func() string {
+			return sign(key, jose.ES256, claims("alice"), map[string]any{"role": "requester", "team": "logs"})
+		}, &Identity{Subject: "alice", Role: RoleRequester, Team: "logs", Indices: []string{"logs-*"}}, ""),
+		Entry("with the highest known role of a role list", func() string {
+			return sign(key, jose.ES256, claims("alice"), map[string]any{"role": []string{"viewer", "superuser", "operator"}})
+		}, &Identity{Subject: "alice", Role: RoleOperator}, ""),
+		Entry("with the default role without role claim", func() string {
+			return sign(key, jose.ES256, claims("alice"))
+		}, &Identity{Subject: "alice", Role: RoleViewer}, ""),
+		Entry("with the role of its principal over the claim", func() string {
+			return sign(key, jose.ES256, claims("bob"), map[string]any{"role": "viewer"})
+		}, &Identity{Subject: "bob", Role: RoleAdmin}, ""),
+		Entry("with the team and indices of its principal over the claim", func() string {
+			return sign(key, jose.ES256, claims("carol"), map[string]any{"role": "requester", "team": "logs"})
+		}, &Identity{Subject: "carol", Role: RoleRequester, Team: "search", Indices: []string{"metrics-*", "search-*"}}, ""),
+		Entry("rejecting an expired one", func() string {
+			c := claims("alice")
+			c.Expiry = jwt.NewNumericDate(time.Now().Add(-2 * time.Minute))
+			return sign(key, jose.ES256, c)
+		}, nil, "invalid jwt claims"),
+		Entry("rejecting one not valid yet", func() string {
+			c := claims("alice")
+			c.NotBefore = jwt.NewNumericDate(time.Now().Add(10 * time.Minute))
+			return sign(key, jose.ES256, c)
+		}, nil, "invalid jwt claims"),
+		Entry("rejecting another issuer", func() string {
+			c := claims("alice")
+			c.Issuer = "https://other.example.com"
+			return sign(key, jose.ES256, c)
+		}, nil, "invalid jwt claims"),
+		Entry("rejecting another audience", func() string {
+			c := claims("alice")
+			c.Audience = jwt.Audience{"other"}
+			return sign(key, jose.ES256, c)
+		}, nil, "invalid jwt claims"),
+		Entry("rejecting one without subject", func() string {
+			return sign(key, jose.ES256, claims(""))
+		}, nil, "jwt without subject"),
+		Entry("rejecting one signed by an unknown key", func() string {
+			return sign(other, jose.ES256, claims("alice"))
+		}, nil, "invalid jwt signature"),
+		Entry("rejecting a symmetric algorithm", func() string {
+			return sign([]byte("a shared secret of at least 32 bytes"), jose.HS256, claims("alice"))
+		}, nil, "invalid jwt"),
+		Entry("rejecting a malformed one", func() string {
+			return "not.a.jwt"
+		}, nil, "invalid jwt"),
+	)
+
+	DescribeTable("authenticates a request",
+		func(authorization string, expected *Identity, reason string) {
+			r, err := http.NewRequest(http.MethodGet, "/api/v1/tasks", nil)
+			Expect(err).NotTo(HaveOccurred())
+			if authorization != "" {
+				r.Header.Set("Authorization", authorization)
+			}
+
+			identity, err := a.Authenticate(r)
+			if reason != "" {
+				Expect(err).To(MatchError(ErrUnauthenticated))
+				Expect(err).To(MatchError(ContainSubstring(reason)))
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			if expected == nil {
+				Expect(identity).To(BeNil())
+				return
+			}
+			Expect(identity.Subject).To(Equal(expected.Subject))
+			Expect(identity.Method).To(Equal(expected.Method))
+			Expect(identity.Role).To(Equal(expected.Role))
+		},
+		Entry("with a static token", "Bearer ci-token", &Identity{Subject: "ci", Method: "token", Role: RoleOperator}, ""),
+		Entry("rejecting an unknown token", "Bearer other-token", nil, "invalid jwt"),
+		Entry("rejecting another scheme", "Basic Y2k6Y2ktdG9rZW4=", nil, "only bearer tokens are supported"),
+		Entry("without credentials as no caller", "", nil, ""),
+	)
+
+	It("authenticates every request as admin when disabled", func() {
+		config.GlobalConfig.Auth.Enabled = false
+		a, err := NewAuthenticator(fxtest.NewLifecycle(GinkgoT()))
+		Expect(err).NotTo(HaveOccurred())
+
+		r, err := http.NewRequest(http.MethodGet, "/api/v1/tasks", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(a.Authenticate(r)).To(Equal(Anonymous))
+	})
+})
+
+var _ = Describe("Identity", func() {
+	DescribeTable("ParseRole",
+		func(s string, expected Role, valid bool) {
+			role, err := ParseRole(s)
+			if !valid {
+				Expect(err).To(HaveOccurred())
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(role).To(Equal(expected))
+		},
+		Entry("a role", "requester", RoleRequester, true),
+		Entry("a role in another case with spaces", " Admin ", RoleAdmin, true),
+		Entry("an unknown role", "root", Role(""), false),
+		Entry("no role", "", Role(""), false),
+	)
+
+	DescribeTable("Allows",
+		func(role Role, required Role, allowed bool) {
+			Expect((&Identity{Role: role}).Allows(required)).To(Equal(allowed))
+		},
+		Entry("a viewer to view", RoleViewer, RoleViewer, true),
+		Entry("not a viewer to restore", RoleViewer, RoleRequester, false),
+		Entry("a requester to view", RoleRequester, RoleViewer, true),
+		Entry("not a requester to operate", RoleRequester, RoleOperator, false),
+		Entry("an operator to restore", RoleOperator, RoleRequester, true),
+		Entry("not an operator to administer", RoleOperator, RoleAdmin, false),
+		Entry("an admin to operate", RoleAdmin, RoleOperator, true),
+		Entry("not a caller without role to view", Role(""), RoleViewer, false),
+	)
+
+	DescribeTable("CanRestore",
+		func(role Role, p config.Principal, team string, index string, allowed bool) {
+			a := &Authenticator{
+				defaultRole: RoleViewer,
+				teams: map[string][]string{
+					"logs": {"logs-*", "audit-2026.*"},
+				},
+			}
+			Expect(a.identity("alice", "token", p, role, team).CanRestore(index)).To(Equal(allowed))
+		},
+		Entry("every index as admin", RoleAdmin, config.Principal{}, "", "prod-1", true),
+		Entry("an index granted to the principal", RoleRequester, config.Principal{Indices: []string{"metrics-*"}}, "", "metrics-2026.10.19", true),
+		Entry("an index granted to the team", RoleRequester, config.Principal{}, "logs", "logs-2026.10.19", true),
+		Entry("an index granted to the team of the principal", RoleRequester, config.Principal{Team: "logs"}, "search", "logs-1", true),
+		Entry("not an index granted to another team", RoleRequester, config.Principal{}, "search", "logs-1", false),
+		Entry("not an index only prefixed by a grant", RoleRequester, config.Principal{}, "logs", "logs", false),
+		Entry("not an index matching a grant anywhere but its start", RoleRequester, config.Principal{}, "logs", "old-logs-1", false),
+		Entry("not an index where a grant has a literal dot", RoleRequester, config.Principal{}, "logs", "audit-2026x10", false),
+		Entry("an index where a grant has a literal dot", RoleRequester, config.Principal{}, "logs", "audit-2026.10", true),
+		Entry("not any index without grants as operator", RoleOperator, config.Principal{}, "", "logs-1", false),
+	)
+})
@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/rs/zerolog/log"
+	"go.uber.org/fx"
+)
+
+// signatureAlgorithms are the algorithms a jwt may be signed with, the asymmetric ones an OIDC provider publishes
+// keys for
+var signatureAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// jwtClaims are the claims of a verified jwt the caller is read from
+type jwtClaims struct {
+	Subject string
+	Role    Role
+	Team    string
+}
+
+// keySet verifies the jwts with the keys of a jwks file or url, reloaded periodically so rotated keys are picked up
+type keySet struct {
+	cfg config.JWT
+
+	mu   sync.RWMutex
+	keys *jose.JSONWebKeySet
+}
+
+func newKeySet(lc fx.Lifecycle, cfg config.JWT) *keySet {
+	s := &keySet{cfg: cfg}
+	if cfg.RoleClaim == "" {
+		s.cfg.RoleClaim = "role"
+	}
+	if cfg.TeamClaim == "" {
+		s.cfg.TeamClaim = "team"
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	lc.Append(fx.Hook{
+		OnStart: func(start_ctx context.Context) error {
+			// a provider down at startup only rejects the jwts until the next reload
+			if err := s.reload(start_ctx); err != nil {
+				log.Error().Err(err).Msg("failed to load jwks")
+			}
+			go s.refresh(ctx)
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			cancel()
+			return nil
+		},
+	})
+	return s
+}
+
+// refresh reloads the keys every jwt.refreshinterval minutes until ctx is done
+func (s *keySet) refresh(ctx context.Context) {
+	interval := time.Duration(max(s.cfg.RefreshInterval, 1)) * time.Minute
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.reload(ctx); err != nil {
+				log.Error().Err(err).Msg("failed to reload jwks, keep the previous keys")
+			}
+		}
+	}
+}
+
+func (s *keySet) reload(ctx context.Context) error {
+	var data []byte
+	var err error
+	if s.cfg.JWKSFile != "" {
+		data, err = os.ReadFile(s.cfg.JWKSFile)
+	} else {
+		data, err = fetch(ctx, s.cfg.JWKSURL)
+	}
+	if err != nil {
+		return err
+	}
+
+	var keys jose.JSONWebKeySet
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("failed to decode jwks: %w", err)
+	}
+
+	s.mu.Lock()
+	s.keys = &keys
+	s.mu.Unlock()
+	log.Info().Msgf("loaded %d jwks keys", len(keys.Keys))
+	return nil
+}
+
+func fetch(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get jwks %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get jwks %s: status %d", url, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// verify checks the signature, the expiry, the issuer and the audience of token and returns its claims
+func (s *keySet) verify(token string) (*jwtClaims, error) {
+	s.mu.RLock()
+	keys := s.keys
+	s.mu.RUnlock()
+	if keys == nil {
+		return nil, fmt.Errorf("jwks not loaded")
+	}
+
+	tok, err := jwt.ParseSigned(token, signatureAlgorithms)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwt: %w", err)
+	}
+
+	var std jwt.Claims
+	var custom map[string]any
+	if err := tok.Claims(keys, &std, &custom); err != nil {
+		return nil, fmt.Errorf("invalid jwt signature: %w", err)
+	}
+
+	expected := jwt.Expected{Issuer: s.cfg.Issuer, Time: time.Now()}
+	if s.cfg.Audience != "" {
+		expected.AnyAudience = jwt.Audience{s.cfg.Audience}
+	}
+	if err := std.ValidateWithLeeway(expected, time.Minute); err != nil {
+		return nil, fmt.Errorf("invalid jwt claims: %w", err)
+	}
+	if std.Subject == "" {
+		return nil, fmt.Errorf("jwt without subject")
+	}
+
+	claims := &jwtClaims{Subject: std.Subject}
+	if team, ok := custom[s.cfg.TeamClaim].(string); ok {
+		claims.Team = team
+	}
+	claims.Role = highestRole(custom[s.cfg.RoleClaim])
+	return claims, nil
+}
+
+// highestRole is the highest known role of a role claim, a string or a list of strings
+func highestRole(claim any) Role {
+	var values []any
+	switch v := claim.(type) {
+	case string:
+		values = []any{v}
+	case []any:
+		values = v
+	}
+
+	var highest Role
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		if role, err := ParseRole(s); err == nil && roleRank[role] > roleRank[highest] {
+			highest = role
+		}
+	}
+	return highest
+}
@@ -0,0 +1,212 @@
+package budget
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/404LifeFound/es-snapshot-restore/internal/k8s"
+	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+var (
+	// ErrExhausted is returned when the demand fits the quota but not what is left of it, the task is queued
+	ErrExhausted = errors.New("restore capacity budget exhausted")
+	// ErrOverBudget is returned when the demand exceeds the quota itself, so it never fits
+	ErrOverBudget = errors.New("restore capacity exceeds budget")
+)
+
+// Usage is an amount of restore capacity, size unit is GB
+type Usage struct {
+	DiskGB   float64 `json:"disk_gb"`
+	CPU      float64 `json:"cpu"`
+	MemoryGB float64 `json:"memory_gb"`
+}
+
+func (u Usage) Add(o Usage) Usage {
+	return Usage{
+		DiskGB:   u.DiskGB + o.DiskGB,
+		CPU:      u.CPU + o.CPU,
+		MemoryGB: u.MemoryGB + o.MemoryGB,
+	}
+}
+
+func (u Usage) Sub(o Usage) Usage {
+	return Usage{
+		DiskGB:   u.DiskGB - o.DiskGB,
+		CPU:      u.CPU - o.CPU,
+		MemoryGB: u.MemoryGB - o.MemoryGB,
+	}
+}
+
+// Exceeds returns the first resource of u above the non-zero fields of quota
+func (u Usage) Exceeds(quota config.Quota) string {
+	switch {
+	case quota.DiskGB > 0 && u.DiskGB > quota.DiskGB:
+		return fmt.Sprintf("disk %.2fGB > %.2fGB", u.DiskGB, quota.DiskGB)
+	case quota.CPU > 0 && u.CPU > quota.CPU:
+		return fmt.Sprintf("cpu %.2f > %.2f", u.CPU, quota.CPU)
+	case quota.MemoryGB > 0 && u.MemoryGB > quota.MemoryGB:
+		return fmt.Sprintf("memory %.2fGB > %.2fGB", u.MemoryGB, quota.MemoryGB)
+	}
+	return ""
+}
+
+// Demand is the capacity of count restore nodes with store_size disk, cpu and memory each. An empty cpu or memory
+// falls back to the es.requestcpu and es.requestmem config, a zero count to es.restorecount.
+func Demand(store_size string, count int32, cpu, memory string) Usage {
+	if count <= 0 {
+		count = config.GlobalConfig.ES.RestoreCount
+	}
+	if cpu == "" {
+		cpu = config.GlobalConfig.ES.RequestCPU
+	}
+	if memory == "" {
+		memory = config.GlobalConfig.ES.RequestMem
+	}
+
+	var u Usage
+	if disk, err := utils.ToGB(store_size); err == nil {
+		u.DiskGB = disk * float64(count)
+	} else if store_size != "" {
+		log.Error().Err(err).Msgf("invalid store size %s", store_size)
+	}
+	if q, err := resource.ParseQuantity(cpu); err == nil {
+		u.CPU = q.AsApproximateFloat64() * float64(count)
+	}
+	if q, err := resource.ParseQuantity(memory); err == nil {
+		u.MemoryGB = k8s.QuantityGB(q) * float64(count)
+	}
+
+	return u
+}
+
+// NodeUsage is the capacity held by the restore node record
+func NodeUsage(node db.RestoreNode) Usage {
+	return Demand(node.StoreSize, node.Count, node.CPU, node.Memory)
+}
+
+type Status struct {
+	Usage Usage        `json:"usage"`
+	Limit config.Quota `json:"limit"`
+}
+
+type Budget struct {
+	DBClient *gorm.DB
+}
+
+func NewBudget(db_client *gorm.DB) (*Budget, error) {
+	if config.GlobalConfig.Budget.RetryInterval <= 0 {
+		return nil, fmt.Errorf("invalid budget retry interval %d, should be greater than 0", config.GlobalConfig.Budget.RetryInterval)
+	}
+	return &Budget{DBClient: db_client}, nil
+}
+
+// Usage returns the capacity held by the restore nodes of team, of every team when team is empty
+func (b *Budget) Usage(team string) (Usage, error) {
+	conds := []any{"status IN ?", []string{string(utils.NodeActive), string(utils.NodeReclaiming)}}
+	if team != "" {
+		conds = []any{"status IN ? AND team = ?", []string{string(utils.NodeActive), string(utils.NodeReclaiming)}, team}
+	}
+
+	nodes, err := db.QueryAll[db.RestoreNode](b.DBClient, "", 0, conds...)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to query restore nodes of team %s", team)
+		return Usage{}, err
+	}
+
+	var u Usage
+	for _, n := range nodes {
+		u = u.Add(NodeUsage(n))
+	}
+	return u, nil
+}
+
+// Fits checks demand against the global limit and the quota of team, ignoring what is used already
+func (b *Budget) Fits(team string, demand Usage) error {
+	if !config.GlobalConfig.Budget.Enabled {
+		return nil
+	}
+
+	if over := demand.Exceeds(config.GlobalConfig.Budget.Limit); over != "" {
+		return fmt.Errorf("%w: %s of the cluster", ErrOverBudget, over)
+	}
+	if quota, ok := config.GlobalConfig.Budget.Teams[team]; ok {
+		if over := demand.Exceeds(quota); over != "" {
+			return fmt.Errorf("%w: %s of team %s", ErrOverBudget, over, team)
+		}
+	}
+
+	return nil
+}
+
+// Admit checks demand on top of the current usage against the global limit and the quota of team
+func (b *Budget) Admit(team string, demand Usage) error {
+	if !config.GlobalConfig.Budget.Enabled {
+		return nil
+	}
+
+	if err := b.Fits(team, demand); err != nil {
+		return err
+	}
+
+	usage, err := b.Usage("")
+	if err != nil {
+		return err
+	}
+	if over := usage.Add(demand).Exceeds(config.GlobalConfig.Budget.Limit); over != "" {
+		return fmt.Errorf("%w: %s of the cluster", ErrExhausted, over)
+	}
+
+	if quota, ok := config.GlobalConfig.Budget.Teams[team]; ok {
+		usage, err := b.Usage(team)
+		if err != nil {
+			return err
+		}
+		if over := usage.Add(demand).Exceeds(quota); over != "" {
+			return fmt.Errorf("%w: %s of team %s", ErrExhausted, over, team)
+		}
+	}
+
+	return nil
+}
+
+// Statuses reports the usage and limit of the cluster, keyed by empty team, and of every team with a quota
+// or a restore node
+func (b *Budget) Statuses() (map[string]Status, error) {
+	nodes, err := db.QueryAll[db.RestoreNode](b.DBClient, "", 0,
+		"status IN ?", []string{string(utils.NodeActive), string(utils.NodeReclaiming)},
+	)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to query restore nodes")
+		return nil, err
+	}
+
+	statuses := map[string]Status{
+		"": {Limit: config.GlobalConfig.Budget.Limit},
+	}
+	for team, quota := range config.GlobalConfig.Budget.Teams {
+		statuses[team] = Status{Limit: quota}
+	}
+
+	for _, n := range nodes {
+		u := NodeUsage(n)
+
+		s := statuses[""]
+		s.Usage = s.Usage.Add(u)
+		statuses[""] = s
+
+		if n.Team == "" {
+			continue
+		}
+		s = statuses[n.Team]
+		s.Usage = s.Usage.Add(u)
+		statuses[n.Team] = s
+	}
+
+	return statuses, nil
+}
@@ -0,0 +1,30 @@
+package budget
+
+import (
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+)
+
+func TestBudget(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "Budget Suite")
+}
+
+// newTestDB opens a sqlite db of the restore nodes, removed after the spec
+func newTestDB() *gorm.DB {
+	db_client, err := gorm.Open(sqlite.Open(filepath.Join(GinkgoT().TempDir(), "budget.db")), &gorm.Config{
+		Logger: logger.Discard,
+	})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(db_client.AutoMigrate(&db.RestoreNode{})).To(Succeed())
+	return db_client
+}
@@ -0,0 +1,78 @@
+package budget
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
+)
+
+var _ = Describe("Budget", func() {
+	var b *Budget
+
+	BeforeEach(func() {
+		saved := config.GlobalConfig
+		DeferCleanup(func() { config.GlobalConfig = saved })
+		config.GlobalConfig.Budget = config.Budget{
+			Enabled: true,
+			Limit:   config.Quota{DiskGB: 100, CPU: 8, MemoryGB: 32},
+			Teams: map[string]config.Quota{
+				"search": {DiskGB: 50},
+			},
+			RetryInterval: 30,
+		}
+
+		var err error
+		b, err = NewBudget(newTestDB())
+		Expect(err).NotTo(HaveOccurred())
+
+		// the cluster uses 70GB of disk, 4 cpu and 16GB of memory, the search team 30GB of disk
+		Expect(db.CreateRecords(b.DBClient, &[]db.RestoreNode{
+			{Name: "search-node", Team: "search", StoreSize: "30Gi", Count: 1, CPU: "2", Memory: "8Gi", Status: string(utils.NodeActive)},
+			{Name: "logs-node", Team: "logs", StoreSize: "40Gi", Count: 1, CPU: "2", Memory: "8Gi", Status: string(utils.NodeReclaiming)},
+			{Name: "deleted-node", Team: "search", StoreSize: "100Gi", Count: 1, CPU: "8", Memory: "32Gi", Status: "DELETED"},
+		})).To(Succeed())
+	})
+
+	DescribeTable("Fits",
+		func(enabled bool, team string, demand Usage, expected error) {
+			config.GlobalConfig.Budget.Enabled = enabled
+			err := b.Fits(team, demand)
+			if expected == nil {
+				Expect(err).NotTo(HaveOccurred())
+				return
+			}
+			Expect(err).To(MatchError(expected))
+		},
+		Entry("anything when the budget is disabled", false, "search", Usage{DiskGB: 1000}, nil),
+		Entry("a demand within the limit", true, "", Usage{DiskGB: 100, CPU: 8, MemoryGB: 32}, nil),
+		Entry("not more disk than the limit", true, "", Usage{DiskGB: 101}, ErrOverBudget),
+		Entry("not more cpu than the limit", true, "", Usage{CPU: 9}, ErrOverBudget),
+		Entry("not more memory than the limit", true, "", Usage{MemoryGB: 33}, ErrOverBudget),
+		Entry("not more than the quota of the team", true, "search", Usage{DiskGB: 51}, ErrOverBudget),
+		Entry("a team without quota up to the limit", true, "logs", Usage{DiskGB: 100}, nil),
+	)
+
+	DescribeTable("Admit",
+		func(enabled bool, team string, demand Usage, expected error) {
+			config.GlobalConfig.Budget.Enabled = enabled
+			err := b.Admit(team, demand)
+			if expected == nil {
+				Expect(err).NotTo(HaveOccurred())
+				return
+			}
+			Expect(err).To(MatchError(expected))
+		},
+		Entry("anything when the budget is disabled", false, "search", Usage{DiskGB: 1000}, nil),
+		Entry("a demand within what is left", true, "search", Usage{DiskGB: 20, CPU: 2, MemoryGB: 8}, nil),
+		Entry("not more disk than what is left of the limit", true, "", Usage{DiskGB: 31}, ErrExhausted),
+		Entry("not more cpu than what is left of the limit", true, "", Usage{CPU: 5}, ErrExhausted),
+		Entry("not more memory than what is left of the limit", true, "", Usage{MemoryGB: 17}, ErrExhausted),
+		Entry("not more than what is left of the quota of the team", true, "search", Usage{DiskGB: 25}, ErrExhausted),
+		Entry("a team without quota up to what is left of the limit", true, "logs", Usage{DiskGB: 25}, nil),
+		Entry("never a demand over the limit itself", true, "", Usage{DiskGB: 120}, ErrOverBudget),
+		Entry("never a demand over the quota of the team itself", true, "search", Usage{DiskGB: 60}, ErrOverBudget),
+	)
+})
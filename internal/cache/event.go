@@ -1,8 +1,175 @@
 package cache
 
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/redis/rueidis"
+	"github.com/rs/zerolog/log"
+	"go.uber.org/fx"
+)
+
+// eventChannel is the redis channel the events are fanned out through between instances
+const eventChannel = "es-snapshot-restore:task-events"
+
+// subscriberBuffer is the count of events a slow subscriber may lag behind before its events are dropped
+const subscriberBuffer = 64
+
+type EventType string
+
+const (
+	// EventStage is a change of the stage of an index of a task
+	EventStage EventType = "stage"
+	// EventStatus is a change of the status of a task, or of one of its indices when Index is set
+	EventStatus EventType = "status"
+	// EventProgress is the recovered percent of an index of a task
+	EventProgress EventType = "progress"
+	// EventRetry is a failed attempt to restore an index of a task, followed by another attempt
+	EventRetry EventType = "retry"
+	// EventDone ends the stream of a finished task, with its status
+	EventDone EventType = "done"
+)
+
+// Event is a change of the restore of a task, streamed to the followers of the task
 type Event struct {
-	Index     string
-	Snapshot  string
-	NodeName  string
-	StoreSize string
+	TaskID    string    `json:"task_id"`
+	Type      EventType `json:"type"`
+	Index     string    `json:"index,omitempty"`
+	Snapshot  string    `json:"snapshot,omitempty"`
+	NodeName  string    `json:"node_name,omitempty"`
+	StoreSize string    `json:"store_size,omitempty"`
+	Stage     string    `json:"stage,omitempty"`
+	Status    string    `json:"status,omitempty"`
+	Progress  float64   `json:"progress,omitempty"`
+	Attempt   int       `json:"attempt,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// Broker fans the events out to the subscribers of their task, through redis pub/sub when redis is reachable so
+// the subscribers of every instance receive them
+type Broker struct {
+	mu    sync.Mutex
+	subs  map[string]map[chan Event]struct{} // by task id
+	redis rueidis.Client                     // nil fans out in process
+}
+
+func NewBroker(lc fx.Lifecycle) *Broker {
+	b := &Broker{subs: make(map[string]map[chan Event]struct{})}
+
+	if config.GlobalConfig.Redis.Host != "" {
+		client, err := rueidis.NewClient(rueidis.ClientOption{
+			InitAddress: []string{fmt.Sprintf("%s:%d", config.GlobalConfig.Redis.Host, config.GlobalConfig.Redis.Port)},
+			Password:    config.GlobalConfig.Redis.Password,
+			SelectDB:    config.GlobalConfig.Redis.DB,
+		})
+		if err != nil {
+			// the events still reach the subscribers of this instance
+			log.Warn().Err(err).Msgf("failed to connect to redis %s:%d, fan events out in process", config.GlobalConfig.Redis.Host, config.GlobalConfig.Redis.Port)
+			return b
+		}
+		b.redis = client
+
+		ctx, cancel := context.WithCancel(context.Background())
+		lc.Append(fx.Hook{
+			OnStart: func(context.Context) error {
+				log.Info().Msgf("event broker subscribe redis channel %s", eventChannel)
+				go b.receive(ctx)
+				return nil
+			},
+			OnStop: func(context.Context) error {
+				cancel()
+				client.Close()
+				return nil
+			},
+		})
+	}
+
+	return b
+}
+
+// receive dispatches the events of the redis channel until ctx is done, resubscribing when the connection breaks
+func (b *Broker) receive(ctx context.Context) {
+	for {
+		err := b.redis.Receive(ctx, b.redis.B().Subscribe().Channel(eventChannel).Build(), func(msg rueidis.PubSubMessage) {
+			var e Event
+			if err := json.Unmarshal([]byte(msg.Message), &e); err != nil {
+				log.Error().Err(err).Msgf("failed to decode event %s", msg.Message)
+				return
+			}
+			b.dispatch(e)
+		})
+
+		if ctx.Err() != nil {
+			return
+		}
+		log.Error().Err(err).Msgf("redis channel %s subscription broke, resubscribe", eventChannel)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Publish sends e to the subscribers of its task
+func (b *Broker) Publish(ctx context.Context, e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	if b.redis == nil {
+		b.dispatch(e)
+		return
+	}
+
+	msg, err := json.Marshal(e)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to encode %s event of task id %s", e.Type, e.TaskID)
+		return
+	}
+	if err := b.redis.Do(ctx, b.redis.B().Publish().Channel(eventChannel).Message(string(msg)).Build()).Error(); err != nil {
+		log.Error().Err(err).Msgf("failed to publish %s event of task id %s", e.Type, e.TaskID)
+	}
+}
+
+// dispatch hands e to the local subscribers of its task, a subscriber lagging behind misses it
+func (b *Broker) dispatch(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs[e.TaskID] {
+		select {
+		case ch <- e:
+		default:
+			log.Warn().Msgf("drop %s event of task id %s for a slow subscriber", e.Type, e.TaskID)
+		}
+	}
+}
+
+// Subscribe returns the events of the task task_id, until the returned func is called
+func (b *Broker) Subscribe(task_id string) (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	b.mu.Lock()
+	if b.subs[task_id] == nil {
+		b.subs[task_id] = make(map[chan Event]struct{})
+	}
+	b.subs[task_id][ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		delete(b.subs[task_id], ch)
+		if len(b.subs[task_id]) == 0 {
+			delete(b.subs, task_id)
+		}
+	}
 }
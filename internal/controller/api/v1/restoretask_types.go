@@ -17,6 +17,7 @@ limitations under the License.
 package v1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -51,6 +52,54 @@ type RestoreTaskSpec struct {
 	Snapshot         SnapshotRef      `json:"snapshot"`
 	Indices          []string         `json:"indices"`
 	ElasticsearchRef ElasticsearchRef `json:"elasticsearchRef"`
+	// Replicas is the number_of_replicas of the restored indices, they keep the one of the snapshot when unset
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+	// Isolation is nodeset to restore on a node set of the referenced Elasticsearch, or cluster to
+	// restore into a standalone Elasticsearch named NodeName
+	// +kubebuilder:validation:Enum=nodeset;cluster
+	// +optional
+	Isolation IsolationMode `json:"isolation,omitempty"`
+	// +optional
+	Placement *Placement `json:"placement,omitempty"`
+	// +optional
+	Resources *NodeResources `json:"resources,omitempty"`
+	// DesiredState pauses, resumes or cancels the restore, empty is running
+	// +kubebuilder:validation:Enum=running;paused;canceled
+	// +optional
+	DesiredState DesiredState `json:"desiredState,omitempty"`
+	// PauseMode is throttle to throttle the recovery of the cluster or close to close the restored indices while
+	// paused, empty is throttle
+	// +kubebuilder:validation:Enum=throttle;close
+	// +optional
+	PauseMode PauseMode `json:"pauseMode,omitempty"`
+	// TeardownOnCancel tears the restore node down when the restore is canceled and no other task uses it
+	// +optional
+	TeardownOnCancel bool `json:"teardownOnCancel,omitempty"`
+	// Throttle bounds the recovery bandwidth while the restore runs, empty fields fall back to the throttle config
+	// +optional
+	Throttle *Throttle `json:"throttle,omitempty"`
+	// Approval is pending while the restore waits for an approval, nothing is provisioned until it is approved
+	// and a rejected restore is canceled. Empty needs no approval.
+	// +kubebuilder:validation:Enum=pending;approved;rejected
+	// +optional
+	Approval ApprovalState `json:"approval,omitempty"`
+}
+
+// Throttle is the recovery bandwidth of a restore, the most restrictive of the running restores of a cluster is
+// applied. Byte rates use the Elasticsearch units, like 40mb.
+type Throttle struct {
+	// MaxBytesPerSec is the indices.recovery.max_bytes_per_sec of the cluster
+	// +optional
+	MaxBytesPerSec string `json:"maxBytesPerSec,omitempty"`
+	// ConcurrentRecoveries is the cluster.routing.allocation.node_concurrent_recoveries of the cluster
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	ConcurrentRecoveries int `json:"concurrentRecoveries,omitempty"`
+	// RestoreBytesPerSec is the max_restore_bytes_per_sec of the snapshot repository
+	// +optional
+	RestoreBytesPerSec string `json:"restoreBytesPerSec,omitempty"`
 }
 
 type SnapshotRef struct {
@@ -63,6 +112,73 @@ type ElasticsearchRef struct {
 	Name      string `json:"name"`
 }
 
+// NodeResources is the restore node layout computed by the sizing engine
+type NodeResources struct {
+	// +optional
+	Count int32 `json:"count,omitempty"`
+	// +optional
+	CPU string `json:"cpu,omitempty"`
+	// +optional
+	Memory string `json:"memory,omitempty"`
+	// +optional
+	Heap string `json:"heap,omitempty"`
+}
+
+type IsolationMode string
+
+var (
+	IsolationNodeSet IsolationMode = "nodeset"
+	IsolationCluster IsolationMode = "cluster"
+)
+
+type DesiredState string
+
+var (
+	DesiredRunning  DesiredState = "running"
+	DesiredPaused   DesiredState = "paused"
+	DesiredCanceled DesiredState = "canceled"
+)
+
+type PauseMode string
+
+type ApprovalState string
+
+var (
+	ApprovalPending  ApprovalState = "pending"
+	ApprovalApproved ApprovalState = "approved"
+	ApprovalRejected ApprovalState = "rejected"
+)
+
+var (
+	PauseThrottle PauseMode = "throttle"
+	PauseClose    PauseMode = "close"
+)
+
+type AntiAffinityMode string
+
+var (
+	AntiAffinityRequired  AntiAffinityMode = "required"
+	AntiAffinityPreferred AntiAffinityMode = "preferred"
+	AntiAffinityNone      AntiAffinityMode = "none"
+)
+
+// Placement controls where the restore pods are scheduled, empty fields fall back to the es placement config
+type Placement struct {
+	// +optional
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+	// +optional
+	NodeAffinity *corev1.NodeAffinity `json:"nodeAffinity,omitempty"`
+	// +kubebuilder:validation:Enum=required;preferred;none
+	// +optional
+	AntiAffinity AntiAffinityMode `json:"antiAffinity,omitempty" binding:"omitempty,oneof=required preferred none"`
+	// +optional
+	TopologyKey string `json:"topologyKey,omitempty"`
+	// +optional
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+	// +optional
+	Zones []string `json:"zones,omitempty"`
+}
+
 // RestoreTaskStatus defines the observed state of RestoreTask.
 type RestoreTaskStatus struct {
 	Reason     string             `json:"reason"`
@@ -70,6 +186,12 @@ type RestoreTaskStatus struct {
 	FinishedAt *metav1.Time       `json:"finished_at"`
 	Status     string             `json:"status"`
 	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// Endpoint is the http endpoint of the isolated restore cluster
+	// +optional
+	Endpoint string `json:"endpoint,omitempty"`
+	// CredentialsSecret holds the elastic user password of the isolated restore cluster
+	// +optional
+	CredentialsSecret string `json:"credentialsSecret,omitempty"`
 }
 
 // +kubebuilder:object:root=true
@@ -7,8 +7,15 @@ const (
 	ElasticsearchKind       = "Elasticsearch"
 	ElasticsearchAPIVersion = "elasticsearch.k8s.elastic.co/v1"
 
-	RestoreStatusPending = "pending"
-	RestoreStatusRunning = "running"
-	RestoreStatusDone    = "done"
-	RestoreStatusFailed  = "failed"
+	// ConditionPreflight is true once the preflight checks of the RestoreTask passed
+	ConditionPreflight = "Preflight"
+
+	RestoreStatusAwaitingApproval = "awaiting_approval"
+	RestoreStatusPending          = "pending"
+	RestoreStatusQueued           = "queued"
+	RestoreStatusRunning          = "running"
+	RestoreStatusPaused           = "paused"
+	RestoreStatusDone             = "done"
+	RestoreStatusFailed           = "failed"
+	RestoreStatusCanceled         = "canceled"
 )
@@ -18,172 +18,109 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"go.uber.org/fx"
-	"gorm.io/gorm"
-	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime"
-	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/404LifeFound/es-snapshot-restore/internal/audit"
+	"github.com/404LifeFound/es-snapshot-restore/internal/budget"
 	restorev1 "github.com/404LifeFound/es-snapshot-restore/internal/controller/api/v1"
 	"github.com/404LifeFound/es-snapshot-restore/internal/db"
-	"github.com/404LifeFound/es-snapshot-restore/internal/elastic"
-	"github.com/404LifeFound/es-snapshot-restore/internal/k8s"
+	"github.com/404LifeFound/es-snapshot-restore/internal/pool"
+	"github.com/404LifeFound/es-snapshot-restore/internal/preflight"
+	"github.com/404LifeFound/es-snapshot-restore/internal/provisioner"
 	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
-	esv1 "github.com/elastic/cloud-on-k8s/v3/pkg/apis/elasticsearch/v1"
+	"github.com/404LifeFound/es-snapshot-restore/internal/worker"
 	"github.com/rs/zerolog/log"
-	appsv1 "k8s.io/api/apps/v1"
-	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
 )
 
-type RestoreTask struct {
-	Namespace string
-	Name      string
-	TaskID    string
-	Index     []string
-}
-
 // RestoreTaskReconciler reconciles a RestoreTask object
 type RestoreTaskReconciler struct {
 	client.Client
-	ESClient  *elastic.ES
-	DBClient  *gorm.DB
-	Scheme    *runtime.Scheme
-	taskQueue chan *RestoreTask // taskID queue
-	sem       chan struct{}     // concurrent queue
+	Scheme      *runtime.Scheme
+	Provisioner provisioner.Provisioner
+	Worker      *worker.Worker
+	Pool        *pool.Pool
+	Preflight   *preflight.Checker
+	Auditor     *audit.Auditor
 }
 
-func (r *RestoreTaskReconciler) StartWorker(ctx context.Context) {
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case task := <-r.taskQueue:
-				r.sem <- struct{}{}
-				go func(task *RestoreTask) {
-					defer func() { <-r.sem }()
-					err := r.restoreIndices(task)
-					if err != nil {
-						r.updateTaskStatus(ctx, task, RestoreStatusFailed)
-					} else {
-						r.updateTaskStatus(ctx, task, RestoreStatusDone)
-					}
-				}(task)
-			}
-		}
-	}()
+// audit records action of the controller on target in the audit log, err is why it failed
+func (r *RestoreTaskReconciler) audit(action, target string, err error) {
+	entry := audit.Entry{
+		Actor:   "controller",
+		Source:  audit.SourceController,
+		Action:  action,
+		Target:  target,
+		Outcome: audit.OutcomeSuccess,
+	}
+	if err != nil {
+		entry.Outcome = audit.OutcomeFailure
+		entry.Message = err.Error()
+	}
+	r.Auditor.Record(entry)
 }
 
-func (r *RestoreTaskReconciler) updateTaskStatus(ctx context.Context, task *RestoreTask, status string) {
+func (r *RestoreTaskReconciler) updateTaskStatus(ctx context.Context, key client.ObjectKey, status string) {
 	var restore_task restorev1.RestoreTask
-	if err := r.Get(ctx, client.ObjectKey{Namespace: task.Namespace, Name: task.Name}, &restore_task); err != nil {
-		log.Error().Err(err).Msgf("Failed to get RestoreTask: %s", task.Name)
+	if err := r.Get(ctx, key, &restore_task); err != nil {
+		log.Error().Err(err).Msgf("Failed to get RestoreTask: %s", key.Name)
 		return
 	}
 
 	restore_task.Status.FinishedAt = utils.PtrToAny(metav1.Now())
 	restore_task.Status.Status = status
-	if err := r.Client.Update(ctx, &restore_task); err != nil {
+	if err := r.Status().Update(ctx, &restore_task); err != nil {
 		log.Error().Err(err).Msgf("failed to update RestoreTask %s", restore_task.Name)
 		// TODO retry
 	}
 }
 
-func (r *RestoreTaskReconciler) restoreIndices(task *RestoreTask) error {
-	t, err := db.QueryAll[db.Task](r.DBClient, "", 0, "task_id = ? and index = ?", task.TaskID, task.Index[0])
-	if err != nil {
-		log.Error().Err(err).Msgf("failed to query task id %s for index %s", task.TaskID, task.Index[0])
-		return err
-	}
-
-	if len(t) != 1 {
-		log.Error().Err(err).Msgf("records for task_id %s of index %s not equal 1 but %d", task.TaskID, task.Index[0], len(t))
-		return err
-	}
-
-	task_one := t[0]
-
-	log.Info().Msgf("restoring index %s from snapshot %s", task_one.Index, task_one.Snapshot)
-	if err := r.ESClient.Restore(
-		context.Background(),
-		task_one.Repository,
-		task_one.Snapshot,
-		config.GlobalConfig.ES.RestoreKey,
-		config.GlobalConfig.ES.RestoreKey,
-		task_one.Repository,
-		[]string{task_one.Index},
-	); err != nil {
-		log.Error().Err(err).Msgf("failed to restore index %s from snapshot %s", task_one.Index, task_one.Snapshot)
-		if err := r.DBClient.Model(&t).Updates(map[string]any{
-			"Status":       string(utils.TaskFailed),
-			"ErrorMessage": utils.PtrToAny(fmt.Sprintf("failed to restore index %s from snapshot %s", task_one.Index, task_one.Snapshot)),
-		}).Error; err != nil {
-			log.Error().Err(err).Msgf("failed to update status and error_message for task id %s of index %s", task_one.TaskID, task_one.Index)
-		}
-		return err
+// updateTaskEndpoint records where the indices of the RestoreTask are restored to, when it isn't the production Elasticsearch
+func (r *RestoreTaskReconciler) updateTaskEndpoint(ctx context.Context, key client.ObjectKey, target *provisioner.Target) {
+	if target.Endpoint == "" {
+		return
 	}
 
-	restoreTimeout := time.Duration(config.GlobalConfig.ES.Timeout) * time.Minute
-	pollInterval := time.Duration(config.GlobalConfig.ES.Interval) * time.Second
-
-	ticker := time.NewTicker(pollInterval)
-	defer ticker.Stop()
-
-	timeout := time.After(restoreTimeout)
-
-	for {
-		select {
-		case <-ticker.C:
-			res, err := r.ESClient.GetRestoreIndexProcess([]string{task_one.Index})
-			if err != nil {
-				log.Error().Err(err).Msgf("failed to check the recovery process of restore index %s from snapshot %s", task_one.Index, task_one.Snapshot)
-				continue
-			}
-
-			if len(res) == 0 {
-				log.Warn().Msgf("no recovery info found for index %s, retrying...", task_one.Index)
-				continue
-			}
+	var restore_task restorev1.RestoreTask
+	if err := r.Get(ctx, key, &restore_task); err != nil {
+		log.Error().Err(err).Msgf("Failed to get RestoreTask: %s", key.Name)
+		return
+	}
 
-			log.Info().Msgf("restore progress of index %s: %s", task_one.Index, res[0].RecoveredPercent)
-
-			if res[0].RecoveredPercent == "100%" {
-				log.Info().Msgf("restore of index %s completed successfully", task_one.Index)
-				if err := r.DBClient.Model(&t).Updates(map[string]any{
-					"Status": string(utils.TaskSuccess),
-				}).Error; err != nil {
-					log.Error().Err(err).Msgf("failed to update status for task id %s of index %s when task success", task_one.TaskID, task_one.Index)
-					continue
-				}
-				return nil
-			}
+	if restore_task.Status.Endpoint == target.Endpoint {
+		return
+	}
 
-		case <-timeout:
-			if err := r.DBClient.Model(&t).Updates(map[string]any{
-				"Status": string(utils.TaskTimeout),
-			}).Error; err != nil {
-				log.Error().Err(err).Msgf("failed to update status for task id %s of index %s when task timeout", task_one.TaskID, task_one.Index)
-			}
-			return fmt.Errorf("restore of index %s timed out after %s", task_one.Index, restoreTimeout)
-		}
+	restore_task.Status.Endpoint = target.Endpoint
+	restore_task.Status.CredentialsSecret = target.CredentialsSecret
+	if err := r.Status().Update(ctx, &restore_task); err != nil {
+		log.Error().Err(err).Msgf("failed to update endpoint of RestoreTask %s", restore_task.Name)
 	}
 }
 
 // +kubebuilder:rbac:groups=restore.restore.elastic.co,resources=restoretasks,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=restore.restore.elastic.co,resources=restoretasks/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=restore.restore.elastic.co,resources=restoretasks/finalizers,verbs=update
+// +kubebuilder:rbac:groups=storage.k8s.io,resources=storageclasses,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups=elasticsearch.k8s.elastic.co,resources=elasticsearches,verbs=get;list;watch;create;update;patch;delete
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -201,94 +138,313 @@ func (r *RestoreTaskReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	}
 	if restore_task.Status.StartAt == nil {
 		restore_task.Status.StartAt = utils.PtrToAny(metav1.Now())
-		if err := r.Update(ctx, &restore_task); err != nil {
+		if err := r.Status().Update(ctx, &restore_task); err != nil {
 			return ctrl.Result{}, err
 		}
 	}
 
-	var es esv1.Elasticsearch
+	switch restore_task.Status.Status {
+	case RestoreStatusDone, RestoreStatusFailed, RestoreStatusCanceled:
+		return ctrl.Result{}, nil
+	}
+
+	if result, err := r.steer(ctx, &restore_task); result != nil || err != nil {
+		return *result, err
+	}
+
+	if result, err := r.approved(ctx, &restore_task); result != nil || err != nil {
+		return *result, err
+	}
+
+	restore_req := provisioner.NewTaskRequest(&restore_task)
+
+	if config.GlobalConfig.Preflight.Enabled && !meta.IsStatusConditionTrue(restore_task.Status.Conditions, ConditionPreflight) {
+		if passed, err := r.preflight(ctx, &restore_task, restore_req); !passed || err != nil {
+			return ctrl.Result{}, err
+		}
+	}
 
-	es_ns := restore_task.Spec.ElasticsearchRef.Namespace
-	es_name := restore_task.Spec.ElasticsearchRef.Name
-	if es_ns == "" {
-		es_ns = restore_task.Namespace
+	if result, err := r.admit(ctx, &restore_task, restore_req); result != nil || err != nil {
+		return *result, err
 	}
 
-	if err := r.Get(ctx, client.ObjectKey{Namespace: es_ns, Name: es_name}, &es); err != nil {
-		log.Error().Err(err).Msgf("Elasticsearch of %s in %s Namespace not found: %v", es_name, es_ns, err)
+	exists, err := r.Provisioner.Exists(ctx, restore_req)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to check restore node %s of RestoreTask %s", restore_req.Name, restore_task.Name)
 		// requeue
 		return ctrl.Result{}, err
 	}
 
-	// es nodesets
-	var exist_node esv1.NodeSet
-	var node_exist bool
-	var exist_node_index int
-	for i, n := range es.Spec.NodeSets {
-		if n.Name == restore_task.Spec.NodeName {
-			node_exist = true
-			exist_node = n
-			exist_node_index = i
+	if !exists {
+		log.Info().Msgf("node %s not exists, so create it", restore_req.Name)
+		err := r.Provisioner.Create(ctx, restore_req)
+		r.audit("createNode", restore_req.Name, err)
+		if err != nil {
+			return ctrl.Result{}, err
 		}
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
 	}
 
-	if !node_exist {
-		log.Info().Msgf("node % not exists, so create it", restore_task.Spec.NodeName)
-		restore_node := k8s.NewESNodeSet(restore_task.Spec.NodeName, restore_task.Spec.StoreSize)
-		original_es := es.DeepCopy()
-		es.Spec.NodeSets = append(es.Spec.NodeSets, *restore_node.NodeSet)
-		if err := r.Patch(ctx, &es, client.MergeFrom(original_es)); err != nil {
-			log.Error().Err(err).Msgf("failed to patch Elasticsearch of %s in %s Namespace to add new node: %s", es_name, es_ns, restore_task.Spec.NodeName)
-			return ctrl.Result{}, err
+	grown, err := r.Provisioner.Grow(ctx, restore_req)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !grown {
+		log.Info().Msgf("node %s is growing to %s", restore_req.Name, restore_req.StoreSize)
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	}
+
+	ready, err := r.Provisioner.Ready(ctx, restore_req)
+	if err != nil {
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, err
+	}
+	if !ready {
+		log.Info().Msgf("node %s not ready yet", restore_req.Name)
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	}
+
+	// a spec change reconciles the task again while its job runs
+	if r.Worker.Active(restore_task.Spec.TaskId) {
+		return ctrl.Result{}, nil
+	}
+
+	key := client.ObjectKeyFromObject(&restore_task)
+	err = r.Worker.Enqueue(&worker.Job{
+		TaskID:   restore_task.Spec.TaskId,
+		Index:    restore_task.Spec.Indices,
+		Replicas: replicasOf(&restore_task),
+		Request:  restore_req,
+		Throttle: restore_task.Spec.Throttle,
+		OnTarget: func(ctx context.Context, target *provisioner.Target) {
+			r.updateTaskEndpoint(ctx, key, target)
+		},
+		OnDone: func(ctx context.Context, err error) {
+			if errors.Is(err, worker.ErrCanceled) {
+				return
+			}
+			r.audit("restoreTask", restore_task.Spec.TaskId, err)
+			if err != nil {
+				r.updateTaskStatus(ctx, key, RestoreStatusFailed)
+			} else {
+				r.updateTaskStatus(ctx, key, RestoreStatusDone)
+			}
+		},
+	})
+	if errors.Is(err, worker.ErrQueueFull) {
+		log.Info().Err(err).Msgf("RestoreTask %s waits for room in the restore queue", restore_task.Name)
+		return ctrl.Result{RequeueAfter: time.Duration(config.GlobalConfig.Budget.RetryInterval) * time.Second}, nil
+	}
+
+	return ctrl.Result{}, err
+}
+
+// steer cancels, pauses or resumes restore_task to match its desired state. It returns a result when the reconcile
+// stops there, which it does while the task is paused.
+func (r *RestoreTaskReconciler) steer(ctx context.Context, restore_task *restorev1.RestoreTask) (*ctrl.Result, error) {
+	task_id := restore_task.Spec.TaskId
+
+	switch restore_task.Spec.DesiredState {
+	case restorev1.DesiredCanceled:
+		log.Info().Msgf("cancel RestoreTask %s", restore_task.Name)
+		if err := r.Worker.Cancel(ctx, task_id, restore_task.Spec.TeardownOnCancel); err != nil {
+			log.Error().Err(err).Msgf("failed to cancel RestoreTask %s", restore_task.Name)
+			return &ctrl.Result{}, err
+		}
+		restore_task.Status.Status = RestoreStatusCanceled
+		restore_task.Status.FinishedAt = utils.PtrToAny(metav1.Now())
+		return &ctrl.Result{}, r.Status().Update(ctx, restore_task)
+
+	case restorev1.DesiredPaused:
+		if restore_task.Status.Status != RestoreStatusPaused {
+			log.Info().Msgf("pause RestoreTask %s with %s", restore_task.Name, restore_task.Spec.PauseMode)
+			if err := r.Worker.Pause(ctx, task_id, restore_task.Spec.PauseMode); err != nil {
+				log.Error().Err(err).Msgf("failed to pause RestoreTask %s", restore_task.Name)
+				return &ctrl.Result{}, err
+			}
+			restore_task.Status.Status = RestoreStatusPaused
+			if err := r.Status().Update(ctx, restore_task); err != nil {
+				return &ctrl.Result{}, err
+			}
+		}
+		// nothing is provisioned for a paused task
+		return &ctrl.Result{}, nil
+	}
+
+	if restore_task.Status.Status == RestoreStatusPaused {
+		log.Info().Msgf("resume RestoreTask %s", restore_task.Name)
+		if err := r.Worker.Resume(ctx, task_id); err != nil {
+			log.Error().Err(err).Msgf("failed to resume RestoreTask %s", restore_task.Name)
+			return &ctrl.Result{}, err
+		}
+		restore_task.Status.Status = RestoreStatusPending
+		if r.Worker.Active(task_id) {
+			restore_task.Status.Status = RestoreStatusRunning
+		}
+		if err := r.Status().Update(ctx, restore_task); err != nil {
+			return &ctrl.Result{}, err
 		}
-	} else {
-		store_size, err := utils.ToGB(restore_task.Spec.StoreSize)
-		storage_quanlity := exist_node.VolumeClaimTemplates[0].Spec.Resources.Requests[corev1.ResourceStorage]
-		exist_node_storage := float64(storage_quanlity.Value()) / (1024 * 1024 * 1024)
+	}
+
+	return nil, nil
+}
+
+// approved holds restore_task until its approval is decided, it returns a result while the task waits for it or
+// when it was rejected, which cancels it. A task without approval whose records await one is held too, the approval
+// was dropped from its spec.
+func (r *RestoreTaskReconciler) approved(ctx context.Context, restore_task *restorev1.RestoreTask) (*ctrl.Result, error) {
+	approval := restore_task.Spec.Approval
+	if approval == "" {
+		awaiting, err := db.QueryAll[db.Task](r.Worker.DBClient, "", 1, "task_id = ? AND status = ?", restore_task.Spec.TaskId, string(utils.TaskAwaitingApproval))
 		if err != nil {
-			log.Error().Err(err).Msgf("failed to transfer %s to float of RestoreTask %s", restore_task.Spec.StoreSize, restore_task.Name)
-			return ctrl.Result{}, err
+			return &ctrl.Result{}, err
 		}
-		if store_size > exist_node_storage {
-			original_es := es.DeepCopy()
-			es.Spec.NodeSets[exist_node_index].VolumeClaimTemplates[0].Spec.Resources = corev1.VolumeResourceRequirements{
-				Requests: corev1.ResourceList{
-					corev1.ResourceStorage: resource.MustParse(fmt.Sprintf("%sGi", store_size)),
-				},
-			}
-			if err := r.Patch(ctx, &es, client.MergeFrom(original_es)); err != nil {
-				log.Error().Err(err).Msgf("failed to patch Elasticsearch of %s in %s Namespace to add new node: %s", es_name, es_ns, restore_task.Spec.NodeName)
-				return ctrl.Result{}, err
+		if len(awaiting) > 0 {
+			approval = restorev1.ApprovalPending
+		}
+	}
+
+	switch approval {
+	case restorev1.ApprovalPending:
+		if restore_task.Status.Status != RestoreStatusAwaitingApproval {
+			log.Info().Msgf("RestoreTask %s awaits its approval", restore_task.Name)
+			restore_task.Status.Status = RestoreStatusAwaitingApproval
+			if err := r.Status().Update(ctx, restore_task); err != nil {
+				return &ctrl.Result{}, err
 			}
 		}
+		// the approval changes the spec, which reconciles the task again
+		return &ctrl.Result{}, nil
+
+	case restorev1.ApprovalRejected:
+		log.Info().Msgf("RestoreTask %s is rejected", restore_task.Name)
+		restore_task.Status.Status = RestoreStatusCanceled
+		restore_task.Status.Reason = "approval rejected"
+		restore_task.Status.FinishedAt = utils.PtrToAny(metav1.Now())
+		return &ctrl.Result{}, r.Status().Update(ctx, restore_task)
 	}
 
-	// check sts status
-	var sts appsv1.StatefulSet
-	sts_name := fmt.Sprintf("%s-es-%s", es_name, restore_task.Spec.NodeName)
-	if err := r.Get(ctx, client.ObjectKey{Namespace: es_ns, Name: sts_name}, &sts); err != nil {
-		return ctrl.Result{RequeueAfter: 10 * time.Second}, err
+	if restore_task.Status.Status == RestoreStatusAwaitingApproval {
+		restore_task.Status.Status = RestoreStatusPending
+		if err := r.Status().Update(ctx, restore_task); err != nil {
+			return &ctrl.Result{}, err
+		}
+	}
+	return nil, nil
+}
+
+// preflight checks the cluster can accept restore_task before anything is provisioned for it, and fails the task
+// with the failed checks as reason otherwise
+func (r *RestoreTaskReconciler) preflight(ctx context.Context, restore_task *restorev1.RestoreTask, restore_req provisioner.Request) (bool, error) {
+	var replicas int
+	if restore_task.Spec.Replicas != nil {
+		replicas = int(*restore_task.Spec.Replicas)
+	}
+	report := r.Preflight.Run(ctx, preflight.Input{
+		Request:    restore_req,
+		Repository: restore_task.Spec.Snapshot.Repository,
+		Snapshot:   restore_task.Spec.Snapshot.Snapshot,
+		Indices:    restore_task.Spec.Indices,
+		Replicas:   replicas,
+	})
+
+	condition := metav1.Condition{
+		Type:               ConditionPreflight,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Passed",
+		Message:            fmt.Sprintf("%d preflight checks passed", len(report.Checks)),
+		ObservedGeneration: restore_task.Generation,
+	}
+	if !report.Passed {
+		failures := strings.Join(report.Failures(), "; ")
+		log.Error().Msgf("preflight of RestoreTask %s failed: %s", restore_task.Name, failures)
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "Failed"
+		condition.Message = failures
+		restore_task.Status.Status = RestoreStatusFailed
+		restore_task.Status.Reason = failures
+		restore_task.Status.FinishedAt = utils.PtrToAny(metav1.Now())
+		r.audit("preflightTask", restore_task.Spec.TaskId, errors.New(failures))
+	}
+
+	meta.SetStatusCondition(&restore_task.Status.Conditions, condition)
+	if err := r.Status().Update(ctx, restore_task); err != nil {
+		log.Error().Err(err).Msgf("failed to update preflight of RestoreTask %s", restore_task.Name)
+		return false, err
+	}
+
+	if !report.Passed {
+		return false, r.Worker.Fail(ctx, restore_task.Spec.TaskId, fmt.Errorf("preflight failed: %s", restore_task.Status.Reason))
 	}
+	return true, nil
+}
 
-	// ensure the sts owned by Elasticsearch
-	for _, owner := range sts.OwnerReferences {
-		if owner.Kind == "Elasticsearch" &&
-			owner.APIVersion == "elasticsearch.k8s.elastic.co/v1" {
-			return ctrl.Result{}, fmt.Errorf("statefulset %s not owned by Elasticsearch %s", sts_name, es.Name)
+// admit charges the restore node of restore_task to the budget, placing it through the pool when it has no node
+// yet. It returns a result when the reconcile stops there: the spec was updated with the placed node, or the task
+// is queued until the budget is released, or the task never fits the budget.
+func (r *RestoreTaskReconciler) admit(ctx context.Context, restore_task *restorev1.RestoreTask, restore_req provisioner.Request) (*ctrl.Result, error) {
+	if restore_req.Name != "" {
+		recorded, err := r.Pool.Recorded(restore_req.Name)
+		if err != nil {
+			return &ctrl.Result{}, err
+		}
+		if recorded {
+			return nil, nil
 		}
 	}
 
-	if sts.Status.ReadyReplicas != *sts.Spec.Replicas {
-		log.Info().Str("sts", sts.Name).Msg("StatefulSet not ready yet")
-		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	admitted, err := r.Pool.Acquire(ctx, restore_req, 1)
+	if errors.Is(err, budget.ErrExhausted) {
+		log.Info().Err(err).Msgf("RestoreTask %s is queued", restore_task.Name)
+		if restore_task.Status.Status != RestoreStatusQueued {
+			restore_task.Status.Status = RestoreStatusQueued
+			if err := r.Status().Update(ctx, restore_task); err != nil {
+				return &ctrl.Result{}, err
+			}
+		}
+		return &ctrl.Result{RequeueAfter: time.Duration(config.GlobalConfig.Budget.RetryInterval) * time.Second}, nil
+	} else if errors.Is(err, budget.ErrOverBudget) {
+		log.Error().Err(err).Msgf("RestoreTask %s never fits the budget", restore_task.Name)
+		r.audit("admitTask", restore_task.Spec.TaskId, err)
+		restore_task.Status.Status = RestoreStatusFailed
+		restore_task.Status.Reason = err.Error()
+		restore_task.Status.FinishedAt = utils.PtrToAny(metav1.Now())
+		if err := r.Status().Update(ctx, restore_task); err != nil {
+			return &ctrl.Result{}, err
+		}
+		return &ctrl.Result{}, r.Worker.Fail(ctx, restore_task.Spec.TaskId, err)
+	} else if err != nil {
+		return &ctrl.Result{}, err
+	}
+
+	if restore_task.Status.Status == RestoreStatusQueued {
+		restore_task.Status.Status = RestoreStatusPending
+		if err := r.Status().Update(ctx, restore_task); err != nil {
+			return &ctrl.Result{}, err
+		}
 	}
 
-	r.taskQueue <- &RestoreTask{
-		TaskID: restore_task.Spec.TaskId,
-		Index:  restore_task.Spec.Indices,
+	if admitted.Name == restore_task.Spec.NodeName && admitted.StoreSize == restore_task.Spec.StoreSize {
+		return nil, nil
 	}
 
-	return ctrl.Result{}, nil
+	// the generation change of the spec reconciles the task again on the placed node
+	original := restore_task.DeepCopy()
+	restore_task.Spec.NodeName = admitted.Name
+	restore_task.Spec.StoreSize = admitted.StoreSize
+	if err := r.Patch(ctx, restore_task, client.MergeFrom(original)); err != nil {
+		log.Error().Err(err).Msgf("failed to place RestoreTask %s on restore node %s", restore_task.Name, admitted.Name)
+		return &ctrl.Result{}, err
+	}
+	return &ctrl.Result{}, nil
+}
+
+// replicasOf is the number_of_replicas of the indices restored by restore_task, nil when they keep the one of
+// the snapshot
+func replicasOf(restore_task *restorev1.RestoreTask) *int {
+	if restore_task.Spec.Replicas == nil {
+		return nil
+	}
+	return utils.PtrToAny(int(*restore_task.Spec.Replicas))
 }
 
 func (r *RestoreTaskReconciler) filterCreate(e event.CreateEvent) bool {
@@ -334,58 +490,56 @@ func (r *RestoreTaskReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		Complete(r)
 }
 
-func NewRestoreTaskReconciler(c client.Client, s *runtime.Scheme, es *elastic.ES, db *gorm.DB) *RestoreTaskReconciler {
+func NewRestoreTaskReconciler(c client.Client, s *runtime.Scheme, p provisioner.Provisioner, w *worker.Worker, restore_pool *pool.Pool, checker *preflight.Checker, auditor *audit.Auditor) *RestoreTaskReconciler {
 	return &RestoreTaskReconciler{
-		Client:    c,
-		Scheme:    s,
-		ESClient:  es,
-		DBClient:  db,
-		taskQueue: make(chan *RestoreTask, config.GlobalConfig.ES.MaxTasks),
-		sem:       make(chan struct{}, config.GlobalConfig.ES.Concurrency),
+		Client:      c,
+		Scheme:      s,
+		Provisioner: p,
+		Worker:      w,
+		Pool:        restore_pool,
+		Preflight:   checker,
+		Auditor:     auditor,
 	}
 }
 
-func NewManager() (*ctrl.Manager, error) {
-	scheme := runtime.NewScheme()
+// NewManager runs the controller against the same cluster and scheme as the kubernetes client
+func NewManager(cfg *rest.Config, scheme *runtime.Scheme) (*ctrl.Manager, error) {
 	//setupLog := ctrl.Log.WithName("setup")
 	ctrl.SetLogger(zap.New())
-	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
-	utilruntime.Must(esv1.AddToScheme(scheme))
-	utilruntime.Must(restorev1.AddToScheme(scheme))
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	options := ctrl.Options{
 		Scheme: scheme,
 		Cache:  cache.Options{},
-	})
+	}
+	if config.GlobalConfig.Policy.WebhookPort != 0 {
+		options.WebhookServer = webhook.NewServer(webhook.Options{
+			Port:    config.GlobalConfig.Policy.WebhookPort,
+			CertDir: config.GlobalConfig.Policy.WebhookCertDir,
+		})
+	}
+
+	mgr, err := ctrl.NewManager(cfg, options)
 	if err != nil {
 		return nil, err
 	}
 	return &mgr, nil
 }
 
-func NewRestoreReconcilerCtrl(lc fx.Lifecycle, mgr *ctrl.Manager, es_client *elastic.ES, db_client *gorm.DB) *RestoreTaskReconciler {
+func NewRestoreReconcilerCtrl(mgr *ctrl.Manager, p provisioner.Provisioner, w *worker.Worker, restore_pool *pool.Pool, checker *preflight.Checker, auditor *audit.Auditor) (*RestoreTaskReconciler, error) {
 	r := NewRestoreTaskReconciler(
 		(*mgr).GetClient(),
 		(*mgr).GetScheme(),
-		es_client,
-		db_client,
+		p,
+		w,
+		restore_pool,
+		checker,
+		auditor,
 	)
 
-	r.StartWorker(context.Background())
-	r.SetupWithManager(*mgr)
-
-	lc.Append(fx.Hook{
-		OnStart: func(ctx context.Context) error {
-			log.Info().Msg("restart worker start")
-			r.StartWorker(ctx)
-			return nil
-		},
-		OnStop: func(context.Context) error {
-			log.Info().Msg("restart worker stop")
-			return nil
-		},
-	})
-	return r
+	if err := r.SetupWithManager(*mgr); err != nil {
+		return nil, err
+	}
+	return r, nil
 }
 
 func RunManager(lc fx.Lifecycle, mgr *ctrl.Manager, _ *RestoreTaskReconciler) {
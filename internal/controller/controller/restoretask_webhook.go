@@ -0,0 +1,183 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	restorev1 "github.com/404LifeFound/es-snapshot-restore/internal/controller/api/v1"
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/404LifeFound/es-snapshot-restore/internal/policy"
+	"github.com/404LifeFound/es-snapshot-restore/internal/provisioner"
+	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// +kubebuilder:webhook:path=/validate-restore-restore-elastic-co-v1-restoretask,mutating=false,failurePolicy=fail,sideEffects=None,groups=restore.restore.elastic.co,resources=restoretasks,verbs=create;update,versions=v1,name=vrestoretask.restore.elastic.co,admissionReviewVersions=v1
+
+// RestoreTaskValidator admits the RestoreTasks created through kubernetes with the policy rules. The ones created
+// by this server were admitted by its http api already.
+type RestoreTaskValidator struct {
+	Client   client.Client
+	DBClient *gorm.DB
+	Policy   *policy.Engine
+
+	selfOnce sync.Once
+	self     string // username of this server
+}
+
+var _ admission.CustomValidator = &RestoreTaskValidator{}
+
+// ValidateCreate evaluates the policy rules for the new RestoreTask, a denied or unapproved one is rejected with
+// the reason of the decision
+func (v *RestoreTaskValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	restore_task, ok := obj.(*restorev1.RestoreTask)
+	if !ok {
+		return nil, fmt.Errorf("expected a RestoreTask but got %T", obj)
+	}
+	return v.validate(ctx, restore_task)
+}
+
+// ValidateUpdate evaluates the policy rules again when what is restored changes, steering a task is always allowed.
+// Only this server decides a pending approval, so the approver is recorded.
+func (v *RestoreTaskValidator) ValidateUpdate(ctx context.Context, old_obj, new_obj runtime.Object) (admission.Warnings, error) {
+	old_restore_task, ok1 := old_obj.(*restorev1.RestoreTask)
+	restore_task, ok2 := new_obj.(*restorev1.RestoreTask)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("expected a RestoreTask but got %T", new_obj)
+	}
+	if old_restore_task.Spec.Approval == restorev1.ApprovalPending && restore_task.Spec.Approval != restorev1.ApprovalPending {
+		self, err := v.fromSelf(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !self {
+			return nil, fmt.Errorf("the approval of task id %s is decided through the http api", restore_task.Spec.TaskId)
+		}
+	}
+	if reflect.DeepEqual(old_restore_task.Spec.Indices, restore_task.Spec.Indices) &&
+		old_restore_task.Spec.Snapshot == restore_task.Spec.Snapshot {
+		return nil, nil
+	}
+	return v.validate(ctx, restore_task)
+}
+
+func (v *RestoreTaskValidator) ValidateDelete(context.Context, runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+func (v *RestoreTaskValidator) validate(ctx context.Context, restore_task *restorev1.RestoreTask) (admission.Warnings, error) {
+	req, err := admission.RequestFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if self, err := v.fromSelf(ctx); err != nil || self {
+		return nil, err
+	}
+
+	team := restore_task.Namespace
+	if label := restore_task.Labels[provisioner.LabelTeam]; label != "" {
+		team = label
+	}
+
+	snapshot := policy.Snapshot{
+		Repository: restore_task.Spec.Snapshot.Repository,
+		Snapshot:   restore_task.Spec.Snapshot.Snapshot,
+	}
+	snapshots, err := db.QueryAll[db.ESSnapshot](v.DBClient, "", 1, "snapshot = ? AND repository = ?", snapshot.Snapshot, snapshot.Repository)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to get snapshot %s of repository %s", snapshot.Snapshot, snapshot.Repository)
+	} else if len(snapshots) == 1 {
+		snapshot.StartTime = snapshots[0].StartTime.Time
+	}
+	var policy_snapshots []policy.Snapshot
+	for _, index := range restore_task.Spec.Indices {
+		s := snapshot
+		s.Index = index
+		policy_snapshots = append(policy_snapshots, s)
+	}
+
+	request := policy.RequestOf(restore_task.Spec)
+	request["labels"] = restore_task.Labels
+	request["namespace"] = restore_task.Namespace
+
+	var node_count int32
+	if restore_task.Spec.Resources != nil {
+		node_count = restore_task.Spec.Resources.Count
+	}
+	size_gb, _ := utils.ToGB(restore_task.Spec.StoreSize)
+
+	decision := v.Policy.Evaluate(policy.Input{
+		Request: request,
+		Identity: policy.Identity{
+			Subject: req.UserInfo.Username,
+			Team:    team,
+			Groups:  req.UserInfo.Groups,
+		},
+		Indices:   restore_task.Spec.Indices,
+		SizeGB:    size_gb,
+		NodeCount: node_count,
+		Snapshots: policy_snapshots,
+	})
+	if err := decision.Err(); err != nil {
+		if errors.Is(err, policy.ErrApprovalRequired) {
+			// the approval is recorded by the http api, which creates the RestoreTask waiting for it
+			err = fmt.Errorf("%w, request the restore through the http api to wait for an approval", err)
+		}
+		log.Info().Msgf("RestoreTask %s/%s of %s rejected: %s", restore_task.Namespace, restore_task.Name, req.UserInfo.Username, err.Error())
+		return nil, err
+	}
+	return nil, nil
+}
+
+// fromSelf reports whether the admission request of ctx is sent by this server
+func (v *RestoreTaskValidator) fromSelf(ctx context.Context) (bool, error) {
+	req, err := admission.RequestFromContext(ctx)
+	if err != nil {
+		return false, err
+	}
+	username := req.UserInfo.Username
+	return username != "" && username == v.selfUsername(ctx), nil
+}
+
+// selfUsername is the username this server authenticates to kubernetes as, empty when it can't be read
+func (v *RestoreTaskValidator) selfUsername(ctx context.Context) string {
+	v.selfOnce.Do(func() {
+		review := &authenticationv1.SelfSubjectReview{}
+		if err := v.Client.Create(ctx, review); err != nil {
+			log.Error().Err(err).Msg("failed to read the kubernetes username of this server, admit its RestoreTasks with the policy rules")
+			return
+		}
+		v.self = review.Status.UserInfo.Username
+		log.Info().Msgf("RestoreTasks created by %s are admitted by the http api", v.self)
+	})
+	return v.self
+}
+
+// SetupRestoreTaskWebhook serves the validating webhook of the RestoreTasks when policy.enabled and
+// policy.webhookport are set
+func SetupRestoreTaskWebhook(mgr *ctrl.Manager, engine *policy.Engine, db_client *gorm.DB) error {
+	if !engine.Enabled() || config.GlobalConfig.Policy.WebhookPort == 0 {
+		return nil
+	}
+
+	log.Info().Msgf("serve RestoreTask validating webhook on port %d", config.GlobalConfig.Policy.WebhookPort)
+	return ctrl.NewWebhookManagedBy(*mgr).
+		For(&restorev1.RestoreTask{}).
+		WithValidator(&RestoreTaskValidator{
+			Client:   (*mgr).GetClient(),
+			DBClient: db_client,
+			Policy:   engine,
+		}).
+		Complete()
+}
@@ -3,10 +3,17 @@ package cron
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/404LifeFound/es-snapshot-restore/internal/approval"
 	"github.com/404LifeFound/es-snapshot-restore/internal/db"
 	"github.com/404LifeFound/es-snapshot-restore/internal/elastic"
+	"github.com/404LifeFound/es-snapshot-restore/internal/notify"
+	"github.com/404LifeFound/es-snapshot-restore/internal/pool"
+	"github.com/404LifeFound/es-snapshot-restore/internal/worker"
 	"github.com/robfig/cron/v3"
 	"github.com/rs/zerolog/log"
 	"go.uber.org/fx"
@@ -36,6 +43,12 @@ func (a *AllIndex) Run() {
 			Name:          i.Name,
 			IndexCreateAt: index_create_time,
 			StoreSize:     i.StoreSize,
+			PriStoreSize:  i.PriStoreSize,
+			PrimaryShards: atoi(i.Pri),
+			Replicas:      atoi(i.Rep),
+			DocsCount:     int64(atoi(i.DocsCount)),
+			Health:        i.Health,
+			Status:        i.Status,
 		})
 	}
 
@@ -46,6 +59,20 @@ func (a *AllIndex) Run() {
 	}
 }
 
+// atoi parses the numeric columns of _cat api, closed index reports them as empty string
+func atoi(s string) int {
+	if s == "" {
+		return 0
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		log.Error().Err(err).Msgf("faild to parse %s to int", s)
+		return 0
+	}
+	return n
+}
+
 type AllSnapshot struct {
 	ES       *elastic.ES
 	DBClient *gorm.DB
@@ -83,9 +110,137 @@ func (a *AllSnapshot) Run() {
 	} else {
 		log.Info().Msg("create all snaphosts records success")
 	}
+
+	a.SyncSnapshotStatus(ctx)
+}
+
+// SyncSnapshotStatus records the per index size of the newest snapshots whose status is not cataloged yet,
+// the snapshot status api reads the repository so only cron.statuslimit snapshots are read per run
+func (a *AllSnapshot) SyncSnapshotStatus(ctx context.Context) {
+	snapshots, err := db.QueryAll[db.ESSnapshot](
+		a.DBClient,
+		"start_time DESC",
+		config.GlobalConfig.Cron.StatusLimit,
+		"state = ? AND status_synced_at IS NULL",
+		"SUCCESS",
+	)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to query snapshots without status")
+		return
+	}
+
+	interval := time.Duration(config.GlobalConfig.Cron.StatusInterval) * time.Millisecond
+	for n, s := range snapshots {
+		if n > 0 {
+			time.Sleep(interval)
+		}
+
+		status, err := a.ES.GetSnapshotStatus(ctx, s.Repository, s.Snapshot)
+		if err != nil {
+			log.Error().Err(err).Msgf("failed to get status of snapshot %s from repo %s", s.Snapshot, s.Repository)
+			continue
+		}
+
+		var snapshot_indices []db.ESSnapshotIndex
+		for name, i := range status.Indices {
+			snapshot_indices = append(snapshot_indices, db.ESSnapshotIndex{
+				Snapshot:    s.Snapshot,
+				Repository:  s.Repository,
+				IndexName:   name,
+				SizeInBytes: i.Stats.Total.SizeInBytes,
+				Shards:      i.ShardsStats.Total,
+			})
+		}
+
+		if len(snapshot_indices) > 0 {
+			if err := db.CreateSnapshotIndexRecords[db.ESSnapshotIndex](a.DBClient, &snapshot_indices); err != nil {
+				log.Error().Err(err).Msgf("failed to create index records of snapshot %s", s.Snapshot)
+				continue
+			}
+		}
+
+		if err := a.DBClient.Model(&s).Update("StatusSyncedAt", time.Now()).Error; err != nil {
+			log.Error().Err(err).Msgf("failed to update status synced time of snapshot %s", s.Snapshot)
+			continue
+		}
+		log.Info().Msgf("synced status of snapshot %s with %d indices", s.Snapshot, len(snapshot_indices))
+	}
+}
+
+// IdleRestoreNode reclaims the restore nodes without task for pool.idletimeout minutes, nor restored task holding them
+type IdleRestoreNode struct {
+	Pool *pool.Pool
+}
+
+func (i *IdleRestoreNode) Run() {
+	if err := i.Pool.Reap(context.Background()); err != nil {
+		log.Error().Err(err).Msg("failed to reclaim idle restore nodes")
+	}
+}
+
+// QueuedTask admits the tasks queued on an exhausted budget or a full restore queue once there is room
+type QueuedTask struct {
+	Worker *worker.Worker
+}
+
+func (q *QueuedTask) Run() {
+	if err := q.Worker.AdmitQueued(context.Background()); err != nil {
+		log.Error().Err(err).Msg("failed to admit queued tasks")
+	}
+}
+
+// ExpiredApproval cancels the restores whose approval expired
+type ExpiredApproval struct {
+	Approvals *approval.Approvals
+}
+
+func (e *ExpiredApproval) Run() {
+	if err := e.Approvals.Expire(context.Background()); err != nil {
+		log.Error().Err(err).Msg("failed to expire approvals")
+	}
+}
+
+// PendingNotification sends again the notifications whose delivery failed
+type PendingNotification struct {
+	Notifier *notify.Notifier
+}
+
+func (p *PendingNotification) Run() {
+	if err := p.Notifier.Retry(context.Background()); err != nil {
+		log.Error().Err(err).Msg("failed to retry notifications")
+	}
+}
+
+// ExpiringRestore warns the requesters whose restored indices are deleted with their idle restore node within
+// notify.expirywarning minutes
+type ExpiringRestore struct {
+	Pool     *pool.Pool
+	Notifier *notify.Notifier
+}
+
+func (e *ExpiringRestore) Run() {
+	expiring, err := e.Pool.Expiring(time.Duration(config.GlobalConfig.Notify.ExpiryWarning) * time.Minute)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to warn of expiring restores")
+		return
+	}
+	for _, expiry := range expiring {
+		e.Notifier.WarnExpiring(context.Background(), expiry.Node, expiry.At)
+	}
+}
+
+// ExpiredIdempotencyKey deletes the idempotency keys past idempotency.retention, their retries are new requests
+type ExpiredIdempotencyKey struct {
+	DBClient *gorm.DB
+}
+
+func (e *ExpiredIdempotencyKey) Run() {
+	if err := db.DeleteRecord(e.DBClient.Unscoped(), &db.IdempotencyKey{}, "expires_at < ?", time.Now()); err != nil {
+		log.Error().Err(err).Msg("failed to delete expired idempotency keys")
+	}
 }
 
-func RegisterJobs(lc fx.Lifecycle, c *cron.Cron, es *elastic.ES, db *gorm.DB) {
+func RegisterJobs(lc fx.Lifecycle, c *cron.Cron, es *elastic.ES, db *gorm.DB, restore_pool *pool.Pool, approvals *approval.Approvals, notifier *notify.Notifier, restore_worker *worker.Worker) {
 	all_index_job := &AllIndex{
 		ES:       es,
 		DBClient: db,
@@ -97,4 +252,22 @@ func RegisterJobs(lc fx.Lifecycle, c *cron.Cron, es *elastic.ES, db *gorm.DB) {
 	}
 	c.AddJob(config.GlobalConfig.Cron.Schedule, all_index_job)
 	c.AddJob(config.GlobalConfig.Cron.Schedule, all_snapshot_job)
+	c.AddJob(config.GlobalConfig.Idempotency.Schedule, &ExpiredIdempotencyKey{DBClient: db})
+
+	if config.GlobalConfig.Pool.Reclaim {
+		c.AddJob(config.GlobalConfig.Pool.Schedule, &IdleRestoreNode{Pool: restore_pool})
+	}
+
+	c.AddJob(fmt.Sprintf("@every %ds", config.GlobalConfig.Budget.RetryInterval), &QueuedTask{Worker: restore_worker})
+
+	if config.GlobalConfig.Policy.Enabled {
+		c.AddJob(config.GlobalConfig.Approval.Schedule, &ExpiredApproval{Approvals: approvals})
+	}
+
+	if config.GlobalConfig.Notify.Enabled {
+		c.AddJob(config.GlobalConfig.Notify.Schedule, &PendingNotification{Notifier: notifier})
+		if config.GlobalConfig.Pool.Reclaim {
+			c.AddJob(config.GlobalConfig.Notify.Schedule, &ExpiringRestore{Pool: restore_pool, Notifier: notifier})
+		}
+	}
 }
@@ -20,15 +20,32 @@ type ESIndex struct {
 	Name          string `gorm:"type:varchar(255);not null;uniqueIndex:uk_es_index_name"`
 	IndexCreateAt TimeString
 	StoreSize     string
+	PriStoreSize  string
+	PrimaryShards int
+	Replicas      int
+	DocsCount     int64
+	Health        string `gorm:"size:16"`
+	Status        string `gorm:"size:16"`
 }
 
 type ESSnapshot struct {
 	gorm.Model
-	Snapshot   string `gorm:"type:varchar(255);not null;uniqueIndex:uk_es_snapshot_name"`
-	Repository string
-	State      string
-	StartTime  TimeString
-	Indices    datatypes.JSON
+	Snapshot       string `gorm:"type:varchar(255);not null;uniqueIndex:uk_es_snapshot_name"`
+	Repository     string
+	State          string
+	StartTime      TimeString
+	Indices        datatypes.JSON
+	StatusSyncedAt *time.Time
+}
+
+// ESSnapshotIndex is the size of an index inside a snapshot, read from the snapshot status api
+type ESSnapshotIndex struct {
+	gorm.Model
+	Snapshot    string `gorm:"type:varchar(255);not null;uniqueIndex:uk_es_snapshot_index"`
+	Repository  string `gorm:"type:varchar(255);not null;uniqueIndex:uk_es_snapshot_index"`
+	IndexName   string `gorm:"type:varchar(255);not null;uniqueIndex:uk_es_snapshot_index"`
+	SizeInBytes int64
+	Shards      int
 }
 
 type Task struct {
@@ -37,13 +54,145 @@ type Task struct {
 	Index        string `gorm:"index;not null"`
 	Repository   string
 	Snapshot     string
-	Status       string  `gorm:"size:20;index;not null"` // PENDING, RUNNING, SUCCESS, FAILED, TIMEOUT, CANCELED
+	Status       string  `gorm:"size:20;index;not null"` // AWAITING_APPROVAL, PENDING, QUEUED, RUNNING, PAUSED, SUCCESS, FAILED, TIMEOUT, CANCELED
+	Node         string  `gorm:"size:255;index"`         // restore node, empty until the task is placed
 	CurrentStage *string `gorm:"size:32"`
 	Payload      *string `gorm:"type:json"`
 	ErrorMessage *string `gorm:"type:text"`
 
+	// Requester is who asked for the restore
+	Requester string `gorm:"size:255;index"`
+
+	// Attempts is the count of restore attempts, see TaskAttempt
+	Attempts int
+	// Progress is the recovered percent of the restored index, over all its shards
+	Progress float64
+	// Throttle is the recovery bandwidth applied while the task restored
+	Throttle *string `gorm:"type:json"`
+
 	StartedAt  *time.Time
 	FinishedAt *time.Time
+	// ReleasedAt is when the requester was done with the restored index, it doesn't hold its restore node anymore
+	ReleasedAt *time.Time
+}
+
+// TaskAttempt is one attempt to restore the index of a task, a retryable failure is followed by another attempt
+type TaskAttempt struct {
+	gorm.Model
+	TaskID       string  `gorm:"size:64;index:idx_task_attempt;not null"`
+	Index        string  `gorm:"index:idx_task_attempt;not null"`
+	Attempt      int     `gorm:"not null"`
+	Status       string  `gorm:"size:20;not null"` // RUNNING, SUCCESS, FAILED, TIMEOUT, CANCELED
+	ErrorMessage *string `gorm:"type:text"`
+	Retryable    bool
+
+	StartedAt  time.Time
+	FinishedAt *time.Time
+}
+
+// Approval is the approval the restore of a task waits for, Request is the restore started once it is approved
+// when the task has no RestoreTask
+type Approval struct {
+	gorm.Model
+	TaskID    string  `gorm:"size:64;not null;uniqueIndex:uk_approval_task_id"`
+	Status    string  `gorm:"size:20;index;not null"` // PENDING, APPROVED, REJECTED, EXPIRED
+	Rule      string  `gorm:"size:255"`
+	Reason    string  `gorm:"type:text"`
+	Requester string  `gorm:"size:255;index"`
+	Team      string  `gorm:"size:64"`
+	Request   *string `gorm:"type:json"`
+	Approver  string  `gorm:"size:255"`
+	Comment   string  `gorm:"type:text"`
+
+	ExpiresAt time.Time `gorm:"index"`
+	DecidedAt *time.Time
+}
+
+// Notification is the delivery of a task event to a notification channel, Key identifies the event so that it is
+// delivered once per channel
+type Notification struct {
+	gorm.Model
+	Key           string  `gorm:"size:255;not null;uniqueIndex:uk_notification"`
+	Channel       string  `gorm:"size:64;not null;uniqueIndex:uk_notification"`
+	Event         string  `gorm:"size:32;index;not null"`
+	TaskID        string  `gorm:"size:64;index"`
+	Requester     string  `gorm:"size:255;index"`
+	Payload       *string `gorm:"type:json"`
+	Status        string  `gorm:"size:16;index;not null"` // PENDING, SENT, FAILED
+	Attempts      int
+	LastError     *string   `gorm:"type:text"`
+	NextAttemptAt time.Time `gorm:"index"`
+	SentAt        *time.Time
+}
+
+// Subscription is the notification preferences of a requester, empty Events and Channels are all of them
+type Subscription struct {
+	gorm.Model
+	Requester string `gorm:"type:varchar(255);not null;uniqueIndex:uk_subscription_requester"`
+	Events    datatypes.JSON
+	Channels  datatypes.JSON
+	Email     string `gorm:"size:255"`
+	Muted     bool
+}
+
+// AuditEntry is a mutating action of the append-only audit log, Hash chains it to the entry before it so that
+// altering or deleting an entry breaks the chain
+type AuditEntry struct {
+	ID          uint      `gorm:"primarykey"`
+	CreatedAt   time.Time `gorm:"index"`
+	Actor       string    `gorm:"size:255;index"`
+	Source      string    `gorm:"size:16;index"` // http, controller, cron
+	Action      string    `gorm:"size:64;index"`
+	Target      string    `gorm:"size:255;index"`
+	PayloadHash string    `gorm:"size:64"`       // sha256 of the request body
+	Outcome     string    `gorm:"size:16;index"` // success, failure, denied
+	Status      int       // http status
+	Message     string    `gorm:"type:text"`
+	SourceIP    string    `gorm:"size:64"`
+	PrevHash    string    `gorm:"size:64;uniqueIndex:uk_audit_entry_prev_hash"`
+	Hash        string    `gorm:"size:64;not null"`
+}
+
+// IdempotencyKey is a request sent with an Idempotency-Key header by Caller, its response is replayed to the retries
+// of the same request until ExpiresAt
+type IdempotencyKey struct {
+	gorm.Model
+	Key            string `gorm:"type:varchar(255);not null;uniqueIndex:uk_idempotency_key"`
+	Caller         string `gorm:"type:varchar(255);not null;uniqueIndex:uk_idempotency_key"`
+	Route          string `gorm:"size:255"`
+	RequestHash    string `gorm:"size:64;not null"` // sha256 of the route and the body of the request
+	Status         string `gorm:"size:16;not null"` // PROCESSING, COMPLETED
+	ResponseStatus int
+	ResponseBody   *string   `gorm:"type:mediumtext"`
+	ContentType    string    `gorm:"size:128"`
+	ExpiresAt      time.Time `gorm:"index"`
+}
+
+// ThrottleSetting is the value a recovery setting of the Elasticsearch reached at Endpoint had before the throttle
+// of the running restores replaced it, Repository is empty for a cluster setting. A nil Previous resets the
+// setting to its default.
+type ThrottleSetting struct {
+	ID         uint `gorm:"primarykey"`
+	CreatedAt  time.Time
+	Endpoint   string  `gorm:"type:varchar(255);not null;uniqueIndex:uk_throttle_setting"`
+	Repository string  `gorm:"type:varchar(255);not null;uniqueIndex:uk_throttle_setting"`
+	Name       string  `gorm:"type:varchar(255);not null;uniqueIndex:uk_throttle_setting"`
+	Previous   *string `gorm:"type:text"`
+}
+
+// RestoreNode is a restore node kept warm between tasks, StoreSize, CPU and Memory are per pod
+type RestoreNode struct {
+	gorm.Model
+	Name        string `gorm:"type:varchar(255);not null;uniqueIndex:uk_restore_node_name"`
+	Team        string `gorm:"size:64;index"`
+	Isolation   string `gorm:"size:16"`
+	StoreSize   string
+	Count       int32
+	CPU         string
+	Memory      string
+	Status      string `gorm:"size:16;index;not null"` // ACTIVE, RECLAIMING
+	ActiveTasks int
+	LastUsedAt  time.Time `gorm:"index"`
 }
 
 func NewDB(lc fx.Lifecycle) (*gorm.DB, error) {
@@ -75,7 +224,7 @@ func NewDB(lc fx.Lifecycle) (*gorm.DB, error) {
 	lc.Append(fx.Hook{
 		OnStart: func(context.Context) error {
 			log.Info().Msg("db start")
-			if err := db.AutoMigrate(&ESIndex{}, &ESSnapshot{}, &Task{}); err != nil {
+			if err := db.AutoMigrate(&ESIndex{}, &ESSnapshot{}, &ESSnapshotIndex{}, &Task{}, &TaskAttempt{}, &RestoreNode{}, &Approval{}, &Notification{}, &Subscription{}, &AuditEntry{}, &IdempotencyKey{}, &ThrottleSetting{}); err != nil {
 				log.Error().Err(err).Msg("failed to migrate db")
 				return err
 			}
@@ -104,13 +253,19 @@ func CreateRecords[T any](db *gorm.DB, records *[]T) error {
 	return db.Create(records).Error
 }
 
-// Create records in batch, if onconflict on name(uniq index) column, then update the store_size and updated_at column
+// Create records in batch, if onconflict on name(uniq index) column, then update the size, shard layout, state and updated_at column
 func CreateIndexRecords[T any](db *gorm.DB, records *[]T) error {
 	err := db.Clauses(clause.OnConflict{
 		Columns: []clause.Column{{Name: "name"}},
 		DoUpdates: clause.Assignments(map[string]any{
-			"store_size": gorm.Expr("VALUES(store_size)"),
-			"updated_at": gorm.Expr("VALUES(updated_at)"),
+			"store_size":     gorm.Expr("VALUES(store_size)"),
+			"pri_store_size": gorm.Expr("VALUES(pri_store_size)"),
+			"primary_shards": gorm.Expr("VALUES(primary_shards)"),
+			"replicas":       gorm.Expr("VALUES(replicas)"),
+			"docs_count":     gorm.Expr("VALUES(docs_count)"),
+			"health":         gorm.Expr("VALUES(health)"),
+			"status":         gorm.Expr("VALUES(status)"),
+			"updated_at":     gorm.Expr("VALUES(updated_at)"),
 		}),
 	}).Create(records).Error
 
@@ -130,6 +285,34 @@ func CreateSnapshotRecords[T any](db *gorm.DB, records *[]T) error {
 	return err
 }
 
+// Create records in batch, if onconflict on snapshot, repository and index_name(uniq index) column, then update the size, shards and updated_at column
+func CreateSnapshotIndexRecords[T any](db *gorm.DB, records *[]T) error {
+	err := db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "snapshot"}, {Name: "repository"}, {Name: "index_name"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"size_in_bytes": gorm.Expr("VALUES(size_in_bytes)"),
+			"shards":        gorm.Expr("VALUES(shards)"),
+			"updated_at":    gorm.Expr("VALUES(updated_at)"),
+		}),
+	}).Create(records).Error
+
+	return err
+}
+
+// Create record unless one with the same uniq index exists, created is false when it does
+func CreateRecordOnce[T any](db *gorm.DB, record *T) (bool, error) {
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(record)
+	return result.RowsAffected > 0, result.Error
+}
+
+// Create or update the subscription of its requester(uniq index)
+func SaveSubscription(db *gorm.DB, subscription *Subscription) error {
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "requester"}},
+		DoUpdates: clause.AssignmentColumns([]string{"events", "channels", "email", "muted", "updated_at"}),
+	}).Create(subscription).Error
+}
+
 // Query all records from db to meet conds and order
 func QueryAll[T any](db *gorm.DB, order string, limit int, conds ...any) ([]T, error) {
 	var records []T
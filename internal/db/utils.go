@@ -32,3 +32,44 @@ func (e *ESIndexs) IndexNames() []string {
 
 	return n
 }
+
+// PrimaryStoreSize is the GB size of the primary shards, which is what a restore brings back from the repository
+func (i *ESIndex) PrimaryStoreSize() (float64, error) {
+	if i.PriStoreSize != "" {
+		return utils.ToGB(i.PriStoreSize)
+	}
+
+	// records cataloged before pri.store.size was collected only know the total size
+	gb, err := utils.ToGB(i.StoreSize)
+	if err != nil {
+		return 0, err
+	}
+	return gb / float64(1+i.Replicas), nil
+}
+
+// PrimaryStoreSizeWithReplicas is the GB size of the indices restored with replicas, or with their cataloged
+// replicas when nil
+func (e *ESIndexs) PrimaryStoreSizeWithReplicas(replicas *int) float64 {
+	var totalGB float64
+	for _, i := range *e {
+		gb, err := i.PrimaryStoreSize()
+		if err != nil {
+			log.Error().Err(err).Msgf("faild to parse index %s primary store size: %s to float GB", i.Name, i.PriStoreSize)
+			continue
+		}
+
+		index_replicas := i.Replicas
+		if replicas != nil {
+			index_replicas = *replicas
+		}
+		totalGB += gb * float64(1+index_replicas)
+	}
+	log.Info().Msgf("total primary store size of %d indices is: %.6f", len(*e), totalGB)
+
+	return totalGB
+}
+
+// GB is the size of the index inside the snapshot, which only holds primaries
+func (i *ESSnapshotIndex) GB() float64 {
+	return float64(i.SizeInBytes) / (1024 * 1024 * 1024)
+}
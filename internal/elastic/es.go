@@ -4,9 +4,11 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/404LifeFound/es-snapshot-restore/config"
@@ -61,6 +63,13 @@ func WithSkipTlsVerify(skip bool) ESConfigOption {
 	}
 }
 
+// WithCACert verifies the certificate of Elasticsearch with the PEM encoded ca
+func WithCACert(ca []byte) ESConfigOption {
+	return func(c *ESConfig) {
+		c.config.CACert = ca
+	}
+}
+
 type ES struct {
 	Client *elasticsearch.Client
 }
@@ -93,15 +102,21 @@ type Indexs struct {
 }
 
 type Index struct {
-	Name      string `json:"index"`
-	CreateAt  string `json:"creation.date.string"`
-	StoreSize string `json:"store.size"`
+	Name         string `json:"index"`
+	CreateAt     string `json:"creation.date.string"`
+	StoreSize    string `json:"store.size"`
+	PriStoreSize string `json:"pri.store.size"`
+	Pri          string `json:"pri"`
+	Rep          string `json:"rep"`
+	DocsCount    string `json:"docs.count"`
+	Health       string `json:"health"`
+	Status       string `json:"status"`
 }
 
 func (es *ES) CatAllIndexRequest() esapi.CatIndicesRequest {
 	return esapi.CatIndicesRequest{
 		Format:          "json",
-		H:               []string{"index", "creation.date.string", "store.size"},
+		H:               []string{"index", "creation.date.string", "store.size", "pri.store.size", "pri", "rep", "docs.count", "health", "status"},
 		S:               []string{"creation.date.string"},
 		ExpandWildcards: "all",
 	}
@@ -138,6 +153,8 @@ type Snapshot struct {
 	State      string   `json:"state"`
 	StartTime  string   `json:"start_time"`
 	Indices    []string `json:"indices"`
+	// Version is the Elasticsearch version which took the snapshot
+	Version string `json:"version"`
 }
 
 type Snapshots struct {
@@ -184,8 +201,50 @@ func (es *ES) GetSnapshotRequest(repo string, snapshot []string) esapi.SnapshotG
 	}
 }
 
-func (es *ES) RestoreSnapshotRequest(repo, snapshot, prefix, restore_attr_key, restore_attr_value string, restore_index []string) esapi.SnapshotRestoreRequest {
+type SnapshotIndexStatus struct {
+	ShardsStats struct {
+		Total int `json:"total"`
+	} `json:"shards_stats"`
+	Stats struct {
+		Total struct {
+			SizeInBytes int64 `json:"size_in_bytes"`
+		} `json:"total"`
+	} `json:"stats"`
+}
+
+type SnapshotStatus struct {
+	Snapshot   string                         `json:"snapshot"`
+	Repository string                         `json:"repository"`
+	State      string                         `json:"state"`
+	Indices    map[string]SnapshotIndexStatus `json:"indices"`
+}
+
+type SnapshotStatuses struct {
+	Snapshots []SnapshotStatus `json:"snapshots"`
+}
+
+func (es *ES) SnapshotStatusRequest(repo, snapshot string) esapi.SnapshotStatusRequest {
+	ignore_unavailable := true
+	return esapi.SnapshotStatusRequest{
+		Repository:        repo,
+		Snapshot:          []string{snapshot},
+		IgnoreUnavailable: &ignore_unavailable,
+	}
+}
+
+// RestoredIndexName is the name index is renamed to by RestoreSnapshotRequest
+func RestoredIndexName(prefix, restore_attr_value, index string) string {
+	return fmt.Sprintf("%s_%s_%s", prefix, restore_attr_value, index)
+}
+
+// RestoreSnapshotRequest restores restore_index renamed with prefix onto the nodes with the restore attribute, with
+// replicas as their number_of_replicas when set, else the number_of_replicas of the snapshotted indices
+func (es *ES) RestoreSnapshotRequest(repo, snapshot, prefix, restore_attr_key, restore_attr_value string, replicas *int, restore_index []string) esapi.SnapshotRestoreRequest {
 	indices := strings.Join(restore_index[:], ",")
+	var replicas_setting string
+	if replicas != nil {
+		replicas_setting = fmt.Sprintf(`"index.number_of_replicas": %d,`, *replicas)
+	}
 	json_body := fmt.Sprintf(`{
 		"indices": "%s",
 		"rename_pattern": "(.+)",
@@ -193,11 +252,12 @@ func (es *ES) RestoreSnapshotRequest(repo, snapshot, prefix, restore_attr_key, r
 		"ignore_index_settings": ["index.lifecycle.name"],
 		"index_settings": {
 			"index.hidden": false,
+			%s
 			"index.routing.allocation.include._tier_preference": null,
 			"index.routing.allocation.exclude.%s": null,
 			"index.routing.allocation.require.%s": "%s"
 		}
-	}`, indices, prefix, restore_attr_value, restore_attr_key, restore_attr_key, restore_attr_value)
+	}`, indices, prefix, restore_attr_value, replicas_setting, restore_attr_key, restore_attr_key, restore_attr_value)
 
 	//wait_for_completion := true
 	return esapi.SnapshotRestoreRequest{
@@ -208,6 +268,76 @@ func (es *ES) RestoreSnapshotRequest(repo, snapshot, prefix, restore_attr_key, r
 	}
 }
 
+// ResponseError is an error response of Elasticsearch, Body holds its error type and reason
+type ResponseError struct {
+	StatusCode int
+	Body       string
+	Message    string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("%s: [%d] %s", e.Message, e.StatusCode, e.Body)
+}
+
+type Repository struct {
+	Type     string         `json:"type"`
+	Settings map[string]any `json:"settings"`
+}
+
+// GetRepository reads the type and settings of the snapshot repository repo
+func (es *ES) GetRepository(ctx context.Context, repo string) (Repository, error) {
+	var repositories map[string]Repository
+	resp, err := esapi.SnapshotGetRepositoryRequest{
+		Repository: []string{repo},
+	}.Do(ctx, es.Client)
+	if err != nil {
+		return Repository{}, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.IsError() {
+		body, _ := io.ReadAll(resp.Body)
+		return Repository{}, fmt.Errorf("failed to get repo %s: %v", repo, string(body))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&repositories); err != nil {
+		return Repository{}, err
+	}
+
+	repository, ok := repositories[repo]
+	if !ok {
+		return Repository{}, fmt.Errorf("repo %s not found", repo)
+	}
+
+	return repository, nil
+}
+
+// PutRepository registers the snapshot repository repo, or updates its settings if it exists
+func (es *ES) PutRepository(ctx context.Context, repo string, repository Repository) error {
+	body, err := json.Marshal(repository)
+	if err != nil {
+		return err
+	}
+
+	resp, err := esapi.SnapshotCreateRepositoryRequest{
+		Repository: repo,
+		Body:       strings.NewReader(string(body)),
+	}.Do(ctx, es.Client)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.IsError() {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to put repo %s: %v", repo, string(body))
+	}
+
+	return nil
+}
+
 func (es *ES) GetAllRepo(ctx context.Context) ([]Repo, error) {
 	var repos []Repo
 
@@ -258,13 +388,40 @@ func (es *ES) GetSnapshotDetail(ctx context.Context, repo string, snapshot []str
 	return snapshots, nil
 }
 
-func (es *ES) Restore(ctx context.Context, repo, snapshot, prefix, restore_attr_key, restore_attr_value string, restore_index []string) error {
+// GetSnapshotStatus reads the per index file size and shard count of snapshot, which is expensive as it reads the repository
+func (es *ES) GetSnapshotStatus(ctx context.Context, repo, snapshot string) (SnapshotStatus, error) {
+	var statuses SnapshotStatuses
+	resp, err := es.SnapshotStatusRequest(repo, snapshot).Do(ctx, es.Client)
+	if err != nil {
+		return SnapshotStatus{}, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.IsError() {
+		body, _ := io.ReadAll(resp.Body)
+		return SnapshotStatus{}, fmt.Errorf("failed to get status of snapshot %s from repo %s: %v", snapshot, repo, string(body))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+		return SnapshotStatus{}, err
+	}
+
+	if len(statuses.Snapshots) != 1 {
+		return SnapshotStatus{}, fmt.Errorf("status of snapshot %s from repo %s has %d records which not equal 1", snapshot, repo, len(statuses.Snapshots))
+	}
+
+	return statuses.Snapshots[0], nil
+}
+
+func (es *ES) Restore(ctx context.Context, repo, snapshot, prefix, restore_attr_key, restore_attr_value string, replicas *int, restore_index []string) error {
 	resp, err := es.RestoreSnapshotRequest(
 		repo,
 		snapshot,
 		prefix,
 		restore_attr_key,
 		restore_attr_value,
+		replicas,
 		restore_index,
 	).Do(ctx, es.Client)
 	if err != nil {
@@ -275,7 +432,11 @@ func (es *ES) Restore(ctx context.Context, repo, snapshot, prefix, restore_attr_
 
 	if resp.StatusCode != 200 {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("failed to restore snapshot of %s from %s: %v", restore_index, snapshot, string(body))
+		return &ResponseError{
+			StatusCode: resp.StatusCode,
+			Body:       string(body),
+			Message:    fmt.Sprintf("failed to restore snapshot of %s from %s", restore_index, snapshot),
+		}
 	}
 
 	return nil
@@ -341,3 +502,438 @@ func (es *ES) GetRestoreIndexProcess(index []string) ([]Recovery, error) {
 
 	return recovery_result, nil
 }
+
+type NodeAttr struct {
+	Node  string `json:"node"`
+	Attr  string `json:"attr"`
+	Value string `json:"value"`
+}
+
+func (es *ES) CatNodeAttrsRequest() esapi.CatNodeattrsRequest {
+	return esapi.CatNodeattrsRequest{
+		Format: "json",
+		H:      []string{"node", "attr", "value"},
+	}
+}
+
+// GetNodesByAttr returns the name of the nodes whose custom attribute attr is value
+func (es *ES) GetNodesByAttr(ctx context.Context, attr, value string) ([]string, error) {
+	var node_attrs []NodeAttr
+	resp, err := es.CatNodeAttrsRequest().Do(ctx, es.Client)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&node_attrs); err != nil {
+		return nil, err
+	}
+
+	var nodes []string
+	for _, n := range node_attrs {
+		if n.Attr == attr && n.Value == value {
+			nodes = append(nodes, n.Node)
+		}
+	}
+
+	return nodes, nil
+}
+
+// Allocation is the disk usage of a node, size unit is byte
+type Allocation struct {
+	Node      string `json:"node"`
+	Shards    string `json:"shards"`
+	DiskUsed  string `json:"disk.used"`
+	DiskAvail string `json:"disk.avail"`
+	DiskTotal string `json:"disk.total"`
+}
+
+func (es *ES) CatAllocationRequest() esapi.CatAllocationRequest {
+	return esapi.CatAllocationRequest{
+		Format: "json",
+		Bytes:  "b",
+		H:      []string{"node", "shards", "disk.used", "disk.avail", "disk.total"},
+	}
+}
+
+func (es *ES) GetAllocation(ctx context.Context) ([]Allocation, error) {
+	var allocations []Allocation
+	resp, err := es.CatAllocationRequest().Do(ctx, es.Client)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&allocations); err != nil {
+		return nil, err
+	}
+
+	return allocations, nil
+}
+
+// AvailGB is the free disk of the node in GB, an unassigned row reports an empty value
+func (a *Allocation) AvailGB() float64 {
+	avail, err := strconv.ParseFloat(a.DiskAvail, 64)
+	if err != nil {
+		return 0
+	}
+	return avail / (1024 * 1024 * 1024)
+}
+
+// TotalGB is the disk size of the node in GB, an unassigned row reports an empty value
+func (a *Allocation) TotalGB() float64 {
+	total, err := strconv.ParseFloat(a.DiskTotal, 64)
+	if err != nil {
+		return 0
+	}
+	return total / (1024 * 1024 * 1024)
+}
+
+// DeleteIndices deletes the indices by name, a missing index is ignored, wildcards are refused when
+// action.destructive_requires_name is set
+func (es *ES) DeleteIndices(ctx context.Context, index []string) error {
+	ignore_unavailable := true
+	resp, err := esapi.IndicesDeleteRequest{
+		Index:             index,
+		IgnoreUnavailable: &ignore_unavailable,
+	}.Do(ctx, es.Client)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.IsError() {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to delete indices %v: %s", index, string(body))
+	}
+
+	return nil
+}
+
+// ClusterHealth is the health of the cluster and the count of its data nodes and shards
+type ClusterHealth struct {
+	Status           string `json:"status"`
+	NumberOfDataNode int    `json:"number_of_data_nodes"`
+	ActiveShards     int    `json:"active_shards"`
+	UnassignedShards int    `json:"unassigned_shards"`
+}
+
+func (es *ES) GetClusterHealth(ctx context.Context) (ClusterHealth, error) {
+	var health ClusterHealth
+	resp, err := esapi.ClusterHealthRequest{}.Do(ctx, es.Client)
+	if err != nil {
+		return ClusterHealth{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.IsError() {
+		body, _ := io.ReadAll(resp.Body)
+		return ClusterHealth{}, fmt.Errorf("failed to get cluster health: %s", string(body))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return ClusterHealth{}, err
+	}
+
+	return health, nil
+}
+
+// ClusterSettings are the flat cluster settings, see GetClusterSettings
+type ClusterSettings struct {
+	Transient  map[string]any `json:"transient"`
+	Persistent map[string]any `json:"persistent"`
+	Defaults   map[string]any `json:"defaults"`
+}
+
+// Get returns the setting name, the transient value wins over the persistent one and the persistent one over the
+// default
+func (s ClusterSettings) Get(name string) string {
+	for _, m := range []map[string]any{s.Transient, s.Persistent, s.Defaults} {
+		if v, ok := m[name]; ok && v != nil {
+			return fmt.Sprint(v)
+		}
+	}
+	return ""
+}
+
+// Explicit reports whether the setting name is set rather than defaulted
+func (s ClusterSettings) Explicit(name string) bool {
+	_, transient := s.Transient[name]
+	_, persistent := s.Persistent[name]
+	return transient || persistent
+}
+
+func (es *ES) GetClusterSettings(ctx context.Context) (ClusterSettings, error) {
+	flat_settings := true
+	include_defaults := true
+	resp, err := esapi.ClusterGetSettingsRequest{
+		FlatSettings:    &flat_settings,
+		IncludeDefaults: &include_defaults,
+	}.Do(ctx, es.Client)
+	if err != nil {
+		return ClusterSettings{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.IsError() {
+		body, _ := io.ReadAll(resp.Body)
+		return ClusterSettings{}, fmt.Errorf("failed to get cluster settings: %s", string(body))
+	}
+
+	var settings ClusterSettings
+	if err := json.NewDecoder(resp.Body).Decode(&settings); err != nil {
+		return ClusterSettings{}, err
+	}
+
+	return settings, nil
+}
+
+// GetClusterSetting returns the flat setting name, see ClusterSettings.Get
+func (es *ES) GetClusterSetting(ctx context.Context, name string) (string, error) {
+	settings, err := es.GetClusterSettings(ctx)
+	if err != nil {
+		return "", err
+	}
+	return settings.Get(name), nil
+}
+
+// GetVersion returns the version number of the cluster
+func (es *ES) GetVersion(ctx context.Context) (string, error) {
+	resp, err := esapi.InfoRequest{}.Do(ctx, es.Client)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.IsError() {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("failed to get cluster info: %s", string(body))
+	}
+
+	var info struct {
+		Version struct {
+			Number string `json:"number"`
+		} `json:"version"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", err
+	}
+
+	return info.Version.Number, nil
+}
+
+// VerifyRepository checks every node of the cluster can reach the snapshot repository repo
+func (es *ES) VerifyRepository(ctx context.Context, repo string) error {
+	resp, err := esapi.SnapshotVerifyRepositoryRequest{
+		Repository: repo,
+	}.Do(ctx, es.Client)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.IsError() {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to verify repo %s: %s", repo, string(body))
+	}
+
+	return nil
+}
+
+// CloseIndices closes the indices by name, which stops their recovery
+func (es *ES) CloseIndices(ctx context.Context, index []string) error {
+	resp, err := esapi.IndicesCloseRequest{
+		Index: index,
+	}.Do(ctx, es.Client)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.IsError() {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to close indices %v: %s", index, string(body))
+	}
+
+	return nil
+}
+
+// OpenIndices opens the indices by name
+func (es *ES) OpenIndices(ctx context.Context, index []string) error {
+	resp, err := esapi.IndicesOpenRequest{
+		Index: index,
+	}.Do(ctx, es.Client)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.IsError() {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to open indices %v: %s", index, string(body))
+	}
+
+	return nil
+}
+
+// PutClusterSettings sets the persistent cluster settings by flat name, a nil value resets a setting to its default
+func (es *ES) PutClusterSettings(ctx context.Context, settings map[string]any) error {
+	body, err := json.Marshal(map[string]any{"persistent": settings})
+	if err != nil {
+		return err
+	}
+
+	resp, err := esapi.ClusterPutSettingsRequest{
+		Body: strings.NewReader(string(body)),
+	}.Do(ctx, es.Client)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.IsError() {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to put cluster settings %v: %s", settings, string(body))
+	}
+
+	return nil
+}
+
+// ErrPartialShardFailure is returned when a shard of a restored index failed to allocate
+var ErrPartialShardFailure = errors.New("restore failed on some shards")
+
+type Shard struct {
+	Index            string `json:"index"`
+	Shard            string `json:"shard"`
+	PriRep           string `json:"prirep"`
+	State            string `json:"state"`
+	UnassignedReason string `json:"unassigned.reason"`
+}
+
+func (es *ES) CatShardsRequest(index []string) esapi.CatShardsRequest {
+	return esapi.CatShardsRequest{
+		Index:  index,
+		Format: "json",
+		H:      []string{"index", "shard", "prirep", "state", "unassigned.reason"},
+	}
+}
+
+// CheckRestoredShards returns ErrPartialShardFailure when a primary shard of index gave up allocating, which a
+// restore does once it failed to recover it from the snapshot index.allocation.max_retries times. A shard whose
+// allocation failed fewer times is still retried by the cluster.
+func (es *ES) CheckRestoredShards(ctx context.Context, index string) error {
+	var shards []Shard
+	resp, err := es.CatShardsRequest([]string{index}).Do(ctx, es.Client)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.IsError() {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to get shards of index %s: %s", index, string(body))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&shards); err != nil {
+		return err
+	}
+
+	max_retries := -1
+	for _, s := range shards {
+		if s.PriRep != "p" || s.State != "UNASSIGNED" || s.UnassignedReason != "ALLOCATION_FAILED" {
+			continue
+		}
+
+		if max_retries < 0 {
+			setting, err := es.GetIndexSetting(ctx, index, "index.allocation.max_retries")
+			if err != nil {
+				return err
+			}
+			if max_retries, err = strconv.Atoi(setting); err != nil {
+				return fmt.Errorf("invalid index.allocation.max_retries %s of index %s: %w", setting, index, err)
+			}
+		}
+		failed, err := es.FailedAllocations(ctx, index, s.Shard)
+		if err != nil {
+			return err
+		}
+		if failed >= max_retries {
+			return fmt.Errorf("%w: shard %s of index %s failed to allocate %d times", ErrPartialShardFailure, s.Shard, index, failed)
+		}
+		log.Warn().Msgf("allocation of shard %s of index %s failed %d of %d times, the cluster retries it", s.Shard, index, failed, max_retries)
+	}
+
+	return nil
+}
+
+// GetIndexSetting returns the flat setting name of index, its default when it isn't set
+func (es *ES) GetIndexSetting(ctx context.Context, index, name string) (string, error) {
+	flat_settings := true
+	include_defaults := true
+	resp, err := esapi.IndicesGetSettingsRequest{
+		Index:           []string{index},
+		Name:            []string{name},
+		FlatSettings:    &flat_settings,
+		IncludeDefaults: &include_defaults,
+	}.Do(ctx, es.Client)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.IsError() {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("failed to get setting %s of index %s: %s", name, index, string(body))
+	}
+
+	var settings map[string]struct {
+		Settings map[string]any `json:"settings"`
+		Defaults map[string]any `json:"defaults"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&settings); err != nil {
+		return "", err
+	}
+
+	for _, m := range []map[string]any{settings[index].Settings, settings[index].Defaults} {
+		if v, ok := m[name]; ok && v != nil {
+			return fmt.Sprint(v), nil
+		}
+	}
+	return "", fmt.Errorf("setting %s of index %s not found", name, index)
+}
+
+// FailedAllocations returns how many times in a row the allocation of the primary shard of index failed
+func (es *ES) FailedAllocations(ctx context.Context, index, shard string) (int, error) {
+	shard_id, err := strconv.Atoi(shard)
+	if err != nil {
+		return 0, fmt.Errorf("invalid shard %s of index %s: %w", shard, index, err)
+	}
+	body, err := json.Marshal(map[string]any{"index": index, "shard": shard_id, "primary": true})
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := esapi.ClusterAllocationExplainRequest{
+		Body: strings.NewReader(string(body)),
+	}.Do(ctx, es.Client)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.IsError() {
+		body, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("failed to explain allocation of shard %s of index %s: %s", shard, index, string(body))
+	}
+
+	var explain struct {
+		UnassignedInfo struct {
+			FailedAllocationAttempts int `json:"failed_allocation_attempts"`
+		} `json:"unassigned_info"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&explain); err != nil {
+		return 0, err
+	}
+
+	return explain.UnassignedInfo.FailedAllocationAttempts, nil
+}
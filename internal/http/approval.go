@@ -0,0 +1,237 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/404LifeFound/es-snapshot-restore/internal/approval"
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/404LifeFound/es-snapshot-restore/internal/policy"
+	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// ApprovalView is the approval the restore of a task waits for, or the decision on it
+type ApprovalView struct {
+	TaskID    string     `json:"task_id"`
+	Status    string     `json:"status"`
+	Rule      string     `json:"rule,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	Requester string     `json:"requester"`
+	Team      string     `json:"team,omitempty"`
+	Approver  string     `json:"approver,omitempty"`
+	Comment   string     `json:"comment,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	DecidedAt *time.Time `json:"decided_at,omitempty"`
+}
+
+func newApprovalView(a db.Approval) ApprovalView {
+	return ApprovalView{
+		TaskID:    a.TaskID,
+		Status:    a.Status,
+		Rule:      a.Rule,
+		Reason:    a.Reason,
+		Requester: a.Requester,
+		Team:      a.Team,
+		Approver:  a.Approver,
+		Comment:   a.Comment,
+		CreatedAt: a.CreatedAt,
+		ExpiresAt: a.ExpiresAt,
+		DecidedAt: a.DecidedAt,
+	}
+}
+
+// requestApprovals records the approval required by decision for each task id of tasks, request is the restore
+// enqueued once a task id is approved when it has no RestoreTask
+func (h *Handler) requestApprovals(decision policy.Decision, team, requester string, tasks []RestoreViaCR, request *RestoreViaWorkerRequest) []ApprovalView {
+	var task_ids []string
+	by_task_id := make(map[string][]RestoreViaCR)
+	for _, t := range tasks {
+		if _, ok := by_task_id[t.TaskID]; !ok {
+			task_ids = append(task_ids, t.TaskID)
+		}
+		by_task_id[t.TaskID] = append(by_task_id[t.TaskID], t)
+	}
+
+	views := make([]ApprovalView, 0, len(task_ids))
+	for _, task_id := range task_ids {
+		a := db.Approval{
+			TaskID:    task_id,
+			Rule:      decision.Rule,
+			Reason:    decision.Reason,
+			Requester: requester,
+			Team:      team,
+		}
+		if request != nil {
+			r := *request
+			r.Tasks = by_task_id[task_id]
+			b, err := json.Marshal(r)
+			if err != nil {
+				log.Error().Err(err).Msgf("failed to encode the restore of task id %s", task_id)
+				continue
+			}
+			a.Request = utils.PtrToAny(string(b))
+		}
+
+		a, err := h.Approvals.Request(a)
+		if err != nil {
+			log.Error().Err(err).Msgf("failed to record the approval of task id %s", task_id)
+			continue
+		}
+		views = append(views, newApprovalView(a))
+	}
+	return views
+}
+
+// restoreStatus is the http status of a restore whose tasks were all recorded, accepted when they await an approval
+func restoreStatus(result restoreResult) int {
+	if len(result.Approvals) > 0 {
+		return http.StatusAccepted
+	}
+	return http.StatusOK
+}
+
+// recordTask records task, in place of its record awaiting the approval of the restore once it is approved
+func (h *Handler) recordTask(task db.Task) error {
+	result := h.DBClient.Model(&db.Task{}).
+		Where("task_id = ? AND `index` = ? AND status = ?", task.TaskID, task.Index, string(utils.TaskAwaitingApproval)).
+		Updates(map[string]any{
+			"Status":    task.Status,
+			"Node":      task.Node,
+			"StartedAt": task.StartedAt,
+		})
+	if result.Error != nil || result.RowsAffected > 0 {
+		return result.Error
+	}
+	return db.CreateRecords(h.DBClient, &[]db.Task{task})
+}
+
+type DecideApprovalRequest struct {
+	Comment string `json:"comment"`
+	// Approver is who decides when the caller is anonymous, it only rejects unless approval.selfapproval is set
+	Approver string `json:"approver"`
+}
+
+// ApproveTask approves the restore of the task of the id path param, which starts it
+func (h *Handler) ApproveTask(c *gin.Context) {
+	h.decideApproval(c, true)
+}
+
+// RejectTask rejects the restore of the task of the id path param, which cancels it
+func (h *Handler) RejectTask(c *gin.Context) {
+	h.decideApproval(c, false)
+}
+
+// decideApproval records the decision of the caller on the approval of the task of the id path param. The approver
+// must be allowed to restore the indices of the task.
+func (h *Handler) decideApproval(c *gin.Context, approve bool) {
+	var r DecideApprovalRequest
+	if !h.bindOptionalJSON(c, &r) {
+		return
+	}
+
+	task_id := c.Param("id")
+	tasks, err := db.QueryAll[db.Task](h.DBClient, "id", 0, "task_id = ?", task_id)
+	if err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to get task id %s: %s", task_id, err.Error()))
+		return
+	}
+	if len(tasks) == 0 {
+		abortWithError(c, http.StatusNotFound, CodeNotFound, fmt.Sprintf("task id %s not found", task_id))
+		return
+	}
+
+	// a task canceled meanwhile is not restored anymore
+	if status := taskStatus(tasks); status != string(utils.TaskAwaitingApproval) {
+		abortWithError(c, http.StatusConflict, CodeConflict, fmt.Sprintf("task id %s is %s, it doesn't await an approval", task_id, status))
+		return
+	}
+
+	indices := make([]string, 0, len(tasks))
+	for _, t := range tasks {
+		indices = append(indices, t.Index)
+	}
+	if !checkGrants(c, indices) {
+		return
+	}
+	approver, _ := callerOf(c, r.Approver, "")
+	if approver == "" {
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, "the approver is required, authenticate or set approver")
+		return
+	}
+	// an anonymous approver may be the requester under another name
+	if approve && identityOf(c).Subject == "" && !config.GlobalConfig.Approval.SelfApproval {
+		abortWithError(c, http.StatusForbidden, CodeForbidden, "an anonymous approver can't be told apart from the requester, authenticate to approve")
+		return
+	}
+
+	var a db.Approval
+	if approve {
+		a, err = h.Approvals.Approve(c.Request.Context(), task_id, approver, r.Comment)
+	} else {
+		a, err = h.Approvals.Reject(c.Request.Context(), task_id, approver, r.Comment)
+	}
+	switch {
+	case errors.Is(err, approval.ErrNotFound):
+		abortWithError(c, http.StatusNotFound, CodeNotFound, fmt.Sprintf("task id %s awaits no approval", task_id))
+		return
+	case errors.Is(err, approval.ErrDecided):
+		abortWithError(c, http.StatusConflict, CodeConflict, err.Error(), gin.H{"approval": newApprovalView(a)})
+		return
+	case errors.Is(err, approval.ErrSelfApproval):
+		abortWithError(c, http.StatusForbidden, CodeForbidden, fmt.Sprintf("%s requested task id %s, another approver is required", approver, task_id))
+		return
+	case err != nil:
+		c.Error(err)
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to decide the approval of task id %s: %s", task_id, err.Error()))
+		return
+	}
+
+	var node string
+	if approve && a.Request != nil {
+		node, err = h.enqueueApproved(c, a)
+		if err != nil {
+			c.Error(err)
+			abortWithError(c, budgetStatus(err), budgetCode(err), fmt.Sprintf("failed to place approved task id %s on a restore node: %s", task_id, err.Error()), gin.H{"approval": newApprovalView(a)})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"task_id":  task_id,
+		"node":     node,
+		"approval": newApprovalView(a),
+	})
+}
+
+// enqueueApproved enqueues the restore of the approved task of a, which has no RestoreTask. Its tasks fail when it
+// can't be placed, they won't be approved again.
+func (h *Handler) enqueueApproved(c *gin.Context, a db.Approval) (string, error) {
+	var r RestoreViaWorkerRequest
+	err := json.Unmarshal([]byte(*a.Request), &r)
+	var result restoreResult
+	if err == nil {
+		result, err = h.enqueueRestoreTasks(c.Request.Context(), r, nil)
+	}
+	if err == nil {
+		return result.Node, nil
+	}
+
+	if dberr := h.DBClient.Model(&db.Task{}).
+		Where("task_id = ? AND status = ?", a.TaskID, string(utils.TaskAwaitingApproval)).
+		Updates(map[string]any{
+			"Status":       string(utils.TaskFailed),
+			"ErrorMessage": utils.PtrToAny(err.Error()),
+			"FinishedAt":   time.Now(),
+		}).Error; dberr != nil {
+		log.Error().Err(dberr).Msgf("failed to update status of approved task id %s", a.TaskID)
+	}
+	return "", err
+}
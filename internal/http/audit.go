@@ -0,0 +1,263 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/404LifeFound/es-snapshot-restore/internal/audit"
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// auditTargetKey is the gin context key of what a request acted on, set by the handlers knowing it
+	auditTargetKey = "audit_target"
+	// auditMessageKey is the gin context key of the error message a request was rejected with
+	auditMessageKey = "audit_message"
+	// successorKey is the gin context key of the route of the current api version of a deprecated route
+	successorKey = "successor"
+)
+
+// setAuditTarget records what the request acted on in its audit entry
+func setAuditTarget(c *gin.Context, targets ...string) {
+	var unique []string
+	for _, t := range targets {
+		if t != "" && !slices.Contains(unique, t) {
+			unique = append(unique, t)
+		}
+	}
+	c.Set(auditTargetKey, strings.Join(unique, ","))
+}
+
+// audit records the mutating requests in the audit log once they are replied, the rejected ones too, the action is
+// the operation of the route in doc
+func (h *Handler) audit(doc *openapi3.T) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+
+		var body []byte
+		if c.Request.Body != nil {
+			body, _ = io.ReadAll(c.Request.Body)
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		c.Next()
+
+		status := c.Writer.Status()
+		entry := audit.Entry{
+			Actor:       identityOf(c).Subject,
+			Source:      audit.SourceHTTP,
+			Action:      auditAction(doc, c),
+			Target:      c.GetString(auditTargetKey),
+			PayloadHash: audit.PayloadHash(body),
+			Outcome:     audit.OutcomeSuccess,
+			Status:      status,
+			Message:     c.GetString(auditMessageKey),
+			SourceIP:    c.ClientIP(),
+		}
+		if entry.Actor == "" {
+			entry.Actor = "anonymous"
+		}
+		if entry.Target == "" {
+			entry.Target = c.Param("id") + c.Param("name")
+		}
+		switch {
+		case status == http.StatusUnauthorized || status == http.StatusForbidden:
+			entry.Outcome = audit.OutcomeDenied
+		case status >= http.StatusBadRequest:
+			entry.Outcome = audit.OutcomeFailure
+		}
+		h.Auditor.Record(entry)
+	}
+}
+
+// auditAction is the operation id of the route of the request, the one of its successor for a deprecated route
+func auditAction(doc *openapi3.T, c *gin.Context) string {
+	path := specPath(c.FullPath())
+	if successor := c.GetString(successorKey); successor != "" {
+		path = specPath(successor)
+	}
+	if path_item := doc.Paths.Find(path); path_item != nil {
+		if operation := path_item.GetOperation(c.Request.Method); operation != nil {
+			return operation.OperationID
+		}
+		// the deprecated routes creating a resource were PUT
+		if operation := path_item.GetOperation(http.MethodPost); operation != nil {
+			return operation.OperationID
+		}
+	}
+	return fmt.Sprintf("%s %s", c.Request.Method, c.FullPath())
+}
+
+// AuditEntryView is an entry of the audit log
+type AuditEntryView struct {
+	ID          uint      `json:"id"`
+	Time        time.Time `json:"time"`
+	Actor       string    `json:"actor"`
+	Source      string    `json:"source"`
+	Action      string    `json:"action"`
+	Target      string    `json:"target,omitempty"`
+	PayloadHash string    `json:"payload_hash,omitempty"`
+	Outcome     string    `json:"outcome"`
+	Status      int       `json:"status,omitempty"`
+	Message     string    `json:"message,omitempty"`
+	SourceIP    string    `json:"source_ip,omitempty"`
+	PrevHash    string    `json:"prev_hash"`
+	Hash        string    `json:"hash"`
+}
+
+func newAuditEntryView(e db.AuditEntry) AuditEntryView {
+	return AuditEntryView{
+		ID:          e.ID,
+		Time:        e.CreatedAt,
+		Actor:       e.Actor,
+		Source:      e.Source,
+		Action:      e.Action,
+		Target:      e.Target,
+		PayloadHash: e.PayloadHash,
+		Outcome:     e.Outcome,
+		Status:      e.Status,
+		Message:     e.Message,
+		SourceIP:    e.SourceIP,
+		PrevHash:    e.PrevHash,
+		Hash:        e.Hash,
+	}
+}
+
+type AuditQuery struct {
+	Actor   string `form:"actor"`
+	Action  string `form:"action"`
+	Target  string `form:"target"`
+	Outcome string `form:"outcome"`
+	Source  string `form:"source"`
+	Since   string `form:"since"`
+	Until   string `form:"until"`
+	// After is the id of the last entry of the previous page
+	After uint `form:"after"`
+	Limit int  `form:"limit"`
+}
+
+// where filters the audit entries with q
+func (q AuditQuery) where(tx *gorm.DB) (*gorm.DB, error) {
+	for column, value := range map[string]string{
+		"actor":   q.Actor,
+		"action":  q.Action,
+		"outcome": q.Outcome,
+		"source":  q.Source,
+	} {
+		if value != "" {
+			tx = tx.Where(column+" = ?", value)
+		}
+	}
+	if q.Target != "" {
+		tx = tx.Where("target LIKE ?", "%"+q.Target+"%")
+	}
+	for column, value := range map[string]string{"created_at >= ?": q.Since, "created_at < ?": q.Until} {
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return tx, fmt.Errorf("invalid time %s, should be RFC3339: %w", value, err)
+		}
+		tx = tx.Where(column, t.UTC())
+	}
+	return tx.Where("id > ?", q.After), nil
+}
+
+// ListAudit returns the audit entries matching the query params in the order they were recorded, a page of limit
+// entries after the after id
+func (h *Handler) ListAudit(c *gin.Context) {
+	var q AuditQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid query: %s", err.Error()))
+		return
+	}
+	if q.Limit <= 0 || q.Limit > 1000 {
+		q.Limit = 100
+	}
+	tx, err := q.where(h.DBClient.Model(&db.AuditEntry{}))
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	var entries []db.AuditEntry
+	if err := tx.Order("id").Limit(q.Limit).Find(&entries).Error; err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to query audit entries: %s", err.Error()))
+		return
+	}
+
+	views := make([]AuditEntryView, 0, len(entries))
+	for _, e := range entries {
+		views = append(views, newAuditEntryView(e))
+	}
+	var next *uint
+	if len(entries) == q.Limit {
+		next = &entries[len(entries)-1].ID
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"entries": views,
+		"next":    next,
+	})
+}
+
+// ExportAudit streams the audit entries matching the query params as newline delimited json
+func (h *Handler) ExportAudit(c *gin.Context) {
+	var q AuditQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid query: %s", err.Error()))
+		return
+	}
+	if _, err := q.where(h.DBClient); err != nil {
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=audit-%s.ndjson", time.Now().UTC().Format("20060102T150405Z")))
+	c.Status(http.StatusOK)
+	encoder := json.NewEncoder(c.Writer)
+	for {
+		tx, _ := q.where(h.DBClient.Model(&db.AuditEntry{}))
+		var entries []db.AuditEntry
+		if err := tx.Order("id").Limit(500).Find(&entries).Error; err != nil {
+			c.Error(err)
+			return
+		}
+		for _, e := range entries {
+			if err := encoder.Encode(newAuditEntryView(e)); err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+		if len(entries) < 500 || c.Request.Context().Err() != nil {
+			return
+		}
+		q.After = entries[len(entries)-1].ID
+	}
+}
+
+// VerifyAudit recomputes the hash chain of the audit log, an altered or deleted entry breaks it
+func (h *Handler) VerifyAudit(c *gin.Context) {
+	v, err := h.Auditor.Verify(c.Request.Context())
+	if err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to verify the audit log: %s", err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, v)
+}
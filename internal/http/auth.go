@@ -0,0 +1,118 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/404LifeFound/es-snapshot-restore/internal/auth"
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/gin-gonic/gin"
+)
+
+// identityKey is the gin context key of the caller of a request
+const identityKey = "identity"
+
+// authenticate sets the caller of the request, a request with invalid credentials is rejected and one without
+// credentials goes on anonymously for the routes requiring no role
+func (h *Handler) authenticate(c *gin.Context) {
+	identity, err := h.Auth.Authenticate(c.Request)
+	if err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusUnauthorized, CodeUnauthorized, err.Error())
+		return
+	}
+	if identity != nil {
+		c.Set(identityKey, identity)
+	}
+	c.Next()
+}
+
+// require rejects the requests whose caller doesn't have role
+func require(role auth.Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		identity, ok := c.Get(identityKey)
+		if !ok {
+			c.Header("WWW-Authenticate", "Bearer")
+			abortWithError(c, http.StatusUnauthorized, CodeUnauthorized, "authentication required, send a bearer token or a client cert")
+			return
+		}
+		if i := identity.(*auth.Identity); !i.Allows(role) {
+			abortWithError(c, http.StatusForbidden, CodeForbidden, fmt.Sprintf("%s is %s, %s role required", i.Subject, i.Role, role))
+			return
+		}
+		c.Next()
+	}
+}
+
+// identityOf is the caller of the request, without role when it is anonymous
+func identityOf(c *gin.Context) *auth.Identity {
+	if identity, ok := c.Get(identityKey); ok {
+		return identity.(*auth.Identity)
+	}
+	return &auth.Identity{}
+}
+
+// callerOf is the requester and the team a restore is recorded for, the ones of the caller unless it is anonymous.
+// An operator may restore for another team.
+func callerOf(c *gin.Context, requester, team string) (string, string) {
+	identity := identityOf(c)
+	if identity.Subject != "" {
+		requester = identity.Subject
+	}
+	if identity.Team != "" && (team == "" || !identity.Allows(auth.RoleOperator)) {
+		team = identity.Team
+	}
+	return requester, team
+}
+
+// checkGrants rejects the request when the caller may not restore some of the indices, it reports whether the
+// request goes on
+func checkGrants(c *gin.Context, indices []string) bool {
+	identity := identityOf(c)
+	ungranted := []string{}
+	for _, index := range indices {
+		if !identity.CanRestore(index) {
+			ungranted = append(ungranted, index)
+		}
+	}
+	if len(ungranted) > 0 {
+		c.Error(errors.New("indices not granted"))
+		abortWithError(c, http.StatusForbidden, CodeForbidden, fmt.Sprintf("%s may not restore %d indices", identity.Subject, len(ungranted)), gin.H{"indices": ungranted})
+		return false
+	}
+	return true
+}
+
+// ownsTask reports whether the caller may steer the task of tasks, an operator steers every task and a requester
+// the ones it requested
+func ownsTask(c *gin.Context, tasks []db.Task) bool {
+	identity := identityOf(c)
+	if identity.Allows(auth.RoleOperator) {
+		return true
+	}
+	for _, t := range tasks {
+		if t.Requester != identity.Subject {
+			return false
+		}
+	}
+	return identity.Subject != ""
+}
+
+// taskIDs are the task ids of tasks
+func taskIDs(tasks []RestoreViaCR) []string {
+	task_ids := make([]string, 0, len(tasks))
+	for _, t := range tasks {
+		task_ids = append(task_ids, t.TaskID)
+	}
+	return task_ids
+}
+
+// taskIndices are the indices of tasks
+func taskIndices(tasks []RestoreViaCR) []string {
+	indices := make([]string, 0, len(tasks))
+	for _, t := range tasks {
+		indices = append(indices, t.Index)
+	}
+	return indices
+}
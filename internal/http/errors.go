@@ -0,0 +1,76 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/404LifeFound/es-snapshot-restore/internal/budget"
+	"github.com/gin-gonic/gin"
+)
+
+// ErrorCode is the machine readable reason of an error response
+type ErrorCode string
+
+const (
+	CodeInvalidRequest  ErrorCode = "invalid_request"
+	CodeUnauthorized    ErrorCode = "unauthorized"
+	CodeForbidden       ErrorCode = "forbidden"
+	CodeNotFound        ErrorCode = "not_found"
+	CodeConflict        ErrorCode = "conflict"
+	CodeOverBudget      ErrorCode = "over_budget"
+	CodeBudgetExhausted ErrorCode = "budget_exhausted"
+	CodePolicyDenied    ErrorCode = "policy_denied"
+	CodeKeyReused       ErrorCode = "idempotency_key_reused"
+	CodeUnavailable     ErrorCode = "unavailable"
+	CodeInternal        ErrorCode = "internal"
+)
+
+// APIError is the error of the error envelope every endpoint replies with
+type APIError struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	Details gin.H     `json:"details,omitempty"`
+}
+
+// abortWithError replies with the error envelope, message is also kept at the top level for the clients of the
+// deprecated unversioned routes
+func abortWithError(c *gin.Context, status int, code ErrorCode, message string, details ...gin.H) {
+	e := APIError{Code: code, Message: message}
+	c.Set(auditMessageKey, message)
+	for _, d := range details {
+		if e.Details == nil {
+			e.Details = gin.H{}
+		}
+		for k, v := range d {
+			e.Details[k] = v
+		}
+	}
+
+	c.AbortWithStatusJSON(status, gin.H{
+		"error":   e,
+		"message": message,
+	})
+}
+
+// budgetStatus is the http status of a placement error, a request which never fits the budget is unprocessable
+// and one waiting for capacity is told to retry
+func budgetStatus(err error) int {
+	switch {
+	case errors.Is(err, budget.ErrOverBudget):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, budget.ErrExhausted):
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// budgetCode is the error code of a placement error, see budgetStatus
+func budgetCode(err error) ErrorCode {
+	switch {
+	case errors.Is(err, budget.ErrOverBudget):
+		return CodeOverBudget
+	case errors.Is(err, budget.ErrExhausted):
+		return CodeBudgetExhausted
+	}
+	return CodeInternal
+}
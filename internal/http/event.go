@@ -0,0 +1,189 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/404LifeFound/es-snapshot-restore/internal/cache"
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// heartbeatInterval keeps the idle event streams open through proxies
+	heartbeatInterval = 15 * time.Second
+	writeTimeout      = 10 * time.Second
+)
+
+var upgrader = websocket.Upgrader{}
+
+// TaskEvents streams the events of the task of the id path param as Server-Sent Events, named after the event
+// type. The stream starts with the status of each index of the task and ends with a done event once it finished.
+func (h *Handler) TaskEvents(c *gin.Context) {
+	task_id := c.Param("id")
+	events, unsubscribe := h.Events.Subscribe(task_id)
+	defer unsubscribe()
+
+	tasks, ok := h.taskOf(c, task_id)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	send := func(e cache.Event) error {
+		c.SSEvent(string(e.Type), e)
+		c.Writer.Flush()
+		return nil
+	}
+	ping := func() error {
+		if _, err := c.Writer.WriteString(": ping\n\n"); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	}
+
+	if err := h.followTask(c.Request.Context(), tasks, events, send, ping); err != nil {
+		log.Warn().Err(err).Msgf("stop streaming events of task id %s", task_id)
+	}
+}
+
+// TaskEventsWS streams the events of the task of the id path param over a WebSocket, one json message per event,
+// like TaskEvents
+func (h *Handler) TaskEventsWS(c *gin.Context) {
+	task_id := c.Param("id")
+	events, unsubscribe := h.Events.Subscribe(task_id)
+	defer unsubscribe()
+
+	tasks, ok := h.taskOf(c, task_id)
+	if !ok {
+		return
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// the upgrader already replied with the error
+		log.Error().Err(err).Msgf("failed to upgrade the events of task id %s to websocket", task_id)
+		return
+	}
+	defer conn.Close()
+
+	// the messages of the client are discarded, reading them notices when it goes away
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(e cache.Event) error {
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		return conn.WriteJSON(e)
+	}
+	ping := func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+	}
+
+	if err := h.followTask(ctx, tasks, events, send, ping); err != nil {
+		log.Warn().Err(err).Msgf("stop streaming events of task id %s", task_id)
+		return
+	}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeTimeout))
+}
+
+// taskOf returns the records of the task task_id, it replies with the error when there is none
+func (h *Handler) taskOf(c *gin.Context, task_id string) ([]db.Task, bool) {
+	tasks, err := db.QueryAll[db.Task](h.DBClient, "id", 0, "task_id = ?", task_id)
+	if err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to get task id %s: %s", task_id, err.Error()))
+		return nil, false
+	}
+	if len(tasks) == 0 {
+		abortWithError(c, http.StatusNotFound, CodeNotFound, fmt.Sprintf("task id %s not found", task_id))
+		return nil, false
+	}
+	return tasks, true
+}
+
+// followTask sends the status of each of the tasks, then the events until the task finished or ctx is done. The
+// events are subscribed before the tasks are read so none is missed in between.
+func (h *Handler) followTask(ctx context.Context, tasks []db.Task, events <-chan cache.Event, send func(e cache.Event) error, ping func() error) error {
+	task_id := tasks[0].TaskID
+	for _, t := range tasks {
+		e := cache.Event{
+			TaskID:   t.TaskID,
+			Type:     cache.EventStatus,
+			Index:    t.Index,
+			Snapshot: t.Snapshot,
+			NodeName: t.Node,
+			Stage:    utils.StringValue(t.CurrentStage),
+			Status:   t.Status,
+			Progress: t.Progress,
+			Attempt:  t.Attempts,
+			Message:  utils.StringValue(t.ErrorMessage),
+			Time:     t.UpdatedAt,
+		}
+		if err := send(e); err != nil {
+			return err
+		}
+	}
+	if status := taskStatus(tasks); finishedStatus(status) {
+		return send(cache.Event{TaskID: task_id, Type: cache.EventDone, Status: status, Time: time.Now()})
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-heartbeat.C:
+			if err := ping(); err != nil {
+				return err
+			}
+
+		case e := <-events:
+			if err := send(e); err != nil {
+				return err
+			}
+			if e.Type != cache.EventStatus || !finishedStatus(e.Status) {
+				continue
+			}
+
+			tasks, err := db.QueryAll[db.Task](h.DBClient, "id", 0, "task_id = ?", task_id)
+			if err != nil {
+				log.Error().Err(err).Msgf("failed to get task id %s", task_id)
+				continue
+			}
+			if status := taskStatus(tasks); finishedStatus(status) {
+				return send(cache.Event{TaskID: task_id, Type: cache.EventDone, Status: status, Time: time.Now()})
+			}
+		}
+	}
+}
+
+// finishedStatus reports whether a task in status won't change anymore
+func finishedStatus(status string) bool {
+	switch utils.TaskStatus(status) {
+	case utils.TaskSuccess, utils.TaskFailed, utils.TaskTimeout, utils.TaskCanceled:
+		return true
+	}
+	return false
+}
@@ -1,27 +1,52 @@
 package http
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/404LifeFound/es-snapshot-restore/internal/approval"
+	"github.com/404LifeFound/es-snapshot-restore/internal/audit"
+	"github.com/404LifeFound/es-snapshot-restore/internal/auth"
+	"github.com/404LifeFound/es-snapshot-restore/internal/budget"
+	"github.com/404LifeFound/es-snapshot-restore/internal/cache"
 	restorev1 "github.com/404LifeFound/es-snapshot-restore/internal/controller/api/v1"
 	"github.com/404LifeFound/es-snapshot-restore/internal/db"
 	"github.com/404LifeFound/es-snapshot-restore/internal/elastic"
 	"github.com/404LifeFound/es-snapshot-restore/internal/k8s"
+	"github.com/404LifeFound/es-snapshot-restore/internal/notify"
+	"github.com/404LifeFound/es-snapshot-restore/internal/policy"
+	"github.com/404LifeFound/es-snapshot-restore/internal/pool"
+	"github.com/404LifeFound/es-snapshot-restore/internal/preflight"
+	"github.com/404LifeFound/es-snapshot-restore/internal/provisioner"
 	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
+	"github.com/404LifeFound/es-snapshot-restore/internal/worker"
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog/log"
+	"go.uber.org/fx"
 	"gorm.io/gorm"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtimeclient "sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 type Handler struct {
-	ESClient  *elastic.ES
-	DBClient  *gorm.DB
-	K8Sclient runtimeclient.Client
+	ESClient    *elastic.ES
+	DBClient    *gorm.DB
+	K8Sclient   runtimeclient.Client
+	Provisioner provisioner.Provisioner
+	Worker      *worker.Worker
+	Pool        *pool.Pool
+	Budget      *budget.Budget
+	Preflight   *preflight.Checker
+	Events      *cache.Broker
+	Auth        *auth.Authenticator
+	Policy      *policy.Engine
+	Approvals   *approval.Approvals
+	Notifier    *notify.Notifier
+	Auditor     *audit.Auditor
 }
 
 type RestoreSnapshotHandler struct {
@@ -29,101 +54,168 @@ type RestoreSnapshotHandler struct {
 }
 
 type QueryIndexParam struct {
-	Name    []string `form:"name" binding:"required,min=1" json:"name"`
-	StartAt string   `form:"start_at" json:"start_at"`
-	EndAt   string   `form:"end_at" json:"end_at"`
+	Name     []string `form:"name" binding:"required,min=1" json:"name"`
+	StartAt  string   `form:"start_at" json:"start_at"`
+	EndAt    string   `form:"end_at" json:"end_at"`
+	Replicas *int     `form:"replicas" binding:"omitempty,min=0" json:"replicas"`
 }
 
 func (h *Handler) QueryIndex(c *gin.Context) {
 	var p QueryIndexParam
 	if err := c.ShouldBindQuery(&p); err != nil {
 		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"message": fmt.Sprintf("failed to bind query param to QueryIndexParam: %s", err.Error()),
-		})
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("failed to bind query param to QueryIndexParam: %s", err.Error()))
 		return
 	}
 
 	all_result, err := h.QueryIndexResultViaTime(p.Name, p.StartAt, p.EndAt)
 	if err != nil {
 		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-			"message": fmt.Sprintf("failed to query index to meet the condition: %s", err.Error()),
-		})
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to query index to meet the condition: %s", err.Error()))
 		return
 	}
 
-	storage_size := h.GetIndexGBSize(all_result)
-	if storage_size < config.GlobalConfig.ES.DiskMinSize {
-		storage_size = config.GlobalConfig.ES.DiskMinSize
+	// the size recorded in the snapshot is preferred like for a restore, an index deleted by ILM has no other
+	map_index_snapshot, err := h.QueryLatestSnapshotsViaIndex(all_result)
+	if err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to query snapshot to meet the indices condition: %s", err.Error()))
+		return
 	}
+	plan := h.PlanIndices(all_result, p.Replicas, map_index_snapshot)
 
 	c.JSON(http.StatusOK, gin.H{
 		"index":      h.GetIndexNames(all_result),
-		"store_size": fmt.Sprintf("%fGi", storage_size),
+		"store_size": plan.StoreSize(),
+		"plan":       plan,
 	})
 }
 
 type RestoreSnapshotRequest struct {
-	Name    []string `form:"name" binding:"required,min=1" json:"name"`
-	Node    string   `form:"node" json:"node"`
-	StartAt string   `form:"start_at" json:"start_at"`
-	EndAt   string   `form:"end_at" json:"end_at"`
+	Name     []string          `form:"name" binding:"required,min=1" json:"name"`
+	Node     string            `form:"node" json:"node"`
+	StartAt  string            `form:"start_at" json:"start_at"`
+	EndAt    string            `form:"end_at" json:"end_at"`
+	Replicas *int              `form:"replicas" binding:"omitempty,min=0" json:"replicas"`
+	Team     string            `form:"team" json:"team"`
+	Labels   map[string]string `json:"labels"`
 }
 
 func (r *RestoreSnapshotHandler) RestoreSnapshot(c *gin.Context) {
 	if c.ContentType() != "application/json" {
 		err := fmt.Errorf("content type should be application/json")
 		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"message": fmt.Sprintf("invalid content type %s, please use application/json", c.ContentType()),
-		})
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid content type %s, please use application/json", c.ContentType()))
 		return
 	}
 
 	var restore_snapshot_request RestoreSnapshotRequest
 	if err := c.ShouldBindJSON(&restore_snapshot_request); err != nil {
 		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"message": fmt.Sprintf("invalid post data: %s,can't bind post data to RestoreSnapshotRequest", err.Error()),
-		})
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid post data: %s,can't bind post data to RestoreSnapshotRequest", err.Error()))
 		return
 	}
 
 	matched_indices, err := r.QueryIndexResultViaTime(restore_snapshot_request.Name, restore_snapshot_request.StartAt, restore_snapshot_request.EndAt)
 	if err != nil {
 		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-			"message": fmt.Sprintf("failed to query index to meet the condition: %s", err.Error()),
-		})
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to query index to meet the condition: %s", err.Error()))
 		return
 	}
 
-	log.Info().Msgf("total index size is: %.6f", r.GetIndexGBSize(matched_indices))
-
-	storage_size := r.GetIndexGBSize(matched_indices)
-	if storage_size < config.GlobalConfig.ES.DiskMinSize {
-		storage_size = config.GlobalConfig.ES.DiskMinSize
-	}
+	log.Info().Msgf("total index size is: %.6f", r.GetIndexGBSize(matched_indices, restore_snapshot_request.Replicas))
 
 	map_index_snapshot, err := r.QueryLatestSnapshotsViaIndex(matched_indices)
 	if err != nil {
 		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-			"message": fmt.Sprintf("failed to query snapshot to meet the indices condition: %s", err.Error()),
-		})
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to query snapshot to meet the indices condition: %s", err.Error()))
+		return
+	}
+
+	plan := r.PlanIndices(matched_indices, restore_snapshot_request.Replicas, map_index_snapshot)
+	_, restore_snapshot_request.Team = callerOf(c, "", restore_snapshot_request.Team)
+
+	res := plan.NodeResources()
+	demand := budget.Demand(plan.StoreSize(), plan.NodeCount, res.CPU, res.Memory)
+	admission := gin.H{
+		"demand":   demand,
+		"admitted": true,
+		"queued":   false,
+	}
+	if err := r.Budget.Admit(restore_snapshot_request.Team, demand); errors.Is(err, budget.ErrExhausted) {
+		admission["admitted"] = false
+		admission["queued"] = true
+		admission["reason"] = err.Error()
+	} else if err != nil {
+		c.Error(err)
+		abortWithError(c, budgetStatus(err), budgetCode(err), fmt.Sprintf("the plan of %s doesn't fit the restore capacity budget: %s", plan.StoreSize(), err.Error()), gin.H{"plan": plan})
 		return
 	}
+
+	// the plan only reports the decision, the restore enforces it
+	decision := r.evaluatePolicy(c, restore_snapshot_request, restore_snapshot_request.Team, r.GetIndexNames(matched_indices), plan.DataGB, plan.NodeCount, policySnapshots(map_index_snapshot))
+
 	c.JSON(http.StatusOK, gin.H{
 		"index_snapshot": map_index_snapshot,
-		"store_size":     fmt.Sprintf("%fGi", storage_size),
+		"store_size":     plan.StoreSize(),
+		"plan":           plan,
+		"budget":         admission,
+		"policy":         decision,
+	})
+}
+
+type PreflightRequest struct {
+	Repository string                   `json:"repository" binding:"required"`
+	Snapshot   string                   `json:"snapshot" binding:"required"`
+	Indices    []string                 `json:"indices" binding:"required,min=1"`
+	Node       string                   `json:"node"`
+	Replicas   int                      `json:"replicas" binding:"min=0"`
+	StoreSize  string                   `json:"store_size" binding:"required"`
+	Isolation  restorev1.IsolationMode  `json:"isolation" binding:"omitempty,oneof=nodeset cluster"`
+	Resources  *restorev1.NodeResources `json:"resources"`
+}
+
+// RestorePreflight reports whether the cluster can accept the restore, without provisioning anything
+func (h *Handler) RestorePreflight(c *gin.Context) {
+	if c.ContentType() != "application/json" {
+		err := fmt.Errorf("content type should be application/json")
+		c.Error(err)
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid content type %s, please use application/json", c.ContentType()))
+		return
+	}
+
+	var r PreflightRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid post data: %s,can't bind post data to PreflightRequest", err.Error()))
+		return
+	}
+
+	req := provisioner.NewRequest(r.Node, r.StoreSize)
+	if r.Isolation != "" {
+		req.Isolation = r.Isolation
+	}
+	req.Resources = r.Resources
+
+	report := h.Preflight.Run(c.Request.Context(), preflight.Input{
+		Request:    req,
+		Repository: r.Repository,
+		Snapshot:   r.Snapshot,
+		Indices:    r.Indices,
+		Replicas:   r.Replicas,
 	})
+
+	c.JSON(http.StatusOK, report)
 }
 
 type CreateRestoreNodeRequest struct {
-	TaskID string `json:"task_id" binding:"required"`
-	Name   string `json:"name" binding:"required"`
-	Size   string `json:"size" binding:"required"`
+	TaskID    string                   `json:"task_id" binding:"required"`
+	Name      string                   `json:"name" binding:"required"`
+	Size      string                   `json:"size" binding:"required"`
+	Placement *restorev1.Placement     `json:"placement"`
+	Resources *restorev1.NodeResources `json:"resources"`
+	Isolation restorev1.IsolationMode  `json:"isolation" binding:"omitempty,oneof=nodeset cluster"`
+	Team      string                   `json:"team"`
 }
 
 func (h *Handler) CreateRestoreNode(c *gin.Context) {
@@ -131,41 +223,34 @@ func (h *Handler) CreateRestoreNode(c *gin.Context) {
 	if c.ContentType() != "application/json" {
 		err := fmt.Errorf("content type should be application/json")
 		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"message": fmt.Sprintf("invalid content type %s, please use application/json", c.ContentType()),
-		})
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid content type %s, please use application/json", c.ContentType()))
 		return
 	}
 	err := c.ShouldBindJSON(&create_restore_node_req)
 	if err != nil {
 		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"message": fmt.Sprintf("faild to parse delete_restore_node_req: %s", err.Error()),
-		})
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("faild to parse delete_restore_node_req: %s", err.Error()))
 		return
 	}
 
+	setAuditTarget(c, create_restore_node_req.Name)
 	task, err := db.QueryAll[db.Task](h.DBClient, "", 0, "task_id = ?", create_restore_node_req.TaskID)
 	if err != nil {
 		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"message": fmt.Sprintf("failed to get task id %s: %s", create_restore_node_req.TaskID, err.Error()),
-		})
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("failed to get task id %s: %s", create_restore_node_req.TaskID, err.Error()))
 		return
 	}
 
 	if len(task) != 1 || len(task) == 0 {
 		err := fmt.Errorf("The task_id of %s have %d record which not equal 1", create_restore_node_req.TaskID, len(task))
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"message": fmt.Sprintf("%s", err.Error()),
-		})
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("%s", err.Error()))
 		return
 
 	}
 
 	t := task[0]
 	log.Info().Msgf("update task stage from %s to %s and status from %s to %s for %s...",
-		t.CurrentStage,
+		utils.StringValue(t.CurrentStage),
 		string(utils.StagCreateESNode),
 		t.Status,
 		string(utils.TaskRunning),
@@ -177,13 +262,11 @@ func (h *Handler) CreateRestoreNode(c *gin.Context) {
 		"UpdatedAt":    time.Now(),
 	}).Error; err != nil {
 		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-			"message": fmt.Sprintf("failed to update task of %s: %s", create_restore_node_req.TaskID, err.Error()),
-		})
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to update task of %s: %s", create_restore_node_req.TaskID, err.Error()))
 		return
 	}
 	log.Debug().Msgf("updated task stage from %s to %s and status from %s to %s for %s",
-		t.CurrentStage,
+		utils.StringValue(t.CurrentStage),
 		string(utils.StagCreateESNode),
 		t.Status,
 		string(utils.TaskRunning),
@@ -194,21 +277,55 @@ func (h *Handler) CreateRestoreNode(c *gin.Context) {
 	//t.Status = string(utils.TaskRunning)
 	//h.DBClient.Save(t)
 
-	err = h.NewRestoreESNode(c.Request.Context(), create_restore_node_req.Name, create_restore_node_req.Size)
+	req := provisioner.NewRequest(create_restore_node_req.Name, create_restore_node_req.Size)
+	if create_restore_node_req.Isolation != "" {
+		req.Isolation = create_restore_node_req.Isolation
+	}
+	req.Placement = create_restore_node_req.Placement
+	req.Resources = create_restore_node_req.Resources
+	if req.Resources == nil && t.Index != "" {
+		// the restore node is sized with the plan of the index of the task unless the caller sizes it
+		req.Resources = h.taskPlan([]RestoreViaCR{{
+			TaskID:     t.TaskID,
+			Index:      t.Index,
+			Repository: t.Repository,
+			Snapshot:   t.Snapshot,
+		}}, nil).NodeResources()
+	}
+	req.Team = create_restore_node_req.Team
+
+	recorded, err := h.Pool.Recorded(req.Name)
 	if err != nil {
 		c.Error(err)
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to query restore node %s: %s", req.Name, err.Error()))
+		return
+	}
+
+	// the restore node is charged to the budget, the caller retries it once capacity is released
+	if _, err := h.Pool.Acquire(c.Request.Context(), req, 0); err != nil {
+		c.Error(err)
+		abortWithError(c, budgetStatus(err), budgetCode(err), fmt.Sprintf("failed to admit restore node %s with store size %s: %s", create_restore_node_req.Name, create_restore_node_req.Size, err.Error()))
+		return
+	}
+
+	err = h.Provisioner.Create(c.Request.Context(), req)
+	if err != nil {
+		c.Error(err)
+		// the budget charged for a restore node which was never created is released
+		if !recorded {
+			if err := h.Pool.Forget(req.Name); err != nil {
+				c.Error(err)
+			}
+		}
 		if dberr := h.DBClient.Model(&t).Updates(map[string]any{
 			"Status":    string(utils.TaskFailed),
 			"UpdatedAt": time.Now(),
 		}).Error; dberr != nil {
 			c.Error(dberr)
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-				"message": fmt.Sprintf("failed to update task status of %s: %s", create_restore_node_req.TaskID, dberr.Error()),
-			})
+			abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to update task status of %s: %s", create_restore_node_req.TaskID, dberr.Error()))
+			return
 		}
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-			"message": fmt.Sprintf("failed to create restore node %s with store size %s: %s", create_restore_node_req.Name, create_restore_node_req.Size, err.Error()),
-		})
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to create restore node %s with store size %s: %s", create_restore_node_req.Name, create_restore_node_req.Size, err.Error()))
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{
@@ -225,12 +342,11 @@ func (h *Handler) NewTask(c *gin.Context) {
 		Status:    string(utils.TaskPending),
 		StartedAt: utils.PtrToAny(time.Now()),
 	}
+	setAuditTarget(c, task.TaskID)
 
 	if err := db.CreateRecords(h.DBClient, &[]db.Task{task}); err != nil {
 		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-			"message": fmt.Sprintf("faild to create task %s", err.Error()),
-		})
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("faild to create task %s", err.Error()))
 		return
 	}
 
@@ -244,23 +360,38 @@ type DeleteRestoreNodeRequest struct {
 	Name string `json:"name" binding:"required"`
 }
 
+// DeleteRestoreNode tears down the restore node of the name path param, or of the json body on the deprecated route
 func (h *Handler) DeleteRestoreNode(c *gin.Context) {
 	var delete_restore_node_req DeleteRestoreNodeRequest
-	err := c.ShouldBindJSON(&delete_restore_node_req)
-	if err != nil {
+	if name := c.Param("name"); name != "" {
+		delete_restore_node_req.Name = name
+	} else if err := c.ShouldBindJSON(&delete_restore_node_req); err != nil {
 		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"message": fmt.Sprintf("faild to parse delete_restore_node_req: %s", err.Error()),
-		})
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("faild to parse delete_restore_node_req: %s", err.Error()))
 		return
 	}
+	setAuditTarget(c, delete_restore_node_req.Name)
 
-	err = h.DeleteRestoreESNode(c.Request.Context(), delete_restore_node_req.Name)
+	req := provisioner.NewRequest(delete_restore_node_req.Name, "")
+	nodes, err := db.QueryAll[db.RestoreNode](h.DBClient, "", 1, "name = ?", delete_restore_node_req.Name)
 	if err != nil {
 		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-			"message": fmt.Sprintf("failed to delete restore node %s: %s", delete_restore_node_req.Name, err.Error()),
-		})
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to get restore node %s: %s", delete_restore_node_req.Name, err.Error()))
+		return
+	}
+	if len(nodes) == 1 {
+		// the node is torn down the way it was provisioned
+		req.Isolation = restorev1.IsolationMode(nodes[0].Isolation)
+	}
+
+	if err := h.Provisioner.Teardown(c.Request.Context(), req); err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to delete restore node %s: %s", delete_restore_node_req.Name, err.Error()))
+		return
+	}
+	if err := h.Pool.Forget(delete_restore_node_req.Name); err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to release restore node %s from the budget: %s", delete_restore_node_req.Name, err.Error()))
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{
@@ -268,61 +399,165 @@ func (h *Handler) DeleteRestoreNode(c *gin.Context) {
 	})
 }
 
-// TODO
 type RestoreSnapshotOneStepRequest struct {
-	TaskID string   `json:"task_id" binding:"required"`
-	Name   []string `form:"name" binding:"required,min=1" json:"name"`
-	Node   string   `form:"node" json:"node"`
+	Name      []string                `json:"name" binding:"required,min=1"`
+	StartAt   string                  `json:"start_at"`
+	EndAt     string                  `json:"end_at"`
+	Replicas  *int                    `json:"replicas" binding:"omitempty,min=0"`
+	Team      string                  `json:"team"`
+	Isolation restorev1.IsolationMode `json:"isolation" binding:"omitempty,oneof=nodeset cluster"`
+	Placement *restorev1.Placement    `json:"placement"`
+	Throttle  *restorev1.Throttle     `json:"throttle"`
+	Requester string                  `json:"requester"`
+	// Labels are free form, like a ticket or a ttl, read by the admission policies
+	Labels map[string]string `json:"labels"`
 }
 
+// RestoreSnapshotOneStep plans the restore of the indices matching the name patterns and time range, records a
+// task for them and restores them through RestoreTask resources, or the worker when kubernetes is disabled. The
+// indices without a successful snapshot are skipped.
 func (h *Handler) RestoreSnapshotOneStep(c *gin.Context) {
 	if c.ContentType() != "application/json" {
 		err := fmt.Errorf("content type should be application/json")
 		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"message": fmt.Sprintf("invalid content type %s, please use application/json", c.ContentType()),
-		})
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid content type %s, please use application/json", c.ContentType()))
 		return
 	}
 
 	var r RestoreSnapshotOneStepRequest
 	if err := c.ShouldBindJSON(&r); err != nil {
 		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"message": fmt.Sprintf("invalid post data: %s,can't bind post data to RestoreSnapshotRequest", err.Error()),
-		})
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid post data: %s,can't bind post data to RestoreSnapshotOneStepRequest", err.Error()))
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"message": "success",
-	})
-}
+	matched_indices, err := h.QueryIndexResultViaTime(r.Name, r.StartAt, r.EndAt)
+	if err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to query index to meet the condition: %s", err.Error()))
+		return
+	}
 
-func (h *Handler) DebugHandler(c *gin.Context) {
-	err := h.DeleteRestoreESNode(c.Request.Context(), "restore-xxxx")
+	map_index_snapshot, err := h.QueryLatestSnapshotsViaIndex(matched_indices)
 	if err != nil {
 		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-			"message": fmt.Sprintf("can't get elasticsearch %s from namespace %s: %s", config.GlobalConfig.ES.Name, config.GlobalConfig.ES.Namespace, err.Error()),
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to query snapshot to meet the indices condition: %s", err.Error()))
+		return
+	}
+
+	var indices []db.ESIndex
+	skipped := []string{}
+	for _, i := range matched_indices {
+		if _, ok := map_index_snapshot[i.Name]; ok {
+			indices = append(indices, i)
+		} else {
+			skipped = append(skipped, i.Name)
+		}
+	}
+	if len(indices) == 0 {
+		abortWithError(c, http.StatusNotFound, CodeNotFound, fmt.Sprintf("no index of %v has a snapshot to restore", r.Name), gin.H{"skipped": skipped})
+		return
+	}
+	if !checkGrants(c, h.GetIndexNames(indices)) {
+		return
+	}
+	r.Requester, r.Team = callerOf(c, r.Requester, r.Team)
+
+	plan := h.PlanIndices(indices, r.Replicas, map_index_snapshot)
+	decision := h.evaluatePolicy(c, r, r.Team, h.GetIndexNames(indices), plan.DataGB, plan.NodeCount, policySnapshots(map_index_snapshot))
+	if !admitPolicy(c, decision) {
+		return
+	}
+	awaiting := awaitingApproval(decision)
+	task_id := utils.TaskID()
+	setAuditTarget(c, task_id)
+	log.Info().Msgf("restore %d indices of %v as task id %s with plan %+v", len(indices), r.Name, task_id, plan)
+
+	var replicas *int32
+	if r.Replicas != nil {
+		replicas = utils.PtrToAny(int32(*r.Replicas))
+	}
+	tasks := make([]RestoreViaCR, 0, len(indices))
+	for _, i := range indices {
+		s := map_index_snapshot[i.Name]
+		tasks = append(tasks, RestoreViaCR{
+			TaskID:     task_id,
+			Index:      i.Name,
+			Repository: s.Repository,
+			Snapshot:   s.Snapshot,
+			StoreSize:  plan.StoreSize(),
+			Replicas:   replicas,
+			Isolation:  r.Isolation,
+			Placement:  r.Placement,
+			Resources:  plan.NodeResources(),
+			Throttle:   r.Throttle,
 		})
+	}
 
+	var result restoreResult
+	if h.K8Sclient != nil {
+		result, err = h.createRestoreTasks(c.Request.Context(), r.Team, r.Requester, tasks, awaiting)
+	} else {
+		result, err = h.enqueueRestoreTasks(c.Request.Context(), RestoreViaWorkerRequest{
+			Tasks:     tasks,
+			Replicas:  r.Replicas,
+			StoreSize: plan.StoreSize(),
+			Isolation: r.Isolation,
+			Placement: r.Placement,
+			Resources: plan.NodeResources(),
+			Team:      r.Team,
+			Requester: r.Requester,
+			Labels:    r.Labels,
+		}, awaiting)
 	}
-	c.JSON(http.StatusOK, gin.H{
-		"message": "success",
+	if err != nil {
+		c.Error(err)
+		abortWithError(c, budgetStatus(err), budgetCode(err), fmt.Sprintf("failed to place the plan of %s on a restore node: %s", plan.StoreSize(), err.Error()), gin.H{"plan": plan})
+		return
+	}
+	commit(c)
+
+	status := http.StatusOK
+	if len(result.Failed) > 0 {
+		status = http.StatusInternalServerError
+	} else if awaiting != nil {
+		status = http.StatusAccepted
+	}
+	var approval_view *ApprovalView
+	if len(result.Approvals) > 0 {
+		approval_view = &result.Approvals[0]
+	}
+	c.JSON(status, gin.H{
+		"task_id":        task_id,
+		"node":           result.Node,
+		"queued":         result.Queued,
+		"approval":       approval_view,
+		"index_snapshot": map_index_snapshot,
+		"skipped":        skipped,
+		"failed":         result.Failed,
+		"store_size":     plan.StoreSize(),
+		"plan":           plan,
 	})
 }
 
 type RestoreViaCR struct {
-	TaskID     string `json:"task_id"`
-	Index      string `json:"index"`
-	Repository string `json:"repository"`
-	Snapshot   string `json:"snapshot"`
-	StoreSize  string `json:"store_size"`
+	TaskID     string                   `json:"task_id"`
+	Index      string                   `json:"index"`
+	Repository string                   `json:"repository"`
+	Snapshot   string                   `json:"snapshot"`
+	StoreSize  string                   `json:"store_size"`
+	Replicas   *int32                   `json:"replicas"`
+	Isolation  restorev1.IsolationMode  `json:"isolation"`
+	Placement  *restorev1.Placement     `json:"placement"`
+	Resources  *restorev1.NodeResources `json:"resources"`
+	Throttle   *restorev1.Throttle      `json:"throttle"`
 }
 
 type RestoreViaCRRequest struct {
-	Tasks []RestoreViaCR
+	Tasks     []RestoreViaCR
+	Team      string            `json:"team"`
+	Requester string            `json:"requester"`
+	Labels    map[string]string `json:"labels"`
 }
 
 func (h *Handler) RestoreViaCR(c *gin.Context) {
@@ -330,43 +565,161 @@ func (h *Handler) RestoreViaCR(c *gin.Context) {
 	if c.ContentType() != "application/json" {
 		err := fmt.Errorf("content type should be application/json")
 		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"message": fmt.Sprintf("invalid content type %s, please use application/json", c.ContentType()),
-		})
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid content type %s, please use application/json", c.ContentType()))
 		return
 	}
 
 	if err := c.ShouldBindJSON(&r); err != nil {
 		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"message": fmt.Sprintf("invalid post data: %s,can't bind post data to RestoreViaCRRequest", err.Error()),
-		})
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid post data: %s,can't bind post data to RestoreViaCRRequest", err.Error()))
+		return
+	}
+
+	if len(r.Tasks) == 0 {
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, "no task to restore")
 		return
 	}
 
-	var success_taskes []string
-	var failed_taskes []string
-	node_name := fmt.Sprintf("%s-%s", config.GlobalConfig.ES.RestoreKey, utils.RandomName())
+	if h.K8Sclient == nil {
+		abortWithError(c, http.StatusServiceUnavailable, CodeUnavailable, "kubernetes is disabled, restore the tasks through "+apiPrefix+"/tasks/batch")
+		return
+	}
 
+	setAuditTarget(c, taskIDs(r.Tasks)...)
+	if !checkGrants(c, taskIndices(r.Tasks)) {
+		return
+	}
+	r.Requester, r.Team = callerOf(c, r.Requester, r.Team)
+	// the indices keep the replicas of their snapshot unless a task sets them
+	var replicas *int
 	for _, t := range r.Tasks {
+		if t.Replicas != nil && (replicas == nil || int(*t.Replicas) > *replicas) {
+			replicas = utils.PtrToAny(int(*t.Replicas))
+		}
+	}
+	plan := h.taskPlan(r.Tasks, replicas)
+	for i := range r.Tasks {
+		if r.Tasks[i].Resources == nil {
+			// the restore node is sized with the plan unless the caller sizes it
+			r.Tasks[i].Resources = plan.NodeResources()
+		}
+	}
+	node_count := plan.NodeCount
+	if r.Tasks[0].Resources.Count > 0 {
+		node_count = r.Tasks[0].Resources.Count
+	}
+	decision := h.evaluatePolicy(c, r, r.Team, taskIndices(r.Tasks), plan.DataGB, node_count, h.taskSnapshots(r.Tasks))
+	if !admitPolicy(c, decision) {
+		return
+	}
+
+	result, err := h.createRestoreTasks(c.Request.Context(), r.Team, r.Requester, r.Tasks, awaitingApproval(decision))
+	if err != nil {
+		c.Error(err)
+		abortWithError(c, budgetStatus(err), budgetCode(err), fmt.Sprintf("failed to place tasks on a restore node: %s", err.Error()))
+		return
+	}
+	commit(c)
+
+	if len(result.Failed) > 0 {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success_taskes": result.Success,
+			"failed_taskes":  result.Failed,
+			"queued":         result.Queued,
+			"approvals":      result.Approvals,
+		})
+		return
+	}
+
+	c.JSON(restoreStatus(result), gin.H{
+		"success_taskes": result.Success,
+		"queued":         result.Queued,
+		"approvals":      result.Approvals,
+	})
+}
+
+// restoreResult is what became of the tasks of a restore, Node is empty while they are queued or await an approval
+type restoreResult struct {
+	Node      string
+	Success   []string
+	Failed    []string
+	Queued    bool
+	Approvals []ApprovalView
+}
+
+// createRestoreTasks records the tasks and creates a RestoreTask resource for each of them, placed on one restore
+// node sized for the largest of them. On an exhausted budget they are created without a node, the controller
+// places them once capacity is released, and so are the ones awaiting the approval required by awaiting. The error
+// is the one of the placement.
+func (h *Handler) createRestoreTasks(ctx context.Context, team, requester string, tasks []RestoreViaCR, awaiting *policy.Decision) (restoreResult, error) {
+	var result restoreResult
+
+	req := provisioner.NewRequest("", tasks[0].StoreSize)
+	req.Team = team
+	req.Isolation = tasks[0].Isolation
+	if req.Isolation == "" {
+		req.Isolation = restorev1.IsolationMode(config.GlobalConfig.ES.Isolation)
+	}
+	max_size := 0.0
+	for _, t := range tasks {
+		size, err := utils.ToGB(t.StoreSize)
+		if err != nil {
+			return result, fmt.Errorf("invalid store_size %s of task %s: %w", t.StoreSize, t.TaskID, err)
+		}
+		if size > max_size {
+			max_size = size
+			req.StoreSize = t.StoreSize
+		}
+	}
+
+	status := utils.TaskAwaitingApproval
+	if awaiting == nil {
+		var err error
+		req, err = h.Pool.Acquire(ctx, req, len(tasks))
+		result.Queued = errors.Is(err, budget.ErrExhausted)
+		if err != nil && !result.Queued {
+			return result, err
+		}
+
+		status = utils.TaskPending
+		if result.Queued {
+			log.Info().Err(err).Msgf("queue %d tasks until the restore capacity budget is released", len(tasks))
+			status = utils.TaskQueued
+		} else {
+			result.Node = req.Name
+		}
+	}
+
+	for _, t := range tasks {
 		task := db.Task{
 			TaskID:     t.TaskID,
 			Index:      t.Index,
 			Repository: t.Repository,
 			Snapshot:   t.Snapshot,
+			Status:     string(status),
+			Node:       result.Node,
+			Requester:  requester,
+		}
+		if awaiting == nil {
+			task.StartedAt = utils.PtrToAny(time.Now())
 		}
 
 		if err := db.CreateRecords(h.DBClient, &[]db.Task{task}); err != nil {
-			c.Error(err)
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-				"message": fmt.Sprintf("faild to create task %s", err.Error()),
-			})
-			failed_taskes = append(failed_taskes, t.TaskID)
+			log.Error().Err(err).Msgf("faild to create task id %s of index %s", t.TaskID, t.Index)
+			result.Failed = append(result.Failed, t.TaskID)
+			h.releaseFailed(result.Node)
 			continue
 		}
 
 		// create RestoreTask resource
-		restore_task_name := fmt.Sprintf("%s-%s", node_name, utils.RandomString(8))
+		restore_task_name := fmt.Sprintf("%s-%s", config.GlobalConfig.ES.RestoreKey, utils.RandomString(8))
+		if result.Node != "" {
+			restore_task_name = fmt.Sprintf("%s-%s", result.Node, utils.RandomString(8))
+		}
+		labels := map[string]string{}
+		if team != "" {
+			labels[provisioner.LabelTeam] = team
+		}
 		restore_task := restorev1.RestoreTask{
 			TypeMeta: metav1.TypeMeta{
 				Kind:       "RestoreTask",
@@ -375,6 +728,7 @@ func (h *Handler) RestoreViaCR(c *gin.Context) {
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      restore_task_name,
 				Namespace: config.GlobalConfig.ES.Namespace,
+				Labels:    labels,
 			},
 			Spec: restorev1.RestoreTaskSpec{
 				TaskId:  t.TaskID,
@@ -387,47 +741,532 @@ func (h *Handler) RestoreViaCR(c *gin.Context) {
 					Namespace: config.GlobalConfig.ES.Namespace,
 					Name:      config.GlobalConfig.ES.Name,
 				},
-				NodeName:  node_name,
-				StoreSize: t.StoreSize,
+				NodeName:  result.Node,
+				StoreSize: req.StoreSize,
+				Replicas:  t.Replicas,
+				Isolation: t.Isolation,
+				Placement: t.Placement,
+				Resources: t.Resources,
+				Throttle:  t.Throttle,
 			},
 		}
+		if awaiting != nil {
+			restore_task.Spec.Approval = restorev1.ApprovalPending
+		}
 
-		if err := h.K8Sclient.Create(c.Request.Context(), &restore_task); err != nil {
-			c.Error(err)
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-				"message": fmt.Sprintf("failed to create RestoreTask %s: %s", restore_task_name, err.Error()),
-			})
-			failed_taskes = append(failed_taskes, t.TaskID)
+		if err := h.K8Sclient.Create(ctx, &restore_task); err != nil {
+			log.Error().Err(err).Msgf("failed to create RestoreTask %s", restore_task_name)
+			if dberr := h.DBClient.Model(&db.Task{}).Where("task_id = ? AND `index` = ?", t.TaskID, t.Index).Updates(map[string]any{
+				"Status":       string(utils.TaskFailed),
+				"ErrorMessage": utils.PtrToAny(err.Error()),
+				"FinishedAt":   time.Now(),
+			}).Error; dberr != nil {
+				log.Error().Err(dberr).Msgf("failed to update status for task id %s of index %s", t.TaskID, t.Index)
+			}
+			result.Failed = append(result.Failed, t.TaskID)
+			h.releaseFailed(result.Node)
+			continue
 		}
-		success_taskes = append(success_taskes, t.TaskID)
+		result.Success = append(result.Success, t.TaskID)
+	}
+
+	if awaiting != nil {
+		result.Approvals = h.requestApprovals(*awaiting, team, requester, tasks, nil)
 	}
+	h.Notifier.TasksCreated(ctx, result.Success)
+	return result, nil
+}
+
+// releaseFailed releases the restore node a task was placed on before it failed to be created, it does nothing
+// when the task wasn't placed
+func (h *Handler) releaseFailed(node string) {
+	if node != "" {
+		h.Pool.Release(node)
+	}
+}
 
-	if len(failed_taskes) > 0 {
+type RestoreViaWorkerRequest struct {
+	Node      string                   `json:"node"`
+	Tasks     []RestoreViaCR           `json:"tasks" binding:"required,min=1"`
+	Replicas  *int                     `json:"replicas" binding:"omitempty,min=0"`
+	StoreSize string                   `json:"store_size" binding:"required"`
+	Isolation restorev1.IsolationMode  `json:"isolation" binding:"omitempty,oneof=nodeset cluster"`
+	Placement *restorev1.Placement     `json:"placement"`
+	Resources *restorev1.NodeResources `json:"resources"`
+	Team      string                   `json:"team"`
+	Requester string                   `json:"requester"`
+	Labels    map[string]string        `json:"labels"`
+}
+
+// RestoreViaWorker restores the tasks without a RestoreTask resource, the worker provisions the restore node
+// itself, so it works when kubernetes is disabled. On an exhausted budget the tasks are recorded as queued and
+// the worker starts them once capacity is released.
+func (h *Handler) RestoreViaWorker(c *gin.Context) {
+	if c.ContentType() != "application/json" {
+		err := fmt.Errorf("content type should be application/json")
+		c.Error(err)
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid content type %s, please use application/json", c.ContentType()))
+		return
+	}
+
+	var r RestoreViaWorkerRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid post data: %s,can't bind post data to RestoreViaWorkerRequest", err.Error()))
+		return
+	}
+
+	setAuditTarget(c, taskIDs(r.Tasks)...)
+	if !checkGrants(c, taskIndices(r.Tasks)) {
+		return
+	}
+	r.Requester, r.Team = callerOf(c, r.Requester, r.Team)
+	plan := h.taskPlan(r.Tasks, r.Replicas)
+	if r.Resources == nil {
+		// the restore node is sized with the plan unless the caller sizes it
+		r.Resources = plan.NodeResources()
+	}
+	node_count := plan.NodeCount
+	if r.Resources.Count > 0 {
+		node_count = r.Resources.Count
+	}
+	decision := h.evaluatePolicy(c, r, r.Team, taskIndices(r.Tasks), plan.DataGB, node_count, h.taskSnapshots(r.Tasks))
+	if !admitPolicy(c, decision) {
+		return
+	}
+
+	result, err := h.enqueueRestoreTasks(c.Request.Context(), r, awaitingApproval(decision))
+	if err != nil {
+		c.Error(err)
+		abortWithError(c, budgetStatus(err), budgetCode(err), fmt.Sprintf("failed to place tasks on a restore node: %s", err.Error()))
+		return
+	}
+	commit(c)
+
+	if len(result.Failed) > 0 {
 		c.JSON(http.StatusInternalServerError, gin.H{
-			"success_taskes": success_taskes,
-			"failed_taskes":  failed_taskes,
+			"node":           result.Node,
+			"success_taskes": result.Success,
+			"failed_taskes":  result.Failed,
+			"queued":         result.Queued,
+			"approvals":      result.Approvals,
 		})
+		return
+	}
+
+	c.JSON(restoreStatus(result), gin.H{
+		"node":           result.Node,
+		"success_taskes": result.Success,
+		"queued":         result.Queued,
+		"approvals":      result.Approvals,
+	})
+}
+
+// enqueueRestoreTasks records the tasks and hands them to the worker, which provisions the restore node of r. On an
+// exhausted budget they are recorded as queued and the worker admits them once capacity is released. The ones awaiting the
+// approval required by awaiting are only recorded, r is enqueued again once it is approved. The error is the one of
+// the placement.
+func (h *Handler) enqueueRestoreTasks(ctx context.Context, r RestoreViaWorkerRequest, awaiting *policy.Decision) (restoreResult, error) {
+	var result restoreResult
+
+	if awaiting != nil {
+		for _, t := range r.Tasks {
+			task := db.Task{
+				TaskID:     t.TaskID,
+				Index:      t.Index,
+				Repository: t.Repository,
+				Snapshot:   t.Snapshot,
+				Status:     string(utils.TaskAwaitingApproval),
+				Requester:  r.Requester,
+			}
+			if err := db.CreateRecords(h.DBClient, &[]db.Task{task}); err != nil {
+				log.Error().Err(err).Msgf("faild to create task id %s of index %s", t.TaskID, t.Index)
+				result.Failed = append(result.Failed, t.TaskID)
+				continue
+			}
+			result.Success = append(result.Success, t.TaskID)
+		}
+		result.Approvals = h.requestApprovals(*awaiting, r.Team, r.Requester, r.Tasks, &r)
+		h.Notifier.TasksCreated(ctx, result.Success)
+		return result, nil
+	}
+
+	queued := worker.Queued{
+		Group:     utils.TaskID(),
+		Node:      r.Node,
+		Replicas:  r.Replicas,
+		StoreSize: r.StoreSize,
+		Isolation: r.Isolation,
+		Placement: r.Placement,
+		Resources: r.Resources,
+		Team:      r.Team,
+	}
+
+	req, err := h.Pool.Acquire(ctx, queued.Request(), len(r.Tasks))
+	result.Queued = errors.Is(err, budget.ErrExhausted)
+	if err != nil && !result.Queued {
+		return result, err
+	}
+	status := utils.TaskRunning
+	if result.Queued {
+		log.Info().Err(err).Msgf("queue %d tasks until the restore capacity budget is released", len(r.Tasks))
+		status = utils.TaskQueued
+	} else {
+		result.Node = req.Name
+	}
+
+	for _, t := range r.Tasks {
+		task := db.Task{
+			TaskID:     t.TaskID,
+			Index:      t.Index,
+			Repository: t.Repository,
+			Snapshot:   t.Snapshot,
+			Status:     string(status),
+			Node:       result.Node,
+			Requester:  r.Requester,
+			StartedAt:  utils.PtrToAny(time.Now()),
+		}
+		// the worker admits the queued task from its payload once capacity is released, and queues it again from
+		// its payload when a restart interrupts its restore
+		queued.Throttle = t.Throttle
+		payload, err := queued.Payload()
+		if err != nil {
+			log.Error().Err(err).Msgf("faild to encode payload of task id %s of index %s", t.TaskID, t.Index)
+			result.Failed = append(result.Failed, t.TaskID)
+			h.releaseFailed(result.Node)
+			continue
+		}
+		task.Payload = payload
+
+		if err := h.recordTask(task); err != nil {
+			log.Error().Err(err).Msgf("faild to create task id %s of index %s", t.TaskID, t.Index)
+			result.Failed = append(result.Failed, t.TaskID)
+			h.releaseFailed(result.Node)
+			continue
+		}
+		result.Success = append(result.Success, t.TaskID)
+		if result.Queued {
+			continue
+		}
+
+		if err := h.Worker.Submit(&worker.Job{
+			TaskID:    t.TaskID,
+			Index:     []string{t.Index},
+			Replicas:  r.Replicas,
+			Request:   req,
+			Provision: true,
+			Throttle:  t.Throttle,
+			OnDone:    h.Worker.FailOnError(t.TaskID, t.Index),
+		}, queued); err != nil {
+			log.Error().Err(err).Msgf("faild to enqueue task id %s of index %s", t.TaskID, t.Index)
+		}
+	}
+
+	h.Notifier.TasksCreated(ctx, result.Success)
+	return result, nil
+}
+
+type CancelTaskRequest struct {
+	// Teardown tears the restore node down when no other task uses it
+	Teardown bool `json:"teardown"`
+}
+
+// CancelTask stops the restore of a task and deletes its partially restored indices, a task restored by a
+// RestoreTask is canceled through its desired state
+func (h *Handler) CancelTask(c *gin.Context) {
+	var r CancelTaskRequest
+	if !h.bindOptionalJSON(c, &r) {
+		return
+	}
+
+	h.steerTask(c, "cancel", func(spec *restorev1.RestoreTaskSpec) {
+		spec.DesiredState = restorev1.DesiredCanceled
+		spec.TeardownOnCancel = r.Teardown
+	}, func(ctx context.Context, task_id string) error {
+		return h.Worker.Cancel(ctx, task_id, r.Teardown)
+	})
+}
+
+type PauseTaskRequest struct {
+	Mode restorev1.PauseMode `json:"mode" binding:"omitempty,oneof=throttle close"`
+}
+
+// PauseTask throttles the recovery of a task or closes its restored indices until it is resumed
+func (h *Handler) PauseTask(c *gin.Context) {
+	var r PauseTaskRequest
+	if !h.bindOptionalJSON(c, &r) {
+		return
+	}
+
+	h.steerTask(c, "pause", func(spec *restorev1.RestoreTaskSpec) {
+		spec.DesiredState = restorev1.DesiredPaused
+		spec.PauseMode = r.Mode
+	}, func(ctx context.Context, task_id string) error {
+		return h.Worker.Pause(ctx, task_id, r.Mode)
+	})
+}
+
+// ResumeTask resumes a paused task
+func (h *Handler) ResumeTask(c *gin.Context) {
+	h.steerTask(c, "resume", func(spec *restorev1.RestoreTaskSpec) {
+		spec.DesiredState = restorev1.DesiredRunning
+	}, func(ctx context.Context, task_id string) error {
+		return h.Worker.Resume(ctx, task_id)
+	})
+}
+
+// ReleaseTask releases the indices restored by the finished task of the id path param, they don't hold their
+// restore node anymore so it is reclaimed once idle
+func (h *Handler) ReleaseTask(c *gin.Context) {
+	task_id := c.Param("id")
+	tasks, err := db.QueryAll[db.Task](h.DBClient, "", 0, "task_id = ?", task_id)
+	if err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to get task id %s: %s", task_id, err.Error()))
+		return
+	}
+	if len(tasks) == 0 {
+		abortWithError(c, http.StatusNotFound, CodeNotFound, fmt.Sprintf("task id %s not found", task_id))
+		return
+	}
+	if !ownsTask(c, tasks) {
+		abortWithError(c, http.StatusForbidden, CodeForbidden, fmt.Sprintf("%s may not release task id %s requested by %s", identityOf(c).Subject, task_id, tasks[0].Requester))
+		return
+	}
+	if status := taskStatus(tasks); !utils.TaskStatus(status).Final() {
+		abortWithError(c, http.StatusConflict, CodeConflict, fmt.Sprintf("task id %s is %s, cancel it instead", task_id, status))
+		return
+	}
+
+	if err := h.DBClient.Model(&db.Task{}).
+		Where("task_id = ? AND released_at IS NULL", task_id).
+		Update("ReleasedAt", time.Now()).Error; err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to release task id %s: %s", task_id, err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": fmt.Sprintf("success to release task id %s", task_id),
+		"task_id": task_id,
+	})
+}
+
+// steerTask applies action to the task of the id path param, by patching the spec of its RestoreTasks when it
+// has some, so the controller honours it, or through the worker otherwise
+func (h *Handler) steerTask(c *gin.Context, action string, patch func(spec *restorev1.RestoreTaskSpec), direct func(ctx context.Context, task_id string) error) {
+	task_id := c.Param("id")
+	tasks, err := db.QueryAll[db.Task](h.DBClient, "", 0, "task_id = ?", task_id)
+	if err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to get task id %s: %s", task_id, err.Error()))
+		return
+	}
+	if len(tasks) == 0 {
+		abortWithError(c, http.StatusNotFound, CodeNotFound, fmt.Sprintf("task id %s not found", task_id))
+		return
+	}
+	if !ownsTask(c, tasks) {
+		abortWithError(c, http.StatusForbidden, CodeForbidden, fmt.Sprintf("%s may not %s task id %s requested by %s", identityOf(c).Subject, action, task_id, tasks[0].Requester))
+		return
+	}
+	if status := taskStatus(tasks); utils.TaskStatus(status).Final() {
+		abortWithError(c, http.StatusConflict, CodeConflict, fmt.Sprintf("task id %s is %s, there is nothing to %s", task_id, status, action))
+		return
+	}
+
+	restore_tasks, err := h.restoreTasksOf(c.Request.Context(), task_id)
+	if err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to list RestoreTask of task id %s: %s", task_id, err.Error()))
+		return
+	}
+
+	if len(restore_tasks) > 0 {
+		for i := range restore_tasks {
+			restore_task := &restore_tasks[i]
+			original := restore_task.DeepCopy()
+			patch(&restore_task.Spec)
+			if err := h.K8Sclient.Patch(c.Request.Context(), restore_task, runtimeclient.MergeFrom(original)); err != nil {
+				c.Error(err)
+				abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to %s RestoreTask %s: %s", action, restore_task.Name, err.Error()))
+				return
+			}
+		}
+	} else if err := direct(c.Request.Context(), task_id); err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to %s task id %s: %s", action, task_id, err.Error()))
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"success_taskes": success_taskes,
+		"message": fmt.Sprintf("success to %s task id %s", action, task_id),
+		"task_id": task_id,
 	})
 }
 
-func RegisterHandler(e *gin.Engine, es_client *elastic.ES, db_client *gorm.DB, k8s_client *k8s.Client) error {
+// restoreTasksOf lists the RestoreTasks of the task task_id, none when kubernetes is disabled
+func (h *Handler) restoreTasksOf(ctx context.Context, task_id string) ([]restorev1.RestoreTask, error) {
+	if h.K8Sclient == nil {
+		return nil, nil
+	}
+
+	var list restorev1.RestoreTaskList
+	if err := h.K8Sclient.List(ctx, &list, runtimeclient.InNamespace(config.GlobalConfig.ES.Namespace)); err != nil {
+		return nil, err
+	}
+
+	var restore_tasks []restorev1.RestoreTask
+	for _, t := range list.Items {
+		if t.Spec.TaskId == task_id {
+			restore_tasks = append(restore_tasks, t)
+		}
+	}
+	return restore_tasks, nil
+}
+
+// bindOptionalJSON binds the json body into obj when there is one
+func (h *Handler) bindOptionalJSON(c *gin.Context, obj any) bool {
+	if c.Request.ContentLength == 0 {
+		return true
+	}
+
+	if err := c.ShouldBindJSON(obj); err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid post data: %s", err.Error()))
+		return false
+	}
+	return true
+}
+
+// GetBudget reports the usage and limit of the restore capacity budget, the cluster wide one under the empty team
+func (h *Handler) GetBudget(c *gin.Context) {
+	statuses, err := h.Budget.Statuses()
+	if err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to get the restore capacity budget: %s", err.Error()))
+		return
+	}
+
+	teams := make(map[string]budget.Status, len(statuses))
+	for team, status := range statuses {
+		if team != "" {
+			teams[team] = status
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"enabled": config.GlobalConfig.Budget.Enabled,
+		"cluster": statuses[""],
+		"teams":   teams,
+	})
+}
+
+type HandlerParams struct {
+	fx.In
+
+	Engine      *gin.Engine
+	ES          *elastic.ES
+	DB          *gorm.DB
+	Provisioner provisioner.Provisioner
+	Worker      *worker.Worker
+	Pool        *pool.Pool
+	Budget      *budget.Budget
+	Preflight   *preflight.Checker
+	Events      *cache.Broker
+	Auth        *auth.Authenticator
+	Policy      *policy.Engine
+	Approvals   *approval.Approvals
+	Notifier    *notify.Notifier
+	Auditor     *audit.Auditor
+	// K8SClient is only provided when kube.enabled is set
+	K8SClient *k8s.Client `optional:"true"`
+}
+
+func RegisterHandler(p HandlerParams) error {
 	handler := &Handler{
-		ESClient:  es_client,
-		DBClient:  db_client,
-		K8Sclient: k8s_client,
+		ESClient:    p.ES,
+		DBClient:    p.DB,
+		Provisioner: p.Provisioner,
+		Worker:      p.Worker,
+		Pool:        p.Pool,
+		Budget:      p.Budget,
+		Preflight:   p.Preflight,
+		Events:      p.Events,
+		Auth:        p.Auth,
+		Policy:      p.Policy,
+		Approvals:   p.Approvals,
+		Notifier:    p.Notifier,
+		Auditor:     p.Auditor,
+	}
+	if p.K8SClient != nil {
+		handler.K8Sclient = p.K8SClient
 	}
 
 	restore_snaphost_handler := &RestoreSnapshotHandler{Handler: handler}
 
-	e.GET("/indices", handler.QueryIndex)
-	e.POST("/restore", restore_snaphost_handler.RestoreSnapshot)
-	e.PUT("/task", handler.NewTask)
-	e.PUT("/node", handler.CreateRestoreNode)
-	e.DELETE("/node", handler.DeleteRestoreNode)
-	e.GET("/debug", handler.DebugHandler)
-	return nil
+	doc, err := loadOpenAPI()
+	if err != nil {
+		return err
+	}
+
+	e := p.Engine
+	validate := validateRequest(doc)
+	audited := handler.audit(doc)
+	v1 := e.Group(apiPrefix)
+	v1.GET("/openapi.json", handler.authenticate, handler.OpenAPI)
+
+	// the mutating groups are audited before they authenticate, so the requests rejected with bad credentials are too
+	v1_viewer := v1.Group("", handler.authenticate, require(auth.RoleViewer), validate)
+	v1_viewer.GET("/indices", handler.QueryIndex)
+	v1_viewer.POST("/plans", restore_snaphost_handler.RestoreSnapshot)
+	v1_viewer.POST("/preflights", handler.RestorePreflight)
+	v1_viewer.GET("/tasks", handler.ListTasks)
+	v1_viewer.GET("/tasks/:id", handler.GetTask)
+	v1_viewer.GET("/tasks/:id/events", handler.TaskEvents)
+	v1_viewer.GET("/tasks/:id/ws", handler.TaskEventsWS)
+	v1_viewer.GET("/budget", handler.GetBudget)
+
+	// a requester restores the indices it is granted and steers its own tasks
+	v1_requester := v1.Group("", audited, handler.authenticate, require(auth.RoleRequester), validate)
+	v1_requester.POST("/restores", handler.idempotent, handler.RestoreSnapshotOneStep)
+	v1_requester.POST("/restore-tasks", handler.idempotent, handler.RestoreViaCR)
+	v1_requester.POST("/tasks", handler.idempotent, handler.NewTask)
+	v1_requester.POST("/tasks/batch", handler.idempotent, handler.RestoreViaWorker)
+	v1_requester.POST("/tasks/:id/cancel", handler.CancelTask)
+	v1_requester.POST("/tasks/:id/pause", handler.PauseTask)
+	v1_requester.POST("/tasks/:id/resume", handler.ResumeTask)
+	v1_requester.POST("/tasks/:id/release", handler.ReleaseTask)
+	v1_requester.GET("/subscription", handler.GetSubscription)
+	v1_requester.PUT("/subscription", handler.PutSubscription)
+
+	// an operator approves the restores a policy rule requires an approval for
+	v1_operator := v1.Group("", audited, handler.authenticate, require(auth.RoleOperator), validate)
+	v1_operator.POST("/tasks/:id/approve", handler.ApproveTask)
+	v1_operator.POST("/tasks/:id/reject", handler.RejectTask)
+	v1_operator.POST("/nodes", handler.idempotent, handler.CreateRestoreNode)
+	v1_operator.DELETE("/nodes/:name", handler.DeleteRestoreNode)
+
+	// an admin reads the audit log of the mutating requests above and of the actions of the controller and cron
+	v1_admin := v1.Group("", handler.authenticate, require(auth.RoleAdmin), validate)
+	v1_admin.GET("/audit", handler.ListAudit)
+	v1_admin.GET("/audit/export", handler.ExportAudit)
+	v1_admin.GET("/audit/verify", handler.VerifyAudit)
+
+	// the unversioned routes of the api before v1 are kept for the existing clients until they move to v1, the
+	// routes added since are only served under apiPrefix
+	legacy := e.Group("")
+
+	viewer := legacy.Group("", handler.authenticate, require(auth.RoleViewer))
+	viewer.GET("/indices", deprecated(apiPrefix+"/indices"), handler.QueryIndex)
+	viewer.POST("/restore", deprecated(apiPrefix+"/plans"), restore_snaphost_handler.RestoreSnapshot)
+
+	requester := legacy.Group("", audited, handler.authenticate, require(auth.RoleRequester))
+	requester.PUT("/task", deprecated(apiPrefix+"/tasks"), handler.idempotent, handler.NewTask)
+
+	operator := legacy.Group("", audited, handler.authenticate, require(auth.RoleOperator))
+	operator.PUT("/node", deprecated(apiPrefix+"/nodes"), handler.idempotent, handler.CreateRestoreNode)
+	operator.DELETE("/node", deprecated(apiPrefix+"/nodes/:name"), handler.DeleteRestoreNode)
+
+	return checkRoutes(e.Routes(), doc)
 }
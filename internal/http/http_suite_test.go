@@ -0,0 +1,32 @@
+package http
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+)
+
+func TestHttp(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	gin.SetMode(gin.TestMode)
+	RunSpecs(t, "Http Suite")
+}
+
+// newTestDB opens a sqlite db of the tasks and idempotency keys, removed after the spec
+func newTestDB() *gorm.DB {
+	db_client, err := gorm.Open(sqlite.Open(filepath.Join(GinkgoT().TempDir(), "http.db")), &gorm.Config{
+		Logger: logger.Discard,
+	})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(db_client.AutoMigrate(&db.Task{}, &db.IdempotencyKey{})).To(Succeed())
+	return db_client
+}
@@ -0,0 +1,168 @@
+package http
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	HeaderIdempotencyKey = "Idempotency-Key"
+	// HeaderReplayed marks a response replayed to the retry of a request
+	HeaderReplayed = "Idempotent-Replayed"
+
+	idempotencyProcessing = "PROCESSING"
+	idempotencyCompleted  = "COMPLETED"
+	// processingTimeout is how long a request holds its key, a key held longer was left by a stopped instance
+	processingTimeout = 5 * time.Minute
+	// committedKey is the gin context key set once a request had side effects, a retry mustn't repeat them
+	committedKey = "idempotency_committed"
+)
+
+// commit marks the request as having had side effects, its response is kept whatever its status
+func commit(c *gin.Context) {
+	c.Set(committedKey, true)
+}
+
+// responseRecorder keeps a copy of the response body written to the client
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *responseRecorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
+
+// idempotent replies to the retries of a request sent with an Idempotency-Key header with the response of the
+// first one for idempotency.retention minutes. The key is scoped to the caller, reusing it for another request is
+// rejected and so is a retry while the first request is processed. A response the request may be retried after,
+// a server error or an exhausted budget, isn't kept unless the request was committed.
+func (h *Handler) idempotent(c *gin.Context) {
+	key := c.GetHeader(HeaderIdempotencyKey)
+	if key == "" {
+		c.Next()
+		return
+	}
+	if len(key) > 255 {
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("%s is longer than 255 characters", HeaderIdempotencyKey))
+		return
+	}
+
+	var body []byte
+	if c.Request.Body != nil {
+		body, _ = io.ReadAll(c.Request.Body)
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	route := fmt.Sprintf("%s %s", c.Request.Method, c.FullPath())
+	request_hash := requestHash(route, body)
+
+	record := db.IdempotencyKey{
+		Key:         key,
+		Caller:      identityOf(c).Subject,
+		Route:       route,
+		RequestHash: request_hash,
+		Status:      idempotencyProcessing,
+		ExpiresAt:   time.Now().Add(time.Duration(config.GlobalConfig.Idempotency.Retention) * time.Minute),
+	}
+	held, err := h.holdKey(&record)
+	if err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to record %s %s: %s", HeaderIdempotencyKey, key, err.Error()))
+		return
+	}
+	if !held {
+		replay(c, record, request_hash)
+		return
+	}
+
+	recorder := &responseRecorder{ResponseWriter: c.Writer}
+	c.Writer = recorder
+	c.Next()
+
+	status := recorder.Status()
+	if !c.GetBool(committedKey) && (status >= http.StatusInternalServerError || status == http.StatusTooManyRequests) {
+		if err := h.DBClient.Unscoped().Delete(&db.IdempotencyKey{}, record.ID).Error; err != nil {
+			log.Error().Err(err).Msgf("failed to release %s %s", HeaderIdempotencyKey, key)
+		}
+		return
+	}
+	if err := h.DBClient.Model(&db.IdempotencyKey{}).Where("id = ?", record.ID).Updates(map[string]any{
+		"Status":         idempotencyCompleted,
+		"ResponseStatus": status,
+		"ResponseBody":   utils.PtrToAny(recorder.body.String()),
+		"ContentType":    recorder.Header().Get("Content-Type"),
+	}).Error; err != nil {
+		log.Error().Err(err).Msgf("failed to record the response of %s %s", HeaderIdempotencyKey, key)
+	}
+}
+
+// holdKey records the key of record for its request, it returns false with the record of the key when another
+// request holds it. An expired key, or one held by a request which never completed, is taken over.
+func (h *Handler) holdKey(record *db.IdempotencyKey) (bool, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		held, err := db.CreateRecordOnce(h.DBClient, record)
+		if err != nil || held {
+			return held, err
+		}
+
+		existing, err := db.QueryAll[db.IdempotencyKey](h.DBClient, "", 1, "`key` = ? AND caller = ?", record.Key, record.Caller)
+		if err != nil {
+			return false, err
+		}
+		if len(existing) == 0 {
+			continue
+		}
+		abandoned := existing[0].Status == idempotencyProcessing && time.Since(existing[0].UpdatedAt) > processingTimeout
+		if time.Now().Before(existing[0].ExpiresAt) && !abandoned {
+			*record = existing[0]
+			return false, nil
+		}
+		if err := h.DBClient.Unscoped().Where("id = ? AND updated_at = ?", existing[0].ID, existing[0].UpdatedAt).
+			Delete(&db.IdempotencyKey{}).Error; err != nil {
+			return false, err
+		}
+	}
+	return false, fmt.Errorf("%s %s is taken over by another request", HeaderIdempotencyKey, record.Key)
+}
+
+// requestHash is the sha256 of the route and the body of a request
+func requestHash(route string, body []byte) string {
+	sum := sha256.Sum256(append([]byte(route+"\n"), body...))
+	return hex.EncodeToString(sum[:])
+}
+
+// replay replies with the response of the request holding the key of record, when it is the same request as the
+// one of request_hash
+func replay(c *gin.Context, record db.IdempotencyKey, request_hash string) {
+	if record.RequestHash != request_hash {
+		abortWithError(c, http.StatusUnprocessableEntity, CodeKeyReused,
+			fmt.Sprintf("%s %s was used for another request to %s, use a new key for a new request", HeaderIdempotencyKey, record.Key, record.Route))
+		return
+	}
+	if record.Status != idempotencyCompleted {
+		c.Header("Retry-After", "1")
+		abortWithError(c, http.StatusConflict, CodeConflict, fmt.Sprintf("the request with %s %s is still processed, retry later", HeaderIdempotencyKey, record.Key))
+		return
+	}
+
+	c.Header(HeaderReplayed, "true")
+	c.Data(record.ResponseStatus, record.ContentType, []byte(utils.StringValue(record.ResponseBody)))
+	c.Abort()
+}
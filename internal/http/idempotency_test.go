@@ -0,0 +1,167 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gorm.io/gorm"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/404LifeFound/es-snapshot-restore/internal/auth"
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+)
+
+// idempotentCall is a request to the idempotent route and the response its handler replies with
+type idempotentCall struct {
+	Subject string
+	Key     string
+	Body    string
+	Status  int
+	Commit  bool
+}
+
+var _ = Describe("idempotent", func() {
+	var h *Handler
+	var engine *gin.Engine
+	var calls int
+	var reply idempotentCall
+
+	BeforeEach(func() {
+		saved := config.GlobalConfig
+		DeferCleanup(func() { config.GlobalConfig = saved })
+		config.GlobalConfig.Idempotency.Retention = 60
+
+		h = &Handler{DBClient: newTestDB()}
+		calls = 0
+		engine = gin.New()
+		engine.POST("/api/v1/restore",
+			func(c *gin.Context) {
+				c.Set(identityKey, &auth.Identity{Subject: c.GetHeader("X-Subject")})
+			},
+			h.idempotent,
+			func(c *gin.Context) {
+				calls++
+				if reply.Commit {
+					commit(c)
+				}
+				c.JSON(reply.Status, gin.H{"calls": calls})
+			},
+		)
+	})
+
+	send := func(call idempotentCall) *httptest.ResponseRecorder {
+		reply = call
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/restore", strings.NewReader(call.Body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("X-Subject", call.Subject)
+		if call.Key != "" {
+			r.Header.Set(HeaderIdempotencyKey, call.Key)
+		}
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, r)
+		return w
+	}
+
+	DescribeTable("replies to a retry",
+		func(first idempotentCall, tamper func(db_client *gorm.DB), retry idempotentCall, status int, replayed bool, expected_calls int, code ErrorCode) {
+			w := send(first)
+			Expect(w.Code).To(Equal(first.Status))
+			first_body := w.Body.String()
+
+			tamper(h.DBClient)
+
+			w = send(retry)
+			Expect(w.Code).To(Equal(status))
+			Expect(calls).To(Equal(expected_calls))
+			if replayed {
+				Expect(w.Header().Get(HeaderReplayed)).To(Equal("true"))
+				Expect(w.Body.String()).To(Equal(first_body))
+			} else {
+				Expect(w.Header().Get(HeaderReplayed)).To(BeEmpty())
+			}
+			if code != "" {
+				var res struct {
+					Error APIError `json:"error"`
+				}
+				Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+				Expect(res.Error.Code).To(Equal(code))
+			}
+		},
+		Entry("with the response of the request",
+			idempotentCall{Subject: "alice", Key: "k1", Body: `{"name":["logs-*"]}`, Status: http.StatusOK},
+			func(*gorm.DB) {},
+			idempotentCall{Subject: "alice", Key: "k1", Body: `{"name":["logs-*"]}`, Status: http.StatusOK},
+			http.StatusOK, true, 1, ErrorCode("")),
+		Entry("with the response of a request it may not be retried after",
+			idempotentCall{Subject: "alice", Key: "k1", Body: `{"name":["logs-*"]}`, Status: http.StatusBadRequest},
+			func(*gorm.DB) {},
+			idempotentCall{Subject: "alice", Key: "k1", Body: `{"name":["logs-*"]}`, Status: http.StatusOK},
+			http.StatusBadRequest, true, 1, ErrorCode("")),
+		Entry("with the response of a committed request failing with a server error",
+			idempotentCall{Subject: "alice", Key: "k1", Body: `{"name":["logs-*"]}`, Status: http.StatusInternalServerError, Commit: true},
+			func(*gorm.DB) {},
+			idempotentCall{Subject: "alice", Key: "k1", Body: `{"name":["logs-*"]}`, Status: http.StatusOK},
+			http.StatusInternalServerError, true, 1, ErrorCode("")),
+		Entry("processing it again after a server error",
+			idempotentCall{Subject: "alice", Key: "k1", Body: `{"name":["logs-*"]}`, Status: http.StatusInternalServerError},
+			func(*gorm.DB) {},
+			idempotentCall{Subject: "alice", Key: "k1", Body: `{"name":["logs-*"]}`, Status: http.StatusOK},
+			http.StatusOK, false, 2, ErrorCode("")),
+		Entry("processing it again after an exhausted budget",
+			idempotentCall{Subject: "alice", Key: "k1", Body: `{"name":["logs-*"]}`, Status: http.StatusTooManyRequests},
+			func(*gorm.DB) {},
+			idempotentCall{Subject: "alice", Key: "k1", Body: `{"name":["logs-*"]}`, Status: http.StatusOK},
+			http.StatusOK, false, 2, ErrorCode("")),
+		Entry("rejecting the key reused for another request",
+			idempotentCall{Subject: "alice", Key: "k1", Body: `{"name":["logs-*"]}`, Status: http.StatusOK},
+			func(*gorm.DB) {},
+			idempotentCall{Subject: "alice", Key: "k1", Body: `{"name":["prod-*"]}`, Status: http.StatusOK},
+			http.StatusUnprocessableEntity, false, 1, CodeKeyReused),
+		Entry("rejecting it while the request is processed",
+			idempotentCall{Subject: "alice", Key: "k1", Body: `{"name":["logs-*"]}`, Status: http.StatusOK},
+			func(db_client *gorm.DB) {
+				Expect(db_client.Model(&db.IdempotencyKey{}).Where("`key` = ?", "k1").Update("status", idempotencyProcessing).Error).To(Succeed())
+			},
+			idempotentCall{Subject: "alice", Key: "k1", Body: `{"name":["logs-*"]}`, Status: http.StatusOK},
+			http.StatusConflict, false, 1, CodeConflict),
+		Entry("processing it again once the request was abandoned",
+			idempotentCall{Subject: "alice", Key: "k1", Body: `{"name":["logs-*"]}`, Status: http.StatusOK},
+			func(db_client *gorm.DB) {
+				Expect(db_client.Model(&db.IdempotencyKey{}).Where("`key` = ?", "k1").UpdateColumns(map[string]any{
+					"status":     idempotencyProcessing,
+					"updated_at": time.Now().Add(-processingTimeout - time.Minute),
+				}).Error).To(Succeed())
+			},
+			idempotentCall{Subject: "alice", Key: "k1", Body: `{"name":["logs-*"]}`, Status: http.StatusOK},
+			http.StatusOK, false, 2, ErrorCode("")),
+		Entry("processing it again once the key expired",
+			idempotentCall{Subject: "alice", Key: "k1", Body: `{"name":["logs-*"]}`, Status: http.StatusOK},
+			func(db_client *gorm.DB) {
+				Expect(db_client.Model(&db.IdempotencyKey{}).Where("`key` = ?", "k1").Update("expires_at", time.Now().Add(-time.Minute)).Error).To(Succeed())
+			},
+			idempotentCall{Subject: "alice", Key: "k1", Body: `{"name":["logs-*"]}`, Status: http.StatusOK},
+			http.StatusOK, false, 2, ErrorCode("")),
+		Entry("processing the same key of another caller",
+			idempotentCall{Subject: "alice", Key: "k1", Body: `{"name":["logs-*"]}`, Status: http.StatusOK},
+			func(*gorm.DB) {},
+			idempotentCall{Subject: "bob", Key: "k1", Body: `{"name":["logs-*"]}`, Status: http.StatusOK},
+			http.StatusOK, false, 2, ErrorCode("")),
+		Entry("processing every request without key",
+			idempotentCall{Subject: "alice", Body: `{"name":["logs-*"]}`, Status: http.StatusOK},
+			func(*gorm.DB) {},
+			idempotentCall{Subject: "alice", Body: `{"name":["logs-*"]}`, Status: http.StatusOK},
+			http.StatusOK, false, 2, ErrorCode("")),
+	)
+
+	It("rejects a key longer than 255 characters", func() {
+		w := send(idempotentCall{Subject: "alice", Key: strings.Repeat("k", 256), Body: `{}`, Status: http.StatusOK})
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+		Expect(calls).To(BeZero())
+	})
+})
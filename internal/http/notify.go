@@ -0,0 +1,122 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/404LifeFound/es-snapshot-restore/internal/notify"
+	"github.com/gin-gonic/gin"
+)
+
+// SubscriptionView is which task events of its restores a requester is notified of and through which channels,
+// empty Events and Channels are all of them
+type SubscriptionView struct {
+	Requester string     `json:"requester"`
+	Events    []string   `json:"events"`
+	Channels  []string   `json:"channels"`
+	Email     string     `json:"email,omitempty"`
+	Muted     bool       `json:"muted"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+func newSubscriptionView(s db.Subscription) SubscriptionView {
+	view := SubscriptionView{
+		Requester: s.Requester,
+		Events:    []string{},
+		Channels:  []string{},
+		Email:     s.Email,
+		Muted:     s.Muted,
+	}
+	if len(s.Events) > 0 {
+		json.Unmarshal(s.Events, &view.Events)
+	}
+	if len(s.Channels) > 0 {
+		json.Unmarshal(s.Channels, &view.Channels)
+	}
+	if !s.UpdatedAt.IsZero() {
+		view.UpdatedAt = &s.UpdatedAt
+	}
+	return view
+}
+
+type SubscriptionRequest struct {
+	Events   []string `json:"events"`
+	Channels []string `json:"channels"`
+	Email    string   `json:"email" binding:"omitempty,email"`
+	Muted    bool     `json:"muted"`
+	// Requester is whose subscription it is when the caller is anonymous
+	Requester string `json:"requester"`
+}
+
+// GetSubscription returns the notification preferences of the caller, the requester query param when it is
+// anonymous
+func (h *Handler) GetSubscription(c *gin.Context) {
+	requester, _ := callerOf(c, c.Query("requester"), "")
+	if requester == "" {
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, "the requester is required, authenticate or set requester")
+		return
+	}
+
+	subscription, err := h.Notifier.Subscription(requester)
+	if err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to get subscription of %s: %s", requester, err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, newSubscriptionView(subscription))
+}
+
+// PutSubscription replaces the notification preferences of the caller
+func (h *Handler) PutSubscription(c *gin.Context) {
+	var r SubscriptionRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid post data: %s,can't bind post data to SubscriptionRequest", err.Error()))
+		return
+	}
+	requester, _ := callerOf(c, r.Requester, "")
+	if requester == "" {
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, "the requester is required, authenticate or set requester")
+		return
+	}
+
+	for _, event := range r.Events {
+		if !slices.Contains(notify.Events(), notify.Event(event)) {
+			abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("unknown event %s", event), gin.H{"events": notify.Events()})
+			return
+		}
+	}
+	for _, channel := range r.Channels {
+		if !h.Notifier.Channel(channel) {
+			abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("unknown notify channel %s", channel))
+			return
+		}
+	}
+
+	events, _ := json.Marshal(nonNil(r.Events))
+	channels, _ := json.Marshal(nonNil(r.Channels))
+	subscription, err := h.Notifier.Subscribe(db.Subscription{
+		Requester: requester,
+		Events:    events,
+		Channels:  channels,
+		Email:     r.Email,
+		Muted:     r.Muted,
+	})
+	if err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to save subscription of %s: %s", requester, err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, newSubscriptionView(subscription))
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
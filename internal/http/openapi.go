@@ -0,0 +1,145 @@
+package http
+
+import (
+	_ "embed"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/gin-gonic/gin"
+)
+
+// apiPrefix is the path the routes of the current api version are served under
+const apiPrefix = "/api/v1"
+
+// legacyRoutes are the unversioned routes of the api before v1, the only ones served outside apiPrefix
+var legacyRoutes = map[string]bool{
+	"GET /indices":  true,
+	"POST /restore": true,
+	"PUT /task":     true,
+	"PUT /node":     true,
+	"DELETE /node":  true,
+}
+
+//go:embed openapi.json
+var openapiSpec []byte
+
+// ginParam matches the params of a gin route, which the openapi document writes in braces
+var ginParam = regexp.MustCompile(`:(\w+)`)
+
+// loadOpenAPI loads and validates the embedded openapi document
+func loadOpenAPI() (*openapi3.T, error) {
+	// the validation errors reply with the failed constraint, not with the whole schema and value
+	openapi3.SchemaErrorDetailsDisabled = true
+
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData(openapiSpec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load openapi document: %w", err)
+	}
+	if err := doc.Validate(loader.Context); err != nil {
+		return nil, fmt.Errorf("invalid openapi document: %w", err)
+	}
+	return doc, nil
+}
+
+// specPath is the path of the openapi document of the gin route full_path
+func specPath(full_path string) string {
+	return ginParam.ReplaceAllString(strings.TrimPrefix(full_path, apiPrefix), "{$1}")
+}
+
+// OpenAPI replies with the openapi document of the api
+func (h *Handler) OpenAPI(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json", openapiSpec)
+}
+
+// validateRequest checks the params and the body of the requests against the operation of their route in doc, it
+// replies with invalid_request before the handler binds them
+func validateRequest(doc *openapi3.T) gin.HandlerFunc {
+	options := &openapi3filter.Options{AuthenticationFunc: openapi3filter.NoopAuthenticationFunc}
+	return func(c *gin.Context) {
+		path := specPath(c.FullPath())
+		path_item := doc.Paths.Find(path)
+		if path_item == nil {
+			c.Next()
+			return
+		}
+		operation := path_item.GetOperation(c.Request.Method)
+		if operation == nil {
+			c.Next()
+			return
+		}
+
+		path_params := make(map[string]string, len(c.Params))
+		for _, p := range c.Params {
+			path_params[p.Key] = p.Value
+		}
+		input := &openapi3filter.RequestValidationInput{
+			Request:    c.Request,
+			PathParams: path_params,
+			Route: &routers.Route{
+				Spec:      doc,
+				Path:      path,
+				PathItem:  path_item,
+				Method:    c.Request.Method,
+				Operation: operation,
+			},
+			Options: options,
+		}
+		if err := openapi3filter.ValidateRequest(c.Request.Context(), input); err != nil {
+			c.Error(err)
+			abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid request to %s %s: %s", c.Request.Method, path, err.Error()), gin.H{"operation": operation.OperationID})
+			return
+		}
+		c.Next()
+	}
+}
+
+// checkRoutes reports the routes of the current api version missing from doc, the operations of doc without a
+// route and the unversioned routes which aren't legacy ones, so the document can't drift from the api
+func checkRoutes(routes gin.RoutesInfo, doc *openapi3.T) error {
+	registered := make(map[string]bool)
+	var missing []string
+	for _, r := range routes {
+		if !strings.HasPrefix(r.Path, apiPrefix+"/") {
+			if !legacyRoutes[r.Method+" "+r.Path] {
+				missing = append(missing, fmt.Sprintf("%s %s is not served under %s", r.Method, r.Path, apiPrefix))
+			}
+			continue
+		}
+		path := specPath(r.Path)
+		registered[r.Method+" "+path] = true
+		if path_item := doc.Paths.Find(path); path_item == nil || path_item.GetOperation(r.Method) == nil {
+			missing = append(missing, fmt.Sprintf("%s %s is not documented", r.Method, r.Path))
+		}
+	}
+	for path, path_item := range doc.Paths.Map() {
+		for method := range path_item.Operations() {
+			if !registered[method+" "+path] {
+				missing = append(missing, fmt.Sprintf("%s %s%s has no route", method, apiPrefix, path))
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the openapi document doesn't match the routes: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// deprecated marks the replies of an unversioned route as deprecated, with a link to successor, the route of the
+// current api version whose :params are filled from the request
+func deprecated(successor string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		link := ginParam.ReplaceAllStringFunc(successor, func(param string) string {
+			return c.Param(param[1:])
+		})
+		c.Set(successorKey, successor)
+		c.Header("Deprecation", "true")
+		c.Header("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", link))
+		c.Next()
+	}
+}
@@ -0,0 +1,103 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/404LifeFound/es-snapshot-restore/internal/planner"
+	"github.com/404LifeFound/es-snapshot-restore/internal/policy"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// evaluatePolicy decides whether the caller may restore indices for team with the request
+func (h *Handler) evaluatePolicy(c *gin.Context, request any, team string, indices []string, size_gb float64, node_count int32, snapshots []policy.Snapshot) policy.Decision {
+	identity := identityOf(c)
+	return h.Policy.Evaluate(policy.Input{
+		Request: policy.RequestOf(request),
+		Identity: policy.Identity{
+			Subject: identity.Subject,
+			Role:    string(identity.Role),
+			Team:    team,
+		},
+		Indices:   indices,
+		SizeGB:    size_gb,
+		NodeCount: node_count,
+		Snapshots: snapshots,
+	})
+}
+
+// admitPolicy replies with the decision of the policy when it denies the restore, it reports whether the request
+// goes on. A restore requiring an approval goes on, its tasks await the approval.
+func admitPolicy(c *gin.Context, decision policy.Decision) bool {
+	if decision.Effect == policy.EffectDeny {
+		abortWithError(c, http.StatusForbidden, CodePolicyDenied, decision.Err().Error(), gin.H{"policy": decision})
+		return false
+	}
+	return true
+}
+
+// awaitingApproval is decision when it requires an approval of the restore, nil when the restore starts right away
+func awaitingApproval(decision policy.Decision) *policy.Decision {
+	if decision.Effect != policy.EffectRequireApproval {
+		return nil
+	}
+	return &decision
+}
+
+// policySnapshots are the snapshots of the indices of snapshots, keyed by index
+func policySnapshots(snapshots map[string]db.ESSnapshot) []policy.Snapshot {
+	result := make([]policy.Snapshot, 0, len(snapshots))
+	for index, s := range snapshots {
+		result = append(result, policy.Snapshot{
+			Index:      index,
+			Repository: s.Repository,
+			Snapshot:   s.Snapshot,
+			StartTime:  s.StartTime.Time,
+		})
+	}
+	return result
+}
+
+// taskSnapshots are the snapshots the tasks restore from, with the start time recorded by the snapshot sync
+func (h *Handler) taskSnapshots(tasks []RestoreViaCR) []policy.Snapshot {
+	result := make([]policy.Snapshot, 0, len(tasks))
+	for _, t := range tasks {
+		s := policy.Snapshot{Index: t.Index, Repository: t.Repository, Snapshot: t.Snapshot}
+		snapshots, err := db.QueryAll[db.ESSnapshot](h.DBClient, "", 1, "snapshot = ? AND repository = ?", t.Snapshot, t.Repository)
+		if err != nil {
+			log.Error().Err(err).Msgf("failed to get snapshot %s of repository %s", t.Snapshot, t.Repository)
+		} else if len(snapshots) == 1 {
+			s.StartTime = snapshots[0].StartTime.Time
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+// taskPlan plans the tasks from the sizes of their indices in the snapshots they restore from, like the plan of
+// RestoreSnapshotOneStep, so the policy doesn't rely on the store size the caller claims
+func (h *Handler) taskPlan(tasks []RestoreViaCR, replicas *int) planner.Plan {
+	names := taskIndices(tasks)
+	catalog, err := db.QueryAll[db.ESIndex](h.DBClient, "", 0, "name IN ?", names)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to query indices %v", names)
+	}
+	by_name := make(map[string]db.ESIndex, len(catalog))
+	for _, i := range catalog {
+		by_name[i.Name] = i
+	}
+
+	indices := make([]db.ESIndex, 0, len(tasks))
+	snapshots := make(map[string]db.ESSnapshot, len(tasks))
+	for _, t := range tasks {
+		i, ok := by_name[t.Index]
+		if !ok {
+			// the index isn't live anymore, it is sized from the snapshot only
+			i = db.ESIndex{Name: t.Index}
+		}
+		indices = append(indices, i)
+		snapshots[t.Index] = db.ESSnapshot{Snapshot: t.Snapshot, Repository: t.Repository}
+	}
+	return h.PlanIndices(indices, replicas, snapshots)
+}
@@ -2,8 +2,11 @@ package http
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net/http"
+	"os"
 
 	"github.com/404LifeFound/es-snapshot-restore/config"
 	"github.com/gin-contrib/logger"
@@ -12,7 +15,7 @@ import (
 	"go.uber.org/fx"
 )
 
-func NewGinEngine(lc fx.Lifecycle) *gin.Engine {
+func NewGinEngine(lc fx.Lifecycle) (*gin.Engine, error) {
 	if config.GlobalConfig.Http.ReleaseMode {
 		gin.SetMode(gin.ReleaseMode)
 	}
@@ -24,16 +27,42 @@ func NewGinEngine(lc fx.Lifecycle) *gin.Engine {
 		})),
 		gin.Recovery(),
 	)
+	// the client ip is recorded in the audit log, only the configured proxies may forward it
+	if err := e.SetTrustedProxies(config.GlobalConfig.Http.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid http trusted proxies %v: %w", config.GlobalConfig.Http.TrustedProxies, err)
+	}
 
 	srv := &http.Server{
 		Addr:    fmt.Sprintf("%s:%d", config.GlobalConfig.Http.Host, config.GlobalConfig.Http.Port),
 		Handler: e,
 	}
 
+	if config.GlobalConfig.Http.ClientCA != "" {
+		pem, err := os.ReadFile(config.GlobalConfig.Http.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client ca %s: %w", config.GlobalConfig.Http.ClientCA, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no cert found in client ca %s", config.GlobalConfig.Http.ClientCA)
+		}
+		// a client without cert may still authenticate with a bearer token
+		srv.TLSConfig = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: tls.VerifyClientCertIfGiven,
+		}
+	}
+
 	lc.Append(fx.Hook{
 		OnStart: func(context.Context) error {
 			go func() {
-				if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				var err error
+				if config.GlobalConfig.Http.TLSCert != "" {
+					err = srv.ListenAndServeTLS(config.GlobalConfig.Http.TLSCert, config.GlobalConfig.Http.TLSKey)
+				} else {
+					err = srv.ListenAndServe()
+				}
+				if err != nil && err != http.ErrServerClosed {
 					panic(err)
 				}
 			}()
@@ -43,5 +72,5 @@ func NewGinEngine(lc fx.Lifecycle) *gin.Engine {
 			return srv.Shutdown(ctx)
 		},
 	})
-	return e
+	return e, nil
 }
@@ -0,0 +1,355 @@
+package http
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultTaskLimit = 50
+	maxTaskLimit     = 500
+)
+
+// TaskAttemptView is one attempt to restore the index of a task
+type TaskAttemptView struct {
+	Attempt    int        `json:"attempt"`
+	Status     string     `json:"status"`
+	Error      *string    `json:"error,omitempty"`
+	Retryable  bool       `json:"retryable"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// TaskIndexView is the restore of one index of a task
+type TaskIndexView struct {
+	TaskID     string            `json:"task_id"`
+	Index      string            `json:"index"`
+	Repository string            `json:"repository"`
+	Snapshot   string            `json:"snapshot"`
+	Node       string            `json:"node"`
+	Status     string            `json:"status"`
+	Stage      *string           `json:"stage"`
+	Progress   float64           `json:"progress"`
+	Error      *string           `json:"error,omitempty"`
+	Requester  string            `json:"requester"`
+	Throttle   json.RawMessage   `json:"throttle,omitempty"`
+	Attempts   int               `json:"attempts"`
+	History    []TaskAttemptView `json:"history,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+	StartedAt  *time.Time        `json:"started_at"`
+	FinishedAt *time.Time        `json:"finished_at"`
+	Duration   string            `json:"duration,omitempty"`
+}
+
+// TaskView is a task with the restore of each of its indices
+type TaskView struct {
+	TaskID     string          `json:"task_id"`
+	Status     string          `json:"status"`
+	Progress   float64         `json:"progress"`
+	Requester  string          `json:"requester"`
+	Nodes      []string        `json:"nodes"`
+	Errors     []string        `json:"errors"`
+	StartedAt  *time.Time      `json:"started_at"`
+	FinishedAt *time.Time      `json:"finished_at"`
+	Duration   string          `json:"duration,omitempty"`
+	Indices    []TaskIndexView `json:"indices"`
+	// Approval is the approval the restore waits for, or the decision on it
+	Approval *ApprovalView `json:"approval,omitempty"`
+}
+
+func newTaskIndexView(t db.Task) TaskIndexView {
+	v := TaskIndexView{
+		TaskID:     t.TaskID,
+		Index:      t.Index,
+		Repository: t.Repository,
+		Snapshot:   t.Snapshot,
+		Node:       t.Node,
+		Status:     t.Status,
+		Stage:      t.CurrentStage,
+		Progress:   t.Progress,
+		Error:      t.ErrorMessage,
+		Requester:  t.Requester,
+		Attempts:   t.Attempts,
+		CreatedAt:  t.CreatedAt,
+		UpdatedAt:  t.UpdatedAt,
+		StartedAt:  t.StartedAt,
+		FinishedAt: t.FinishedAt,
+		Duration:   duration(t.StartedAt, t.FinishedAt),
+	}
+	if t.Throttle != nil {
+		v.Throttle = json.RawMessage(*t.Throttle)
+	}
+	return v
+}
+
+// duration is the time from started to finished, or to now while it runs
+func duration(started, finished *time.Time) string {
+	if started == nil {
+		return ""
+	}
+	end := time.Now()
+	if finished != nil {
+		end = *finished
+	}
+	return end.Sub(*started).Round(time.Second).String()
+}
+
+// taskStatus is the status of a task from the one of its indices, an unfinished index keeps it active and a
+// finished one reports the worst result
+func taskStatus(tasks []db.Task) string {
+	counts := make(map[string]int)
+	for _, t := range tasks {
+		counts[t.Status]++
+	}
+	for _, status := range []utils.TaskStatus{
+		utils.TaskRunning,
+		utils.TaskPaused,
+		utils.TaskQueued,
+		utils.TaskAwaitingApproval,
+		utils.TaskPending,
+		utils.TaskFailed,
+		utils.TaskTimeout,
+		utils.TaskCanceled,
+		utils.TaskSuccess,
+	} {
+		if counts[string(status)] > 0 {
+			return string(status)
+		}
+	}
+	return string(utils.TaskPending)
+}
+
+// GetTask reports the status, progress, errors and timings of the task of the id path param and of each of its
+// indices, with the attempts to restore them
+func (h *Handler) GetTask(c *gin.Context) {
+	task_id := c.Param("id")
+	tasks, err := db.QueryAll[db.Task](h.DBClient, "id", 0, "task_id = ?", task_id)
+	if err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to get task id %s: %s", task_id, err.Error()))
+		return
+	}
+	if len(tasks) == 0 {
+		abortWithError(c, http.StatusNotFound, CodeNotFound, fmt.Sprintf("task id %s not found", task_id))
+		return
+	}
+
+	attempts, err := db.QueryAll[db.TaskAttempt](h.DBClient, "attempt", 0, "task_id = ?", task_id)
+	if err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to get attempts of task id %s: %s", task_id, err.Error()))
+		return
+	}
+	history := make(map[string][]TaskAttemptView)
+	for _, a := range attempts {
+		history[a.Index] = append(history[a.Index], TaskAttemptView{
+			Attempt:    a.Attempt,
+			Status:     a.Status,
+			Error:      a.ErrorMessage,
+			Retryable:  a.Retryable,
+			StartedAt:  a.StartedAt,
+			FinishedAt: a.FinishedAt,
+		})
+	}
+
+	view := TaskView{
+		TaskID:  task_id,
+		Status:  taskStatus(tasks),
+		Nodes:   []string{},
+		Errors:  []string{},
+		Indices: make([]TaskIndexView, 0, len(tasks)),
+	}
+	finished := true
+	seen := make(map[string]bool)
+	for _, t := range tasks {
+		index_view := newTaskIndexView(t)
+		index_view.History = history[t.Index]
+		view.Indices = append(view.Indices, index_view)
+
+		view.Progress += t.Progress / float64(len(tasks))
+		if view.Requester == "" {
+			view.Requester = t.Requester
+		}
+		if t.Node != "" && !seen[t.Node] {
+			seen[t.Node] = true
+			view.Nodes = append(view.Nodes, t.Node)
+		}
+		if t.ErrorMessage != nil {
+			view.Errors = append(view.Errors, fmt.Sprintf("%s: %s", t.Index, *t.ErrorMessage))
+		}
+		if t.StartedAt != nil && (view.StartedAt == nil || t.StartedAt.Before(*view.StartedAt)) {
+			view.StartedAt = t.StartedAt
+		}
+		if t.FinishedAt == nil {
+			finished = false
+		} else if view.FinishedAt == nil || t.FinishedAt.After(*view.FinishedAt) {
+			view.FinishedAt = t.FinishedAt
+		}
+	}
+	if !finished {
+		view.FinishedAt = nil
+	}
+	view.Duration = duration(view.StartedAt, view.FinishedAt)
+
+	approvals, err := db.QueryAll[db.Approval](h.DBClient, "", 1, "task_id = ?", task_id)
+	if err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to get approval of task id %s: %s", task_id, err.Error()))
+		return
+	}
+	if len(approvals) == 1 {
+		view.Approval = utils.PtrToAny(newApprovalView(approvals[0]))
+	}
+
+	c.JSON(http.StatusOK, view)
+}
+
+type ListTasksParam struct {
+	Status    []string `form:"status"`
+	Requester string   `form:"requester"`
+	// Index is an index name, * matches any characters
+	Index  string `form:"index"`
+	TaskID string `form:"task_id"`
+	Since  string `form:"since"`
+	Until  string `form:"until"`
+	Sort   string `form:"sort" binding:"omitempty,oneof=created_at updated_at"`
+	Order  string `form:"order" binding:"omitempty,oneof=asc desc"`
+	Limit  int    `form:"limit" binding:"min=0"`
+	Cursor string `form:"cursor"`
+}
+
+// taskCursor is the position after the last listed task record, in the sort order of the listing
+type taskCursor struct {
+	Value time.Time `json:"v"`
+	ID    uint      `json:"id"`
+}
+
+func (c taskCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeTaskCursor(s string) (taskCursor, error) {
+	var c taskCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(b, &c)
+	return c, err
+}
+
+// ListTasks lists the task records, one per index of a task, matching the filters. The time range applies to
+// their creation, the sort defaults to the newest first and next_cursor fetches the following page.
+func (h *Handler) ListTasks(c *gin.Context) {
+	var p ListTasksParam
+	if err := c.ShouldBindQuery(&p); err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("failed to bind query param to ListTasksParam: %s", err.Error()))
+		return
+	}
+
+	if p.Sort == "" {
+		p.Sort = "created_at"
+	}
+	if p.Order == "" {
+		p.Order = "desc"
+	}
+	if p.Limit == 0 {
+		p.Limit = defaultTaskLimit
+	}
+	p.Limit = min(p.Limit, maxTaskLimit)
+
+	tx := h.DBClient.Model(&db.Task{})
+
+	var statuses []string
+	for _, s := range p.Status {
+		for _, status := range strings.Split(s, ",") {
+			if status = strings.TrimSpace(status); status != "" {
+				statuses = append(statuses, strings.ToUpper(status))
+			}
+		}
+	}
+	if len(statuses) > 0 {
+		tx = tx.Where("status IN ?", statuses)
+	}
+	if p.Requester != "" {
+		tx = tx.Where("requester = ?", p.Requester)
+	}
+	if p.TaskID != "" {
+		tx = tx.Where("task_id = ?", p.TaskID)
+	}
+	if p.Index != "" {
+		if strings.Contains(p.Index, "*") {
+			tx = tx.Where("`index` LIKE ?", strings.ReplaceAll(p.Index, "*", "%"))
+		} else {
+			tx = tx.Where("`index` = ?", p.Index)
+		}
+	}
+	for _, bound := range []struct {
+		value string
+		op    string
+	}{{p.Since, ">="}, {p.Until, "<"}} {
+		if bound.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, bound.value)
+		if err != nil {
+			c.Error(err)
+			abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid time %s, please use RFC3339: %s", bound.value, err.Error()))
+			return
+		}
+		tx = tx.Where(fmt.Sprintf("created_at %s ?", bound.op), t)
+	}
+
+	op := "<"
+	if p.Order == "asc" {
+		op = ">"
+	}
+	if p.Cursor != "" {
+		cursor, err := decodeTaskCursor(p.Cursor)
+		if err != nil {
+			c.Error(err)
+			abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid cursor %s: %s", p.Cursor, err.Error()))
+			return
+		}
+		tx = tx.Where(fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?))", p.Sort, op), cursor.Value, cursor.Value, cursor.ID)
+	}
+
+	var tasks []db.Task
+	if err := tx.Order(fmt.Sprintf("%[1]s %[2]s, id %[2]s", p.Sort, p.Order)).Limit(p.Limit + 1).Find(&tasks).Error; err != nil {
+		c.Error(err)
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("failed to list tasks: %s", err.Error()))
+		return
+	}
+
+	var next_cursor string
+	if len(tasks) > p.Limit {
+		tasks = tasks[:p.Limit]
+		last := tasks[len(tasks)-1]
+		cursor := taskCursor{Value: last.CreatedAt, ID: last.ID}
+		if p.Sort == "updated_at" {
+			cursor.Value = last.UpdatedAt
+		}
+		next_cursor = cursor.encode()
+	}
+
+	items := make([]TaskIndexView, 0, len(tasks))
+	for _, t := range tasks {
+		items = append(items, newTaskIndexView(t))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"items":       items,
+		"next_cursor": next_cursor,
+	})
+}
@@ -0,0 +1,124 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gorm.io/gorm"
+
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
+)
+
+// taskList is the body of a task listing
+type taskList struct {
+	Items      []TaskIndexView `json:"items"`
+	NextCursor string          `json:"next_cursor"`
+}
+
+var _ = Describe("ListTasks", func() {
+	var engine *gin.Engine
+	var created time.Time
+
+	BeforeEach(func() {
+		h := &Handler{DBClient: newTestDB()}
+		engine = gin.New()
+		engine.GET("/api/v1/tasks", h.ListTasks)
+
+		// logs-2 and logs-3 are created at once, their order is the one of their id
+		created = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+		tasks := []db.Task{
+			{Model: gorm.Model{CreatedAt: created}, TaskID: "a", Index: "logs-0", Status: string(utils.TaskSuccess), Requester: "alice"},
+			{Model: gorm.Model{CreatedAt: created.Add(time.Hour)}, TaskID: "a", Index: "logs-1", Status: string(utils.TaskFailed), Requester: "alice"},
+			{Model: gorm.Model{CreatedAt: created.Add(2 * time.Hour)}, TaskID: "b", Index: "logs-2", Status: string(utils.TaskRunning), Requester: "bob"},
+			{Model: gorm.Model{CreatedAt: created.Add(2 * time.Hour)}, TaskID: "b", Index: "logs-3", Status: string(utils.TaskQueued), Requester: "bob"},
+			{Model: gorm.Model{CreatedAt: created.Add(3 * time.Hour)}, TaskID: "c", Index: "metrics-4", Status: string(utils.TaskSuccess), Requester: "bob"},
+		}
+		Expect(db.CreateRecords(h.DBClient, &tasks)).To(Succeed())
+	})
+
+	list := func(query url.Values) (int, taskList) {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/tasks?"+query.Encode(), nil))
+		var body taskList
+		if w.Code == http.StatusOK {
+			Expect(json.Unmarshal(w.Body.Bytes(), &body)).To(Succeed())
+		}
+		return w.Code, body
+	}
+
+	indices := func(items []TaskIndexView) []string {
+		var indices []string
+		for _, i := range items {
+			indices = append(indices, i.Index)
+		}
+		return indices
+	}
+
+	DescribeTable("pages through the tasks",
+		func(order string, limit string, expected [][]string) {
+			query := url.Values{"limit": {limit}}
+			if order != "" {
+				query.Set("order", order)
+			}
+
+			var pages [][]string
+			for range 10 {
+				code, body := list(query)
+				Expect(code).To(Equal(http.StatusOK))
+				pages = append(pages, indices(body.Items))
+				if body.NextCursor == "" {
+					break
+				}
+				query.Set("cursor", body.NextCursor)
+			}
+			Expect(pages).To(Equal(expected))
+		},
+		Entry("newest first by default", "", "2", [][]string{{"metrics-4", "logs-3"}, {"logs-2", "logs-1"}, {"logs-0"}}),
+		Entry("oldest first", "asc", "2", [][]string{{"logs-0", "logs-1"}, {"logs-2", "logs-3"}, {"metrics-4"}}),
+		Entry("in a page of tasks created at once", "asc", "3", [][]string{{"logs-0", "logs-1", "logs-2"}, {"logs-3", "metrics-4"}}),
+		Entry("without a cursor after the last page", "desc", "5", [][]string{{"metrics-4", "logs-3", "logs-2", "logs-1", "logs-0"}}),
+	)
+
+	DescribeTable("filters the tasks",
+		func(query url.Values, expected []string) {
+			query.Set("order", "asc")
+			code, body := list(query)
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(indices(body.Items)).To(Equal(expected))
+		},
+		Entry("by status", url.Values{"status": {"success"}}, []string{"logs-0", "metrics-4"}),
+		Entry("by comma separated statuses", url.Values{"status": {"running,queued"}}, []string{"logs-2", "logs-3"}),
+		Entry("by repeated statuses", url.Values{"status": {"failed", "queued"}}, []string{"logs-1", "logs-3"}),
+		Entry("by requester", url.Values{"requester": {"alice"}}, []string{"logs-0", "logs-1"}),
+		Entry("by task id", url.Values{"task_id": {"b"}}, []string{"logs-2", "logs-3"}),
+		Entry("by index", url.Values{"index": {"logs-1"}}, []string{"logs-1"}),
+		Entry("by index pattern", url.Values{"index": {"metrics*"}}, []string{"metrics-4"}),
+		Entry("by creation time", url.Values{"since": {"2026-01-01T01:00:00Z"}, "until": {"2026-01-01T03:00:00Z"}}, []string{"logs-1", "logs-2", "logs-3"}),
+	)
+
+	It("sorts by update time", func() {
+		code, body := list(url.Values{"sort": {"updated_at"}, "limit": {"1"}})
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(body.Items).To(HaveLen(1))
+		Expect(body.NextCursor).NotTo(BeEmpty())
+	})
+
+	DescribeTable("rejects",
+		func(query url.Values) {
+			code, _ := list(query)
+			Expect(code).To(Equal(http.StatusBadRequest))
+		},
+		Entry("an unknown sort", url.Values{"sort": {"index"}}),
+		Entry("an unknown order", url.Values{"order": {"up"}}),
+		Entry("a negative limit", url.Values{"limit": {"-1"}}),
+		Entry("a time which isn't RFC3339", url.Values{"since": {"yesterday"}}),
+		Entry("a cursor it didn't encode", url.Values{"cursor": {"!"}}),
+	)
+})
@@ -1,17 +1,12 @@
 package http
 
 import (
-	"context"
 	"fmt"
 	"strings"
 
-	"github.com/404LifeFound/es-snapshot-restore/config"
 	"github.com/404LifeFound/es-snapshot-restore/internal/db"
-	"github.com/404LifeFound/es-snapshot-restore/internal/k8s"
-	elasticsearchv1 "github.com/elastic/cloud-on-k8s/v3/pkg/apis/elasticsearch/v1"
+	"github.com/404LifeFound/es-snapshot-restore/internal/planner"
 	"github.com/rs/zerolog/log"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	runtimeclient "sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 func (h *Handler) QueryIndexResultViaTime(name []string, startAt, endAt string) ([]db.ESIndex, error) {
@@ -145,9 +140,75 @@ func (h *Handler) QueryIndexResultViaTime(name []string, startAt, endAt string)
 		}
 	}
 
+	snapshot_only, err := h.querySnapshotOnlyIndices(name, startAt, endAt, all_result)
+	if err != nil {
+		return nil, err
+	}
+	all_result = append(all_result, snapshot_only...)
+
 	return all_result, err
 }
 
+// querySnapshotOnlyIndices returns the indices matching name which are only in the snapshot catalog, like the ones
+// ILM deleted, with a successful snapshot started between startAt and endAt. The snapshot sizes them, live is the
+// result of the index catalog.
+func (h *Handler) querySnapshotOnlyIndices(name []string, startAt, endAt string, live []db.ESIndex) ([]db.ESIndex, error) {
+	snapshot_conds := []string{"state = 'SUCCESS'"}
+	var snapshot_param []any
+	if startAt != "" {
+		snapshot_conds = append(snapshot_conds, "start_time >= ?")
+		snapshot_param = append(snapshot_param, startAt)
+	}
+	if endAt != "" {
+		snapshot_conds = append(snapshot_conds, "start_time <= ?")
+		snapshot_param = append(snapshot_param, endAt)
+	}
+	snapshots, err := db.QueryAll[db.ESSnapshot](h.DBClient, "", 0, append([]any{strings.Join(snapshot_conds, " AND ")}, snapshot_param...)...)
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		return nil, nil
+	}
+	snapshot_names := make([]string, 0, len(snapshots))
+	for _, s := range snapshots {
+		snapshot_names = append(snapshot_names, s.Snapshot)
+	}
+
+	var name_conds []string
+	param := []any{snapshot_names}
+	for _, n := range name {
+		name_conds = append(name_conds, "index_name LIKE ?")
+		param = append(param, fmt.Sprintf("%%%s%%", n))
+	}
+	snapshot_indices, err := db.QueryAll[db.ESSnapshotIndex](
+		h.DBClient,
+		"index_name",
+		0,
+		append([]any{fmt.Sprintf("snapshot IN ? AND (%s)", strings.Join(name_conds, " OR "))}, param...)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool, len(live))
+	for _, i := range live {
+		known[i.Name] = true
+	}
+	var result []db.ESIndex
+	for _, i := range snapshot_indices {
+		if known[i.IndexName] {
+			continue
+		}
+		known[i.IndexName] = true
+		result = append(result, db.ESIndex{Name: i.IndexName, PrimaryShards: i.Shards})
+	}
+	if len(result) > 0 {
+		log.Info().Msgf("%d indices matching %v are only in the snapshot catalog", len(result), name)
+	}
+	return result, nil
+}
+
 func (h *Handler) QueryLatestSnapshotsViaIndex(index []db.ESIndex) (map[string]db.ESSnapshot, error) {
 	all_matched_snapshots := make(map[string]db.ESSnapshot)
 	for _, i := range index {
@@ -165,89 +226,82 @@ func (h *Handler) QueryLatestSnapshotsViaIndex(index []db.ESIndex) (map[string]d
 	return all_matched_snapshots, nil
 }
 
-func (h *Handler) GetIndexGBSize(index []db.ESIndex) float64 {
+func (h *Handler) GetIndexGBSize(index []db.ESIndex, replicas *int) float64 {
 	indices := db.ESIndexs(index)
-	return indices.StoreSize()
+	return indices.PrimaryStoreSizeWithReplicas(replicas)
 }
 
-func (h *Handler) GetIndexNames(index []db.ESIndex) []string {
-	indices := db.ESIndexs(index)
-	return indices.IndexNames()
-}
-
-func (h *Handler) GetElasticsearch(ctx context.Context) (*elasticsearchv1.Elasticsearch, error) {
-	es := &elasticsearchv1.Elasticsearch{
-		TypeMeta: metav1.TypeMeta{
-			Kind:       "Elasticsearch",
-			APIVersion: "elasticsearch.k8s.elastic.co/v1",
-		},
-	}
-
-	err := h.K8Sclient.Get(ctx,
-		runtimeclient.ObjectKey{Namespace: config.GlobalConfig.ES.Namespace, Name: config.GlobalConfig.ES.Name},
-		es,
-	)
+// PlanIndices computes the restore node plan for index restored with replicas, or with their cataloged replicas
+// when nil as the restore keeps the ones of the snapshot. The size recorded in the snapshot is preferred as the
+// live index may be deleted by ILM or differ from the snapshotted data.
+func (h *Handler) PlanIndices(index []db.ESIndex, replicas *int, snapshots map[string]db.ESSnapshot) planner.Plan {
+	snapshot_sizes := h.snapshotIndexSizes(snapshots)
 
-	if err != nil {
-		log.Error().Err(err).Msgf("faild to get Elasticsearch %s from %s namespace", config.GlobalConfig.ES.Name, config.GlobalConfig.ES.Namespace)
-		return nil, err
-	}
+	var sizes []planner.IndexSize
+	for _, i := range index {
+		index_replicas := i.Replicas
+		if replicas != nil {
+			index_replicas = *replicas
+		}
+		if s, ok := snapshots[i.Name]; ok {
+			if snapshot_index, ok := snapshot_sizes[s.Repository+"/"+s.Snapshot+"/"+i.Name]; ok {
+				sizes = append(sizes, planner.IndexSize{
+					Name:      i.Name,
+					PrimaryGB: snapshot_index.GB(),
+					Shards:    snapshot_index.Shards,
+					Replicas:  index_replicas,
+				})
+				continue
+			}
+		}
 
-	return es, nil
-}
+		gb, err := i.PrimaryStoreSize()
+		if err != nil {
+			log.Error().Err(err).Msgf("faild to parse index %s primary store size: %s to float GB", i.Name, i.PriStoreSize)
+			continue
+		}
 
-func (h *Handler) MergeElasticsearch(ctx context.Context, name, size string) (*elasticsearchv1.Elasticsearch, error) {
-	node_set := k8s.NewESNodeSet(name, size)
-	es, err := h.GetElasticsearch(ctx)
-	if err != nil {
-		return nil, err
+		sizes = append(sizes, planner.IndexSize{
+			Name:      i.Name,
+			PrimaryGB: gb,
+			Shards:    i.PrimaryShards,
+			Replicas:  index_replicas,
+		})
 	}
 
-	es.Spec.NodeSets = append(es.Spec.NodeSets, *node_set.NodeSet)
-	return es, nil
+	return planner.NewPlan(sizes)
 }
 
-func (h *Handler) NewRestoreESNode(ctx context.Context, name, size string) error {
-	node_set := k8s.NewESNodeSet(name, size)
-	es, err := h.GetElasticsearch(ctx)
-	if err != nil {
-		return err
+// snapshotIndexSizes returns the sizes recorded for the indices of snapshots in one query, keyed by repository,
+// snapshot and index
+func (h *Handler) snapshotIndexSizes(snapshots map[string]db.ESSnapshot) map[string]db.ESSnapshotIndex {
+	sizes := make(map[string]db.ESSnapshotIndex)
+	if len(snapshots) == 0 {
+		return sizes
 	}
 
-	patch := runtimeclient.MergeFrom(es.DeepCopy())
-	es.Spec.NodeSets = append(es.Spec.NodeSets, *node_set.NodeSet)
-
-	err = h.K8Sclient.Patch(ctx, es, patch)
-	if err != nil {
-		log.Error().Err(err).Msgf("failed to patch Elasticsearch of %s in %s nanespace", config.GlobalConfig.ES.Name, config.GlobalConfig.ES.Namespace)
-		return err
+	index_names := make([]string, 0, len(snapshots))
+	var snapshot_names []string
+	for index, s := range snapshots {
+		index_names = append(index_names, index)
+		snapshot_names = append(snapshot_names, s.Snapshot)
 	}
-
-	log.Info().Msgf("success to patch Elasticsearch of %s in %s nanespace", config.GlobalConfig.ES.Name, config.GlobalConfig.ES.Namespace)
-	return nil
-}
-
-func (h *Handler) DeleteRestoreESNode(ctx context.Context, name string) error {
-	es, err := h.GetElasticsearch(ctx)
+	snapshot_indices, err := db.QueryAll[db.ESSnapshotIndex](h.DBClient, "", 0, "snapshot IN ? AND index_name IN ?", snapshot_names, index_names)
 	if err != nil {
-		return err
+		log.Error().Err(err).Msgf("failed to query size of indices %v in their snapshots", index_names)
+		return sizes
 	}
 
-	patch := runtimeclient.MergeFrom(es.DeepCopy())
-	var node_sets []elasticsearchv1.NodeSet
-	for _, node := range es.Spec.NodeSets {
-		if node.Name != name {
-			node_sets = append(node_sets, node)
+	for _, i := range snapshot_indices {
+		// the query matches any snapshot of any index, only the snapshot of each index is kept
+		if s, ok := snapshots[i.IndexName]; ok && s.Snapshot == i.Snapshot && s.Repository == i.Repository {
+			sizes[i.Repository+"/"+i.Snapshot+"/"+i.IndexName] = i
 		}
 	}
-	es.Spec.NodeSets = node_sets
-
-	err = h.K8Sclient.Patch(ctx, es, patch)
-	if err != nil {
-		log.Error().Err(err).Msgf("failed to patch Elasticsearch of %s in %s nanespace", config.GlobalConfig.ES.Name, config.GlobalConfig.ES.Namespace)
-		return err
-	}
+	return sizes
+}
 
-	log.Info().Msgf("success to patch Elasticsearch of %s in %s nanespace", config.GlobalConfig.ES.Name, config.GlobalConfig.ES.Namespace)
-	return nil
+func (h *Handler) GetIndexNames(index []db.ESIndex) []string {
+	indices := db.ESIndexs(index)
+	return indices.IndexNames()
 }
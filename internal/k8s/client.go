@@ -9,13 +9,12 @@ import (
 	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
 	commonv1 "github.com/elastic/cloud-on-k8s/v3/pkg/apis/common/v1"
 	esv1 "github.com/elastic/cloud-on-k8s/v3/pkg/apis/elasticsearch/v1"
-	eslabel "github.com/elastic/cloud-on-k8s/v3/pkg/controller/elasticsearch/label"
 	"github.com/rs/zerolog/log"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/rest"
 	runtimeclient "sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -23,19 +22,9 @@ type Client struct {
 	runtimeclient.Client
 }
 
-func NewClient() (*Client, error) {
-	config, err := clientcmd.BuildConfigFromFlags("", config.GlobalConfig.Kube.Config)
-	if err != nil {
-		log.Error().Err(err).Msg("failed to build kubernetes config")
-		return nil, err
-	}
-
-	scheme := runtime.NewScheme()
-	esv1.AddToScheme(scheme)
-	restorev1.AddToScheme(scheme)
-
+func NewClient(cfg *rest.Config, scheme *runtime.Scheme) (*Client, error) {
 	c, err := runtimeclient.New(
-		config,
+		cfg,
 		runtimeclient.Options{
 			Scheme: scheme,
 		},
@@ -52,29 +41,27 @@ func NewClient() (*Client, error) {
 type ESNodeSetOption func(*ESNodeSet)
 
 type ESNodeSet struct {
-	NodeSet *esv1.NodeSet
+	NodeSet   *esv1.NodeSet
+	ESName    string
+	Placement restorev1.Placement
 }
 
-func NewESNodeSet(name, size string) *ESNodeSet {
-	var tolerations []v1.Toleration
-	for k, v := range config.GlobalConfig.ES.Tolerations {
-		tolerations = append(tolerations, v1.Toleration{
-			Key:      k,
-			Operator: v1.TolerationOpEqual,
-			Value:    v,
-		})
+func NewESNodeSet(name, size string, opts ...ESNodeSetOption) *ESNodeSet {
+	labels := map[string]string{}
+	for k, v := range config.GlobalConfig.ES.Labels {
+		labels[k] = v
 	}
+	labels["app.kubernetes.io/instance"] = name
 
-	labels := config.GlobalConfig.ES.Labels
-	labels["app.kubernetes.io/instance"] = fmt.Sprintf("%s", name)
-
-	return &ESNodeSet{
+	n := &ESNodeSet{
+		ESName:    config.GlobalConfig.ES.Name,
+		Placement: DefaultPlacement(),
 		NodeSet: &esv1.NodeSet{
 			Name:  name,
 			Count: config.GlobalConfig.ES.RestoreCount,
 			Config: &commonv1.Config{
 				Data: map[string]interface{}{
-					fmt.Sprintf("node.attr.%s", config.GlobalConfig.ES.RestoreKey): name,
+					RestoreAttrKey():        name,
 					"node.store.allow_mmap": false,
 					"node.roles":            []string{"data"},
 				},
@@ -86,23 +73,6 @@ func NewESNodeSet(name, size string) *ESNodeSet {
 					Annotations: config.GlobalConfig.ES.Annotations,
 				},
 				Spec: v1.PodSpec{
-					//TODO
-					Affinity: &v1.Affinity{
-						NodeAffinity: &config.GlobalConfig.ES.NodeAffinity,
-						PodAntiAffinity: &v1.PodAntiAffinity{
-							RequiredDuringSchedulingIgnoredDuringExecution: []v1.PodAffinityTerm{
-								{
-									TopologyKey: config.GlobalConfig.ES.TopologyKey,
-									LabelSelector: &metav1.LabelSelector{
-										MatchLabels: map[string]string{
-											eslabel.StatefulSetNameLabelName: fmt.Sprintf("%s-es-%s", config.GlobalConfig.ES.Name, name),
-										},
-									},
-								},
-							},
-						},
-					},
-					Tolerations:        tolerations,
 					ServiceAccountName: config.GlobalConfig.ES.ServiceAccount,
 					InitContainers: []v1.Container{
 						{
@@ -153,4 +123,61 @@ func NewESNodeSet(name, size string) *ESNodeSet {
 			},
 		},
 	}
+
+	for _, opt := range opts {
+		opt(n)
+	}
+	n.setPlacement(n.Placement)
+
+	return n
+}
+
+// withEnv sets env in envs, replacing the variable of the same name
+func withEnv(envs []v1.EnvVar, env v1.EnvVar) []v1.EnvVar {
+	for i := range envs {
+		if envs[i].Name == env.Name {
+			envs[i] = env
+			return envs
+		}
+	}
+	return append(envs, env)
+}
+
+// WithResources sizes the restore node with the plan computed by the sizing engine
+func WithResources(r *restorev1.NodeResources) ESNodeSetOption {
+	return func(n *ESNodeSet) {
+		if r == nil {
+			return
+		}
+
+		if r.Count > 0 {
+			n.NodeSet.Count = r.Count
+		}
+
+		for i := range n.NodeSet.PodTemplate.Spec.Containers {
+			container := &n.NodeSet.PodTemplate.Spec.Containers[i]
+			if container.Name != config.GlobalConfig.ES.ContainerName {
+				continue
+			}
+
+			if cpu, err := resource.ParseQuantity(r.CPU); err == nil {
+				container.Resources.Requests[v1.ResourceCPU] = cpu
+				container.Resources.Limits[v1.ResourceCPU] = cpu
+			} else if r.CPU != "" {
+				log.Error().Err(err).Msgf("invalid cpu %s for restore node %s", r.CPU, n.NodeSet.Name)
+			}
+			if memory, err := resource.ParseQuantity(r.Memory); err == nil {
+				container.Resources.Requests[v1.ResourceMemory] = memory
+				container.Resources.Limits[v1.ResourceMemory] = memory
+			} else if r.Memory != "" {
+				log.Error().Err(err).Msgf("invalid memory %s for restore node %s", r.Memory, n.NodeSet.Name)
+			}
+			if r.Heap != "" {
+				container.Env = withEnv(container.Env, v1.EnvVar{
+					Name:  "ES_JAVA_OPTS",
+					Value: fmt.Sprintf("-Xms%s -Xmx%s", r.Heap, r.Heap),
+				})
+			}
+		}
+	}
 }
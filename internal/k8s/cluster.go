@@ -0,0 +1,124 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	esv1 "github.com/elastic/cloud-on-k8s/v3/pkg/apis/elasticsearch/v1"
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	runtimeclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// LabelRestoreCluster marks the Elasticsearch created for an isolated restore
+	LabelRestoreCluster = "restore.elastic.co/cluster"
+
+	ElasticUser = "elastic"
+)
+
+// WithESName sets the Elasticsearch the node set belongs to, which is part of the StatefulSet name
+func WithESName(es_name string) ESNodeSetOption {
+	return func(n *ESNodeSet) {
+		n.ESName = es_name
+	}
+}
+
+// WithRoles overrides the node.roles of the node set
+func WithRoles(roles ...string) ESNodeSetOption {
+	return func(n *ESNodeSet) {
+		n.NodeSet.Config.Data["node.roles"] = roles
+	}
+}
+
+// NewRestoreCluster builds a standalone Elasticsearch named name with a single master and data node set,
+// running the same version, image and secure settings as the production Elasticsearch prod
+func NewRestoreCluster(prod *esv1.Elasticsearch, name, size string, opts ...ESNodeSetOption) *esv1.Elasticsearch {
+	opts = append([]ESNodeSetOption{WithESName(name), WithRoles("master", "data")}, opts...)
+	node_set := NewESNodeSet(name, size, opts...)
+
+	labels := map[string]string{
+		LabelRestoreCluster: "true",
+	}
+	for k, v := range config.GlobalConfig.ES.Labels {
+		labels[k] = v
+	}
+
+	return &esv1.Elasticsearch{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Elasticsearch",
+			APIVersion: "elasticsearch.k8s.elastic.co/v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   prod.Namespace,
+			Labels:      labels,
+			Annotations: config.GlobalConfig.ES.Annotations,
+		},
+		Spec: esv1.ElasticsearchSpec{
+			Version:        prod.Spec.Version,
+			Image:          prod.Spec.Image,
+			SecureSettings: prod.Spec.SecureSettings,
+			NodeSets:       []esv1.NodeSet{*node_set.NodeSet},
+		},
+	}
+}
+
+// IsRestoreCluster reports whether es is an Elasticsearch created for an isolated restore
+func IsRestoreCluster(es *esv1.Elasticsearch) bool {
+	return es.Labels[LabelRestoreCluster] == "true"
+}
+
+// ClusterReady reports whether the Elasticsearch es is ready to serve requests
+func ClusterReady(es *esv1.Elasticsearch) bool {
+	return es.Status.Phase == esv1.ElasticsearchReadyPhase && es.Status.Health == esv1.ElasticsearchGreenHealth
+}
+
+// ClusterEndpoint is the in cluster http endpoint of the Elasticsearch name
+func ClusterEndpoint(namespace, name string) string {
+	return fmt.Sprintf("https://%s-es-http.%s.svc:9200", name, namespace)
+}
+
+// ClusterCredentialsSecret is the Secret ECK stores the elastic user password of the Elasticsearch name in
+func ClusterCredentialsSecret(name string) string {
+	return fmt.Sprintf("%s-es-elastic-user", name)
+}
+
+// ClusterPassword reads the elastic user password of the Elasticsearch name
+func ClusterPassword(ctx context.Context, c runtimeclient.Client, namespace, name string) (string, error) {
+	var secret v1.Secret
+	if err := c.Get(ctx, runtimeclient.ObjectKey{Namespace: namespace, Name: ClusterCredentialsSecret(name)}, &secret); err != nil {
+		log.Error().Err(err).Msgf("failed to get Secret %s in %s namespace", ClusterCredentialsSecret(name), namespace)
+		return "", err
+	}
+
+	password, ok := secret.Data[ElasticUser]
+	if !ok {
+		return "", fmt.Errorf("Secret %s in %s namespace has no %s key", ClusterCredentialsSecret(name), namespace, ElasticUser)
+	}
+
+	return string(password), nil
+}
+
+// ClusterCASecret is the Secret ECK stores the CA of the http certificate of the Elasticsearch name in
+func ClusterCASecret(name string) string {
+	return fmt.Sprintf("%s-es-http-certs-public", name)
+}
+
+// ClusterCA reads the CA verifying the http certificate of the Elasticsearch name
+func ClusterCA(ctx context.Context, c runtimeclient.Client, namespace, name string) ([]byte, error) {
+	var secret v1.Secret
+	if err := c.Get(ctx, runtimeclient.ObjectKey{Namespace: namespace, Name: ClusterCASecret(name)}, &secret); err != nil {
+		log.Error().Err(err).Msgf("failed to get Secret %s in %s namespace", ClusterCASecret(name), namespace)
+		return nil, err
+	}
+
+	ca, ok := secret.Data["ca.crt"]
+	if !ok {
+		return nil, fmt.Errorf("Secret %s in %s namespace has no ca.crt key", ClusterCASecret(name), namespace)
+	}
+
+	return ca, nil
+}
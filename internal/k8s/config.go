@@ -0,0 +1,76 @@
+package k8s
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	restorev1 "github.com/404LifeFound/es-snapshot-restore/internal/controller/api/v1"
+	esv1 "github.com/elastic/cloud-on-k8s/v3/pkg/apis/elasticsearch/v1"
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// NewRestConfig builds the config shared by the kubernetes client and the controller manager. In a pod without
+// kube.config and kube.context the service account is used, otherwise the kubeconfig at kube.config, or found
+// by KUBECONFIG and ~/.kube/config when it is empty, with kube.context as the current context.
+func NewRestConfig() (*rest.Config, error) {
+	kube_config := ExpandPath(config.GlobalConfig.Kube.Config)
+	kube_context := config.GlobalConfig.Kube.Context
+
+	if kube_config == "" && kube_context == "" {
+		cfg, err := rest.InClusterConfig()
+		if err == nil {
+			log.Info().Msg("use in cluster kubernetes config")
+			return cfg, nil
+		} else if err != rest.ErrNotInCluster {
+			log.Error().Err(err).Msg("failed to build in cluster kubernetes config")
+			return nil, err
+		}
+	}
+
+	loading_rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loading_rules.ExplicitPath = kube_config
+
+	cfg, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		loading_rules,
+		&clientcmd.ConfigOverrides{CurrentContext: kube_context},
+	).ClientConfig()
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to build kubernetes config from kubeconfig %s with context %s", kube_config, kube_context)
+		return nil, err
+	}
+
+	log.Info().Msgf("use kubernetes config %s with context %s", cfg.Host, kube_context)
+	return cfg, nil
+}
+
+// NewScheme registers the kubernetes, ECK and RestoreTask types
+func NewScheme() *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(esv1.AddToScheme(scheme))
+	utilruntime.Must(restorev1.AddToScheme(scheme))
+	return scheme
+}
+
+// ExpandPath expands the environment variables and a leading ~ of path
+func ExpandPath(path string) string {
+	path = os.ExpandEnv(path)
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to expand %s", path)
+		return path
+	}
+
+	return filepath.Join(home, strings.TrimPrefix(path, "~"))
+}
@@ -0,0 +1,161 @@
+package k8s
+
+import (
+	"fmt"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	restorev1 "github.com/404LifeFound/es-snapshot-restore/internal/controller/api/v1"
+	eslabel "github.com/elastic/cloud-on-k8s/v3/pkg/controller/elasticsearch/label"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	DefaultZoneKey            = "topology.kubernetes.io/zone"
+	DefaultAntiAffinityWeight = 100
+)
+
+// DefaultPlacement returns the placement configured by the es.* config
+func DefaultPlacement() restorev1.Placement {
+	return restorev1.Placement{
+		Tolerations:               config.GlobalConfig.ES.Tolerations,
+		NodeAffinity:              config.GlobalConfig.ES.NodeAffinity.DeepCopy(),
+		AntiAffinity:              restorev1.AntiAffinityMode(config.GlobalConfig.ES.AntiAffinity),
+		TopologyKey:               config.GlobalConfig.ES.TopologyKey,
+		TopologySpreadConstraints: config.GlobalConfig.ES.TopologySpreadConstraints,
+		Zones:                     config.GlobalConfig.ES.Zones,
+	}
+}
+
+// MergePlacement overrides the fields of base with the non-empty fields of p
+func MergePlacement(base restorev1.Placement, p *restorev1.Placement) restorev1.Placement {
+	if p == nil {
+		return base
+	}
+
+	if len(p.Tolerations) > 0 {
+		base.Tolerations = p.Tolerations
+	}
+	if p.NodeAffinity != nil {
+		base.NodeAffinity = p.NodeAffinity.DeepCopy()
+	}
+	if p.AntiAffinity != "" {
+		base.AntiAffinity = p.AntiAffinity
+	}
+	if p.TopologyKey != "" {
+		base.TopologyKey = p.TopologyKey
+	}
+	if len(p.TopologySpreadConstraints) > 0 {
+		base.TopologySpreadConstraints = p.TopologySpreadConstraints
+	}
+	if len(p.Zones) > 0 {
+		base.Zones = p.Zones
+	}
+
+	return base
+}
+
+// WithPlacement schedules the restore pods with p on top of the es placement config
+func WithPlacement(p *restorev1.Placement) ESNodeSetOption {
+	return func(n *ESNodeSet) {
+		n.Placement = MergePlacement(n.Placement, p)
+	}
+}
+
+func (n *ESNodeSet) setPlacement(p restorev1.Placement) {
+	spec := &n.NodeSet.PodTemplate.Spec
+	selector := &metav1.LabelSelector{
+		MatchLabels: map[string]string{
+			eslabel.StatefulSetNameLabelName: fmt.Sprintf("%s-es-%s", n.ESName, n.NodeSet.Name),
+		},
+	}
+
+	affinity := &v1.Affinity{
+		NodeAffinity: zoneNodeAffinity(p.NodeAffinity, p.Zones),
+	}
+
+	// a pod affinity term without topology key is rejected by the apiserver
+	if p.TopologyKey != "" {
+		term := v1.PodAffinityTerm{
+			TopologyKey:   p.TopologyKey,
+			LabelSelector: selector,
+		}
+
+		switch p.AntiAffinity {
+		case restorev1.AntiAffinityNone:
+		case restorev1.AntiAffinityPreferred:
+			weight := config.GlobalConfig.ES.AntiAffinityWeight
+			if weight <= 0 {
+				weight = DefaultAntiAffinityWeight
+			}
+			affinity.PodAntiAffinity = &v1.PodAntiAffinity{
+				PreferredDuringSchedulingIgnoredDuringExecution: []v1.WeightedPodAffinityTerm{
+					{
+						Weight:          weight,
+						PodAffinityTerm: term,
+					},
+				},
+			}
+		default:
+			affinity.PodAntiAffinity = &v1.PodAntiAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: []v1.PodAffinityTerm{term},
+			}
+		}
+	}
+
+	var constraints []v1.TopologySpreadConstraint
+	for _, c := range p.TopologySpreadConstraints {
+		constraint := *c.DeepCopy()
+		if constraint.LabelSelector == nil {
+			constraint.LabelSelector = selector.DeepCopy()
+		}
+		constraints = append(constraints, constraint)
+	}
+
+	spec.Affinity = affinity
+	spec.Tolerations = p.Tolerations
+	spec.TopologySpreadConstraints = constraints
+}
+
+// zoneNodeAffinity adds a zone requirement to every required node selector term of node_affinity
+func zoneNodeAffinity(node_affinity *v1.NodeAffinity, zones []string) *v1.NodeAffinity {
+	if node_affinity == nil {
+		node_affinity = &v1.NodeAffinity{}
+	} else {
+		node_affinity = node_affinity.DeepCopy()
+	}
+
+	if len(zones) == 0 {
+		return node_affinity
+	}
+
+	zone_key := config.GlobalConfig.ES.ZoneKey
+	if zone_key == "" {
+		zone_key = DefaultZoneKey
+	}
+
+	requirement := v1.NodeSelectorRequirement{
+		Key:      zone_key,
+		Operator: v1.NodeSelectorOpIn,
+		Values:   zones,
+	}
+
+	required := node_affinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if required == nil || len(required.NodeSelectorTerms) == 0 {
+		node_affinity.RequiredDuringSchedulingIgnoredDuringExecution = &v1.NodeSelector{
+			NodeSelectorTerms: []v1.NodeSelectorTerm{
+				{
+					MatchExpressions: []v1.NodeSelectorRequirement{requirement},
+				},
+			},
+		}
+		return node_affinity
+	}
+
+	// node selector terms are ORed, so every term needs the zone requirement
+	for i := range required.NodeSelectorTerms {
+		required.NodeSelectorTerms[i].MatchExpressions = append(required.NodeSelectorTerms[i].MatchExpressions, requirement)
+	}
+
+	return node_affinity
+}
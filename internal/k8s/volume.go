@@ -0,0 +1,138 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	esv1 "github.com/elastic/cloud-on-k8s/v3/pkg/apis/elasticsearch/v1"
+	eslabel "github.com/elastic/cloud-on-k8s/v3/pkg/controller/elasticsearch/label"
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	runtimeclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	GiB = 1024 * 1024 * 1024
+
+	AnnotationDefaultStorageClass = "storageclass.kubernetes.io/is-default-class"
+)
+
+// GBQuantity converts gb to a binary quantity rounded up to whole Gi
+func GBQuantity(gb float64) resource.Quantity {
+	return *resource.NewQuantity(int64(math.Ceil(gb))*GiB, resource.BinarySI)
+}
+
+// QuantityGB converts a storage quantity to float GB
+func QuantityGB(q resource.Quantity) float64 {
+	return float64(q.Value()) / GiB
+}
+
+// RestoreAttrKey is the node attribute the restored indices are allocated by
+func RestoreAttrKey() string {
+	return fmt.Sprintf("node.attr.%s", config.GlobalConfig.ES.RestoreKey)
+}
+
+// WithAttrValue sets the restore node attribute to value instead of the node set name, so an
+// extension node set receives the shards allocated to the restore node value
+func WithAttrValue(value string) ESNodeSetOption {
+	return func(n *ESNodeSet) {
+		n.NodeSet.Config.Data[RestoreAttrKey()] = value
+	}
+}
+
+// RestoreNodeSets returns the index of the node sets serving the restore node name, extension node sets included
+func RestoreNodeSets(es *esv1.Elasticsearch, name string) []int {
+	var node_sets []int
+	for i, n := range es.Spec.NodeSets {
+		if n.Name == name {
+			node_sets = append(node_sets, i)
+			continue
+		}
+
+		if n.Config != nil && fmt.Sprint(n.Config.Data[RestoreAttrKey()]) == name {
+			node_sets = append(node_sets, i)
+		}
+	}
+
+	return node_sets
+}
+
+// NodeSetStorageGB is the per pod data volume size of node set
+func NodeSetStorageGB(n esv1.NodeSet) float64 {
+	if len(n.VolumeClaimTemplates) == 0 {
+		return 0
+	}
+
+	return QuantityGB(n.VolumeClaimTemplates[0].Spec.Resources.Requests[v1.ResourceStorage])
+}
+
+// AllowVolumeExpansion reports whether the storage class of claim allows the volume to be expanded online
+func AllowVolumeExpansion(ctx context.Context, c runtimeclient.Client, claim v1.PersistentVolumeClaim) (bool, error) {
+	var storage_class storagev1.StorageClass
+
+	if claim.Spec.StorageClassName != nil && *claim.Spec.StorageClassName != "" {
+		if err := c.Get(ctx, runtimeclient.ObjectKey{Name: *claim.Spec.StorageClassName}, &storage_class); err != nil {
+			log.Error().Err(err).Msgf("failed to get StorageClass %s", *claim.Spec.StorageClassName)
+			return false, err
+		}
+	} else {
+		var storage_classes storagev1.StorageClassList
+		if err := c.List(ctx, &storage_classes); err != nil {
+			log.Error().Err(err).Msg("failed to list StorageClass")
+			return false, err
+		}
+
+		found := false
+		for _, s := range storage_classes.Items {
+			if s.Annotations[AnnotationDefaultStorageClass] == "true" {
+				storage_class = s
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, fmt.Errorf("claim %s has no storage class and there is no default StorageClass", claim.Name)
+		}
+	}
+
+	return storage_class.AllowVolumeExpansion != nil && *storage_class.AllowVolumeExpansion, nil
+}
+
+// VolumesResized reports whether every PVC of the StatefulSet sts reached size and has no resize in progress. It
+// reports false while the StatefulSet has no PVC yet.
+func VolumesResized(ctx context.Context, c runtimeclient.Client, namespace, sts string, size resource.Quantity) (bool, error) {
+	var pvcs v1.PersistentVolumeClaimList
+	if err := c.List(ctx, &pvcs,
+		runtimeclient.InNamespace(namespace),
+		runtimeclient.MatchingLabels{eslabel.StatefulSetNameLabelName: sts},
+	); err != nil {
+		log.Error().Err(err).Msgf("failed to list PersistentVolumeClaim of StatefulSet %s in %s namespace", sts, namespace)
+		return false, err
+	}
+	if len(pvcs.Items) == 0 {
+		log.Info().Msgf("StatefulSet %s in %s namespace has no PersistentVolumeClaim yet", sts, namespace)
+		return false, nil
+	}
+
+	for _, pvc := range pvcs.Items {
+		for _, c := range pvc.Status.Conditions {
+			if (c.Type == v1.PersistentVolumeClaimResizing || c.Type == v1.PersistentVolumeClaimFileSystemResizePending) &&
+				c.Status == v1.ConditionTrue {
+				log.Info().Msgf("PersistentVolumeClaim %s is resizing: %s", pvc.Name, c.Type)
+				return false, nil
+			}
+		}
+
+		capacity := pvc.Status.Capacity[v1.ResourceStorage]
+		if capacity.Cmp(size) < 0 {
+			log.Info().Msgf("PersistentVolumeClaim %s capacity %s is less than %s", pvc.Name, capacity.String(), size.String())
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
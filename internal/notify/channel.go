@@ -0,0 +1,215 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+)
+
+const (
+	ChannelWebhook = "webhook"
+	ChannelSlack   = "slack"
+	ChannelTeams   = "teams"
+	ChannelEmail   = "email"
+
+	// HeaderSignature is the HMAC-SHA256 of the body of a webhook request keyed by the secret of its channel
+	HeaderSignature = "X-Signature-256"
+	HeaderEvent     = "X-Event"
+	HeaderDelivery  = "X-Delivery"
+)
+
+func validateChannel(c config.NotifyChannel) error {
+	if c.Name == "" {
+		return fmt.Errorf("a notify channel of type %s has no name", c.Type)
+	}
+	for _, event := range c.Events {
+		if !slices.Contains(Events(), Event(event)) {
+			return fmt.Errorf("unknown event %s of notify channel %s", event, c.Name)
+		}
+	}
+	switch c.Type {
+	case ChannelWebhook, ChannelSlack, ChannelTeams:
+		if c.URL == "" {
+			return fmt.Errorf("notify channel %s has no url", c.Name)
+		}
+	case ChannelEmail:
+		if config.GlobalConfig.Notify.SMTP.Host == "" || config.GlobalConfig.Notify.SMTP.From == "" {
+			return fmt.Errorf("notify channel %s needs notify.smtp.host and notify.smtp.from", c.Name)
+		}
+	default:
+		return fmt.Errorf("unknown type %s of notify channel %s, should be webhook, slack, teams or email", c.Type, c.Name)
+	}
+	return nil
+}
+
+// send delivers notification to c in the format of its type
+func (n *Notifier) send(ctx context.Context, c config.NotifyChannel, notification db.Notification) error {
+	var msg Message
+	if notification.Payload == nil {
+		return fmt.Errorf("notification %d has no payload", notification.ID)
+	}
+	if err := json.Unmarshal([]byte(*notification.Payload), &msg); err != nil {
+		return err
+	}
+
+	switch c.Type {
+	case ChannelWebhook:
+		return post(ctx, c, notification, []byte(*notification.Payload))
+	case ChannelSlack:
+		return postJSON(ctx, c, notification, slackPayload(msg))
+	case ChannelTeams:
+		return postJSON(ctx, c, notification, teamsPayload(msg))
+	case ChannelEmail:
+		subscription, err := n.Subscription(notification.Requester)
+		if err != nil {
+			return err
+		}
+		return sendEmail(ctx, recipients(c, subscription), msg)
+	}
+	return fmt.Errorf("unknown type %s of notify channel %s", c.Type, c.Name)
+}
+
+func postJSON(ctx context.Context, c config.NotifyChannel, notification db.Notification, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return post(ctx, c, notification, body)
+}
+
+// post sends body to the url of c, signed when c has a secret
+func post(ctx context.Context, c config.NotifyChannel, notification db.Notification, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, notification.Event)
+	req.Header.Set(HeaderDelivery, strconv.FormatUint(uint64(notification.ID), 10))
+	if c.Secret != "" {
+		req.Header.Set(HeaderSignature, Sign(c.Secret, body))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("notify channel %s replied %s: %s", c.Name, resp.Status, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+// Sign is the signature of body sent in HeaderSignature, a receiver recomputes it with the shared secret
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func slackPayload(msg Message) map[string]any {
+	return map[string]any{
+		"text": fmt.Sprintf("*%s*\n%s", msg.Title, msg.Text),
+	}
+}
+
+// teamsPayload is a MessageCard of the incoming webhooks of Microsoft Teams
+func teamsPayload(msg Message) map[string]any {
+	facts := []map[string]string{
+		{"name": "Task", "value": msg.TaskID},
+		{"name": "Requester", "value": requesterOf(msg)},
+		{"name": "Status", "value": msg.Status},
+	}
+	if msg.Node != "" {
+		facts = append(facts, map[string]string{"name": "Node", "value": msg.Node})
+	}
+	if msg.ExpiresAt != nil {
+		facts = append(facts, map[string]string{"name": "Expires at", "value": msg.ExpiresAt.Format(time.RFC3339)})
+	}
+	return map[string]any{
+		"@type":      "MessageCard",
+		"@context":   "https://schema.org/extensions",
+		"summary":    msg.Title,
+		"title":      msg.Title,
+		"text":       msg.Text,
+		"themeColor": themeColor(msg.Event),
+		"sections":   []map[string]any{{"facts": facts}},
+	}
+}
+
+func themeColor(event Event) string {
+	switch event {
+	case EventRestoreCompleted:
+		return "2EB886"
+	case EventRestoreFailed, EventRestoreTimedOut:
+		return "D40E0D"
+	case EventExpiryApproaching:
+		return "DAA038"
+	}
+	return "0078D7"
+}
+
+// recipients are the recipients of an email channel, its own ones and the email of the requester subscription
+func recipients(c config.NotifyChannel, subscription db.Subscription) []string {
+	to := slices.Clone(c.To)
+	if subscription.Email != "" && !slices.Contains(to, subscription.Email) {
+		to = append(to, subscription.Email)
+	}
+	return to
+}
+
+// sendEmail sends msg through notify.smtp, upgraded to tls when the server supports it
+func sendEmail(ctx context.Context, to []string, msg Message) error {
+	if len(to) == 0 {
+		return fmt.Errorf("no recipient")
+	}
+	conf := config.GlobalConfig.Notify.SMTP
+	addr := net.JoinHostPort(conf.Host, strconv.Itoa(conf.Port))
+	var auth smtp.Auth
+	if conf.Username != "" {
+		auth = smtp.PlainAuth("", conf.Username, conf.Password, conf.Host)
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\n", conf.From)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&body, "Subject: [es-snapshot-restore] %s: %s\r\n", msg.Title, msg.TaskID)
+	fmt.Fprintf(&body, "Date: %s\r\n", msg.Time.Format(time.RFC1123Z))
+	body.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&body, "%s\r\n\r\n", msg.Text)
+	fmt.Fprintf(&body, "task: %s\r\nrequester: %s\r\nstatus: %s\r\nindices: %s\r\n", msg.TaskID, requesterOf(msg), msg.Status, strings.Join(msg.Indices, ", "))
+	if msg.Node != "" {
+		fmt.Fprintf(&body, "node: %s\r\n", msg.Node)
+	}
+	if msg.ExpiresAt != nil {
+		fmt.Fprintf(&body, "expires at: %s\r\n", msg.ExpiresAt.Format(time.RFC3339))
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(addr, auth, conf.From, to, []byte(body.String()))
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-done:
+		return err
+	}
+}
@@ -0,0 +1,146 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
+)
+
+// received is a request sent to a channel
+type received struct {
+	header http.Header
+	body   []byte
+}
+
+var _ = Describe("Channel", func() {
+	DescribeTable("Sign",
+		func(secret, body, expected string) {
+			Expect(Sign(secret, []byte(body))).To(Equal(expected))
+		},
+		Entry("the HMAC-SHA256 test vector of RFC 4231", "Jefe", "what do ya want for nothing?", "sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"),
+		Entry("the signature of a GitHub webhook", "It's a Secret to Everybody", "Hello, World!", "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"),
+	)
+
+	Describe("send", func() {
+		var (
+			requests chan received
+			url      string
+			msg      Message
+		)
+
+		BeforeEach(func() {
+			requests = make(chan received, 1)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				requests <- received{header: r.Header, body: body}
+			}))
+			DeferCleanup(srv.Close)
+			url = srv.URL
+
+			msg = Message{
+				Event:     EventRestoreCompleted,
+				Title:     "Restore completed",
+				Text:      "the indices of task t-1 are restored",
+				TaskID:    "t-1",
+				Requester: "alice",
+				Status:    "SUCCESS",
+				Indices:   []string{"logs"},
+				Time:      time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+			}
+		})
+
+		// deliver sends msg through a channel of type with secret and returns the request the channel received
+		deliver := func(channel, secret string) received {
+			payload, err := json.Marshal(msg)
+			Expect(err).NotTo(HaveOccurred())
+			notification := db.Notification{Event: string(msg.Event), Payload: utils.PtrToAny(string(payload))}
+			notification.ID = 7
+
+			n := &Notifier{}
+			Expect(n.send(context.Background(), config.NotifyChannel{Name: "channel", Type: channel, URL: url, Secret: secret}, notification)).To(Succeed())
+			var r received
+			Eventually(requests).Should(Receive(&r))
+			return r
+		}
+
+		It("posts the message to a webhook, signed with the secret of the channel", func() {
+			r := deliver(ChannelWebhook, "secret")
+
+			var sent Message
+			Expect(json.Unmarshal(r.body, &sent)).To(Succeed())
+			Expect(sent).To(Equal(msg))
+			Expect(r.header.Get(HeaderSignature)).To(Equal(Sign("secret", r.body)))
+			Expect(r.header.Get(HeaderEvent)).To(Equal(string(EventRestoreCompleted)))
+			Expect(r.header.Get(HeaderDelivery)).To(Equal("7"))
+			Expect(r.header.Get("Content-Type")).To(Equal("application/json"))
+		})
+
+		It("doesn't sign without a secret", func() {
+			r := deliver(ChannelWebhook, "")
+			Expect(r.header.Values(HeaderSignature)).To(BeEmpty())
+		})
+
+		It("posts the text of a slack message", func() {
+			r := deliver(ChannelSlack, "secret")
+			Expect(r.body).To(MatchJSON(`{"text": "*Restore completed*\nthe indices of task t-1 are restored"}`))
+			Expect(r.header.Get(HeaderSignature)).To(Equal(Sign("secret", r.body)))
+		})
+
+		It("posts a MessageCard to teams", func() {
+			expires_at := time.Date(2026, 1, 3, 3, 4, 5, 0, time.UTC)
+			msg.Node = "restore-abc"
+			msg.ExpiresAt = &expires_at
+
+			r := deliver(ChannelTeams, "")
+			Expect(r.body).To(MatchJSON(`{
+				"@type": "MessageCard",
+				"@context": "https://schema.org/extensions",
+				"summary": "Restore completed",
+				"title": "Restore completed",
+				"text": "the indices of task t-1 are restored",
+				"themeColor": "2EB886",
+				"sections": [{"facts": [
+					{"name": "Task", "value": "t-1"},
+					{"name": "Requester", "value": "alice"},
+					{"name": "Status", "value": "SUCCESS"},
+					{"name": "Node", "value": "restore-abc"},
+					{"name": "Expires at", "value": "2026-01-03T03:04:05Z"}
+				]}]
+			}`))
+		})
+	})
+
+	DescribeTable("teamsPayload",
+		func(msg Message, color string, facts []map[string]string) {
+			payload := teamsPayload(msg)
+			Expect(payload).To(HaveKeyWithValue("themeColor", color))
+			Expect(payload).To(HaveKeyWithValue("sections", []map[string]any{{"facts": facts}}))
+		},
+		Entry("a failed restore of an anonymous requester", Message{Event: EventRestoreFailed, TaskID: "t-1", Status: "FAILED"}, "D40E0D", []map[string]string{
+			{"name": "Task", "value": "t-1"},
+			{"name": "Requester", "value": "an anonymous requester"},
+			{"name": "Status", "value": "FAILED"},
+		}),
+		Entry("a timed out restore", Message{Event: EventRestoreTimedOut, TaskID: "t-1", Requester: "alice", Status: "TIMEOUT"}, "D40E0D", []map[string]string{
+			{"name": "Task", "value": "t-1"},
+			{"name": "Requester", "value": "alice"},
+			{"name": "Status", "value": "TIMEOUT"},
+		}),
+		Entry("a ready node", Message{Event: EventNodeReady, TaskID: "t-1", Requester: "alice", Status: "RUNNING", Node: "restore-abc"}, "0078D7", []map[string]string{
+			{"name": "Task", "value": "t-1"},
+			{"name": "Requester", "value": "alice"},
+			{"name": "Status", "value": "RUNNING"},
+			{"name": "Node", "value": "restore-abc"},
+		}),
+	)
+})
@@ -0,0 +1,453 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
+	"github.com/rs/zerolog/log"
+	"go.uber.org/fx"
+	"gorm.io/gorm"
+)
+
+type Event string
+
+const (
+	EventTaskCreated       Event = "task_created"
+	EventNodeReady         Event = "node_ready"
+	EventRestoreCompleted  Event = "restore_completed"
+	EventRestoreFailed     Event = "restore_failed"
+	EventRestoreTimedOut   Event = "restore_timed_out"
+	EventExpiryApproaching Event = "expiry_approaching"
+)
+
+// Events are the task lifecycle events a channel or a subscription may select
+func Events() []Event {
+	return []Event{
+		EventTaskCreated,
+		EventNodeReady,
+		EventRestoreCompleted,
+		EventRestoreFailed,
+		EventRestoreTimedOut,
+		EventExpiryApproaching,
+	}
+}
+
+type Status string
+
+const (
+	StatusPending Status = "PENDING"
+	StatusSent    Status = "SENT"
+	StatusFailed  Status = "FAILED"
+)
+
+// Message is the event sent to the channels, it is the body of the webhook requests
+type Message struct {
+	Event     Event      `json:"event"`
+	Title     string     `json:"title"`
+	Text      string     `json:"text"`
+	TaskID    string     `json:"task_id"`
+	Requester string     `json:"requester,omitempty"`
+	Status    string     `json:"status,omitempty"`
+	Indices   []string   `json:"indices"`
+	Node      string     `json:"node,omitempty"`
+	Endpoint  string     `json:"endpoint,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Time      time.Time  `json:"time"`
+}
+
+// Notifier records a delivery of each task event per channel selected by the channel and the subscription of the
+// requester, and sends it until it is sent or notify.maxattempts deliveries failed
+type Notifier struct {
+	DBClient *gorm.DB
+	channels map[string]config.NotifyChannel
+	ctx      context.Context // canceled when the notifier stops
+	wg       sync.WaitGroup
+}
+
+func NewNotifier(lc fx.Lifecycle, db_client *gorm.DB) (*Notifier, error) {
+	n := &Notifier{
+		DBClient: db_client,
+		channels: make(map[string]config.NotifyChannel),
+	}
+	if config.GlobalConfig.Notify.Enabled {
+		for _, c := range config.GlobalConfig.Notify.Channels {
+			if err := validateChannel(c); err != nil {
+				return nil, err
+			}
+			if _, ok := n.channels[c.Name]; ok {
+				return nil, fmt.Errorf("notify channel %s is configured twice", c.Name)
+			}
+			n.channels[c.Name] = c
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n.ctx = ctx
+	lc.Append(fx.Hook{
+		OnStop: func(context.Context) error {
+			cancel()
+			n.wg.Wait()
+			return nil
+		},
+	})
+	return n, nil
+}
+
+// Channel reports whether name is a configured channel
+func (n *Notifier) Channel(name string) bool {
+	_, ok := n.channels[name]
+	return ok
+}
+
+// TasksCreated notifies that the tasks of task_ids were created
+func (n *Notifier) TasksCreated(ctx context.Context, task_ids []string) {
+	seen := make(map[string]bool)
+	for _, task_id := range task_ids {
+		if seen[task_id] {
+			continue
+		}
+		seen[task_id] = true
+
+		msg, ok := n.taskMessage(EventTaskCreated, task_id)
+		if !ok {
+			continue
+		}
+		msg.Text = fmt.Sprintf("task %s of %s restores %d indices: %s, it is %s", task_id, requesterOf(msg), len(msg.Indices), strings.Join(msg.Indices, ", "), msg.Status)
+		n.Notify(ctx, fmt.Sprintf("%s:%s", EventTaskCreated, task_id), msg)
+	}
+}
+
+// NodeReady notifies that the restore node of the task task_id is ready and its indices are being restored
+func (n *Notifier) NodeReady(ctx context.Context, task_id, node, endpoint string) {
+	msg, ok := n.taskMessage(EventNodeReady, task_id)
+	if !ok {
+		return
+	}
+	msg.Node = node
+	msg.Endpoint = endpoint
+	msg.Text = fmt.Sprintf("restore node %s of task %s is ready, restoring %d indices", node, task_id, len(msg.Indices))
+	n.Notify(ctx, fmt.Sprintf("%s:%s", EventNodeReady, task_id), msg)
+}
+
+// TaskFinished notifies the result of the task task_id once none of its indices is restoring anymore, a canceled
+// task isn't notified
+func (n *Notifier) TaskFinished(ctx context.Context, task_id string) {
+	if !config.GlobalConfig.Notify.Enabled {
+		return
+	}
+	tasks, err := db.QueryAll[db.Task](n.DBClient, "id", 0, "task_id = ?", task_id)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to query task id %s to notify", task_id)
+		return
+	}
+
+	var event Event
+	var errs []string
+	success := 0
+	for _, t := range tasks {
+		switch utils.TaskStatus(t.Status) {
+		case utils.TaskSuccess:
+			success++
+		case utils.TaskFailed:
+			event = EventRestoreFailed
+		case utils.TaskTimeout:
+			if event != EventRestoreFailed {
+				event = EventRestoreTimedOut
+			}
+		case utils.TaskCanceled:
+		default:
+			return
+		}
+		if t.ErrorMessage != nil && t.Status != string(utils.TaskSuccess) {
+			errs = append(errs, fmt.Sprintf("%s: %s", t.Index, *t.ErrorMessage))
+		}
+	}
+	if len(tasks) > 0 && success == len(tasks) {
+		event = EventRestoreCompleted
+	}
+	if event == "" {
+		return
+	}
+
+	msg := newTaskMessage(event, tasks)
+	msg.Error = strings.Join(errs, "; ")
+	switch event {
+	case EventRestoreCompleted:
+		msg.Text = fmt.Sprintf("task %s restored %d indices on %s: %s", task_id, len(msg.Indices), msg.Node, strings.Join(msg.Indices, ", "))
+	case EventRestoreFailed:
+		msg.Text = fmt.Sprintf("task %s failed to restore %d of %d indices: %s", task_id, len(tasks)-success, len(tasks), msg.Error)
+	case EventRestoreTimedOut:
+		msg.Text = fmt.Sprintf("task %s timed out restoring %d of %d indices: %s", task_id, len(tasks)-success, len(tasks), msg.Error)
+	}
+	n.Notify(ctx, fmt.Sprintf("%s:%s", event, task_id), msg)
+}
+
+// WarnExpiring warns the requesters of the tasks restored onto the idle restore node reclaimed at expires_at that
+// their restored indices are deleted, once per expiry of the node
+func (n *Notifier) WarnExpiring(ctx context.Context, node db.RestoreNode, expires_at time.Time) {
+	if !config.GlobalConfig.Notify.Enabled {
+		return
+	}
+
+	tasks, err := db.QueryAll[db.Task](n.DBClient, "id", 0, "node = ? AND status = ? AND released_at IS NULL", node.Name, string(utils.TaskSuccess))
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to query tasks of restore node %s to notify", node.Name)
+		return
+	}
+
+	var task_ids []string
+	by_task_id := make(map[string][]db.Task)
+	for _, t := range tasks {
+		if _, ok := by_task_id[t.TaskID]; !ok {
+			task_ids = append(task_ids, t.TaskID)
+		}
+		by_task_id[t.TaskID] = append(by_task_id[t.TaskID], t)
+	}
+
+	for _, task_id := range task_ids {
+		msg := newTaskMessage(EventExpiryApproaching, by_task_id[task_id])
+		msg.Node = node.Name
+		msg.ExpiresAt = &expires_at
+		msg.Text = fmt.Sprintf("restore node %s of task %s is reclaimed at %s, its %d restored indices are deleted: %s",
+			node.Name, task_id, expires_at.Format(time.RFC3339), len(msg.Indices), strings.Join(msg.Indices, ", "))
+		n.Notify(ctx, fmt.Sprintf("%s:%s:%s:%d", EventExpiryApproaching, task_id, node.Name, expires_at.Unix()), msg)
+	}
+}
+
+// Notify records the delivery of msg to each channel selected for it and sends them, key identifies the event so
+// that it is notified once
+func (n *Notifier) Notify(ctx context.Context, key string, msg Message) {
+	if !config.GlobalConfig.Notify.Enabled {
+		return
+	}
+
+	subscription, err := n.Subscription(msg.Requester)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to get subscription of %s", msg.Requester)
+	}
+	if subscription.Muted {
+		return
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to encode %s notification of task id %s", msg.Event, msg.TaskID)
+		return
+	}
+
+	for _, c := range config.GlobalConfig.Notify.Channels {
+		if !selected(c.Events, string(msg.Event)) ||
+			!selected(jsonStrings(subscription.Events), string(msg.Event)) ||
+			!selected(jsonStrings(subscription.Channels), c.Name) {
+			continue
+		}
+		if c.Type == ChannelEmail && len(recipients(c, subscription)) == 0 {
+			continue
+		}
+
+		notification := db.Notification{
+			Key:           key,
+			Channel:       c.Name,
+			Event:         string(msg.Event),
+			TaskID:        msg.TaskID,
+			Requester:     msg.Requester,
+			Payload:       utils.PtrToAny(string(payload)),
+			Status:        string(StatusPending),
+			NextAttemptAt: time.Now(),
+		}
+		created, err := db.CreateRecordOnce(n.DBClient, &notification)
+		if err != nil {
+			log.Error().Err(err).Msgf("failed to record %s notification of task id %s to %s", msg.Event, msg.TaskID, c.Name)
+			continue
+		}
+		if !created {
+			continue
+		}
+
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			n.deliver(n.ctx, notification)
+		}()
+	}
+}
+
+// Retry sends the pending notifications whose next attempt is due, the first attempt of one is made by Notify
+func (n *Notifier) Retry(ctx context.Context) error {
+	if !config.GlobalConfig.Notify.Enabled {
+		return nil
+	}
+	due, err := db.QueryAll[db.Notification](n.DBClient, "next_attempt_at", 100, "status = ? AND next_attempt_at <= ?", string(StatusPending), time.Now())
+	if err != nil {
+		return err
+	}
+	for _, notification := range due {
+		n.deliver(ctx, notification)
+	}
+	return nil
+}
+
+// deliver sends notification once, the delivery is claimed first so that one instance sends it. A failed delivery
+// is attempted again after the backoff until notify.maxattempts.
+func (n *Notifier) deliver(ctx context.Context, notification db.Notification) {
+	timeout := time.Duration(config.GlobalConfig.Notify.Timeout) * time.Second
+	claim := n.DBClient.Model(&db.Notification{}).
+		Where("id = ? AND status = ? AND next_attempt_at <= ?", notification.ID, string(StatusPending), time.Now()).
+		Update("NextAttemptAt", time.Now().Add(2*timeout))
+	if claim.Error != nil {
+		log.Error().Err(claim.Error).Msgf("failed to claim notification %d", notification.ID)
+		return
+	}
+	if claim.RowsAffected == 0 {
+		return
+	}
+
+	var err error
+	c, ok := n.channels[notification.Channel]
+	if !ok {
+		err = fmt.Errorf("notify channel %s is not configured", notification.Channel)
+	} else {
+		send_ctx, cancel := context.WithTimeout(ctx, timeout)
+		err = n.send(send_ctx, c, notification)
+		cancel()
+	}
+
+	attempts := notification.Attempts + 1
+	updates := map[string]any{"Attempts": attempts}
+	if err == nil {
+		log.Info().Msgf("sent %s notification of task id %s to %s", notification.Event, notification.TaskID, notification.Channel)
+		updates["Status"] = string(StatusSent)
+		updates["SentAt"] = time.Now()
+		updates["LastError"] = nil
+	} else {
+		updates["LastError"] = utils.PtrToAny(err.Error())
+		if !ok || attempts >= config.GlobalConfig.Notify.MaxAttempts {
+			log.Error().Err(err).Msgf("%s notification of task id %s to %s failed after %d attempts", notification.Event, notification.TaskID, notification.Channel, attempts)
+			updates["Status"] = string(StatusFailed)
+		} else {
+			wait := backoff(attempts + 1)
+			log.Warn().Err(err).Msgf("attempt %d to send %s notification of task id %s to %s failed, retry in %s", attempts, notification.Event, notification.TaskID, notification.Channel, wait)
+			updates["NextAttemptAt"] = time.Now().Add(wait)
+		}
+	}
+	if err := n.DBClient.Model(&db.Notification{}).Where("id = ?", notification.ID).Updates(updates).Error; err != nil {
+		log.Error().Err(err).Msgf("failed to update notification %d", notification.ID)
+	}
+}
+
+// backoff is the wait before attempt of a notification, notify.backoff seconds doubled after each attempt
+func backoff(attempt int) time.Duration {
+	if attempt < 2 {
+		return 0
+	}
+	seconds := float64(config.GlobalConfig.Notify.Backoff) * math.Pow(2, float64(attempt-2))
+	return time.Duration(seconds) * time.Second
+}
+
+// Subscription returns the subscription of requester, an empty one when it has none
+func (n *Notifier) Subscription(requester string) (db.Subscription, error) {
+	if requester == "" {
+		return db.Subscription{}, nil
+	}
+	subscriptions, err := db.QueryAll[db.Subscription](n.DBClient, "", 1, "requester = ?", requester)
+	if err != nil || len(subscriptions) == 0 {
+		return db.Subscription{Requester: requester}, err
+	}
+	return subscriptions[0], nil
+}
+
+// Subscribe records subscription in place of the one of its requester
+func (n *Notifier) Subscribe(subscription db.Subscription) (db.Subscription, error) {
+	if subscription.Requester == "" {
+		return subscription, errors.New("the requester of a subscription is required")
+	}
+	if err := db.SaveSubscription(n.DBClient, &subscription); err != nil {
+		return subscription, err
+	}
+	return n.Subscription(subscription.Requester)
+}
+
+// taskMessage is the message of event about the tasks of task_id, false when notify is disabled or they can't be
+// read
+func (n *Notifier) taskMessage(event Event, task_id string) (Message, bool) {
+	if !config.GlobalConfig.Notify.Enabled {
+		return Message{}, false
+	}
+	tasks, err := db.QueryAll[db.Task](n.DBClient, "id", 0, "task_id = ?", task_id)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to query task id %s to notify", task_id)
+		return Message{}, false
+	}
+	if len(tasks) == 0 {
+		return Message{}, false
+	}
+	return newTaskMessage(event, tasks), true
+}
+
+func newTaskMessage(event Event, tasks []db.Task) Message {
+	msg := Message{
+		Event:   event,
+		Title:   title(event),
+		Indices: make([]string, 0, len(tasks)),
+		Time:    time.Now(),
+	}
+	for _, t := range tasks {
+		msg.TaskID = t.TaskID
+		msg.Requester = t.Requester
+		msg.Status = t.Status
+		if t.Node != "" {
+			msg.Node = t.Node
+		}
+		msg.Indices = append(msg.Indices, t.Index)
+	}
+	return msg
+}
+
+func title(event Event) string {
+	switch event {
+	case EventTaskCreated:
+		return "Restore task created"
+	case EventNodeReady:
+		return "Restore node ready"
+	case EventRestoreCompleted:
+		return "Restore completed"
+	case EventRestoreFailed:
+		return "Restore failed"
+	case EventRestoreTimedOut:
+		return "Restore timed out"
+	case EventExpiryApproaching:
+		return "Restored indices expiring"
+	}
+	return string(event)
+}
+
+func requesterOf(msg Message) string {
+	if msg.Requester == "" {
+		return "an anonymous requester"
+	}
+	return msg.Requester
+}
+
+// selected reports whether value is in names, empty names select every value
+func selected(names []string, value string) bool {
+	return len(names) == 0 || slices.Contains(names, value)
+}
+
+// jsonStrings decodes a json array of strings, nil when it isn't one
+func jsonStrings(b []byte) []string {
+	var s []string
+	if len(b) == 0 || json.Unmarshal(b, &s) != nil {
+		return nil
+	}
+	return s
+}
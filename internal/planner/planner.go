@@ -0,0 +1,122 @@
+package planner
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	restorev1 "github.com/404LifeFound/es-snapshot-restore/internal/controller/api/v1"
+	"github.com/rs/zerolog/log"
+)
+
+// IndexSize is the input of the sizing engine, size unit is GB
+type IndexSize struct {
+	Name      string  `json:"name"`
+	PrimaryGB float64 `json:"primary_gb"`
+	Shards    int     `json:"shards"`
+	Replicas  int     `json:"replicas"`
+}
+
+// Plan is the restore node layout computed from the indices to restore, size unit is GB
+type Plan struct {
+	NodeCount       int32   `json:"node_count"`
+	DataGB          float64 `json:"data_gb"`
+	Shards          int     `json:"shards"`
+	DiskPerNodeGB   float64 `json:"disk_per_node_gb"`
+	MemoryPerNodeGB float64 `json:"memory_per_node_gb"`
+	HeapPerNodeGB   float64 `json:"heap_per_node_gb"`
+	CPUPerNode      float64 `json:"cpu_per_node"`
+}
+
+// NewPlan computes node count, disk, memory, heap and cpu of the restore nodes
+func NewPlan(indices []IndexSize) Plan {
+	sizing := config.GlobalConfig.Sizing
+
+	var data_gb float64
+	var shards int
+	copies := 1
+	for _, i := range indices {
+		index_shards := i.Shards
+		if index_shards < 1 {
+			index_shards = 1
+		}
+		data_gb += i.PrimaryGB * float64(1+i.Replicas)
+		shards += index_shards * (1 + i.Replicas)
+		// a replica is never allocated on the node holding its primary
+		copies = max(copies, 1+i.Replicas)
+	}
+
+	watermark := sizing.HighWatermark
+	if watermark <= 0 || watermark > 1 {
+		watermark = 1
+	}
+	disk_gb := data_gb / watermark
+
+	node_count := max(int(config.GlobalConfig.ES.RestoreCount), copies, 1)
+	if sizing.MaxDiskPerNode > 0 {
+		node_count = max(node_count, int(math.Ceil(disk_gb/sizing.MaxDiskPerNode)))
+	}
+	if sizing.MaxShardsPerNode > 0 {
+		node_count = max(node_count, int(math.Ceil(float64(shards)/float64(sizing.MaxShardsPerNode))))
+	}
+
+	disk_per_node := math.Max(math.Ceil(disk_gb/float64(node_count)), config.GlobalConfig.ES.DiskMinSize)
+	data_per_node := data_gb / float64(node_count)
+
+	memory := data_per_node
+	if sizing.DataRatio > 0 {
+		memory = data_per_node / sizing.DataRatio
+	}
+	memory = math.Ceil(clamp(memory, sizing.MinMemory, sizing.MaxMemory))
+
+	heap := memory * sizing.HeapRatio
+	if sizing.HeapRatio <= 0 {
+		heap = memory / 2
+	}
+	heap = math.Max(math.Floor(clamp(heap, 0, sizing.MaxHeap)), 1)
+
+	cpu := 1.0
+	if sizing.MemoryPerCPU > 0 {
+		cpu = math.Ceil(memory / sizing.MemoryPerCPU)
+	}
+	cpu = clamp(cpu, 1, sizing.MaxCPU)
+
+	plan := Plan{
+		NodeCount:       int32(node_count),
+		DataGB:          data_gb,
+		Shards:          shards,
+		DiskPerNodeGB:   disk_per_node,
+		MemoryPerNodeGB: memory,
+		HeapPerNodeGB:   heap,
+		CPUPerNode:      cpu,
+	}
+	log.Info().Msgf("restore plan for %d indices is: %+v", len(indices), plan)
+
+	return plan
+}
+
+// StoreSize is the per node volume size in kubernetes quantity format
+func (p Plan) StoreSize() string {
+	return fmt.Sprintf("%.0fGi", p.DiskPerNodeGB)
+}
+
+// NodeResources converts the plan to the RestoreTask node resources
+func (p Plan) NodeResources() *restorev1.NodeResources {
+	return &restorev1.NodeResources{
+		Count:  p.NodeCount,
+		CPU:    fmt.Sprintf("%g", p.CPUPerNode),
+		Memory: fmt.Sprintf("%.0fGi", p.MemoryPerNodeGB),
+		Heap:   fmt.Sprintf("%.0fg", p.HeapPerNodeGB),
+	}
+}
+
+// clamp limits v to [low, high], a non-positive bound is ignored
+func clamp(v, low, high float64) float64 {
+	if low > 0 && v < low {
+		v = low
+	}
+	if high > 0 && v > high {
+		v = high
+	}
+	return v
+}
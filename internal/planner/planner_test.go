@@ -0,0 +1,78 @@
+package planner
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	restorev1 "github.com/404LifeFound/es-snapshot-restore/internal/controller/api/v1"
+)
+
+var _ = Describe("NewPlan", func() {
+	bounded := config.Sizing{
+		MaxDiskPerNode:   100,
+		HighWatermark:    0.5,
+		DataRatio:        10,
+		MinMemory:        2,
+		MaxMemory:        64,
+		HeapRatio:        0.5,
+		MaxHeap:          31,
+		MemoryPerCPU:     4,
+		MaxCPU:           8,
+		MaxShardsPerNode: 10,
+	}
+	unbounded := config.Sizing{
+		DataRatio:    1,
+		MaxMemory:    64,
+		HeapRatio:    0.5,
+		MaxHeap:      31,
+		MemoryPerCPU: 4,
+		MaxCPU:       8,
+	}
+
+	BeforeEach(func() {
+		saved := config.GlobalConfig
+		DeferCleanup(func() { config.GlobalConfig = saved })
+		config.GlobalConfig.ES.RestoreCount = 1
+		config.GlobalConfig.ES.DiskMinSize = 10
+	})
+
+	DescribeTable("sizes the restore nodes",
+		func(sizing config.Sizing, indices []IndexSize, expected Plan) {
+			config.GlobalConfig.Sizing = sizing
+			Expect(NewPlan(indices)).To(Equal(expected))
+		},
+		Entry("with the disk floor and the memory floor when there is nothing to restore", bounded,
+			nil,
+			Plan{NodeCount: 1, DataGB: 0, Shards: 0, DiskPerNodeGB: 10, MemoryPerNodeGB: 2, HeapPerNodeGB: 1, CPUPerNode: 1}),
+		Entry("with watermark headroom on one node", bounded,
+			[]IndexSize{{Name: "a", PrimaryGB: 20, Shards: 2}},
+			Plan{NodeCount: 1, DataGB: 20, Shards: 2, DiskPerNodeGB: 40, MemoryPerNodeGB: 2, HeapPerNodeGB: 1, CPUPerNode: 1}),
+		Entry("counting an index without shards as one shard", bounded,
+			[]IndexSize{{Name: "a", PrimaryGB: 4}},
+			Plan{NodeCount: 1, DataGB: 4, Shards: 1, DiskPerNodeGB: 10, MemoryPerNodeGB: 2, HeapPerNodeGB: 1, CPUPerNode: 1}),
+		Entry("on a node per copy so a replica is never beside its primary", bounded,
+			[]IndexSize{{Name: "a", PrimaryGB: 20, Shards: 2, Replicas: 1}},
+			Plan{NodeCount: 2, DataGB: 40, Shards: 4, DiskPerNodeGB: 40, MemoryPerNodeGB: 2, HeapPerNodeGB: 1, CPUPerNode: 1}),
+		Entry("on enough nodes for the max disk per node", bounded,
+			[]IndexSize{{Name: "a", PrimaryGB: 100, Shards: 3}, {Name: "b", PrimaryGB: 50, Shards: 2}},
+			Plan{NodeCount: 3, DataGB: 150, Shards: 5, DiskPerNodeGB: 100, MemoryPerNodeGB: 5, HeapPerNodeGB: 2, CPUPerNode: 2}),
+		Entry("on enough nodes for the max shards per node", bounded,
+			[]IndexSize{{Name: "a", PrimaryGB: 1, Shards: 25}},
+			Plan{NodeCount: 3, DataGB: 1, Shards: 25, DiskPerNodeGB: 10, MemoryPerNodeGB: 2, HeapPerNodeGB: 1, CPUPerNode: 1}),
+		Entry("with memory, heap and cpu capped", unbounded,
+			[]IndexSize{{Name: "a", PrimaryGB: 100, Shards: 1}},
+			Plan{NodeCount: 1, DataGB: 100, Shards: 1, DiskPerNodeGB: 100, MemoryPerNodeGB: 64, HeapPerNodeGB: 31, CPUPerNode: 8}),
+	)
+
+	DescribeTable("converts the plan to the node resources",
+		func(plan Plan, store_size string, expected restorev1.NodeResources) {
+			Expect(plan.StoreSize()).To(Equal(store_size))
+			Expect(*plan.NodeResources()).To(Equal(expected))
+		},
+		Entry("of one node", Plan{NodeCount: 1, DiskPerNodeGB: 40, MemoryPerNodeGB: 2, HeapPerNodeGB: 1, CPUPerNode: 1},
+			"40Gi", restorev1.NodeResources{Count: 1, CPU: "1", Memory: "2Gi", Heap: "1g"}),
+		Entry("of several nodes", Plan{NodeCount: 3, DiskPerNodeGB: 100, MemoryPerNodeGB: 5, HeapPerNodeGB: 2, CPUPerNode: 2},
+			"100Gi", restorev1.NodeResources{Count: 3, CPU: "2", Memory: "5Gi", Heap: "2g"}),
+	)
+})
@@ -0,0 +1,270 @@
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/404LifeFound/es-snapshot-restore/internal/budget"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// ErrDenied is returned when a rule denies the restore
+	ErrDenied = errors.New("restore denied by policy")
+	// ErrApprovalRequired is returned when a rule requires the restore to be approved first
+	ErrApprovalRequired = errors.New("restore requires approval")
+)
+
+type Effect string
+
+const (
+	EffectAllow           Effect = "allow"
+	EffectDeny            Effect = "deny"
+	EffectRequireApproval Effect = "require_approval"
+)
+
+func ParseEffect(s string) (Effect, error) {
+	switch e := Effect(s); e {
+	case EffectAllow, EffectDeny, EffectRequireApproval:
+		return e, nil
+	}
+	return "", fmt.Errorf("invalid effect %s, should be one of allow, deny or require_approval", s)
+}
+
+// Identity is the caller of a restore, Role is empty for a RestoreTask created through kubernetes
+type Identity struct {
+	Subject string
+	Role    string
+	Team    string
+	Groups  []string
+}
+
+// Snapshot is the snapshot an index is restored from
+type Snapshot struct {
+	Index      string
+	Repository string
+	Snapshot   string
+	StartTime  time.Time
+}
+
+// Input is what the rules are evaluated over
+type Input struct {
+	// Request is the restore request as its json fields
+	Request   map[string]any
+	Identity  Identity
+	Indices   []string
+	SizeGB    float64
+	NodeCount int32
+	Snapshots []Snapshot
+}
+
+// Decision is the outcome of the rules for a restore, Rule is empty when the default decided
+type Decision struct {
+	Effect Effect `json:"effect"`
+	Rule   string `json:"rule,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Err is the error of a decision not allowing the restore
+func (d Decision) Err() error {
+	switch d.Effect {
+	case EffectDeny:
+		return fmt.Errorf("%w: %s", ErrDenied, d.Reason)
+	case EffectRequireApproval:
+		return fmt.Errorf("%w: %s", ErrApprovalRequired, d.Reason)
+	}
+	return nil
+}
+
+type rule struct {
+	name    string
+	effect  Effect
+	reason  string
+	program cel.Program
+}
+
+// Engine evaluates the policy rules of the restores in order, the first rule whose expression is true decides
+type Engine struct {
+	enabled bool
+	deflt   Effect
+	rules   []rule
+	budget  *budget.Budget
+}
+
+func NewEngine(b *budget.Budget) (*Engine, error) {
+	cfg := config.GlobalConfig.Policy
+	e := &Engine{enabled: cfg.Enabled, deflt: EffectAllow, budget: b}
+	if !e.enabled {
+		return e, nil
+	}
+
+	if cfg.Default != "" {
+		deflt, err := ParseEffect(cfg.Default)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy.default: %w", err)
+		}
+		e.deflt = deflt
+	}
+
+	env, err := cel.NewEnv(
+		cel.Variable("request", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("identity", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("plan", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("usage", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("now", cel.TimestampType),
+		cel.CrossTypeNumericComparisons(true),
+		ext.Strings(),
+		ext.Lists(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create policy environment: %w", err)
+	}
+
+	for i, r := range cfg.Rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i)
+		}
+		effect, err := ParseEffect(r.Effect)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy rule %s: %w", r.Name, err)
+		}
+		ast, issues := env.Compile(r.Expression)
+		if issues.Err() != nil {
+			return nil, fmt.Errorf("invalid expression of policy rule %s: %w", r.Name, issues.Err())
+		}
+		if ast.OutputType() != cel.BoolType && ast.OutputType() != cel.DynType {
+			return nil, fmt.Errorf("expression of policy rule %s is %s, not bool", r.Name, ast.OutputType())
+		}
+		program, err := env.Program(ast)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build policy rule %s: %w", r.Name, err)
+		}
+		e.rules = append(e.rules, rule{name: r.Name, effect: effect, reason: r.Reason, program: program})
+	}
+
+	log.Info().Msgf("restore admission policy enabled with %d rules, default %s", len(e.rules), e.deflt)
+	return e, nil
+}
+
+// Enabled reports whether the restores are admitted by the rules
+func (e *Engine) Enabled() bool {
+	return e.enabled
+}
+
+// Evaluate decides whether the restore of in is allowed. A rule failing to evaluate denies it, so a broken rule
+// never lets a restore through.
+func (e *Engine) Evaluate(in Input) Decision {
+	if !e.enabled {
+		return Decision{Effect: EffectAllow}
+	}
+
+	vars := e.variables(in)
+	for _, r := range e.rules {
+		out, _, err := r.program.Eval(vars)
+		if err != nil {
+			log.Error().Err(err).Msgf("failed to evaluate policy rule %s", r.name)
+			return Decision{Effect: EffectDeny, Rule: r.name, Reason: fmt.Sprintf("failed to evaluate policy rule %s: %s", r.name, err.Error())}
+		}
+		matched, ok := out.Value().(bool)
+		if !ok {
+			return Decision{Effect: EffectDeny, Rule: r.name, Reason: fmt.Sprintf("policy rule %s is %v, not bool", r.name, out.Value())}
+		}
+		if matched {
+			reason := r.reason
+			if reason == "" {
+				reason = fmt.Sprintf("policy rule %s matched", r.name)
+			}
+			return Decision{Effect: r.effect, Rule: r.name, Reason: reason}
+		}
+	}
+
+	return Decision{Effect: e.deflt, Reason: fmt.Sprintf("no policy rule matched, default is %s", e.deflt)}
+}
+
+// variables are the CEL variables of in: the request, the identity, the plan with the age of its snapshots and
+// the usage of the cluster and of the team of the caller
+func (e *Engine) variables(in Input) map[string]any {
+	now := time.Now()
+
+	snapshots := make([]any, 0, len(in.Snapshots))
+	var max_age time.Duration
+	for _, s := range in.Snapshots {
+		age := now.Sub(s.StartTime)
+		if s.StartTime.IsZero() {
+			age = 0
+		}
+		max_age = max(max_age, age)
+		snapshots = append(snapshots, map[string]any{
+			"index":      s.Index,
+			"repository": s.Repository,
+			"snapshot":   s.Snapshot,
+			"start_time": s.StartTime,
+			"age":        age,
+		})
+	}
+
+	// a caller without team uses nothing of a team
+	usage := map[string]any{"cluster": usageOf(budget.Usage{}), "team": usageOf(budget.Usage{})}
+	if cluster, err := e.budget.Usage(""); err == nil {
+		usage["cluster"] = usageOf(cluster)
+	}
+	if in.Identity.Team != "" {
+		if team, err := e.budget.Usage(in.Identity.Team); err == nil {
+			usage["team"] = usageOf(team)
+		}
+	}
+
+	// the rules may test the labels of any request
+	request := map[string]any{"labels": map[string]any{}}
+	for k, v := range in.Request {
+		if v != nil {
+			request[k] = v
+		}
+	}
+
+	return map[string]any{
+		"request": request,
+		"identity": map[string]any{
+			"subject": in.Identity.Subject,
+			"role":    in.Identity.Role,
+			"team":    in.Identity.Team,
+			"groups":  append([]string{}, in.Identity.Groups...),
+		},
+		"plan": map[string]any{
+			"indices":          append([]string{}, in.Indices...),
+			"size_gb":          in.SizeGB,
+			"node_count":       int64(in.NodeCount),
+			"snapshots":        snapshots,
+			"max_snapshot_age": max_age,
+		},
+		"usage": usage,
+		"now":   now,
+	}
+}
+
+func usageOf(u budget.Usage) map[string]any {
+	return map[string]any{
+		"disk_gb":   u.DiskGB,
+		"cpu":       u.CPU,
+		"memory_gb": u.MemoryGB,
+	}
+}
+
+// RequestOf is the json fields of request, the shape the rules read it in
+func RequestOf(request any) map[string]any {
+	m := map[string]any{}
+	b, err := json.Marshal(request)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to encode the request of a policy evaluation")
+		return m
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		log.Error().Err(err).Msg("failed to decode the request of a policy evaluation")
+	}
+	return m
+}
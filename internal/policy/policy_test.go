@@ -0,0 +1,173 @@
+package policy
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/404LifeFound/es-snapshot-restore/internal/budget"
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
+)
+
+var _ = Describe("Engine", func() {
+	var b *budget.Budget
+
+	BeforeEach(func() {
+		saved := config.GlobalConfig
+		DeferCleanup(func() { config.GlobalConfig = saved })
+
+		// the search team uses 80GB of disk
+		b = &budget.Budget{DBClient: newTestDB()}
+		Expect(db.CreateRecords(b.DBClient, &[]db.RestoreNode{
+			{Name: "search-node", Team: "search", StoreSize: "80Gi", Count: 1, CPU: "2", Memory: "8Gi", Status: string(utils.NodeActive)},
+		})).To(Succeed())
+	})
+
+	DescribeTable("compiles the rules",
+		func(policy config.Policy, expected string) {
+			config.GlobalConfig.Policy = policy
+			e, err := NewEngine(b)
+			if expected != "" {
+				Expect(err).To(MatchError(ContainSubstring(expected)))
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(e.Enabled()).To(Equal(policy.Enabled))
+		},
+		Entry("without checking them when disabled", config.Policy{
+			Rules: []config.PolicyRule{{Name: "broken", Expression: "plan.size_gb >", Effect: "deny"}},
+		}, ""),
+		Entry("when they are valid", config.Policy{
+			Enabled: true,
+			Default: "require_approval",
+			Rules:   []config.PolicyRule{{Name: "huge", Expression: "plan.size_gb > 500", Effect: "deny"}},
+		}, ""),
+		Entry("rejecting an invalid default", config.Policy{
+			Enabled: true,
+			Default: "maybe",
+		}, "invalid policy.default"),
+		Entry("rejecting an invalid effect", config.Policy{
+			Enabled: true,
+			Rules:   []config.PolicyRule{{Name: "huge", Expression: "plan.size_gb > 500", Effect: "block"}},
+		}, "invalid policy rule huge"),
+		Entry("rejecting a syntax error", config.Policy{
+			Enabled: true,
+			Rules:   []config.PolicyRule{{Name: "huge", Expression: "plan.size_gb >", Effect: "deny"}},
+		}, "invalid expression of policy rule huge"),
+		Entry("rejecting an undeclared variable", config.Policy{
+			Enabled: true,
+			Rules:   []config.PolicyRule{{Name: "huge", Expression: "size_gb > 500", Effect: "deny"}},
+		}, "invalid expression of policy rule huge"),
+		Entry("rejecting an expression which isn't bool", config.Policy{
+			Enabled: true,
+			Rules:   []config.PolicyRule{{Name: "name", Expression: `identity.subject + "-restore"`, Effect: "deny"}},
+		}, "not bool"),
+		Entry("naming an unnamed rule after its position", config.Policy{
+			Enabled: true,
+			Rules: []config.PolicyRule{
+				{Name: "huge", Expression: "plan.size_gb > 500", Effect: "deny"},
+				{Expression: "plan.size_gb >", Effect: "deny"},
+			},
+		}, "invalid expression of policy rule rule-1"),
+	)
+
+	Describe("evaluates the rules", func() {
+		rules := []config.PolicyRule{
+			{Name: "admins", Expression: `identity.role == "admin"`, Effect: "allow"},
+			{Name: "huge", Expression: "plan.size_gb > 500", Effect: "deny", Reason: "restores over 500GB are denied"},
+			{Name: "stale", Expression: `plan.max_snapshot_age > duration("720h")`, Effect: "deny"},
+			{Name: "team-quota", Expression: "usage.team.disk_gb + plan.size_gb > 100", Effect: "deny"},
+			{Name: "prod", Expression: `plan.indices.exists(i, i.startsWith("prod-"))`, Effect: "require_approval"},
+			{Expression: `!("ticket" in request.labels) && plan.node_count > 3`, Effect: "require_approval"},
+			{Name: "replicas", Expression: "request.replicas > 1", Effect: "deny"},
+		}
+
+		input := func(role, team string, indices []string, size_gb float64, node_count int32, age time.Duration, request map[string]any) Input {
+			return Input{
+				Request:   request,
+				Identity:  Identity{Subject: "alice", Role: role, Team: team},
+				Indices:   indices,
+				SizeGB:    size_gb,
+				NodeCount: node_count,
+				Snapshots: []Snapshot{{Index: indices[0], Repository: "repo", Snapshot: "snap", StartTime: time.Now().Add(-age)}},
+			}
+		}
+		request := map[string]any{"replicas": float64(0)}
+
+		DescribeTable("the first matching rule decides",
+			func(in Input, effect Effect, rule string, reason string) {
+				config.GlobalConfig.Policy = config.Policy{Enabled: true, Rules: rules}
+				e, err := NewEngine(b)
+				Expect(err).NotTo(HaveOccurred())
+
+				decision := e.Evaluate(in)
+				Expect(decision.Effect).To(Equal(effect))
+				Expect(decision.Rule).To(Equal(rule))
+				Expect(decision.Reason).To(ContainSubstring(reason))
+			},
+			Entry("allowing what no rule matches by default",
+				input("requester", "logs", []string{"logs-1"}, 10, 1, 24*time.Hour, request),
+				EffectAllow, "", "no policy rule matched"),
+			Entry("allowing an admin before any other rule",
+				input("admin", "logs", []string{"prod-1"}, 1000, 1, 24*time.Hour, request),
+				EffectAllow, "admins", "policy rule admins matched"),
+			Entry("with the reason of the rule",
+				input("requester", "logs", []string{"logs-1"}, 1000, 1, 24*time.Hour, request),
+				EffectDeny, "huge", "restores over 500GB are denied"),
+			Entry("over the age of the oldest snapshot",
+				input("requester", "logs", []string{"logs-1"}, 10, 1, 40*24*time.Hour, request),
+				EffectDeny, "stale", "policy rule stale matched"),
+			Entry("over the usage of the team of the caller",
+				input("requester", "search", []string{"logs-1"}, 30, 1, 24*time.Hour, request),
+				EffectDeny, "team-quota", ""),
+			Entry("within the usage of the team of the caller",
+				input("requester", "search", []string{"logs-1"}, 10, 1, 24*time.Hour, request),
+				EffectAllow, "", ""),
+			Entry("over the indices",
+				input("requester", "logs", []string{"logs-1", "prod-1"}, 10, 1, 24*time.Hour, request),
+				EffectRequireApproval, "prod", ""),
+			Entry("named after its position when unnamed",
+				input("requester", "logs", []string{"logs-1"}, 10, 4, 24*time.Hour, request),
+				EffectRequireApproval, "rule-5", ""),
+			Entry("over the labels of the request",
+				input("requester", "logs", []string{"logs-1"}, 10, 4, 24*time.Hour, map[string]any{"replicas": float64(0), "labels": map[string]any{"ticket": "OPS-1"}}),
+				EffectAllow, "", ""),
+			Entry("over the fields of the request",
+				input("requester", "logs", []string{"logs-1"}, 10, 1, 24*time.Hour, map[string]any{"replicas": float64(2)}),
+				EffectDeny, "replicas", ""),
+			Entry("denying when a rule fails to evaluate",
+				input("requester", "logs", []string{"logs-1"}, 10, 1, 24*time.Hour, map[string]any{}),
+				EffectDeny, "replicas", "failed to evaluate policy rule replicas"),
+		)
+	})
+
+	DescribeTable("falls back to the default",
+		func(policy config.Policy, effect Effect) {
+			config.GlobalConfig.Policy = policy
+			e, err := NewEngine(b)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(e.Evaluate(Input{Indices: []string{"logs-1"}}).Effect).To(Equal(effect))
+		},
+		Entry("allowing every restore when disabled", config.Policy{Default: "deny"}, EffectAllow),
+		Entry("allowing when no default is set", config.Policy{Enabled: true}, EffectAllow),
+		Entry("denying", config.Policy{Enabled: true, Default: "deny"}, EffectDeny),
+		Entry("requiring an approval", config.Policy{Enabled: true, Default: "require_approval"}, EffectRequireApproval),
+	)
+
+	DescribeTable("Decision.Err",
+		func(decision Decision, expected error) {
+			if expected == nil {
+				Expect(decision.Err()).NotTo(HaveOccurred())
+				return
+			}
+			Expect(decision.Err()).To(MatchError(expected))
+			Expect(decision.Err()).To(MatchError(ContainSubstring(decision.Reason)))
+		},
+		Entry("is nil when allowed", Decision{Effect: EffectAllow}, nil),
+		Entry("is ErrDenied when denied", Decision{Effect: EffectDeny, Reason: "too big"}, ErrDenied),
+		Entry("is ErrApprovalRequired when an approval is required", Decision{Effect: EffectRequireApproval, Reason: "prod"}, ErrApprovalRequired),
+	)
+})
@@ -0,0 +1,421 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/404LifeFound/es-snapshot-restore/internal/audit"
+	"github.com/404LifeFound/es-snapshot-restore/internal/budget"
+	restorev1 "github.com/404LifeFound/es-snapshot-restore/internal/controller/api/v1"
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/404LifeFound/es-snapshot-restore/internal/elastic"
+	"github.com/404LifeFound/es-snapshot-restore/internal/provisioner"
+	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// Pool keeps the restore nodes warm between tasks, a task is placed on a node with enough free disk before a
+// node is grown or added
+type Pool struct {
+	ESClient    *elastic.ES
+	DBClient    *gorm.DB
+	Provisioner provisioner.Provisioner
+	Budget      *budget.Budget
+	Auditor     *audit.Auditor
+	mu          sync.Mutex // serializes the placement decisions
+}
+
+func NewPool(es_client *elastic.ES, db_client *gorm.DB, p provisioner.Provisioner, b *budget.Budget, auditor *audit.Auditor) *Pool {
+	return &Pool{
+		ESClient:    es_client,
+		DBClient:    db_client,
+		Provisioner: p,
+		Budget:      b,
+		Auditor:     auditor,
+	}
+}
+
+// pooled reports whether the restore node of req can be shared, a restore cluster is dedicated to its task
+func (p *Pool) pooled(req provisioner.Request) bool {
+	return config.GlobalConfig.Pool.Enabled && req.Isolation != restorev1.IsolationCluster
+}
+
+// Acquire places tasks restoring req.StoreSize per node on a restore node and returns req with its name and
+// per node store size. An active node with enough free disk is reused, otherwise an active node is grown while it
+// stays below sizing.maxdiskpernode, otherwise a new node is added. Growing or adding a node is charged to the
+// budget, which returns budget.ErrExhausted when the tasks have to wait for capacity to be released.
+func (p *Pool) Acquire(ctx context.Context, req provisioner.Request, tasks int) (provisioner.Request, error) {
+	if !p.Provisioner.Managed() {
+		if req.Name == "" {
+			req.Name = utils.RandomName()
+		}
+		return req, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if req.Name != "" || !p.pooled(req) {
+		return p.reserve(req, tasks)
+	}
+
+	required, err := utils.ToGB(req.StoreSize)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to transfer %s to float", req.StoreSize)
+		return req, err
+	}
+
+	nodes, err := db.QueryAll[db.RestoreNode](p.DBClient, "last_used_at desc", 0,
+		"status = ? AND isolation = ? AND team = ?", string(utils.NodeActive), string(restorev1.IsolationNodeSet), req.Team,
+	)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to query active restore nodes")
+		return req, err
+	}
+
+	var reuse, grow *db.RestoreNode
+	var grow_size float64
+	if len(nodes) > 0 {
+		allocations, err := p.ESClient.GetAllocation(ctx)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get disk allocation of nodes")
+			return req, err
+		}
+
+		for i := range nodes {
+			free, err := p.freeGB(ctx, nodes[i].Name, allocations)
+			if err != nil {
+				return req, err
+			}
+			log.Info().Msgf("restore node %s has %.2fGB free disk per node, %.2fGB required", nodes[i].Name, free, required)
+
+			if free >= required {
+				reuse = &nodes[i]
+				break
+			}
+
+			size, err := utils.ToGB(nodes[i].StoreSize)
+			if err != nil {
+				continue
+			}
+			size += required - math.Max(free, 0)
+			if grow == nil && size <= config.GlobalConfig.Sizing.MaxDiskPerNode {
+				grow = &nodes[i]
+				grow_size = size
+			}
+		}
+	}
+
+	updates := map[string]any{
+		"ActiveTasks": gorm.Expr("active_tasks + ?", tasks),
+		"LastUsedAt":  time.Now(),
+	}
+
+	switch {
+	case reuse != nil:
+		log.Info().Msgf("place %d tasks on restore node %s", tasks, reuse.Name)
+		req.Name = reuse.Name
+		req.StoreSize = reuse.StoreSize
+	case grow != nil:
+		store_size := fmt.Sprintf("%.0fGi", math.Ceil(grow_size))
+		grown := *grow
+		grown.StoreSize = store_size
+		if err := p.Budget.Admit(req.Team, budget.NodeUsage(grown).Sub(budget.NodeUsage(*grow))); err != nil {
+			log.Info().Err(err).Msgf("restore node %s can't grow to %s", grow.Name, store_size)
+			return req, err
+		}
+
+		log.Info().Msgf("place %d tasks on restore node %s growing to %s", tasks, grow.Name, store_size)
+		req.Name = grow.Name
+		req.StoreSize = store_size
+		updates["StoreSize"] = req.StoreSize
+	default:
+		req.Name = utils.RandomName()
+		log.Info().Msgf("no restore node has %.2fGB free disk, add restore node %s", required, req.Name)
+		return p.reserve(req, tasks)
+	}
+
+	if err := p.DBClient.Model(&db.RestoreNode{}).Where("name = ?", req.Name).Updates(updates).Error; err != nil {
+		log.Error().Err(err).Msgf("failed to update restore node %s", req.Name)
+		return req, err
+	}
+
+	return req, nil
+}
+
+// reserve records the restore node of req, charging it to the budget when it isn't recorded yet
+func (p *Pool) reserve(req provisioner.Request, tasks int) (provisioner.Request, error) {
+	if req.Name == "" {
+		req.Name = utils.RandomName()
+	}
+
+	nodes, err := db.QueryAll[db.RestoreNode](p.DBClient, "", 0, "name = ?", req.Name)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to query restore node %s", req.Name)
+		return req, err
+	}
+
+	if len(nodes) > 0 {
+		if err := p.DBClient.Model(&nodes[0]).Updates(map[string]any{
+			"ActiveTasks": gorm.Expr("active_tasks + ?", tasks),
+			"LastUsedAt":  time.Now(),
+		}).Error; err != nil {
+			log.Error().Err(err).Msgf("failed to update restore node %s", req.Name)
+			return req, err
+		}
+		return req, nil
+	}
+
+	node := db.RestoreNode{
+		Name:        req.Name,
+		Team:        req.Team,
+		Isolation:   string(req.Isolation),
+		StoreSize:   req.StoreSize,
+		Status:      string(utils.NodeActive),
+		ActiveTasks: tasks,
+		LastUsedAt:  time.Now(),
+	}
+	if req.Resources != nil {
+		node.Count = req.Resources.Count
+		node.CPU = req.Resources.CPU
+		node.Memory = req.Resources.Memory
+	}
+
+	if err := p.Budget.Admit(req.Team, budget.NodeUsage(node)); err != nil {
+		log.Info().Err(err).Msgf("restore node %s is not admitted", req.Name)
+		return req, err
+	}
+
+	if err := p.DBClient.Create(&node).Error; err != nil {
+		log.Error().Err(err).Msgf("failed to record restore node %s", req.Name)
+		return req, err
+	}
+
+	return req, nil
+}
+
+// Recorded reports whether the restore node name was placed by the pool
+func (p *Pool) Recorded(name string) (bool, error) {
+	var count int64
+	if err := p.DBClient.Model(&db.RestoreNode{}).Where("name = ?", name).Count(&count).Error; err != nil {
+		log.Error().Err(err).Msgf("failed to query restore node %s", name)
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// Forget deletes the record of the restore node name torn down outside the pool, releasing its budget
+func (p *Pool) Forget(name string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.DBClient.Unscoped().Where("name = ?", name).Delete(&db.RestoreNode{}).Error; err != nil {
+		log.Error().Err(err).Msgf("failed to delete restore node %s record", name)
+		return err
+	}
+	return nil
+}
+
+// freeGB is the smallest free disk below the high watermark across the Elasticsearch nodes of the restore node
+func (p *Pool) freeGB(ctx context.Context, name string, allocations []elastic.Allocation) (float64, error) {
+	es_nodes, err := p.ESClient.GetNodesByAttr(ctx, config.GlobalConfig.ES.RestoreKey, name)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to get nodes of restore node %s", name)
+		return 0, err
+	}
+
+	if len(es_nodes) == 0 {
+		return 0, nil
+	}
+
+	in_node := make(map[string]bool)
+	for _, n := range es_nodes {
+		in_node[n] = true
+	}
+
+	free := math.Inf(1)
+	for _, a := range allocations {
+		if !in_node[a.Node] {
+			continue
+		}
+
+		usable := a.AvailGB() - a.TotalGB()*(1-config.GlobalConfig.Sizing.HighWatermark)
+		free = math.Min(free, usable)
+	}
+
+	if math.IsInf(free, 1) {
+		return 0, nil
+	}
+	return free, nil
+}
+
+// Release marks a task placed on the restore node name as done, the node becomes idle with its last task
+func (p *Pool) Release(name string) {
+	if err := p.DBClient.Model(&db.RestoreNode{}).
+		Where("name = ? AND active_tasks > 0", name).
+		Updates(map[string]any{
+			"ActiveTasks": gorm.Expr("active_tasks - 1"),
+			"LastUsedAt":  time.Now(),
+		}).Error; err != nil {
+		log.Error().Err(err).Msgf("failed to release restore node %s", name)
+	}
+}
+
+// ReclaimAt returns when the idle restore node is reclaimed, pool.idletimeout minutes after its last task unless a
+// restored task holds it longer. It returns false when a restored task holds it until it is released.
+func (p *Pool) ReclaimAt(node db.RestoreNode) (time.Time, bool, error) {
+	at := node.LastUsedAt.Add(time.Duration(config.GlobalConfig.Pool.IdleTimeout) * time.Minute)
+	tasks, err := db.QueryAll[db.Task](p.DBClient, "", 0, "node = ? AND status = ? AND released_at IS NULL", node.Name, string(utils.TaskSuccess))
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to query restored tasks of restore node %s", node.Name)
+		return at, false, err
+	}
+
+	for _, t := range tasks {
+		if config.GlobalConfig.Pool.TaskTTL <= 0 || t.FinishedAt == nil {
+			return at, false, nil
+		}
+		if expires_at := t.FinishedAt.Add(time.Duration(config.GlobalConfig.Pool.TaskTTL) * time.Minute); expires_at.After(at) {
+			at = expires_at
+		}
+	}
+	return at, true, nil
+}
+
+// Expiry is when an idle restore node is reclaimed
+type Expiry struct {
+	Node db.RestoreNode
+	At   time.Time
+}
+
+// Expiring returns the idle restore nodes reclaimed within d, none unless pool.reclaim is set
+func (p *Pool) Expiring(d time.Duration) ([]Expiry, error) {
+	if !config.GlobalConfig.Pool.Reclaim {
+		return nil, nil
+	}
+
+	nodes, err := db.QueryAll[db.RestoreNode](p.DBClient, "", 0, "status = ? AND active_tasks = 0", string(utils.NodeActive))
+	if err != nil {
+		log.Error().Err(err).Msg("failed to query idle restore nodes")
+		return nil, err
+	}
+
+	var expiring []Expiry
+	for _, node := range nodes {
+		at, reclaimed, err := p.ReclaimAt(node)
+		if err != nil || !reclaimed || time.Until(at) > d {
+			continue
+		}
+		expiring = append(expiring, Expiry{Node: node, At: at})
+	}
+	return expiring, nil
+}
+
+// Reap deletes the restored indices of the idle restore nodes past their ReclaimAt and tears them down, the
+// deletion is audited before the indices are deleted
+func (p *Pool) Reap(ctx context.Context) error {
+	if !config.GlobalConfig.Pool.Reclaim {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	nodes, err := db.QueryAll[db.RestoreNode](p.DBClient, "", 0,
+		"status IN ? AND active_tasks = 0",
+		[]string{string(utils.NodeActive), string(utils.NodeReclaiming)},
+	)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to query idle restore nodes")
+		return err
+	}
+
+	for _, node := range nodes {
+		// a node left reclaiming by a failed reclaim is reclaimed again
+		if node.Status == string(utils.NodeActive) {
+			at, reclaimed, err := p.ReclaimAt(node)
+			if err != nil || !reclaimed || time.Now().Before(at) {
+				continue
+			}
+		}
+
+		log.Info().Msgf("reclaim restore node %s idle since %s", node.Name, node.LastUsedAt)
+		if err := p.DBClient.Model(&node).Update("Status", string(utils.NodeReclaiming)).Error; err != nil {
+			log.Error().Err(err).Msgf("failed to mark restore node %s reclaiming", node.Name)
+			continue
+		}
+
+		if err := p.deleteRestoredIndices(ctx, node.Name); err != nil {
+			p.audit("reclaimNode", node.Name, "", err)
+			continue
+		}
+
+		req := provisioner.NewRequest(node.Name, node.StoreSize)
+		req.Isolation = restorev1.IsolationMode(node.Isolation)
+		if err := p.Provisioner.Teardown(ctx, req); err != nil {
+			log.Error().Err(err).Msgf("failed to tear down restore node %s", node.Name)
+			p.audit("reclaimNode", node.Name, "", err)
+			continue
+		}
+		p.audit("reclaimNode", node.Name, "", nil)
+
+		if err := p.DBClient.Unscoped().Delete(&node).Error; err != nil {
+			log.Error().Err(err).Msgf("failed to delete restore node %s record", node.Name)
+		}
+	}
+
+	return nil
+}
+
+// audit records action of the reaper on the idle restore node name in the audit log, err is why it failed
+func (p *Pool) audit(action, name, message string, err error) {
+	entry := audit.Entry{
+		Actor:   "reaper",
+		Source:  audit.SourceCron,
+		Action:  action,
+		Target:  name,
+		Outcome: audit.OutcomeSuccess,
+		Message: message,
+	}
+	if err != nil {
+		entry.Outcome = audit.OutcomeFailure
+		entry.Message = err.Error()
+	}
+	p.Auditor.Record(entry)
+}
+
+// deleteRestoredIndices deletes the indices restored onto the restore node name, which would turn red without it
+func (p *Pool) deleteRestoredIndices(ctx context.Context, name string) error {
+	indices, err := p.ESClient.GetAllIndex(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to get all index from elasticsearch")
+		return err
+	}
+
+	prefix := elastic.RestoredIndexName(config.GlobalConfig.ES.RestoreKey, name, "")
+	var restored []string
+	for _, i := range indices {
+		if strings.HasPrefix(i.Name, prefix) {
+			restored = append(restored, i.Name)
+		}
+	}
+
+	if len(restored) == 0 {
+		return nil
+	}
+
+	log.Info().Msgf("delete indices %v restored onto restore node %s", restored, name)
+	p.audit("deleteRestoredIndices", name, strings.Join(restored, ","), nil)
+	if err := p.ESClient.DeleteIndices(ctx, restored); err != nil {
+		log.Error().Err(err).Msgf("failed to delete indices restored onto restore node %s", name)
+		return err
+	}
+
+	return nil
+}
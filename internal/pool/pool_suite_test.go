@@ -0,0 +1,109 @@
+package pool
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/404LifeFound/es-snapshot-restore/internal/elastic"
+	"github.com/404LifeFound/es-snapshot-restore/internal/provisioner"
+)
+
+func TestPool(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "Pool Suite")
+}
+
+// newTestDB opens a sqlite db of the restore nodes and their tasks, removed after the spec
+func newTestDB() *gorm.DB {
+	db_client, err := gorm.Open(sqlite.Open(filepath.Join(GinkgoT().TempDir(), "pool.db")), &gorm.Config{
+		Logger: logger.Discard,
+	})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(db_client.AutoMigrate(&db.RestoreNode{}, &db.Task{}, &db.AuditEntry{})).To(Succeed())
+	return db_client
+}
+
+// fakeES replies to the cat requests of an Elasticsearch client with the json of the same path prefix in cat,
+// and records the other requests
+type fakeES struct {
+	mu       sync.Mutex
+	cat      map[string]string
+	requests []string
+}
+
+// Requests returns the method and path of the requests received so far, but the cat ones
+func (f *fakeES) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+// newFakeES serves an Elasticsearch client with f
+func newFakeES(f *fakeES) *elastic.ES {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.Header().Set("Content-Type", "application/json")
+		for prefix, body := range f.cat {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				w.Write([]byte(body))
+				return
+			}
+		}
+		f.mu.Lock()
+		f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+		f.mu.Unlock()
+		w.Write([]byte("{}"))
+	}))
+	DeferCleanup(srv.Close)
+
+	es, err := elastic.NewES(elastic.NewESConfig(elastic.WithAddr([]string{srv.URL})))
+	Expect(err).NotTo(HaveOccurred())
+	return es
+}
+
+// fakeProvisioner manages restore nodes which are always ready, and records the ones torn down
+type fakeProvisioner struct {
+	torndown []string
+}
+
+func (p *fakeProvisioner) Exists(ctx context.Context, req provisioner.Request) (bool, error) {
+	return true, nil
+}
+
+func (p *fakeProvisioner) Create(ctx context.Context, req provisioner.Request) error {
+	return nil
+}
+
+func (p *fakeProvisioner) Grow(ctx context.Context, req provisioner.Request) (bool, error) {
+	return true, nil
+}
+
+func (p *fakeProvisioner) Ready(ctx context.Context, req provisioner.Request) (bool, error) {
+	return true, nil
+}
+
+func (p *fakeProvisioner) Target(ctx context.Context, req provisioner.Request, repository string) (*provisioner.Target, error) {
+	return &provisioner.Target{AttrValue: req.Name}, nil
+}
+
+func (p *fakeProvisioner) Teardown(ctx context.Context, req provisioner.Request) error {
+	p.torndown = append(p.torndown, req.Name)
+	return nil
+}
+
+func (p *fakeProvisioner) Managed() bool {
+	return true
+}
@@ -0,0 +1,236 @@
+package pool
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/404LifeFound/es-snapshot-restore/internal/audit"
+	"github.com/404LifeFound/es-snapshot-restore/internal/budget"
+	restorev1 "github.com/404LifeFound/es-snapshot-restore/internal/controller/api/v1"
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/404LifeFound/es-snapshot-restore/internal/provisioner"
+	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
+)
+
+const gb = 1 << 30
+
+var _ = Describe("Pool", func() {
+	var (
+		es          *fakeES
+		provisioned *fakeProvisioner
+		p           *Pool
+		now         time.Time
+	)
+
+	BeforeEach(func() {
+		saved := config.GlobalConfig
+		DeferCleanup(func() { config.GlobalConfig = saved })
+		config.GlobalConfig.ES.RestoreKey = "restore"
+		config.GlobalConfig.Sizing.MaxDiskPerNode = 100
+		config.GlobalConfig.Sizing.HighWatermark = 0.9
+		config.GlobalConfig.Budget = config.Budget{RetryInterval: 30}
+		config.GlobalConfig.Pool = config.Pool{Enabled: true, Reclaim: true, IdleTimeout: 30, TaskTTL: 60}
+
+		// node-a keeps 40GB free below the high watermark, node-b 5GB
+		es = &fakeES{cat: map[string]string{
+			"/_cat/nodeattrs": `[
+				{"node": "es-a-0", "attr": "restore", "value": "node-a"},
+				{"node": "es-b-0", "attr": "restore", "value": "node-b"}
+			]`,
+			"/_cat/allocation": `[
+				{"node": "es-a-0", "disk.avail": "53687091200", "disk.total": "107374182400"},
+				{"node": "es-b-0", "disk.avail": "16106127360", "disk.total": "107374182400"}
+			]`,
+			"/_cat/indices": `[
+				{"index": "restore_node-a_logs"},
+				{"index": "restore_node-b_logs"},
+				{"index": "logs"}
+			]`,
+		}}
+		db_client := newTestDB()
+		b, err := budget.NewBudget(db_client)
+		Expect(err).NotTo(HaveOccurred())
+		provisioned = &fakeProvisioner{}
+		p = NewPool(newFakeES(es), db_client, provisioned, b, audit.NewAuditor(db_client))
+		now = time.Now()
+	})
+
+	node := func(name string) db.RestoreNode {
+		nodes, err := db.QueryAll[db.RestoreNode](p.DBClient, "", 0, "name = ?", name)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(nodes).To(HaveLen(1))
+		return nodes[0]
+	}
+
+	Describe("Acquire", func() {
+		BeforeEach(func() {
+			Expect(db.CreateRecords(p.DBClient, &[]db.RestoreNode{
+				{Name: "node-a", Isolation: string(restorev1.IsolationNodeSet), StoreSize: "60Gi", Status: string(utils.NodeActive), ActiveTasks: 1, LastUsedAt: now.Add(-time.Hour)},
+				{Name: "node-b", Isolation: string(restorev1.IsolationNodeSet), StoreSize: "50Gi", Status: string(utils.NodeActive), ActiveTasks: 1, LastUsedAt: now},
+			})).To(Succeed())
+		})
+
+		DescribeTable("places the tasks",
+			func(req provisioner.Request, name, store_size string) {
+				placed, err := p.Acquire(context.Background(), req, 2)
+				Expect(err).NotTo(HaveOccurred())
+				if name != "" {
+					Expect(placed.Name).To(Equal(name))
+				}
+				Expect(placed.StoreSize).To(Equal(store_size))
+
+				recorded := node(placed.Name)
+				Expect(recorded.StoreSize).To(Equal(store_size))
+				if name == "node-a" || name == "node-b" {
+					Expect(recorded.ActiveTasks).To(Equal(3))
+				} else {
+					Expect(recorded.ActiveTasks).To(Equal(2))
+				}
+			},
+			Entry("on a node with enough free disk", provisioner.NewRequest("", "30Gi"), "node-a", "60Gi"),
+			Entry("on the first node growing below sizing.maxdiskpernode", provisioner.NewRequest("", "45Gi"), "node-b", "90Gi"),
+			Entry("on a node growing up to sizing.maxdiskpernode", provisioner.NewRequest("", "80Gi"), "node-a", "100Gi"),
+			Entry("on a new node when none can grow enough", provisioner.NewRequest("", "95Gi"), "", "95Gi"),
+		)
+
+		It("places the tasks on the named node as it is", func() {
+			placed, err := p.Acquire(context.Background(), provisioner.NewRequest("node-b", "90Gi"), 2)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(placed.Name).To(Equal("node-b"))
+			Expect(node("node-b").StoreSize).To(Equal("50Gi"))
+			Expect(node("node-b").ActiveTasks).To(Equal(3))
+		})
+
+		It("doesn't share the nodes of another team", func() {
+			req := provisioner.NewRequest("", "30Gi")
+			req.Team = "search"
+			placed, err := p.Acquire(context.Background(), req, 1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(placed.Name).NotTo(BeElementOf("node-a", "node-b"))
+			Expect(node(placed.Name).Team).To(Equal("search"))
+		})
+
+		It("dedicates a restore cluster to its task", func() {
+			req := provisioner.NewRequest("", "30Gi")
+			req.Isolation = restorev1.IsolationCluster
+			placed, err := p.Acquire(context.Background(), req, 1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(placed.Name).NotTo(BeElementOf("node-a", "node-b"))
+			Expect(node(placed.Name).Isolation).To(Equal(string(restorev1.IsolationCluster)))
+		})
+
+		It("adds a node per task when the pool is disabled", func() {
+			config.GlobalConfig.Pool.Enabled = false
+			placed, err := p.Acquire(context.Background(), provisioner.NewRequest("", "30Gi"), 1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(placed.Name).NotTo(BeElementOf("node-a", "node-b"))
+		})
+
+		It("releases a node down to no task", func() {
+			p.Release("node-a")
+			p.Release("node-a")
+			Expect(node("node-a").ActiveTasks).To(Equal(0))
+		})
+	})
+
+	DescribeTable("ReclaimAt",
+		func(task_ttl int, tasks []db.Task, after time.Duration, reclaimed bool) {
+			config.GlobalConfig.Pool.TaskTTL = task_ttl
+			for i := range tasks {
+				tasks[i].TaskID = "task"
+				tasks[i].Node = "node-a"
+			}
+			if len(tasks) > 0 {
+				Expect(db.CreateRecords(p.DBClient, &tasks)).To(Succeed())
+			}
+
+			at, ok, err := p.ReclaimAt(db.RestoreNode{Name: "node-a", LastUsedAt: now})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(Equal(reclaimed))
+			if reclaimed {
+				Expect(at).To(BeTemporally("~", now.Add(after), time.Second))
+			}
+		},
+		Entry("pool.idletimeout after its last task", 60, nil, 30*time.Minute, true),
+		Entry("pool.taskttl after a restored task", 60, []db.Task{
+			{Index: "logs", Status: string(utils.TaskSuccess), FinishedAt: utils.PtrToAny(time.Now())},
+		}, time.Hour, true),
+		Entry("pool.idletimeout after a restored task past pool.taskttl", 60, []db.Task{
+			{Index: "logs", Status: string(utils.TaskSuccess), FinishedAt: utils.PtrToAny(time.Now().Add(-2 * time.Hour))},
+		}, 30*time.Minute, true),
+		Entry("pool.idletimeout after a released task", 60, []db.Task{
+			{Index: "logs", Status: string(utils.TaskSuccess), FinishedAt: utils.PtrToAny(time.Now()), ReleasedAt: utils.PtrToAny(time.Now())},
+		}, 30*time.Minute, true),
+		Entry("pool.idletimeout after a failed task", 60, []db.Task{
+			{Index: "logs", Status: string(utils.TaskFailed), FinishedAt: utils.PtrToAny(time.Now())},
+		}, 30*time.Minute, true),
+		Entry("never while a restored task isn't released without pool.taskttl", 0, []db.Task{
+			{Index: "logs", Status: string(utils.TaskSuccess), FinishedAt: utils.PtrToAny(time.Now())},
+		}, time.Duration(0), false),
+	)
+
+	Describe("reclaim", func() {
+		BeforeEach(func() {
+			Expect(db.CreateRecords(p.DBClient, &[]db.RestoreNode{
+				{Name: "node-a", StoreSize: "60Gi", Status: string(utils.NodeActive), LastUsedAt: now.Add(-time.Hour)},
+				{Name: "node-b", StoreSize: "50Gi", Status: string(utils.NodeActive), LastUsedAt: now.Add(-25 * time.Minute)},
+				{Name: "node-busy", StoreSize: "50Gi", Status: string(utils.NodeActive), ActiveTasks: 1, LastUsedAt: now.Add(-time.Hour)},
+				{Name: "node-held", StoreSize: "50Gi", Status: string(utils.NodeActive), LastUsedAt: now.Add(-time.Hour)},
+			})).To(Succeed())
+			Expect(db.CreateRecords(p.DBClient, &[]db.Task{
+				{TaskID: "task", Index: "logs", Node: "node-held", Status: string(utils.TaskSuccess), FinishedAt: utils.PtrToAny(now)},
+			})).To(Succeed())
+		})
+
+		It("warns of the idle nodes reclaimed soon", func() {
+			expiring, err := p.Expiring(10 * time.Minute)
+			Expect(err).NotTo(HaveOccurred())
+			var names []string
+			for _, e := range expiring {
+				names = append(names, e.Node.Name)
+			}
+			Expect(names).To(ConsistOf("node-a", "node-b"))
+		})
+
+		It("reaps the idle nodes past their reclaim time", func() {
+			Expect(p.Reap(context.Background())).To(Succeed())
+
+			Expect(provisioned.torndown).To(ConsistOf("node-a"))
+			Expect(es.Requests()).To(ConsistOf("DELETE /restore_node-a_logs"))
+			nodes, err := db.QueryAll[db.RestoreNode](p.DBClient, "", 0, "")
+			Expect(err).NotTo(HaveOccurred())
+			var names []string
+			for _, n := range nodes {
+				names = append(names, n.Name)
+			}
+			Expect(names).To(ConsistOf("node-b", "node-busy", "node-held"))
+
+			entries, err := db.QueryAll[db.AuditEntry](p.DBClient, "id", 0, "")
+			Expect(err).NotTo(HaveOccurred())
+			var actions []string
+			for _, e := range entries {
+				actions = append(actions, e.Action)
+			}
+			Expect(actions).To(Equal([]string{"deleteRestoredIndices", "reclaimNode"}))
+		})
+
+		It("reaps a node left reclaiming by a failed reclaim", func() {
+			Expect(p.DBClient.Model(&db.RestoreNode{}).Where("name = ?", "node-b").Update("Status", string(utils.NodeReclaiming)).Error).To(Succeed())
+			Expect(p.Reap(context.Background())).To(Succeed())
+			Expect(provisioned.torndown).To(ConsistOf("node-a", "node-b"))
+		})
+
+		It("reclaims nothing without pool.reclaim", func() {
+			config.GlobalConfig.Pool.Reclaim = false
+			expiring, err := p.Expiring(time.Hour)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(expiring).To(BeEmpty())
+			Expect(p.Reap(context.Background())).To(Succeed())
+			Expect(provisioned.torndown).To(BeEmpty())
+		})
+	})
+})
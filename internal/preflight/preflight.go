@@ -0,0 +1,470 @@
+package preflight
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	restorev1 "github.com/404LifeFound/es-snapshot-restore/internal/controller/api/v1"
+	"github.com/404LifeFound/es-snapshot-restore/internal/elastic"
+	"github.com/404LifeFound/es-snapshot-restore/internal/k8s"
+	"github.com/404LifeFound/es-snapshot-restore/internal/provisioner"
+	"github.com/rs/zerolog/log"
+	"go.uber.org/fx"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	CheckClusterHealth     = "cluster_health"
+	CheckDiskWatermark     = "disk_watermark"
+	CheckShardHeadroom     = "shard_headroom"
+	CheckIndexCollision    = "index_collision"
+	CheckRepository        = "repository"
+	CheckSnapshotVersion   = "snapshot_version"
+	CheckNamespaceQuota    = "namespace_quota"
+	defaultMaxShardPerNode = 1000
+)
+
+type Result string
+
+var (
+	ResultPass Result = "pass"
+	ResultWarn Result = "warn"
+	ResultFail Result = "fail"
+	ResultSkip Result = "skip"
+)
+
+type Check struct {
+	Name    string `json:"name"`
+	Result  Result `json:"result"`
+	Message string `json:"message"`
+}
+
+// Report is the result of every preflight check, a restore is only started when Passed
+type Report struct {
+	Passed bool    `json:"passed"`
+	Checks []Check `json:"checks"`
+}
+
+func (r *Report) add(name string, result Result, format string, args ...any) {
+	r.Checks = append(r.Checks, Check{
+		Name:    name,
+		Result:  result,
+		Message: fmt.Sprintf(format, args...),
+	})
+	if result == ResultFail {
+		r.Passed = false
+	}
+}
+
+// Failures returns the message of every failed check
+func (r *Report) Failures() []string {
+	var failures []string
+	for _, c := range r.Checks {
+		if c.Result == ResultFail {
+			failures = append(failures, fmt.Sprintf("%s: %s", c.Name, c.Message))
+		}
+	}
+	return failures
+}
+
+// Input is the restore checked by the preflight, Request.Name is empty when the pool hasn't placed it yet
+type Input struct {
+	Request    provisioner.Request
+	Repository string
+	Snapshot   string
+	Indices    []string
+	Replicas   int
+}
+
+// Checker checks the cluster can accept a restore before its restore node is provisioned, so a restore which
+// can't succeed fails at once instead of after es.timeout minutes
+type Checker struct {
+	ESClient    *elastic.ES
+	Provisioner provisioner.Provisioner
+	K8SClient   client.Client
+}
+
+type Params struct {
+	fx.In
+
+	ES          *elastic.ES
+	Provisioner provisioner.Provisioner
+	// K8SClient is only provided when kube.enabled is set
+	K8SClient *k8s.Client `optional:"true"`
+}
+
+func NewChecker(p Params) *Checker {
+	c := &Checker{
+		ESClient:    p.ES,
+		Provisioner: p.Provisioner,
+	}
+	if p.K8SClient != nil {
+		c.K8SClient = p.K8SClient
+	}
+	return c
+}
+
+// Run runs every check of in, a check which can't run is reported as failed
+func (c *Checker) Run(ctx context.Context, in Input) Report {
+	report := Report{Passed: true}
+	dedicated := in.Request.Isolation == restorev1.IsolationCluster
+
+	health, err := c.ESClient.GetClusterHealth(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to get cluster health")
+	}
+
+	if dedicated {
+		report.add(CheckClusterHealth, ResultSkip, "restored into a dedicated cluster")
+		report.add(CheckDiskWatermark, ResultSkip, "restored into a dedicated cluster")
+		report.add(CheckShardHeadroom, ResultSkip, "restored into a dedicated cluster")
+		report.add(CheckIndexCollision, ResultSkip, "restored into a dedicated cluster")
+	} else {
+		if err != nil {
+			report.add(CheckClusterHealth, ResultFail, "failed to get cluster health: %s", err.Error())
+		} else {
+			c.checkHealth(&report, health)
+		}
+		c.checkWatermark(ctx, &report)
+	}
+
+	status, status_err := c.ESClient.GetSnapshotStatus(ctx, in.Repository, in.Snapshot)
+	if status_err != nil {
+		log.Error().Err(status_err).Msgf("failed to get status of snapshot %s from repo %s", in.Snapshot, in.Repository)
+	}
+
+	if !dedicated {
+		switch {
+		case err != nil:
+			report.add(CheckShardHeadroom, ResultFail, "failed to get cluster health: %s", err.Error())
+		case status_err != nil:
+			report.add(CheckShardHeadroom, ResultFail, "failed to get shards of snapshot %s: %s", in.Snapshot, status_err.Error())
+		default:
+			c.checkShards(ctx, &report, in, health, status)
+		}
+		c.checkCollision(ctx, &report, in)
+	}
+
+	c.checkRepository(ctx, &report, in)
+	c.checkSnapshot(ctx, &report, in, status, status_err)
+	c.checkQuota(ctx, &report, in)
+
+	return report
+}
+
+func (c *Checker) checkHealth(report *Report, health elastic.ClusterHealth) {
+	switch health.Status {
+	case "green":
+		report.add(CheckClusterHealth, ResultPass, "cluster is green")
+	case "yellow":
+		report.add(CheckClusterHealth, ResultWarn, "cluster is yellow with %d unassigned shards", health.UnassignedShards)
+	default:
+		report.add(CheckClusterHealth, ResultFail, "cluster is %s with %d unassigned shards", health.Status, health.UnassignedShards)
+	}
+}
+
+// checkWatermark compares the high disk watermark with sizing.highwatermark, the restore node is sized to fill its
+// disk up to it so a lower watermark keeps shards unassigned
+func (c *Checker) checkWatermark(ctx context.Context, report *Report) {
+	enabled, err := c.ESClient.GetClusterSetting(ctx, "cluster.routing.allocation.disk.threshold_enabled")
+	if err != nil {
+		report.add(CheckDiskWatermark, ResultFail, "failed to get disk threshold setting: %s", err.Error())
+		return
+	}
+	if enabled == "false" {
+		report.add(CheckDiskWatermark, ResultWarn, "disk based shard allocation is disabled")
+		return
+	}
+
+	high, err := c.ESClient.GetClusterSetting(ctx, "cluster.routing.allocation.disk.watermark.high")
+	if err != nil {
+		report.add(CheckDiskWatermark, ResultFail, "failed to get high disk watermark setting: %s", err.Error())
+		return
+	}
+
+	ratio, ok := watermarkRatio(high)
+	if !ok {
+		report.add(CheckDiskWatermark, ResultWarn, "high disk watermark %s is an absolute size, the restore node is sized for %.0f%%", high, config.GlobalConfig.Sizing.HighWatermark*100)
+		return
+	}
+
+	if sizing := config.GlobalConfig.Sizing.HighWatermark; sizing > ratio {
+		report.add(CheckDiskWatermark, ResultFail, "high disk watermark %s is below the %.0f%% the restore node is sized for", high, sizing*100)
+		return
+	}
+
+	report.add(CheckDiskWatermark, ResultPass, "high disk watermark is %s", high)
+}
+
+// watermarkRatio parses a watermark given as a percentage or a ratio, a watermark given as a byte size is false
+func watermarkRatio(watermark string) (float64, bool) {
+	if p, ok := strings.CutSuffix(watermark, "%"); ok {
+		v, err := strconv.ParseFloat(p, 64)
+		return v / 100, err == nil
+	}
+	v, err := strconv.ParseFloat(watermark, 64)
+	return v, err == nil && v <= 1
+}
+
+// checkShards compares the shards of the restored indices with what cluster.max_shards_per_node leaves, counting
+// the data nodes the restore node adds
+func (c *Checker) checkShards(ctx context.Context, report *Report, in Input, health elastic.ClusterHealth, status elastic.SnapshotStatus) {
+	max_shards := defaultMaxShardPerNode
+	setting, err := c.ESClient.GetClusterSetting(ctx, "cluster.max_shards_per_node")
+	if err != nil {
+		report.add(CheckShardHeadroom, ResultFail, "failed to get max_shards_per_node setting: %s", err.Error())
+		return
+	}
+	if v, err := strconv.Atoi(setting); err == nil {
+		max_shards = v
+	}
+
+	var required int
+	for _, index := range in.Indices {
+		if i, ok := status.Indices[index]; ok {
+			required += i.ShardsStats.Total * (1 + in.Replicas)
+		}
+	}
+
+	data_nodes := health.NumberOfDataNode
+	exists, err := c.nodeExists(ctx, in.Request)
+	if err != nil {
+		report.add(CheckShardHeadroom, ResultFail, "failed to get nodes of restore node %s: %s", in.Request.Name, err.Error())
+		return
+	}
+	if !exists {
+		data_nodes += int(nodeCount(in.Request))
+	}
+
+	used := health.ActiveShards + health.UnassignedShards
+	headroom := max_shards*data_nodes - used
+	if required > headroom {
+		report.add(CheckShardHeadroom, ResultFail, "%d shards to restore but %d left of %d shards per node on %d data nodes", required, headroom, max_shards, data_nodes)
+		return
+	}
+
+	report.add(CheckShardHeadroom, ResultPass, "%d shards to restore, %d left", required, headroom)
+}
+
+// checkCollision fails when an index is already restored under the name the restore renames it to
+func (c *Checker) checkCollision(ctx context.Context, report *Report, in Input) {
+	if in.Request.Name == "" {
+		report.add(CheckIndexCollision, ResultSkip, "the restore node isn't placed yet")
+		return
+	}
+
+	indices, err := c.ESClient.GetAllIndex(ctx)
+	if err != nil {
+		report.add(CheckIndexCollision, ResultFail, "failed to get all index: %s", err.Error())
+		return
+	}
+
+	existing := make(map[string]bool, len(indices))
+	for _, i := range indices {
+		existing[i.Name] = true
+	}
+
+	var collisions []string
+	for _, index := range in.Indices {
+		name := elastic.RestoredIndexName(config.GlobalConfig.ES.RestoreKey, in.Request.Name, index)
+		if existing[name] {
+			collisions = append(collisions, name)
+		}
+	}
+
+	if len(collisions) > 0 {
+		report.add(CheckIndexCollision, ResultFail, "indices %v already exist", collisions)
+		return
+	}
+
+	report.add(CheckIndexCollision, ResultPass, "no restored index exists")
+}
+
+func (c *Checker) checkRepository(ctx context.Context, report *Report, in Input) {
+	if err := c.ESClient.VerifyRepository(ctx, in.Repository); err != nil {
+		report.add(CheckRepository, ResultFail, "%s", err.Error())
+		return
+	}
+
+	report.add(CheckRepository, ResultPass, "repo %s is reachable from every node", in.Repository)
+}
+
+// checkSnapshot checks the snapshot holds the indices and was taken by a version the cluster can restore, which is
+// a version not newer than the cluster and at most one major older
+func (c *Checker) checkSnapshot(ctx context.Context, report *Report, in Input, status elastic.SnapshotStatus, status_err error) {
+	if status_err != nil {
+		report.add(CheckSnapshotVersion, ResultFail, "failed to get status of snapshot %s: %s", in.Snapshot, status_err.Error())
+		return
+	}
+
+	var missing []string
+	for _, index := range in.Indices {
+		if _, ok := status.Indices[index]; !ok {
+			missing = append(missing, index)
+		}
+	}
+	if len(missing) > 0 {
+		report.add(CheckSnapshotVersion, ResultFail, "snapshot %s doesn't hold indices %v", in.Snapshot, missing)
+		return
+	}
+
+	snapshots, err := c.ESClient.GetSnapshotDetail(ctx, in.Repository, []string{in.Snapshot})
+	if err != nil || len(snapshots.Snapshots) != 1 {
+		report.add(CheckSnapshotVersion, ResultFail, "failed to get snapshot %s from repo %s: %v", in.Snapshot, in.Repository, err)
+		return
+	}
+	snapshot := snapshots.Snapshots[0]
+
+	cluster_version, err := c.ESClient.GetVersion(ctx)
+	if err != nil {
+		report.add(CheckSnapshotVersion, ResultFail, "failed to get cluster version: %s", err.Error())
+		return
+	}
+
+	snapshot_major, snapshot_minor, ok := parseVersion(snapshot.Version)
+	cluster_major, cluster_minor, cluster_ok := parseVersion(cluster_version)
+	switch {
+	case !ok || !cluster_ok:
+		report.add(CheckSnapshotVersion, ResultWarn, "can't compare snapshot version %s with cluster version %s", snapshot.Version, cluster_version)
+	case snapshot_major > cluster_major || (snapshot_major == cluster_major && snapshot_minor > cluster_minor):
+		report.add(CheckSnapshotVersion, ResultFail, "snapshot version %s is newer than cluster version %s", snapshot.Version, cluster_version)
+	case snapshot_major < cluster_major-1:
+		report.add(CheckSnapshotVersion, ResultFail, "snapshot version %s is more than one major older than cluster version %s", snapshot.Version, cluster_version)
+	case snapshot.State != "SUCCESS":
+		report.add(CheckSnapshotVersion, ResultWarn, "snapshot %s is %s", in.Snapshot, snapshot.State)
+	default:
+		report.add(CheckSnapshotVersion, ResultPass, "snapshot version %s restores into cluster version %s", snapshot.Version, cluster_version)
+	}
+}
+
+func parseVersion(version string) (int, int, bool) {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, false
+	}
+	return major, minor, true
+}
+
+// checkQuota checks the ResourceQuotas of the namespace leave room for the pods and volumes of a new restore node
+func (c *Checker) checkQuota(ctx context.Context, report *Report, in Input) {
+	if !c.Provisioner.Managed() || c.K8SClient == nil {
+		report.add(CheckNamespaceQuota, ResultSkip, "restore nodes aren't provisioned on kubernetes")
+		return
+	}
+
+	exists, err := c.nodeExists(ctx, in.Request)
+	if err != nil {
+		report.add(CheckNamespaceQuota, ResultFail, "failed to get nodes of restore node %s: %s", in.Request.Name, err.Error())
+		return
+	}
+	if exists {
+		report.add(CheckNamespaceQuota, ResultSkip, "restore node %s already exists", in.Request.Name)
+		return
+	}
+
+	var quotas corev1.ResourceQuotaList
+	if err := c.K8SClient.List(ctx, &quotas, client.InNamespace(in.Request.ESNamespace)); err != nil {
+		log.Error().Err(err).Msgf("failed to list ResourceQuota of namespace %s", in.Request.ESNamespace)
+		report.add(CheckNamespaceQuota, ResultFail, "failed to list ResourceQuota of namespace %s: %s", in.Request.ESNamespace, err.Error())
+		return
+	}
+
+	demand := podDemand(in.Request)
+	var exceeded []string
+	for _, quota := range quotas.Items {
+		for name, hard := range quota.Status.Hard {
+			want, ok := demand[name]
+			if !ok {
+				continue
+			}
+			used := quota.Status.Used[name]
+			used.Add(want)
+			if used.Cmp(hard) > 0 {
+				exceeded = append(exceeded, fmt.Sprintf("%s %s of %s", quota.Name, name, hard.String()))
+			}
+		}
+	}
+
+	if len(exceeded) > 0 {
+		report.add(CheckNamespaceQuota, ResultFail, "the restore node exceeds %s", strings.Join(exceeded, ", "))
+		return
+	}
+
+	report.add(CheckNamespaceQuota, ResultPass, "%d ResourceQuota in namespace %s leave room for the restore node", len(quotas.Items), in.Request.ESNamespace)
+}
+
+// nodeExists reports whether Elasticsearch nodes of the restore node of req already joined the cluster
+func (c *Checker) nodeExists(ctx context.Context, req provisioner.Request) (bool, error) {
+	if req.Name == "" || req.Isolation == restorev1.IsolationCluster {
+		return false, nil
+	}
+
+	nodes, err := c.ESClient.GetNodesByAttr(ctx, config.GlobalConfig.ES.RestoreKey, req.Name)
+	if err != nil {
+		return false, err
+	}
+	return len(nodes) > 0, nil
+}
+
+func nodeCount(req provisioner.Request) int32 {
+	if req.Resources != nil && req.Resources.Count > 0 {
+		return req.Resources.Count
+	}
+	return config.GlobalConfig.ES.RestoreCount
+}
+
+// podDemand is what the pods and volumes of the restore node of req charge to a ResourceQuota
+func podDemand(req provisioner.Request) corev1.ResourceList {
+	count := int64(nodeCount(req))
+	// the sizing engine sets the limits to the requests
+	cpu, memory := config.GlobalConfig.ES.RequestCPU, config.GlobalConfig.ES.RequestMem
+	limit_cpu, limit_memory := config.GlobalConfig.ES.LimitCPU, config.GlobalConfig.ES.LimitMem
+	if req.Resources != nil && req.Resources.CPU != "" {
+		cpu, limit_cpu = req.Resources.CPU, req.Resources.CPU
+	}
+	if req.Resources != nil && req.Resources.Memory != "" {
+		memory, limit_memory = req.Resources.Memory, req.Resources.Memory
+	}
+
+	demand := corev1.ResourceList{
+		corev1.ResourcePods:                   *resource.NewQuantity(count, resource.DecimalSI),
+		"count/pods":                          *resource.NewQuantity(count, resource.DecimalSI),
+		corev1.ResourcePersistentVolumeClaims: *resource.NewQuantity(count, resource.DecimalSI),
+	}
+
+	add := func(q string, names ...corev1.ResourceName) {
+		v, err := resource.ParseQuantity(q)
+		if err != nil {
+			return
+		}
+		total := resource.NewMilliQuantity(v.MilliValue()*count, v.Format)
+		for _, n := range names {
+			demand[n] = *total
+		}
+	}
+	add(cpu, corev1.ResourceCPU, corev1.ResourceRequestsCPU)
+	add(limit_cpu, corev1.ResourceLimitsCPU)
+	add(memory, corev1.ResourceMemory, corev1.ResourceRequestsMemory)
+	add(limit_memory, corev1.ResourceLimitsMemory)
+	add(req.StoreSize, corev1.ResourceRequestsStorage)
+
+	if sc := config.GlobalConfig.ES.StorageClass; sc != "" {
+		add(req.StoreSize, corev1.ResourceName(sc+".storageclass.storage.k8s.io/requests.storage"))
+		demand[corev1.ResourceName(sc+".storageclass.storage.k8s.io/persistentvolumeclaims")] = *resource.NewQuantity(count, resource.DecimalSI)
+	}
+
+	return demand
+}
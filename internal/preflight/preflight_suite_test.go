@@ -0,0 +1,48 @@
+package preflight_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/404LifeFound/es-snapshot-restore/internal/elastic"
+	"github.com/404LifeFound/es-snapshot-restore/internal/provisioner"
+)
+
+func TestPreflight(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "Preflight Suite")
+}
+
+// newFakeES serves an Elasticsearch client replying to the "METHOD /path" requests of replies, and 404 to the others
+func newFakeES(replies map[string]string) *elastic.ES {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.Header().Set("Content-Type", "application/json")
+		body, ok := replies[r.Method+" "+r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"type":"resource_not_found_exception"},"status":404}`))
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	DeferCleanup(srv.Close)
+
+	es, err := elastic.NewES(elastic.NewESConfig(elastic.WithAddr([]string{srv.URL})))
+	Expect(err).NotTo(HaveOccurred())
+	return es
+}
+
+// managed provisions restore nodes on kubernetes, only Managed is called by the preflight
+type managed struct {
+	provisioner.Provisioner
+}
+
+func (managed) Managed() bool {
+	return true
+}
@@ -0,0 +1,207 @@
+package preflight_test
+
+import (
+	"context"
+	"maps"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	restorev1 "github.com/404LifeFound/es-snapshot-restore/internal/controller/api/v1"
+	"github.com/404LifeFound/es-snapshot-restore/internal/preflight"
+	"github.com/404LifeFound/es-snapshot-restore/internal/provisioner"
+)
+
+// passing are the replies of a cluster where every check of a restore of logs from repo/snap passes
+var passing = map[string]string{
+	"GET /_cluster/health":             `{"status": "green", "number_of_data_nodes": 3, "active_shards": 100, "unassigned_shards": 0}`,
+	"GET /_cluster/settings":           `{"persistent": {"cluster.max_shards_per_node": "50"}, "defaults": {"cluster.routing.allocation.disk.threshold_enabled": "true", "cluster.routing.allocation.disk.watermark.high": "90%"}}`,
+	"GET /_snapshot/repo/snap/_status": `{"snapshots": [{"snapshot": "snap", "indices": {"logs": {"shards_stats": {"total": 5}}}}]}`,
+	"POST /_snapshot/repo/_verify":     `{"nodes": {}}`,
+	"GET /_snapshot/repo/snap":         `{"snapshots": [{"snapshot": "snap", "state": "SUCCESS", "version": "8.10.2"}]}`,
+	"GET /":                            `{"version": {"number": "8.11.0"}}`,
+	"GET /_cat/indices":                `[{"index": "logs"}, {"index": "restore_node-b_logs"}]`,
+	"GET /_cat/nodeattrs":              `[]`,
+}
+
+// with returns the passing replies with the replies of overrides, an empty reply is removed
+func with(overrides map[string]string) map[string]string {
+	replies := maps.Clone(passing)
+	for k, v := range overrides {
+		if v == "" {
+			delete(replies, k)
+			continue
+		}
+		replies[k] = v
+	}
+	return replies
+}
+
+// result returns the result of the check name of report
+func result(report preflight.Report, name string) preflight.Result {
+	for _, c := range report.Checks {
+		if c.Name == name {
+			return c.Result
+		}
+	}
+	return ""
+}
+
+var _ = Describe("Checker", func() {
+	BeforeEach(func() {
+		saved := config.GlobalConfig
+		DeferCleanup(func() { config.GlobalConfig = saved })
+		config.GlobalConfig.ES.RestoreKey = "restore"
+		config.GlobalConfig.ES.RestoreCount = 1
+		config.GlobalConfig.ES.Isolation = string(restorev1.IsolationNodeSet)
+		config.GlobalConfig.ES.RequestCPU = "1"
+		config.GlobalConfig.ES.LimitCPU = "2"
+		config.GlobalConfig.ES.RequestMem = "4Gi"
+		config.GlobalConfig.ES.LimitMem = "4Gi"
+		config.GlobalConfig.ES.StorageClass = ""
+		config.GlobalConfig.Sizing.HighWatermark = 0.9
+	})
+
+	input := func(name string, indices ...string) preflight.Input {
+		if len(indices) == 0 {
+			indices = []string{"logs"}
+		}
+		return preflight.Input{
+			Request:    provisioner.NewRequest(name, "30Gi"),
+			Repository: "repo",
+			Snapshot:   "snap",
+			Indices:    indices,
+		}
+	}
+
+	It("passes every check of a restore the cluster accepts", func() {
+		es := newFakeES(passing)
+		report := preflight.NewChecker(preflight.Params{ES: es, Provisioner: provisioner.NewStatic(es)}).Run(context.Background(), input("node-a"))
+		Expect(report.Passed).To(BeTrue())
+		Expect(report.Failures()).To(BeEmpty())
+		Expect(report.Checks).To(HaveLen(7))
+		for _, name := range []string{preflight.CheckClusterHealth, preflight.CheckDiskWatermark, preflight.CheckShardHeadroom, preflight.CheckIndexCollision, preflight.CheckRepository, preflight.CheckSnapshotVersion} {
+			Expect(result(report, name)).To(Equal(preflight.ResultPass), name)
+		}
+		Expect(result(report, preflight.CheckNamespaceQuota)).To(Equal(preflight.ResultSkip))
+	})
+
+	DescribeTable("Run",
+		func(overrides map[string]string, in preflight.Input, name string, expected preflight.Result) {
+			es := newFakeES(with(overrides))
+			report := preflight.NewChecker(preflight.Params{ES: es, Provisioner: provisioner.NewStatic(es)}).Run(context.Background(), in)
+			Expect(result(report, name)).To(Equal(expected))
+			Expect(report.Passed).To(Equal(expected != preflight.ResultFail))
+		},
+		Entry("warns of a yellow cluster", map[string]string{
+			"GET /_cluster/health": `{"status": "yellow", "number_of_data_nodes": 3, "active_shards": 100, "unassigned_shards": 2}`,
+		}, input("node-a"), preflight.CheckClusterHealth, preflight.ResultWarn),
+		Entry("fails a red cluster", map[string]string{
+			"GET /_cluster/health": `{"status": "red", "number_of_data_nodes": 3, "active_shards": 100, "unassigned_shards": 2}`,
+		}, input("node-a"), preflight.CheckClusterHealth, preflight.ResultFail),
+		Entry("fails a high watermark below sizing.highwatermark", map[string]string{
+			"GET /_cluster/settings": `{"defaults": {"cluster.routing.allocation.disk.threshold_enabled": "true", "cluster.routing.allocation.disk.watermark.high": "85%"}}`,
+		}, input("node-a"), preflight.CheckDiskWatermark, preflight.ResultFail),
+		Entry("passes a high watermark given as a ratio", map[string]string{
+			"GET /_cluster/settings": `{"defaults": {"cluster.routing.allocation.disk.threshold_enabled": "true", "cluster.routing.allocation.disk.watermark.high": "0.95"}}`,
+		}, input("node-a"), preflight.CheckDiskWatermark, preflight.ResultPass),
+		Entry("warns of a high watermark given as a size", map[string]string{
+			"GET /_cluster/settings": `{"defaults": {"cluster.routing.allocation.disk.threshold_enabled": "true", "cluster.routing.allocation.disk.watermark.high": "500gb"}}`,
+		}, input("node-a"), preflight.CheckDiskWatermark, preflight.ResultWarn),
+		Entry("warns when disk based shard allocation is disabled", map[string]string{
+			"GET /_cluster/settings": `{"persistent": {"cluster.routing.allocation.disk.threshold_enabled": "false"}}`,
+		}, input("node-a"), preflight.CheckDiskWatermark, preflight.ResultWarn),
+		Entry("counts the data nodes the restore node adds", map[string]string{
+			"GET /_cluster/settings": `{"persistent": {"cluster.max_shards_per_node": "27"}}`,
+		}, input("node-a"), preflight.CheckShardHeadroom, preflight.ResultPass),
+		Entry("doesn't count a restore node which already joined", map[string]string{
+			"GET /_cluster/settings": `{"persistent": {"cluster.max_shards_per_node": "27"}}`,
+			"GET /_cat/nodeattrs":    `[{"node": "es-a-0", "attr": "restore", "value": "node-a"}]`,
+		}, input("node-a"), preflight.CheckShardHeadroom, preflight.ResultFail),
+		Entry("fails more shards than cluster.max_shards_per_node leaves", map[string]string{
+			"GET /_cluster/settings": `{"persistent": {"cluster.max_shards_per_node": "26"}}`,
+		}, input("node-a"), preflight.CheckShardHeadroom, preflight.ResultFail),
+		Entry("fails an index already restored on the restore node", nil, input("node-b"), preflight.CheckIndexCollision, preflight.ResultFail),
+		Entry("skips the collisions of a restore node not placed yet", nil, input(""), preflight.CheckIndexCollision, preflight.ResultSkip),
+		Entry("fails a repository it can't verify", map[string]string{
+			"POST /_snapshot/repo/_verify": "",
+		}, input("node-a"), preflight.CheckRepository, preflight.ResultFail),
+		Entry("fails an index the snapshot doesn't hold", nil, input("node-a", "logs", "metrics"), preflight.CheckSnapshotVersion, preflight.ResultFail),
+		Entry("fails a snapshot newer than the cluster", map[string]string{
+			"GET /_snapshot/repo/snap": `{"snapshots": [{"snapshot": "snap", "state": "SUCCESS", "version": "8.12.0"}]}`,
+		}, input("node-a"), preflight.CheckSnapshotVersion, preflight.ResultFail),
+		Entry("passes a snapshot one major older", map[string]string{
+			"GET /_snapshot/repo/snap": `{"snapshots": [{"snapshot": "snap", "state": "SUCCESS", "version": "7.17.9"}]}`,
+		}, input("node-a"), preflight.CheckSnapshotVersion, preflight.ResultPass),
+		Entry("fails a snapshot more than one major older", map[string]string{
+			"GET /_snapshot/repo/snap": `{"snapshots": [{"snapshot": "snap", "state": "SUCCESS", "version": "6.8.23"}]}`,
+		}, input("node-a"), preflight.CheckSnapshotVersion, preflight.ResultFail),
+		Entry("warns of a partial snapshot", map[string]string{
+			"GET /_snapshot/repo/snap": `{"snapshots": [{"snapshot": "snap", "state": "PARTIAL", "version": "8.10.2"}]}`,
+		}, input("node-a"), preflight.CheckSnapshotVersion, preflight.ResultWarn),
+		Entry("fails a snapshot it can't get the status of", map[string]string{
+			"GET /_snapshot/repo/snap/_status": "",
+		}, input("node-a"), preflight.CheckSnapshotVersion, preflight.ResultFail),
+	)
+
+	It("skips the checks of the shared cluster for a dedicated restore cluster", func() {
+		es := newFakeES(with(map[string]string{
+			"GET /_cluster/health": `{"status": "red"}`,
+		}))
+		in := input("node-a")
+		in.Request.Isolation = restorev1.IsolationCluster
+		report := preflight.NewChecker(preflight.Params{ES: es, Provisioner: provisioner.NewStatic(es)}).Run(context.Background(), in)
+		Expect(report.Passed).To(BeTrue())
+		for _, name := range []string{preflight.CheckClusterHealth, preflight.CheckDiskWatermark, preflight.CheckShardHeadroom, preflight.CheckIndexCollision} {
+			Expect(result(report, name)).To(Equal(preflight.ResultSkip), name)
+		}
+	})
+
+	DescribeTable("namespace quota",
+		func(hard, used corev1.ResourceList, nodeattrs string, expected preflight.Result) {
+			quota := &corev1.ResourceQuota{
+				ObjectMeta: metav1.ObjectMeta{Name: "quota", Namespace: "es"},
+				Status:     corev1.ResourceQuotaStatus{Hard: hard, Used: used},
+			}
+			c := &preflight.Checker{
+				ESClient:    newFakeES(with(map[string]string{"GET /_cat/nodeattrs": nodeattrs})),
+				Provisioner: managed{},
+				K8SClient:   fake.NewClientBuilder().WithObjects(quota).Build(),
+			}
+			in := input("node-a")
+			in.Request.ESNamespace = "es"
+
+			report := c.Run(context.Background(), in)
+			Expect(result(report, preflight.CheckNamespaceQuota)).To(Equal(expected))
+		},
+		Entry("passes pods up to the quota",
+			corev1.ResourceList{corev1.ResourcePods: resource.MustParse("10")},
+			corev1.ResourceList{corev1.ResourcePods: resource.MustParse("9")},
+			`[]`, preflight.ResultPass),
+		Entry("fails pods over the quota",
+			corev1.ResourceList{corev1.ResourcePods: resource.MustParse("10")},
+			corev1.ResourceList{corev1.ResourcePods: resource.MustParse("10")},
+			`[]`, preflight.ResultFail),
+		Entry("passes cpu limits up to the quota",
+			corev1.ResourceList{corev1.ResourceLimitsCPU: resource.MustParse("4")},
+			corev1.ResourceList{corev1.ResourceLimitsCPU: resource.MustParse("2")},
+			`[]`, preflight.ResultPass),
+		Entry("fails memory requests over the quota",
+			corev1.ResourceList{corev1.ResourceRequestsMemory: resource.MustParse("16Gi")},
+			corev1.ResourceList{corev1.ResourceRequestsMemory: resource.MustParse("14Gi")},
+			`[]`, preflight.ResultFail),
+		Entry("fails a volume over the storage quota",
+			corev1.ResourceList{corev1.ResourceRequestsStorage: resource.MustParse("100Gi")},
+			corev1.ResourceList{corev1.ResourceRequestsStorage: resource.MustParse("80Gi")},
+			`[]`, preflight.ResultFail),
+		Entry("skips a restore node which already joined",
+			corev1.ResourceList{corev1.ResourcePods: resource.MustParse("10")},
+			corev1.ResourceList{corev1.ResourcePods: resource.MustParse("10")},
+			`[{"node": "es-a-0", "attr": "restore", "value": "node-a"}]`, preflight.ResultSkip),
+	)
+})
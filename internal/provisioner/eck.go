@@ -0,0 +1,399 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	restorev1 "github.com/404LifeFound/es-snapshot-restore/internal/controller/api/v1"
+	"github.com/404LifeFound/es-snapshot-restore/internal/elastic"
+	"github.com/404LifeFound/es-snapshot-restore/internal/k8s"
+	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
+	esv1 "github.com/elastic/cloud-on-k8s/v3/pkg/apis/elasticsearch/v1"
+	"github.com/rs/zerolog/log"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// ECK adds restore node sets to the production Elasticsearch, or creates a standalone Elasticsearch
+// when the request is isolated in cluster mode
+type ECK struct {
+	Client   client.Client
+	Scheme   *runtime.Scheme
+	ESClient *elastic.ES
+}
+
+func NewECK(c client.Client, s *runtime.Scheme, es *elastic.ES) *ECK {
+	return &ECK{
+		Client:   c,
+		Scheme:   s,
+		ESClient: es,
+	}
+}
+
+func (p *ECK) getElasticsearch(ctx context.Context, namespace, name string) (*esv1.Elasticsearch, error) {
+	var es esv1.Elasticsearch
+	if err := p.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, &es); err != nil {
+		log.Error().Err(err).Msgf("faild to get Elasticsearch %s from %s namespace", name, namespace)
+		return nil, err
+	}
+
+	return &es, nil
+}
+
+// getCluster returns the restore cluster of req, nil if it doesn't exist
+func (p *ECK) getCluster(ctx context.Context, req Request) (*esv1.Elasticsearch, error) {
+	var cluster esv1.Elasticsearch
+	err := p.Client.Get(ctx, client.ObjectKey{Namespace: req.ESNamespace, Name: req.Name}, &cluster)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !k8s.IsRestoreCluster(&cluster) {
+		return nil, fmt.Errorf("Elasticsearch %s in %s namespace is not a restore cluster", req.Name, req.ESNamespace)
+	}
+
+	return &cluster, nil
+}
+
+func (p *ECK) Exists(ctx context.Context, req Request) (bool, error) {
+	if req.Isolation == restorev1.IsolationCluster {
+		cluster, err := p.getCluster(ctx, req)
+		return cluster != nil, err
+	}
+
+	es, err := p.getElasticsearch(ctx, req.ESNamespace, req.ESName)
+	if err != nil {
+		return false, err
+	}
+
+	for _, n := range es.Spec.NodeSets {
+		if n.Name == req.Name {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (p *ECK) Create(ctx context.Context, req Request) error {
+	es, err := p.getElasticsearch(ctx, req.ESNamespace, req.ESName)
+	if err != nil {
+		return err
+	}
+
+	opts := []k8s.ESNodeSetOption{
+		k8s.WithPlacement(req.Placement),
+		k8s.WithResources(req.Resources),
+	}
+
+	if req.Isolation == restorev1.IsolationCluster {
+		cluster := k8s.NewRestoreCluster(es, req.Name, req.StoreSize, opts...)
+		if err := p.setClusterOwner(req, cluster); err != nil {
+			return err
+		}
+		if err := p.Client.Create(ctx, cluster); err != nil {
+			log.Error().Err(err).Msgf("failed to create restore cluster %s in %s namespace", req.Name, es.Namespace)
+			return err
+		}
+
+		log.Info().Msgf("success to create restore cluster %s in %s namespace", req.Name, es.Namespace)
+		return nil
+	}
+
+	node_set := k8s.NewESNodeSet(req.Name, req.StoreSize, append(opts, k8s.WithESName(es.Name))...)
+	patch := client.MergeFrom(es.DeepCopy())
+	es.Spec.NodeSets = append(es.Spec.NodeSets, *node_set.NodeSet)
+
+	if err := p.Client.Patch(ctx, es, patch); err != nil {
+		log.Error().Err(err).Msgf("failed to patch Elasticsearch of %s in %s nanespace to add node %s", es.Name, es.Namespace, req.Name)
+		return err
+	}
+
+	log.Info().Msgf("success to patch Elasticsearch of %s in %s nanespace to add node %s", es.Name, es.Namespace, req.Name)
+	return nil
+}
+
+// Grow expands the data volume of the restore node online when its StorageClass allows it, otherwise an
+// extension node set carrying the same restore attribute is added. A restore cluster is created at its
+// full size, only the owner of the request is added to it.
+func (p *ECK) Grow(ctx context.Context, req Request) (bool, error) {
+	if req.Isolation == restorev1.IsolationCluster {
+		cluster, err := p.getCluster(ctx, req)
+		if err != nil {
+			return false, err
+		}
+		if cluster == nil {
+			return false, fmt.Errorf("restore cluster %s in %s namespace not exists", req.Name, req.ESNamespace)
+		}
+
+		original_cluster := cluster.DeepCopy()
+		if err := p.setClusterOwner(req, cluster); err != nil {
+			return false, err
+		}
+		if len(original_cluster.OwnerReferences) != len(cluster.OwnerReferences) {
+			if err := p.Client.Patch(ctx, cluster, client.MergeFrom(original_cluster)); err != nil {
+				log.Error().Err(err).Msgf("failed to add owner to restore cluster %s", req.Name)
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	store_size, err := utils.ToGB(req.StoreSize)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to transfer %s to float of restore node %s", req.StoreSize, req.Name)
+		return false, err
+	}
+
+	es, err := p.getElasticsearch(ctx, req.ESNamespace, req.ESName)
+	if err != nil {
+		return false, err
+	}
+
+	node_index := -1
+	for i, n := range es.Spec.NodeSets {
+		if n.Name == req.Name {
+			node_index = i
+		}
+	}
+	if node_index < 0 {
+		return false, fmt.Errorf("node %s of Elasticsearch %s not exists", req.Name, es.Name)
+	}
+
+	node := es.Spec.NodeSets[node_index]
+	if len(node.VolumeClaimTemplates) == 0 {
+		return false, fmt.Errorf("node %s of Elasticsearch %s has no volume claim template", node.Name, es.Name)
+	}
+
+	node_sets := k8s.RestoreNodeSets(es, node.Name)
+	var capacity float64
+	for _, i := range node_sets {
+		capacity += k8s.NodeSetStorageGB(es.Spec.NodeSets[i])
+	}
+
+	if store_size <= capacity {
+		// a previous expansion may still be resizing the volumes or creating the ones of an extension node set
+		for _, i := range node_sets {
+			n := es.Spec.NodeSets[i]
+			if len(n.VolumeClaimTemplates) == 0 {
+				continue
+			}
+			sts_name := fmt.Sprintf("%s-es-%s", es.Name, n.Name)
+			resized, err := k8s.VolumesResized(ctx, p.Client, es.Namespace, sts_name, n.VolumeClaimTemplates[0].Spec.Resources.Requests[corev1.ResourceStorage])
+			if err != nil || !resized {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	allow_expansion, err := k8s.AllowVolumeExpansion(ctx, p.Client, node.VolumeClaimTemplates[0])
+	if err != nil {
+		return false, err
+	}
+
+	original_es := es.DeepCopy()
+	if allow_expansion {
+		size := k8s.GBQuantity(store_size - (capacity - k8s.NodeSetStorageGB(node)))
+		log.Info().Msgf("expand data volume of node %s to %s", node.Name, size.String())
+		es.Spec.NodeSets[node_index].VolumeClaimTemplates[0].Spec.Resources.Requests[corev1.ResourceStorage] = size
+	} else {
+		extension_name := fmt.Sprintf("%s-%d", node.Name, len(node_sets))
+		extension_size := k8s.GBQuantity(math.Max(store_size-capacity, config.GlobalConfig.ES.DiskMinSize))
+		log.Info().Msgf("StorageClass of node %s does not allow volume expansion, add node %s with %s", node.Name, extension_name, extension_size.String())
+		extension := k8s.NewESNodeSet(
+			extension_name,
+			extension_size.String(),
+			k8s.WithESName(es.Name),
+			k8s.WithAttrValue(node.Name),
+			k8s.WithPlacement(req.Placement),
+			k8s.WithResources(req.Resources),
+		)
+		es.Spec.NodeSets = append(es.Spec.NodeSets, *extension.NodeSet)
+	}
+
+	if err := p.Client.Patch(ctx, es, client.MergeFrom(original_es)); err != nil {
+		log.Error().Err(err).Msgf("failed to patch Elasticsearch of %s in %s namespace to grow node: %s", es.Name, es.Namespace, node.Name)
+		return false, err
+	}
+
+	return false, nil
+}
+
+// Ready checks the StatefulSet of every node set serving the restore node, extension node sets included
+func (p *ECK) Ready(ctx context.Context, req Request) (bool, error) {
+	if req.Isolation == restorev1.IsolationCluster {
+		cluster, err := p.getCluster(ctx, req)
+		if err != nil || cluster == nil {
+			return false, err
+		}
+
+		if !k8s.ClusterReady(cluster) {
+			log.Info().Msgf("restore cluster %s not ready yet, phase: %s, health: %s", req.Name, cluster.Status.Phase, cluster.Status.Health)
+			return false, nil
+		}
+		return true, nil
+	}
+
+	es, err := p.getElasticsearch(ctx, req.ESNamespace, req.ESName)
+	if err != nil {
+		return false, err
+	}
+
+	for _, i := range k8s.RestoreNodeSets(es, req.Name) {
+		var sts appsv1.StatefulSet
+		sts_name := fmt.Sprintf("%s-es-%s", es.Name, es.Spec.NodeSets[i].Name)
+		if err := p.Client.Get(ctx, client.ObjectKey{Namespace: es.Namespace, Name: sts_name}, &sts); err != nil {
+			if apierrors.IsNotFound(err) {
+				log.Info().Str("sts", sts_name).Msg("StatefulSet not created yet")
+				return false, nil
+			}
+			return false, err
+		}
+
+		// ensure the sts owned by Elasticsearch
+		owned := false
+		for _, owner := range sts.OwnerReferences {
+			if owner.Kind == "Elasticsearch" &&
+				owner.APIVersion == "elasticsearch.k8s.elastic.co/v1" &&
+				owner.Name == es.Name {
+				owned = true
+			}
+		}
+		if !owned {
+			return false, fmt.Errorf("statefulset %s not owned by Elasticsearch %s", sts_name, es.Name)
+		}
+
+		if sts.Spec.Replicas == nil || sts.Status.ReadyReplicas != *sts.Spec.Replicas {
+			log.Info().Str("sts", sts.Name).Msg("StatefulSet not ready yet")
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// Target returns the production Elasticsearch for a restore node. A restore cluster gets the snapshot
+// repository registered read only, as the production cluster keeps writing snapshots into it.
+func (p *ECK) Target(ctx context.Context, req Request, repository string) (*Target, error) {
+	if req.Isolation != restorev1.IsolationCluster {
+		return &Target{
+			ES:        p.ESClient,
+			AttrValue: req.Name,
+		}, nil
+	}
+
+	password, err := k8s.ClusterPassword(ctx, p.Client, req.ESNamespace, req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := k8s.ClusterCA(ctx, p.Client, req.ESNamespace, req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := k8s.ClusterEndpoint(req.ESNamespace, req.Name)
+	es_client, err := elastic.NewES(elastic.NewESConfig(
+		elastic.WithAddr([]string{endpoint}),
+		elastic.WithUsername(k8s.ElasticUser),
+		elastic.WithPassword(password),
+		elastic.WithCACert(ca),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := p.ESClient.GetRepository(ctx, repository)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to get repo %s from production Elasticsearch", repository)
+		return nil, err
+	}
+	if repo.Settings == nil {
+		repo.Settings = map[string]any{}
+	}
+	repo.Settings["readonly"] = true
+
+	if err := es_client.PutRepository(ctx, repository, repo); err != nil {
+		log.Error().Err(err).Msgf("failed to register repo %s on Elasticsearch %s", repository, req.Name)
+		return nil, err
+	}
+
+	return &Target{
+		ES:                es_client,
+		AttrValue:         req.Name,
+		Endpoint:          endpoint,
+		CredentialsSecret: k8s.ClusterCredentialsSecret(req.Name),
+	}, nil
+}
+
+// Teardown deletes the restore cluster of req if it exists, otherwise removes the restore node and its
+// extension node sets from the production Elasticsearch
+func (p *ECK) Teardown(ctx context.Context, req Request) error {
+	cluster, err := p.getCluster(ctx, req)
+	if err != nil {
+		return err
+	}
+	if cluster != nil {
+		if err := p.Client.Delete(ctx, cluster); err != nil {
+			log.Error().Err(err).Msgf("failed to delete restore cluster %s in %s namespace", req.Name, req.ESNamespace)
+			return err
+		}
+		log.Info().Msgf("success to delete restore cluster %s in %s namespace", req.Name, req.ESNamespace)
+		return nil
+	}
+
+	es, err := p.getElasticsearch(ctx, req.ESNamespace, req.ESName)
+	if err != nil {
+		return err
+	}
+
+	patch := client.MergeFrom(es.DeepCopy())
+	restore_node_sets := make(map[int]bool)
+	for _, i := range k8s.RestoreNodeSets(es, req.Name) {
+		restore_node_sets[i] = true
+	}
+
+	var node_sets []esv1.NodeSet
+	for i, node := range es.Spec.NodeSets {
+		if !restore_node_sets[i] {
+			node_sets = append(node_sets, node)
+		}
+	}
+	es.Spec.NodeSets = node_sets
+
+	if err := p.Client.Patch(ctx, es, patch); err != nil {
+		log.Error().Err(err).Msgf("failed to patch Elasticsearch of %s in %s nanespace to remove node %s", es.Name, es.Namespace, req.Name)
+		return err
+	}
+
+	log.Info().Msgf("success to patch Elasticsearch of %s in %s nanespace to remove node %s", es.Name, es.Namespace, req.Name)
+	return nil
+}
+
+// Managed is true, the restore nodes are node sets or clusters of ECK
+func (p *ECK) Managed() bool {
+	return true
+}
+
+// setClusterOwner makes the owner of req an owner of the restore cluster, so the cluster is garbage collected
+// once every RestoreTask restored into it is deleted. Owner references can't cross namespaces.
+func (p *ECK) setClusterOwner(req Request, cluster *esv1.Elasticsearch) error {
+	if req.Owner == nil || req.Owner.GetNamespace() != cluster.Namespace {
+		return nil
+	}
+
+	if err := controllerutil.SetOwnerReference(req.Owner, cluster, p.Scheme); err != nil {
+		log.Error().Err(err).Msgf("failed to set owner %s of restore cluster %s", req.Owner.GetName(), cluster.Name)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	restorev1 "github.com/404LifeFound/es-snapshot-restore/internal/controller/api/v1"
+	"github.com/404LifeFound/es-snapshot-restore/internal/elastic"
+	"github.com/404LifeFound/es-snapshot-restore/internal/k8s"
+	"github.com/rs/zerolog/log"
+	"go.uber.org/fx"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	TypeECK    = "eck"
+	TypeStatic = "static"
+
+	// LabelTeam overrides the namespace as the team of a RestoreTask
+	LabelTeam = "restore.elastic.co/team"
+)
+
+// Request describes the restore capacity name, size is the per node data volume size
+type Request struct {
+	Name        string
+	StoreSize   string
+	Isolation   restorev1.IsolationMode
+	Placement   *restorev1.Placement
+	Resources   *restorev1.NodeResources
+	ESNamespace string
+	ESName      string
+	// Team is charged for the restore capacity by the budget
+	Team string
+	// Owner is garbage collecting the restore capacity when it is deleted, optional
+	Owner client.Object
+}
+
+// Target is where the indices of a restore are sent to
+type Target struct {
+	ES *elastic.ES
+	// AttrValue is the value of the restore node attribute the restored indices are allocated by
+	AttrValue         string
+	Endpoint          string
+	CredentialsSecret string
+}
+
+// Provisioner manages the capacity restored indices are allocated on
+type Provisioner interface {
+	// Exists reports whether the restore capacity of req was created
+	Exists(ctx context.Context, req Request) (bool, error)
+	// Create adds the restore capacity of req
+	Create(ctx context.Context, req Request) error
+	// Grow makes every node of req hold at least req.StoreSize, it returns true once the capacity is available
+	Grow(ctx context.Context, req Request) (bool, error)
+	// Ready reports whether the restore capacity of req can receive shards
+	Ready(ctx context.Context, req Request) (bool, error)
+	// Target returns where the restore of req is sent, with repository registered on it
+	Target(ctx context.Context, req Request, repository string) (*Target, error)
+	// Teardown releases the restore capacity of req
+	Teardown(ctx context.Context, req Request) error
+	// Managed reports whether the restore nodes are added and removed on kubernetes, the pool and the budget only
+	// account for managed nodes
+	Managed() bool
+}
+
+type Params struct {
+	fx.In
+
+	ES *elastic.ES
+	// K8SClient is only provided when kube.enabled is set
+	K8SClient *k8s.Client `optional:"true"`
+}
+
+func NewProvisioner(p Params) (Provisioner, error) {
+	switch config.GlobalConfig.Provisioner.Type {
+	case TypeStatic:
+		return NewStatic(p.ES), nil
+	case TypeECK, "":
+		if p.K8SClient == nil {
+			log.Warn().Msg("kubernetes is disabled, restore into the static node pool instead of ECK")
+			return NewStatic(p.ES), nil
+		}
+		switch restorev1.AntiAffinityMode(config.GlobalConfig.ES.AntiAffinity) {
+		case restorev1.AntiAffinityRequired, restorev1.AntiAffinityPreferred, restorev1.AntiAffinityNone, "":
+		default:
+			return nil, fmt.Errorf("unknown es anti affinity: %s, should be required, preferred or none", config.GlobalConfig.ES.AntiAffinity)
+		}
+		return NewECK(p.K8SClient, p.K8SClient.Scheme(), p.ES), nil
+	default:
+		return nil, fmt.Errorf("unknown provisioner type: %s", config.GlobalConfig.Provisioner.Type)
+	}
+}
+
+// NewRequest fills the defaults of the es config into a request for name
+func NewRequest(name, store_size string) Request {
+	return Request{
+		Name:        name,
+		StoreSize:   store_size,
+		Isolation:   restorev1.IsolationMode(config.GlobalConfig.ES.Isolation),
+		ESNamespace: config.GlobalConfig.ES.Namespace,
+		ESName:      config.GlobalConfig.ES.Name,
+	}
+}
+
+// NewTaskRequest builds the request of the restore capacity of restore_task
+func NewTaskRequest(restore_task *restorev1.RestoreTask) Request {
+	req := NewRequest(restore_task.Spec.NodeName, restore_task.Spec.StoreSize)
+	if restore_task.Spec.Isolation != "" {
+		req.Isolation = restore_task.Spec.Isolation
+	}
+	if restore_task.Spec.ElasticsearchRef.Name != "" {
+		req.ESName = restore_task.Spec.ElasticsearchRef.Name
+		req.ESNamespace = restore_task.Spec.ElasticsearchRef.Namespace
+	}
+	if req.ESNamespace == "" {
+		req.ESNamespace = restore_task.Namespace
+	}
+	req.Placement = restore_task.Spec.Placement
+	req.Resources = restore_task.Spec.Resources
+	req.Owner = restore_task
+	req.Team = restore_task.Labels[LabelTeam]
+	if req.Team == "" {
+		req.Team = restore_task.Namespace
+	}
+
+	return req
+}
@@ -0,0 +1,126 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/404LifeFound/es-snapshot-restore/internal/elastic"
+	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
+	"github.com/rs/zerolog/log"
+)
+
+// Static restores into a pre-existing pool of nodes of the production Elasticsearch, the pool is the nodes
+// whose es.restorekey attribute is provisioner.staticattrvalue. It never adds or removes nodes.
+type Static struct {
+	ESClient  *elastic.ES
+	AttrValue string
+}
+
+func NewStatic(es *elastic.ES) *Static {
+	return &Static{
+		ESClient:  es,
+		AttrValue: config.GlobalConfig.Provisioner.StaticAttrValue,
+	}
+}
+
+func (p *Static) nodes(ctx context.Context) ([]string, error) {
+	nodes, err := p.ESClient.GetNodesByAttr(ctx, config.GlobalConfig.ES.RestoreKey, p.AttrValue)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to get nodes with attribute %s:%s", config.GlobalConfig.ES.RestoreKey, p.AttrValue)
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+func (p *Static) Exists(ctx context.Context, req Request) (bool, error) {
+	nodes, err := p.nodes(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return len(nodes) > 0, nil
+}
+
+// Create only checks the node pool is there, as the static nodes are managed outside of this service
+func (p *Static) Create(ctx context.Context, req Request) error {
+	nodes, err := p.nodes(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(nodes) == 0 {
+		return fmt.Errorf("no node with attribute %s:%s to restore %s into", config.GlobalConfig.ES.RestoreKey, p.AttrValue, req.Name)
+	}
+
+	return nil
+}
+
+// Grow checks the free disk of the node pool holds req.StoreSize on every requested node, the pool can't be grown
+// so it isn't grown until the disk is freed
+func (p *Static) Grow(ctx context.Context, req Request) (bool, error) {
+	store_size, err := utils.ToGB(req.StoreSize)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to transfer %s to float of restore node %s", req.StoreSize, req.Name)
+		return false, err
+	}
+
+	nodes, err := p.nodes(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	pool := make(map[string]bool)
+	for _, n := range nodes {
+		pool[n] = true
+	}
+
+	allocations, err := p.ESClient.GetAllocation(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to get disk allocation of nodes")
+		return false, err
+	}
+
+	var avail float64
+	for _, a := range allocations {
+		if pool[a.Node] {
+			avail += a.AvailGB()
+		}
+	}
+
+	count := config.GlobalConfig.ES.RestoreCount
+	if req.Resources != nil && req.Resources.Count > 0 {
+		count = req.Resources.Count
+	}
+
+	required := store_size * float64(count)
+	if avail < required {
+		log.Warn().Msgf("static node pool %s has %.2fGB free disk, %s requires %.2fGB", p.AttrValue, avail, req.Name, required)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+func (p *Static) Ready(ctx context.Context, req Request) (bool, error) {
+	return p.Exists(ctx, req)
+}
+
+func (p *Static) Target(ctx context.Context, req Request, repository string) (*Target, error) {
+	return &Target{
+		ES:        p.ESClient,
+		AttrValue: p.AttrValue,
+	}, nil
+}
+
+// Managed is false, the node pool is managed outside of this service
+func (p *Static) Managed() bool {
+	return false
+}
+
+// Teardown keeps the node pool, the restored indices are removed with the pool's own lifecycle
+func (p *Static) Teardown(ctx context.Context, req Request) error {
+	log.Info().Msgf("static node pool %s is not torn down for %s", p.AttrValue, req.Name)
+	return nil
+}
@@ -0,0 +1,427 @@
+package throttle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	restorev1 "github.com/404LifeFound/es-snapshot-restore/internal/controller/api/v1"
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/404LifeFound/es-snapshot-restore/internal/elastic"
+	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
+	"github.com/rs/zerolog/log"
+	"go.uber.org/fx"
+	"gorm.io/gorm"
+)
+
+const (
+	SettingRecoveryRate         = "indices.recovery.max_bytes_per_sec"
+	SettingConcurrentRecoveries = "cluster.routing.allocation.node_concurrent_recoveries"
+	SettingRestoreRate          = "max_restore_bytes_per_sec"
+)
+
+// restore is a running restore bounding the bandwidth of a cluster, repository is empty when it doesn't bound one
+type restore struct {
+	repository string
+	settings   restorev1.Throttle
+}
+
+// cluster holds the settings applied to an Elasticsearch and the values they replaced, a nil previous value
+// resets the setting to its default. The previous values are recorded in the db, so they are restored after a
+// restart too.
+type cluster struct {
+	es       *elastic.ES
+	db       *gorm.DB
+	endpoint string
+	restores map[string]restore
+	applied  map[string]any
+	previous map[string]any
+	// repositories holds the applied and previous max_restore_bytes_per_sec by repository
+	repositories map[string]*repositoryRate
+}
+
+type repositoryRate struct {
+	applied  string
+	previous any
+	// stale is set for a rate recorded before a restart, its applied value is unknown
+	stale bool
+}
+
+// Manager applies the most restrictive bandwidth of the running restores of every Elasticsearch, and restores the
+// values it replaced once no restore is running
+type Manager struct {
+	ESClient *elastic.ES
+	DBClient *gorm.DB
+	mu       sync.Mutex
+	clusters map[string]*cluster // by endpoint, empty for the production Elasticsearch
+}
+
+func NewManager(lc fx.Lifecycle, es_client *elastic.ES, db_client *gorm.DB) *Manager {
+	m := &Manager{
+		ESClient: es_client,
+		DBClient: db_client,
+		clusters: make(map[string]*cluster),
+	}
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			m.Recover(ctx)
+			return nil
+		},
+	})
+	return m
+}
+
+// Recover restores the recovery settings of the production Elasticsearch a restart left throttled, unless a
+// restore is running. The values replaced on it meanwhile, or on a restore cluster, are restored by the release
+// of its last restore.
+func (m *Manager) Recover(ctx context.Context) {
+	var running int64
+	if err := m.DBClient.Model(&db.Task{}).
+		Where("status IN ?", []string{string(utils.TaskRunning), string(utils.TaskPaused)}).
+		Count(&running).Error; err != nil {
+		log.Error().Err(err).Msg("failed to count running tasks")
+		return
+	}
+	if running > 0 {
+		log.Info().Msgf("keep the recovery settings of the production elasticsearch, %d tasks are running", running)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, err := m.cluster(m.ESClient, "")
+	if err != nil {
+		log.Error().Err(err).Msg("failed to load the previous recovery settings")
+		return
+	}
+	if err := c.apply(ctx); err != nil {
+		log.Error().Err(err).Msg("failed to restore the recovery settings of the production elasticsearch")
+	}
+	if len(c.previous) == 0 && len(c.repositories) == 0 {
+		delete(m.clusters, "")
+	}
+}
+
+// cluster returns the cluster reached at endpoint, loading the values a restart left replaced, the caller holds
+// the lock
+func (m *Manager) cluster(es *elastic.ES, endpoint string) (*cluster, error) {
+	if c, ok := m.clusters[endpoint]; ok {
+		return c, nil
+	}
+
+	recorded, err := db.QueryAll[db.ThrottleSetting](m.DBClient, "", 0, "endpoint = ?", endpoint)
+	if err != nil {
+		return nil, err
+	}
+	c := &cluster{
+		es:           es,
+		db:           m.DBClient,
+		endpoint:     endpoint,
+		restores:     make(map[string]restore),
+		applied:      make(map[string]any),
+		previous:     make(map[string]any),
+		repositories: make(map[string]*repositoryRate),
+	}
+	for _, setting := range recorded {
+		var previous any
+		if setting.Previous != nil {
+			previous = *setting.Previous
+		}
+		if setting.Repository != "" {
+			c.repositories[setting.Repository] = &repositoryRate{previous: previous, stale: true}
+			continue
+		}
+		// the value applied before the restart is unknown, nil puts the previous one back without a restore
+		c.previous[setting.Name] = previous
+		c.applied[setting.Name] = nil
+	}
+	if len(recorded) > 0 {
+		log.Info().Msgf("loaded %d recovery settings replaced on %q before a restart", len(recorded), endpoint)
+	}
+	m.clusters[endpoint] = c
+	return c, nil
+}
+
+// Defaults fills the empty fields of t with the throttle config
+func Defaults(t *restorev1.Throttle) restorev1.Throttle {
+	var settings restorev1.Throttle
+	if t != nil {
+		settings = *t
+	}
+	if settings.MaxBytesPerSec == "" {
+		settings.MaxBytesPerSec = config.GlobalConfig.Throttle.MaxBytesPerSec
+	}
+	if settings.ConcurrentRecoveries == 0 {
+		settings.ConcurrentRecoveries = config.GlobalConfig.Throttle.ConcurrentRecoveries
+	}
+	if settings.RestoreBytesPerSec == "" {
+		settings.RestoreBytesPerSec = config.GlobalConfig.Throttle.RestoreBytesPerSec
+	}
+	return settings
+}
+
+// Acquire registers the restore id reading repository with settings on es, reached at endpoint, and applies the
+// most restrictive settings of the restores of es. It returns the settings applied for the restore.
+func (m *Manager) Acquire(ctx context.Context, es *elastic.ES, endpoint, repository, id string, settings restorev1.Throttle) (restorev1.Throttle, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, err := m.cluster(es, endpoint)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to load the previous recovery settings of %q", endpoint)
+		return restorev1.Throttle{}, err
+	}
+	c.restores[id] = restore{repository: repository, settings: settings}
+
+	err = c.apply(ctx)
+
+	var applied restorev1.Throttle
+	if v, ok := c.applied[SettingRecoveryRate]; ok {
+		applied.MaxBytesPerSec = fmt.Sprint(v)
+	}
+	if v, ok := c.applied[SettingConcurrentRecoveries].(int); ok {
+		applied.ConcurrentRecoveries = v
+	}
+	if r, ok := c.repositories[repository]; ok {
+		applied.RestoreBytesPerSec = r.applied
+	}
+
+	return applied, err
+}
+
+// Release unregisters the restore id of the Elasticsearch reached at endpoint, the replaced values are restored
+// with its last restore
+func (m *Manager) Release(ctx context.Context, endpoint, id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.clusters[endpoint]
+	if !ok {
+		return
+	}
+	delete(c.restores, id)
+
+	if err := c.apply(ctx); err != nil {
+		log.Error().Err(err).Msgf("failed to restore the recovery settings of %s", endpoint)
+	}
+	if len(c.restores) == 0 && len(c.previous) == 0 && len(c.repositories) == 0 {
+		delete(m.clusters, endpoint)
+	}
+}
+
+// apply puts the most restrictive settings of the restores of c, and the previous value of the settings no
+// restore bounds anymore
+func (c *cluster) apply(ctx context.Context) error {
+	desired := make(map[string]any)
+	desired_repositories := make(map[string]string)
+	for _, r := range c.restores {
+		if rate, ok := minRate(desired[SettingRecoveryRate], r.settings.MaxBytesPerSec); ok {
+			desired[SettingRecoveryRate] = rate
+		}
+		if n := r.settings.ConcurrentRecoveries; n > 0 {
+			if cur, ok := desired[SettingConcurrentRecoveries].(int); !ok || n < cur {
+				desired[SettingConcurrentRecoveries] = n
+			}
+		}
+		if r.repository != "" {
+			if rate, ok := minRate(desired_repositories[r.repository], r.settings.RestoreBytesPerSec); ok {
+				desired_repositories[r.repository] = rate
+			}
+		}
+	}
+
+	var errs []error
+	if err := c.applyCluster(ctx, desired); err != nil {
+		errs = append(errs, err)
+	}
+	for name := range c.repositories {
+		if _, ok := desired_repositories[name]; !ok {
+			desired_repositories[name] = ""
+		}
+	}
+	for name, rate := range desired_repositories {
+		if err := c.applyRepository(ctx, name, rate); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *cluster) applyCluster(ctx context.Context, desired map[string]any) error {
+	changes := make(map[string]any)
+	var settings *elastic.ClusterSettings
+	for name, v := range desired {
+		if _, ok := c.previous[name]; !ok {
+			if settings == nil {
+				s, err := c.es.GetClusterSettings(ctx)
+				if err != nil {
+					log.Error().Err(err).Msg("failed to get cluster settings")
+					return err
+				}
+				settings = &s
+			}
+			if settings.Transient[name] != nil {
+				log.Warn().Msgf("transient %s overrides the persistent %v", name, v)
+			}
+			c.previous[name] = nil
+			if settings.Explicit(name) {
+				c.previous[name] = settings.Get(name)
+			}
+			c.record("", name, c.previous[name])
+		}
+		if c.applied[name] != v {
+			changes[name] = v
+		}
+	}
+	for name := range c.applied {
+		if _, ok := desired[name]; !ok {
+			changes[name] = c.previous[name]
+		}
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+
+	log.Info().Msgf("put recovery settings %v", changes)
+	if err := c.es.PutClusterSettings(ctx, changes); err != nil {
+		log.Error().Err(err).Msgf("failed to put recovery settings %v", changes)
+		return err
+	}
+
+	for name := range c.applied {
+		if _, ok := desired[name]; !ok {
+			delete(c.previous, name)
+			c.forget("", name)
+		}
+	}
+	c.applied = desired
+	return nil
+}
+
+// applyRepository puts the max_restore_bytes_per_sec rate of the repository name, an empty rate restores its
+// previous value
+func (c *cluster) applyRepository(ctx context.Context, name, rate string) error {
+	r, ok := c.repositories[name]
+	if ok && r.applied == rate && !r.stale {
+		return nil
+	}
+	if !ok && rate == "" {
+		return nil
+	}
+
+	repo, err := c.es.GetRepository(ctx, name)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to get repo %s", name)
+		return err
+	}
+	if repo.Settings == nil {
+		repo.Settings = make(map[string]any)
+	}
+
+	if !ok {
+		r = &repositoryRate{previous: repo.Settings[SettingRestoreRate]}
+		c.record(name, SettingRestoreRate, r.previous)
+	}
+
+	if rate == "" {
+		if r.previous == nil {
+			delete(repo.Settings, SettingRestoreRate)
+		} else {
+			repo.Settings[SettingRestoreRate] = r.previous
+		}
+	} else {
+		repo.Settings[SettingRestoreRate] = rate
+	}
+
+	log.Info().Msgf("put %s of repo %s to %v", SettingRestoreRate, name, repo.Settings[SettingRestoreRate])
+	if err := c.es.PutRepository(ctx, name, repo); err != nil {
+		log.Error().Err(err).Msgf("failed to put %s of repo %s", SettingRestoreRate, name)
+		return err
+	}
+
+	if rate == "" {
+		delete(c.repositories, name)
+		c.forget(name, SettingRestoreRate)
+		return nil
+	}
+	r.applied = rate
+	r.stale = false
+	c.repositories[name] = r
+	return nil
+}
+
+// record records the value previous of the setting name of repository, of the cluster when repository is empty,
+// before it is replaced. The first value recorded is kept, it is the one before any restore.
+func (c *cluster) record(repository, name string, previous any) {
+	setting := db.ThrottleSetting{Endpoint: c.endpoint, Repository: repository, Name: name}
+	if previous != nil {
+		setting.Previous = utils.PtrToAny(fmt.Sprint(previous))
+	}
+	if _, err := db.CreateRecordOnce(c.db, &setting); err != nil {
+		log.Error().Err(err).Msgf("failed to record the previous %s of %q", name, c.endpoint)
+	}
+}
+
+// forget deletes the record of the setting name of repository once its previous value is restored
+func (c *cluster) forget(repository, name string) {
+	if err := db.DeleteRecord(c.db, &db.ThrottleSetting{}, "endpoint = ? AND repository = ? AND name = ?", c.endpoint, repository, name); err != nil {
+		log.Error().Err(err).Msgf("failed to delete the record of the previous %s of %q", name, c.endpoint)
+	}
+}
+
+// minRate returns the lower of the byte rates cur, empty when unset, and rate, false when both are unset
+func minRate(cur any, rate string) (string, bool) {
+	if rate == "" {
+		return "", false
+	}
+	current, ok := cur.(string)
+	if !ok || current == "" {
+		return rate, true
+	}
+
+	a, err_a := ParseBytes(current)
+	b, err_b := ParseBytes(rate)
+	switch {
+	case err_b != nil:
+		return current, true
+	case err_a != nil:
+		return rate, true
+	// 0 is unlimited
+	case b == 0:
+		return current, true
+	case a == 0 || b < a:
+		return rate, true
+	}
+	return current, true
+}
+
+// ParseBytes parses an Elasticsearch byte size like 40mb, the units are powers of 1024
+func ParseBytes(s string) (int64, error) {
+	v := strings.ToLower(strings.TrimSpace(s))
+	units := []struct {
+		suffix string
+		factor int64
+	}{
+		{"pb", 1 << 50}, {"tb", 1 << 40}, {"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}, {"b", 1},
+	}
+	factor := int64(1)
+	for _, u := range units {
+		if n, ok := strings.CutSuffix(v, u.suffix); ok {
+			v, factor = n, u.factor
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid byte size %s: %w", s, err)
+	}
+	return int64(n * float64(factor)), nil
+}
@@ -0,0 +1,14 @@
+package throttle
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestThrottle(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "Throttle Suite")
+}
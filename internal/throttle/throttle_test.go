@@ -0,0 +1,51 @@
+package throttle
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Throttle", func() {
+	DescribeTable("ParseBytes",
+		func(s string, expected int64, valid bool) {
+			n, err := ParseBytes(s)
+			if !valid {
+				Expect(err).To(HaveOccurred())
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(expected))
+		},
+		Entry("bytes without unit", "512", int64(512), true),
+		Entry("bytes", "512b", int64(512), true),
+		Entry("kb", "4kb", int64(4<<10), true),
+		Entry("mb", "40mb", int64(40<<20), true),
+		Entry("gb", "2gb", int64(2<<30), true),
+		Entry("tb", "1tb", int64(1<<40), true),
+		Entry("pb", "1pb", int64(1<<50), true),
+		Entry("fractional size", "1.5gb", int64(3<<29), true),
+		Entry("upper case with spaces", " 40MB ", int64(40<<20), true),
+		Entry("space before the unit", "40 mb", int64(40<<20), true),
+		Entry("zero, unlimited", "0", int64(0), true),
+		Entry("unknown unit", "40xb", int64(0), false),
+		Entry("empty", "", int64(0), false),
+	)
+
+	DescribeTable("minRate",
+		func(current any, rate string, expected string, set bool) {
+			value, ok := minRate(current, rate)
+			Expect(ok).To(Equal(set))
+			Expect(value).To(Equal(expected))
+		},
+		Entry("no rate leaves the setting alone", "40mb", "", "", false),
+		Entry("an unset setting takes the rate", nil, "20mb", "20mb", true),
+		Entry("an empty setting takes the rate", "", "20mb", "20mb", true),
+		Entry("a lower rate wins", "40mb", "20mb", "20mb", true),
+		Entry("a higher rate loses", "20mb", "40mb", "20mb", true),
+		Entry("the rates are compared across units", "1gb", "512mb", "512mb", true),
+		Entry("an unlimited setting takes the rate", "0", "20mb", "20mb", true),
+		Entry("an unlimited rate keeps the setting", "40mb", "0", "40mb", true),
+		Entry("an invalid rate keeps the setting", "40mb", "fast", "40mb", true),
+		Entry("an invalid setting takes the rate", "fast", "20mb", "20mb", true),
+	)
+})
@@ -4,16 +4,33 @@ type TaskStatus string
 
 type Stag string
 
+type NodeStatus string
+
 var (
-	TaskPending  TaskStatus = "PENDING"
-	TaskRunning  TaskStatus = "RUNNING"
-	TaskSuccess  TaskStatus = "SUCCESS"
-	TaskFailed   TaskStatus = "FAILED"
-	TaskTimeout  TaskStatus = "TIMEOUT"
-	TaskCanceled TaskStatus = "CANCELED"
+	TaskPending          TaskStatus = "PENDING"
+	TaskQueued           TaskStatus = "QUEUED"
+	TaskRunning          TaskStatus = "RUNNING"
+	TaskPaused           TaskStatus = "PAUSED"
+	TaskSuccess          TaskStatus = "SUCCESS"
+	TaskFailed           TaskStatus = "FAILED"
+	TaskTimeout          TaskStatus = "TIMEOUT"
+	TaskCanceled         TaskStatus = "CANCELED"
+	TaskAwaitingApproval TaskStatus = "AWAITING_APPROVAL"
 
 	StagInit         Stag = "INIT"
 	StagCreateESNode Stag = "CREATE_ES_NODE"
 	StageCheckESNode Stag = "CHECK_ES_NODE"
 	StagRestoreIndex Stag = "RESTORE_INDEX"
+
+	NodeActive     NodeStatus = "ACTIVE"
+	NodeReclaiming NodeStatus = "RECLAIMING"
 )
+
+// Final reports whether a task with status s is done restoring
+func (s TaskStatus) Final() bool {
+	switch s {
+	case TaskSuccess, TaskFailed, TaskTimeout, TaskCanceled:
+		return true
+	}
+	return false
+}
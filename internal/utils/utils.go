@@ -30,6 +30,13 @@ func PtrToAny[T any](s T) *T {
 	return &s
 }
 
+func StringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
 func RandomName() string {
 	name := fmt.Sprintf("%s-%s", config.GlobalConfig.ES.RestoreKey, RandomString(config.GlobalConfig.ES.RandomLen))
 	log.Info().Msgf("restore node name is: %s", name)
@@ -0,0 +1,409 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/404LifeFound/es-snapshot-restore/internal/cache"
+	restorev1 "github.com/404LifeFound/es-snapshot-restore/internal/controller/api/v1"
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/404LifeFound/es-snapshot-restore/internal/elastic"
+	"github.com/404LifeFound/es-snapshot-restore/internal/provisioner"
+	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrCanceled is the result of a job whose task was canceled
+var ErrCanceled = errors.New("restore task canceled")
+
+// control steers a queued or running job, target and index are set once its restore started
+type control struct {
+	job    *Job
+	cancel context.CancelFunc
+	target *provisioner.Target
+	index  string
+	paused restorev1.PauseMode // empty when running
+}
+
+type controls struct {
+	mu   sync.Mutex
+	jobs map[*Job]*control
+}
+
+func newControls() *controls {
+	return &controls{
+		jobs: make(map[*Job]*control),
+	}
+}
+
+// Active reports whether a job of the task task_id is queued or running
+func (w *Worker) Active(task_id string) bool {
+	w.controls.mu.Lock()
+	defer w.controls.mu.Unlock()
+
+	for job := range w.controls.jobs {
+		if job.TaskID == task_id {
+			return true
+		}
+	}
+	return false
+}
+
+// of returns the controls of the jobs of the task task_id
+func (c *controls) of(task_id string) []*control {
+	var of []*control
+	for job, ctl := range c.jobs {
+		if job.TaskID == task_id {
+			of = append(of, ctl)
+		}
+	}
+	return of
+}
+
+// Cancel stops the jobs of the task task_id, marks it CANCELED and deletes its restored indices so Elasticsearch
+// aborts their recovery. With teardown the restore node is torn down unless another task still uses it.
+func (w *Worker) Cancel(ctx context.Context, task_id string, teardown bool) error {
+	tasks, err := db.QueryAll[db.Task](w.DBClient, "", 0, "task_id = ?", task_id)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to query task id %s", task_id)
+		return err
+	}
+	// the indices of a finished task are kept, only the ones still restoring are canceled
+	var canceled []db.Task
+	for _, t := range tasks {
+		if slices.Contains(activeStatuses(), t.Status) {
+			canceled = append(canceled, t)
+		}
+	}
+	if len(canceled) == 0 {
+		return nil
+	}
+
+	if err := w.DBClient.Model(&db.Task{}).
+		Where("task_id = ? AND status IN ?", task_id, activeStatuses()).
+		Updates(map[string]any{
+			"Status":     string(utils.TaskCanceled),
+			"FinishedAt": time.Now(),
+		}).Error; err != nil {
+		log.Error().Err(err).Msgf("failed to cancel task id %s", task_id)
+		return err
+	}
+	w.publish(cache.Event{TaskID: task_id, Type: cache.EventStatus, Status: string(utils.TaskCanceled)})
+
+	w.controls.mu.Lock()
+	var restored []*control
+	known := make(map[string]bool)
+	for _, ctl := range w.controls.of(task_id) {
+		if ctl.cancel != nil {
+			ctl.cancel()
+		}
+		if ctl.paused == restorev1.PauseThrottle {
+			w.unthrottle(ctx, ctl)
+		}
+		ctl.paused = ""
+		if ctl.target != nil {
+			restored = append(restored, ctl)
+		}
+		for _, index := range ctl.job.Index {
+			known[index] = true
+		}
+	}
+	w.controls.mu.Unlock()
+
+	var errs []error
+	for _, ctl := range restored {
+		log.Info().Msgf("delete index %s of canceled task id %s", ctl.index, task_id)
+		if err := ctl.target.ES.DeleteIndices(ctx, []string{ctl.index}); err != nil {
+			log.Error().Err(err).Msgf("failed to delete index %s of canceled task id %s", ctl.index, task_id)
+			errs = append(errs, err)
+		}
+	}
+
+	// the job isn't known to this worker, its index is found by name on the target of its restore node and the
+	// node it was placed on is released here rather than when the job finishes
+	for _, t := range canceled {
+		if t.Node == "" || known[t.Index] {
+			continue
+		}
+		w.Pool.Release(t.Node)
+		if err := w.deleteRestored(ctx, t); err != nil {
+			log.Error().Err(err).Msgf("failed to delete index %s restored for canceled task id %s", t.Index, task_id)
+			errs = append(errs, err)
+		}
+	}
+
+	if teardown {
+		for _, node := range taskNodes(canceled) {
+			if err := w.teardown(ctx, node, task_id); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Fail marks the unfinished indices of the task task_id FAILED with err as reason, before a job restores them,
+// and notifies the result
+func (w *Worker) Fail(ctx context.Context, task_id string, err error) error {
+	if dberr := w.DBClient.Model(&db.Task{}).
+		Where("task_id = ? AND status IN ?", task_id, activeStatuses()).
+		Updates(map[string]any{
+			"Status":       string(utils.TaskFailed),
+			"ErrorMessage": utils.PtrToAny(err.Error()),
+			"FinishedAt":   time.Now(),
+		}).Error; dberr != nil {
+		log.Error().Err(dberr).Msgf("failed to update status of failed task id %s", task_id)
+		return dberr
+	}
+	w.publish(cache.Event{TaskID: task_id, Type: cache.EventStatus, Status: string(utils.TaskFailed), Message: err.Error()})
+	w.Notifier.TaskFinished(ctx, task_id)
+	return nil
+}
+
+// teardown tears the restore node name of the canceled task task_id down when no other task uses it
+func (w *Worker) teardown(ctx context.Context, name, task_id string) error {
+	var others int64
+	if err := w.DBClient.Model(&db.Task{}).
+		Where("node = ? AND task_id <> ? AND status IN ?", name, task_id, activeStatuses()).
+		Count(&others).Error; err != nil {
+		log.Error().Err(err).Msgf("failed to count tasks of restore node %s", name)
+		return err
+	}
+	if others > 0 {
+		log.Info().Msgf("keep restore node %s of canceled task id %s, %d other tasks use it", name, task_id, others)
+		return nil
+	}
+
+	req, err := w.nodeRequest(name)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("tear down restore node %s of canceled task id %s", name, task_id)
+	if err := w.Provisioner.Teardown(ctx, req); err != nil {
+		log.Error().Err(err).Msgf("failed to tear down restore node %s", name)
+		return err
+	}
+	return w.Pool.Forget(name)
+}
+
+// deleteRestored deletes the index restored for the task t on the target of its restore node
+func (w *Worker) deleteRestored(ctx context.Context, t db.Task) error {
+	req, err := w.nodeRequest(t.Node)
+	if err != nil {
+		return err
+	}
+	target, err := w.Provisioner.Target(ctx, req, t.Repository)
+	if err != nil {
+		return err
+	}
+
+	index := elastic.RestoredIndexName(config.GlobalConfig.ES.RestoreKey, target.AttrValue, t.Index)
+	log.Info().Msgf("delete index %s of canceled task id %s", index, t.TaskID)
+	return target.ES.DeleteIndices(ctx, []string{index})
+}
+
+// nodeRequest is the request of the restore node name with the isolation it was recorded with
+func (w *Worker) nodeRequest(name string) (provisioner.Request, error) {
+	nodes, err := db.QueryAll[db.RestoreNode](w.DBClient, "", 0, "name = ?", name)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to query restore node %s", name)
+		return provisioner.Request{}, err
+	}
+
+	req := provisioner.NewRequest(name, "")
+	if len(nodes) > 0 {
+		req.Isolation = restorev1.IsolationMode(nodes[0].Isolation)
+	}
+	return req, nil
+}
+
+// Pause marks the task task_id PAUSED and pauses its running jobs with mode, the jobs which haven't started are
+// paused once their restore starts
+func (w *Worker) Pause(ctx context.Context, task_id string, mode restorev1.PauseMode) error {
+	if mode == "" {
+		mode = restorev1.PauseThrottle
+	}
+
+	result := w.DBClient.Model(&db.Task{}).
+		Where("task_id = ? AND status IN ?", task_id, []string{string(utils.TaskPending), string(utils.TaskQueued), string(utils.TaskRunning)}).
+		Updates(map[string]any{
+			"Status":    string(utils.TaskPaused),
+			"UpdatedAt": time.Now(),
+		})
+	if result.Error != nil {
+		log.Error().Err(result.Error).Msgf("failed to pause task id %s", task_id)
+		return result.Error
+	}
+	w.publish(cache.Event{TaskID: task_id, Type: cache.EventStatus, Status: string(utils.TaskPaused), Message: string(mode)})
+
+	w.controls.mu.Lock()
+	defer w.controls.mu.Unlock()
+
+	var errs []error
+	for _, ctl := range w.controls.of(task_id) {
+		if ctl.paused != "" {
+			continue
+		}
+		ctl.paused = mode
+		if ctl.target != nil {
+			if err := w.pause(ctx, ctl); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Resume marks the paused task task_id RUNNING, or QUEUED when it isn't placed yet, and resumes its jobs
+func (w *Worker) Resume(ctx context.Context, task_id string) error {
+	for status, placed := range map[utils.TaskStatus]string{utils.TaskRunning: "node <> ''", utils.TaskQueued: "node = ''"} {
+		result := w.DBClient.Model(&db.Task{}).
+			Where("task_id = ? AND status = ?", task_id, string(utils.TaskPaused)).
+			Where(placed).
+			Updates(map[string]any{
+				"Status":    string(status),
+				"UpdatedAt": time.Now(),
+			})
+		if result.Error != nil {
+			log.Error().Err(result.Error).Msgf("failed to resume task id %s", task_id)
+			return result.Error
+		}
+		if result.RowsAffected > 0 {
+			w.publish(cache.Event{TaskID: task_id, Type: cache.EventStatus, Status: string(status)})
+		}
+	}
+
+	w.controls.mu.Lock()
+	defer w.controls.mu.Unlock()
+
+	var errs []error
+	for _, ctl := range w.controls.of(task_id) {
+		if ctl.paused == "" {
+			continue
+		}
+		if ctl.target != nil {
+			if err := w.resume(ctx, ctl); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		ctl.paused = ""
+	}
+
+	return errors.Join(errs...)
+}
+
+// pause throttles the recovery of the target of ctl or closes its restored index, the caller holds the lock
+func (w *Worker) pause(ctx context.Context, ctl *control) error {
+	log.Info().Msgf("pause restore of index %s with %s", ctl.index, ctl.paused)
+	if ctl.paused == restorev1.PauseClose {
+		return ctl.target.ES.CloseIndices(ctx, []string{ctl.index})
+	}
+
+	_, err := w.Throttle.Acquire(ctx, ctl.target.ES, ctl.target.Endpoint, "", pauseThrottleID(ctl.job), restorev1.Throttle{
+		MaxBytesPerSec: config.GlobalConfig.Pause.RecoveryRate,
+	})
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to throttle restore of index %s to %s", ctl.index, config.GlobalConfig.Pause.RecoveryRate)
+	}
+	return err
+}
+
+// resume undoes pause, the caller holds the lock
+func (w *Worker) resume(ctx context.Context, ctl *control) error {
+	log.Info().Msgf("resume restore of index %s paused with %s", ctl.index, ctl.paused)
+	if ctl.paused == restorev1.PauseClose {
+		return ctl.target.ES.OpenIndices(ctx, []string{ctl.index})
+	}
+	w.unthrottle(ctx, ctl)
+	return nil
+}
+
+// unthrottle releases the recovery rate the pause of ctl bounds, the caller holds the lock
+func (w *Worker) unthrottle(ctx context.Context, ctl *control) {
+	if ctl.target == nil {
+		return
+	}
+	w.Throttle.Release(ctx, ctl.target.Endpoint, pauseThrottleID(ctl.job))
+}
+
+// pauseThrottleID is the id the pause of job bounds the recovery rate by, next to the bandwidth of its restore
+func pauseThrottleID(job *Job) string {
+	return fmt.Sprintf("pause/%p", job)
+}
+
+// started records where the job restores its index to and pauses it when its task was paused before
+func (w *Worker) started(ctx context.Context, job *Job, target *provisioner.Target, index string, status string) {
+	w.controls.mu.Lock()
+	defer w.controls.mu.Unlock()
+
+	ctl, ok := w.controls.jobs[job]
+	if !ok {
+		return
+	}
+	ctl.target = target
+	ctl.index = index
+	if ctl.paused == "" && status == string(utils.TaskPaused) {
+		ctl.paused = restorev1.PauseThrottle
+	}
+	if ctl.paused != "" {
+		if err := w.pause(ctx, ctl); err != nil {
+			log.Error().Err(err).Msgf("failed to pause restore of index %s", index)
+		}
+	}
+}
+
+// isPaused reports whether the job is paused, its restore timeout doesn't run meanwhile
+func (w *Worker) isPaused(job *Job) bool {
+	w.controls.mu.Lock()
+	defer w.controls.mu.Unlock()
+
+	ctl, ok := w.controls.jobs[job]
+	return ok && ctl.paused != ""
+}
+
+// finished forgets the control of the job, releasing what its pause holds
+func (w *Worker) finished(job *Job) {
+	w.controls.mu.Lock()
+	defer w.controls.mu.Unlock()
+
+	ctl, ok := w.controls.jobs[job]
+	if !ok {
+		return
+	}
+	if ctl.paused == restorev1.PauseThrottle {
+		w.unthrottle(w.ctx, ctl)
+	}
+	delete(w.controls.jobs, job)
+}
+
+// activeStatuses are the statuses of a task which isn't finished
+func activeStatuses() []string {
+	return []string{
+		string(utils.TaskAwaitingApproval),
+		string(utils.TaskPending),
+		string(utils.TaskQueued),
+		string(utils.TaskRunning),
+		string(utils.TaskPaused),
+	}
+}
+
+func taskNodes(tasks []db.Task) []string {
+	seen := make(map[string]bool)
+	var nodes []string
+	for _, t := range tasks {
+		if t.Node != "" && !seen[t.Node] {
+			seen[t.Node] = true
+			nodes = append(nodes, t.Node)
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,33 @@
+package worker
+
+import (
+	"github.com/404LifeFound/es-snapshot-restore/internal/cache"
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
+	"github.com/rs/zerolog/log"
+)
+
+// publish sends e to the followers of its task
+func (w *Worker) publish(e cache.Event) {
+	w.Events.Publish(w.ctx, e)
+}
+
+// stage records the stage of the indices of job and publishes it
+func (w *Worker) stage(job *Job, stage utils.Stag) {
+	if err := w.DBClient.Model(&db.Task{}).
+		Where("task_id = ? AND `index` IN ?", job.TaskID, job.Index).
+		Update("CurrentStage", string(stage)).Error; err != nil {
+		log.Error().Err(err).Msgf("failed to update stage of task id %s to %s", job.TaskID, stage)
+	}
+
+	for _, index := range job.Index {
+		w.publish(cache.Event{
+			TaskID:    job.TaskID,
+			Type:      cache.EventStage,
+			Index:     index,
+			NodeName:  job.Request.Name,
+			StoreSize: job.Request.StoreSize,
+			Stage:     string(stage),
+		})
+	}
+}
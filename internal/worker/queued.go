@@ -0,0 +1,239 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/404LifeFound/es-snapshot-restore/internal/budget"
+	restorev1 "github.com/404LifeFound/es-snapshot-restore/internal/controller/api/v1"
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/404LifeFound/es-snapshot-restore/internal/provisioner"
+	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
+	"github.com/rs/zerolog/log"
+)
+
+// Queued is the payload of a task queued on an exhausted budget or a full restore queue, what its restore is placed
+// with once there is room. The tasks of one restore request share its Group and are placed together.
+type Queued struct {
+	Group     string                   `json:"group"`
+	Node      string                   `json:"node,omitempty"`
+	Replicas  *int                     `json:"replicas,omitempty"`
+	StoreSize string                   `json:"store_size"`
+	Isolation restorev1.IsolationMode  `json:"isolation,omitempty"`
+	Placement *restorev1.Placement     `json:"placement,omitempty"`
+	Resources *restorev1.NodeResources `json:"resources,omitempty"`
+	Team      string                   `json:"team,omitempty"`
+	Throttle  *restorev1.Throttle      `json:"throttle,omitempty"`
+}
+
+// Request is the request placing the restore of q
+func (q Queued) Request() provisioner.Request {
+	req := provisioner.NewRequest(q.Node, q.StoreSize)
+	if q.Isolation != "" {
+		req.Isolation = q.Isolation
+	}
+	req.Placement = q.Placement
+	req.Resources = q.Resources
+	req.Team = q.Team
+	return req
+}
+
+// Payload is q recorded as the payload of its task
+func (q Queued) Payload() (*string, error) {
+	payload, err := json.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+	return utils.PtrToAny(string(payload)), nil
+}
+
+// AdmitQueued places the tasks queued on an exhausted budget or a full restore queue and enqueues their jobs. The
+// queued tasks are read from the db, so they are admitted after a restart too, and the ones canceled or paused
+// meanwhile aren't queued anymore.
+func (w *Worker) AdmitQueued(ctx context.Context) error {
+	if cap(w.queue) > 0 && len(w.queue) == cap(w.queue) {
+		log.Info().Msgf("queued tasks keep waiting, %d jobs are waiting already", cap(w.queue))
+		return nil
+	}
+
+	tasks, err := db.QueryAll[db.Task](w.DBClient, "id", 0, "status = ? AND node = '' AND payload IS NOT NULL", string(utils.TaskQueued))
+	if err != nil {
+		log.Error().Err(err).Msg("failed to query queued tasks")
+		return err
+	}
+
+	var groups []string
+	queued := make(map[string][]db.Task)
+	payloads := make(map[uint]Queued)
+	for _, t := range tasks {
+		var q Queued
+		if err := json.Unmarshal([]byte(*t.Payload), &q); err != nil {
+			log.Error().Err(err).Msgf("failed to parse payload of queued task id %s of index %s", t.TaskID, t.Index)
+			continue
+		}
+		if _, ok := queued[q.Group]; !ok {
+			groups = append(groups, q.Group)
+		}
+		queued[q.Group] = append(queued[q.Group], t)
+		payloads[t.ID] = q
+	}
+
+	var errs []error
+	for _, group := range groups {
+		if err := w.admit(ctx, queued[group], payloads); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// admit places the queued tasks of a restore request together and enqueues the ones still queued onto the placed
+// restore node, they keep waiting while the budget is exhausted
+func (w *Worker) admit(ctx context.Context, tasks []db.Task, payloads map[uint]Queued) error {
+	admitted, err := w.Pool.Acquire(ctx, payloads[tasks[0].ID].Request(), len(tasks))
+	if errors.Is(err, budget.ErrExhausted) {
+		log.Info().Err(err).Msgf("%d queued tasks keep waiting for restore capacity", len(tasks))
+		return nil
+	} else if err != nil {
+		log.Error().Err(err).Msgf("failed to place %d queued tasks on a restore node", len(tasks))
+		for _, t := range tasks {
+			w.FailOnError(t.TaskID, t.Index)(ctx, err)
+			w.Notifier.TaskFinished(ctx, t.TaskID)
+		}
+		return err
+	}
+
+	log.Info().Msgf("place %d queued tasks on restore node %s", len(tasks), admitted.Name)
+	var errs []error
+	for _, t := range tasks {
+		result := w.DBClient.Model(&db.Task{}).
+			Where("id = ? AND status = ? AND node = ''", t.ID, string(utils.TaskQueued)).
+			Updates(map[string]any{
+				"Node":      admitted.Name,
+				"Status":    string(utils.TaskRunning),
+				"UpdatedAt": time.Now(),
+			})
+		if result.Error != nil || result.RowsAffected == 0 {
+			// the task was canceled or paused meanwhile, the node doesn't hold it
+			if result.Error != nil {
+				log.Error().Err(result.Error).Msgf("failed to update status of queued task id %s placed on %s", t.TaskID, admitted.Name)
+			}
+			w.Pool.Release(admitted.Name)
+			continue
+		}
+
+		if err := w.Submit(&Job{
+			TaskID:    t.TaskID,
+			Index:     []string{t.Index},
+			Replicas:  payloads[t.ID].Replicas,
+			Request:   admitted,
+			Provision: true,
+			Throttle:  payloads[t.ID].Throttle,
+			OnDone:    w.FailOnError(t.TaskID, t.Index),
+		}, payloads[t.ID]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Submit enqueues the job of a task placed with queued. When the queue is full the task is recorded QUEUED again
+// and the restore node it was placed on released, AdmitQueued places it once the queue has room.
+func (w *Worker) Submit(job *Job, queued Queued) error {
+	err := w.Enqueue(job)
+	if !errors.Is(err, ErrQueueFull) {
+		return err
+	}
+
+	log.Warn().Err(err).Msgf("queue task id %s of index %v until the restore queue has room", job.TaskID, job.Index)
+	w.Pool.Release(job.Request.Name)
+	queued.Throttle = job.Throttle
+	payload, err := queued.Payload()
+	if err != nil {
+		return err
+	}
+	if err := w.DBClient.Model(&db.Task{}).
+		Where("task_id = ? AND `index` IN ? AND status = ?", job.TaskID, job.Index, string(utils.TaskRunning)).
+		Updates(map[string]any{
+			"Status":    string(utils.TaskQueued),
+			"Node":      "",
+			"Payload":   payload,
+			"UpdatedAt": time.Now(),
+		}).Error; err != nil {
+		log.Error().Err(err).Msgf("failed to queue task id %s of index %v", job.TaskID, job.Index)
+		return err
+	}
+	return nil
+}
+
+// errInterrupted is the error of a restore the worker stopped in the middle of
+var errInterrupted = errors.New("restore interrupted by a restart of the worker")
+
+// Recover settles the tasks a stop of the worker left RUNNING, before it starts. Their half restored index is deleted
+// and their restore node released, then a task recorded with its payload is queued again for AdmitQueued to place it
+// and the others are marked FAILED.
+func (w *Worker) Recover(ctx context.Context) error {
+	tasks, err := db.QueryAll[db.Task](w.DBClient, "id", 0, "status = ? AND node <> ''", string(utils.TaskRunning))
+	if err != nil {
+		log.Error().Err(err).Msg("failed to query running tasks")
+		return err
+	}
+
+	var errs []error
+	for _, t := range tasks {
+		log.Warn().Msgf("recover task id %s of index %s interrupted on restore node %s", t.TaskID, t.Index, t.Node)
+		if err := w.DBClient.Model(&db.TaskAttempt{}).
+			Where("task_id = ? AND `index` = ? AND status = ?", t.TaskID, t.Index, string(utils.TaskRunning)).
+			Updates(map[string]any{
+				"Status":       string(utils.TaskFailed),
+				"ErrorMessage": utils.PtrToAny(errInterrupted.Error()),
+				"Retryable":    t.Payload != nil,
+				"FinishedAt":   time.Now(),
+			}).Error; err != nil {
+			log.Error().Err(err).Msgf("failed to update interrupted attempt of task id %s of index %s", t.TaskID, t.Index)
+		}
+		if err := w.deleteRestored(ctx, t); err != nil {
+			log.Error().Err(err).Msgf("failed to delete index %s half restored for task id %s", t.Index, t.TaskID)
+			errs = append(errs, err)
+		}
+		w.Pool.Release(t.Node)
+
+		if t.Payload == nil {
+			w.FailOnError(t.TaskID, t.Index)(ctx, errInterrupted)
+			w.Notifier.TaskFinished(ctx, t.TaskID)
+			continue
+		}
+		if err := w.DBClient.Model(&db.Task{}).
+			Where("id = ? AND status = ?", t.ID, string(utils.TaskRunning)).
+			Updates(map[string]any{
+				"Status":    string(utils.TaskQueued),
+				"Node":      "",
+				"UpdatedAt": time.Now(),
+			}).Error; err != nil {
+			log.Error().Err(err).Msgf("failed to queue interrupted task id %s of index %s", t.TaskID, t.Index)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// FailOnError returns the OnDone of a job of the task task_id restoring index, which marks it FAILED on an error
+// the restore didn't record. A placement or provisioning error leaves the task queued or running.
+func (w *Worker) FailOnError(task_id, index string) func(ctx context.Context, err error) {
+	return func(ctx context.Context, err error) {
+		if err == nil {
+			return
+		}
+		if dberr := w.DBClient.Model(&db.Task{}).
+			Where("task_id = ? AND `index` = ? AND status IN ?", task_id, index,
+				[]string{string(utils.TaskQueued), string(utils.TaskRunning)}).
+			Updates(map[string]any{
+				"Status":       string(utils.TaskFailed),
+				"ErrorMessage": utils.PtrToAny(err.Error()),
+			}).Error; dberr != nil {
+			log.Error().Err(dberr).Msgf("failed to update status for task id %s of index %s", task_id, index)
+		}
+	}
+}
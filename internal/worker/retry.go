@@ -0,0 +1,62 @@
+package worker
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/404LifeFound/es-snapshot-restore/internal/elastic"
+)
+
+// errTimeout is the error of a restore not finished after es.timeout minutes
+var errTimeout = errors.New("restore timed out")
+
+// retryable reports whether the retry policy restores the index again after err
+func retryable(err error) bool {
+	policy := config.GlobalConfig.Retry
+
+	if errors.Is(err, errTimeout) {
+		return policy.Timeout
+	}
+	if errors.Is(err, elastic.ErrPartialShardFailure) {
+		return policy.PartialFailure
+	}
+
+	var resp_err *elastic.ResponseError
+	if !errors.As(err, &resp_err) {
+		return false
+	}
+	if slices.Contains(policy.StatusCodes, resp_err.StatusCode) {
+		return true
+	}
+	for _, reason := range policy.Reasons {
+		if strings.Contains(resp_err.Body, reason) {
+			return true
+		}
+	}
+	return false
+}
+
+// Backoff is the wait before attempt, growing by retry.multiplier from retry.backoff plus up to retry.jitter of it
+// at random, up to retry.maxbackoff
+func Backoff(attempt int) time.Duration {
+	policy := config.GlobalConfig.Retry
+
+	multiplier := policy.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	seconds := float64(policy.Backoff) * math.Pow(multiplier, float64(max(attempt-2, 0)))
+	if policy.Jitter > 0 {
+		seconds += seconds * policy.Jitter * rand.Float64()
+	}
+	if policy.MaxBackoff > 0 {
+		seconds = math.Min(seconds, float64(policy.MaxBackoff))
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
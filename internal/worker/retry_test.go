@@ -0,0 +1,84 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/404LifeFound/es-snapshot-restore/internal/elastic"
+)
+
+var _ = Describe("Retry", func() {
+	BeforeEach(func() {
+		saved := config.GlobalConfig
+		DeferCleanup(func() { config.GlobalConfig = saved })
+		config.GlobalConfig.Retry = config.Retry{
+			MaxAttempts:    3,
+			Backoff:        30,
+			MaxBackoff:     600,
+			Multiplier:     2,
+			StatusCodes:    []int{429, 503},
+			Reasons:        []string{"snapshot_in_progress_exception"},
+			PartialFailure: true,
+			Timeout:        true,
+		}
+	})
+
+	DescribeTable("retryable",
+		func(partial_failure, timeout bool, err error, expected bool) {
+			config.GlobalConfig.Retry.PartialFailure = partial_failure
+			config.GlobalConfig.Retry.Timeout = timeout
+			Expect(retryable(err)).To(Equal(expected))
+		},
+		Entry("a timeout", true, true, fmt.Errorf("%w: restore of index logs after 1m0s", errTimeout), true),
+		Entry("not a timeout when retry.timeout is unset", true, false, errTimeout, false),
+		Entry("a partial shard failure", true, true, fmt.Errorf("%w: shard 0 of index logs", elastic.ErrPartialShardFailure), true),
+		Entry("not a partial shard failure when retry.partialfailure is unset", false, true, elastic.ErrPartialShardFailure, false),
+		Entry("a retryable status", true, true, &elastic.ResponseError{StatusCode: 503}, true),
+		Entry("a wrapped retryable status", true, true, fmt.Errorf("restore: %w", &elastic.ResponseError{StatusCode: 429}), true),
+		Entry("not another status", true, true, &elastic.ResponseError{StatusCode: 400, Body: `{"error":{"type":"index_not_found_exception"}}`}, false),
+		Entry("a retryable reason", true, true, &elastic.ResponseError{StatusCode: 400, Body: `{"error":{"type":"snapshot_in_progress_exception"}}`}, true),
+		Entry("not an error which isn't a response", true, true, errors.New("connection refused"), false),
+	)
+
+	DescribeTable("Backoff",
+		func(backoff, max_backoff int, multiplier float64, attempt int, expected time.Duration) {
+			config.GlobalConfig.Retry.Backoff = backoff
+			config.GlobalConfig.Retry.MaxBackoff = max_backoff
+			config.GlobalConfig.Retry.Multiplier = multiplier
+			Expect(Backoff(attempt)).To(Equal(expected))
+		},
+		Entry("retry.backoff before the second attempt", 30, 600, 2.0, 2, 30*time.Second),
+		Entry("retry.backoff before the first attempt too", 30, 600, 2.0, 1, 30*time.Second),
+		Entry("grows by retry.multiplier", 30, 600, 2.0, 3, 60*time.Second),
+		Entry("grows by retry.multiplier per attempt", 30, 600, 2.0, 5, 240*time.Second),
+		Entry("up to retry.maxbackoff", 30, 100, 2.0, 5, 100*time.Second),
+		Entry("unbounded without retry.maxbackoff", 30, 0, 2.0, 7, 960*time.Second),
+		Entry("a multiplier below 1 keeps retry.backoff", 30, 600, 0.5, 5, 30*time.Second),
+		Entry("no wait without retry.backoff", 0, 600, 2.0, 3, time.Duration(0)),
+	)
+
+	It("adds up to retry.jitter of the backoff at random", func() {
+		config.GlobalConfig.Retry.Jitter = 0.5
+		seen := make(map[time.Duration]bool)
+		for range 100 {
+			backoff := Backoff(3)
+			Expect(backoff).To(BeNumerically(">=", 60*time.Second))
+			Expect(backoff).To(BeNumerically("<=", 90*time.Second))
+			seen[backoff] = true
+		}
+		Expect(len(seen)).To(BeNumerically(">", 1))
+	})
+
+	It("keeps the jitter within retry.maxbackoff", func() {
+		config.GlobalConfig.Retry.Jitter = 0.5
+		config.GlobalConfig.Retry.MaxBackoff = 100
+		for range 100 {
+			Expect(Backoff(5)).To(Equal(100 * time.Second))
+		}
+	})
+})
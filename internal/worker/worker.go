@@ -0,0 +1,537 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	"github.com/404LifeFound/es-snapshot-restore/internal/cache"
+	restorev1 "github.com/404LifeFound/es-snapshot-restore/internal/controller/api/v1"
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/404LifeFound/es-snapshot-restore/internal/elastic"
+	"github.com/404LifeFound/es-snapshot-restore/internal/notify"
+	"github.com/404LifeFound/es-snapshot-restore/internal/pool"
+	"github.com/404LifeFound/es-snapshot-restore/internal/provisioner"
+	"github.com/404LifeFound/es-snapshot-restore/internal/throttle"
+	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
+	"github.com/rs/zerolog/log"
+	"go.uber.org/fx"
+	"gorm.io/gorm"
+)
+
+// ErrQueueFull is returned when es.maxtasks jobs are waiting already
+var ErrQueueFull = errors.New("restore queue is full")
+
+// Job restores the indices of a task into the restore capacity of Request
+type Job struct {
+	TaskID string
+	Index  []string
+	// Replicas is the number_of_replicas of the restored indices, they keep the one of the snapshot when nil
+	Replicas *int
+	Request  provisioner.Request
+	// Provision makes the worker create the restore capacity and wait for it before restoring, the controller
+	// reconciles the capacity itself so it leaves this false
+	Provision bool
+	// Throttle bounds the recovery bandwidth of the restore, the throttle config fills its empty fields, optional
+	Throttle *restorev1.Throttle
+	// OnTarget is called with where the indices are restored to, optional
+	OnTarget func(ctx context.Context, target *provisioner.Target)
+	// OnDone is called with the result of the job, optional
+	OnDone func(ctx context.Context, err error)
+}
+
+// Worker restores the snapshot of the queued jobs, at most es.concurrency at the same time
+type Worker struct {
+	ESClient    *elastic.ES
+	DBClient    *gorm.DB
+	Provisioner provisioner.Provisioner
+	Pool        *pool.Pool
+	Throttle    *throttle.Manager
+	Events      *cache.Broker
+	Notifier    *notify.Notifier
+	queue       chan *Job     // job queue
+	sem         chan struct{} // concurrent queue
+	// provisioning holds a mutex per restore node, so the jobs sharing a node create it once
+	provisioning sync.Map
+	ctx          context.Context // canceled when the worker stops
+	controls     *controls
+}
+
+func NewWorker(lc fx.Lifecycle, es_client *elastic.ES, db_client *gorm.DB, p provisioner.Provisioner, restore_pool *pool.Pool, throttle_manager *throttle.Manager, events *cache.Broker, notifier *notify.Notifier) *Worker {
+	w := &Worker{
+		ESClient:    es_client,
+		DBClient:    db_client,
+		Provisioner: p,
+		Pool:        restore_pool,
+		Throttle:    throttle_manager,
+		Events:      events,
+		Notifier:    notifier,
+		queue:       make(chan *Job, config.GlobalConfig.ES.MaxTasks),
+		sem:         make(chan struct{}, config.GlobalConfig.ES.Concurrency),
+		controls:    newControls(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w.ctx = ctx
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			log.Info().Msg("restore worker start")
+			if err := w.Recover(ctx); err != nil {
+				log.Error().Err(err).Msg("failed to recover the tasks interrupted by the last stop")
+			}
+			w.Start(ctx)
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			log.Info().Msg("restore worker stop")
+			cancel()
+			return nil
+		},
+	})
+
+	return w
+}
+
+func (w *Worker) Start(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case job := <-w.queue:
+				w.sem <- struct{}{}
+				go func(job *Job) {
+					defer func() { <-w.sem }()
+					err := w.run(ctx, job)
+					if job.OnDone != nil {
+						job.OnDone(ctx, err)
+					}
+					w.Notifier.TaskFinished(ctx, job.TaskID)
+				}(job)
+			}
+		}
+	}()
+}
+
+// Enqueue adds job to the queue, it returns ErrQueueFull rather than blocking while es.maxtasks jobs are waiting
+func (w *Worker) Enqueue(job *Job) error {
+	w.controls.mu.Lock()
+	w.controls.jobs[job] = &control{job: job}
+	w.controls.mu.Unlock()
+
+	select {
+	case w.queue <- job:
+		return nil
+	default:
+		w.controls.mu.Lock()
+		delete(w.controls.jobs, job)
+		w.controls.mu.Unlock()
+		return fmt.Errorf("%w, %d jobs are waiting", ErrQueueFull, cap(w.queue))
+	}
+}
+
+func (w *Worker) run(ctx context.Context, job *Job) error {
+	// the restore node of the job becomes idle with its last job
+	defer w.Pool.Release(job.Request.Name)
+	defer w.finished(job)
+
+	job_ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w.controls.mu.Lock()
+	if ctl, ok := w.controls.jobs[job]; ok {
+		ctl.cancel = cancel
+	}
+	w.controls.mu.Unlock()
+
+	err := w.runJob(job_ctx, job)
+	if err != nil && job_ctx.Err() != nil && ctx.Err() == nil {
+		return ErrCanceled
+	}
+	return err
+}
+
+func (w *Worker) runJob(ctx context.Context, job *Job) error {
+	if canceled, err := w.canceled(job); err != nil || canceled {
+		if canceled {
+			return ErrCanceled
+		}
+		return err
+	}
+
+	if job.Provision {
+		w.stage(job, utils.StagCreateESNode)
+		if err := w.provision(ctx, job.Request); err != nil {
+			log.Error().Err(err).Msgf("failed to provision restore node %s for task id %s", job.Request.Name, job.TaskID)
+			return err
+		}
+	}
+
+	return w.restoreIndices(ctx, job)
+}
+
+// canceled reports whether the task of job was canceled before it started
+func (w *Worker) canceled(job *Job) (bool, error) {
+	var count int64
+	if err := w.DBClient.Model(&db.Task{}).
+		Where("task_id = ? AND status = ?", job.TaskID, string(utils.TaskCanceled)).
+		Count(&count).Error; err != nil {
+		log.Error().Err(err).Msgf("failed to query task id %s", job.TaskID)
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// provision creates the restore capacity of req when it doesn't exist and waits until it can receive shards
+func (w *Worker) provision(ctx context.Context, req provisioner.Request) error {
+	mu, _ := w.provisioning.LoadOrStore(req.Name, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+
+	exists, err := w.Provisioner.Exists(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		log.Info().Msgf("node %s not exists, so create it", req.Name)
+		if err := w.Provisioner.Create(ctx, req); err != nil {
+			return err
+		}
+	}
+
+	pollInterval := time.Duration(config.GlobalConfig.ES.Interval) * time.Second
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	timeout := time.After(time.Duration(config.GlobalConfig.ES.Timeout) * time.Minute)
+
+	for {
+		grown, err := w.Provisioner.Grow(ctx, req)
+		if err != nil {
+			return err
+		}
+
+		if grown {
+			ready, err := w.Provisioner.Ready(ctx, req)
+			if err != nil {
+				return err
+			}
+			if ready {
+				return nil
+			}
+		}
+
+		log.Info().Msgf("node %s not ready yet", req.Name)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			return fmt.Errorf("node %s not ready after %d minutes", req.Name, config.GlobalConfig.ES.Timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *Worker) restoreIndices(ctx context.Context, job *Job) error {
+	t, err := db.QueryAll[db.Task](w.DBClient, "", 0, "task_id = ? AND `index` = ?", job.TaskID, job.Index[0])
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to query task id %s for index %s", job.TaskID, job.Index[0])
+		return err
+	}
+
+	if len(t) != 1 {
+		err := fmt.Errorf("records for task_id %s of index %s not equal 1 but %d", job.TaskID, job.Index[0], len(t))
+		log.Error().Err(err).Send()
+		return err
+	}
+
+	task_one := t[0]
+
+	if task_one.Node == "" {
+		if err := w.DBClient.Model(&task_one).Update("Node", job.Request.Name).Error; err != nil {
+			log.Error().Err(err).Msgf("failed to update node for task id %s of index %s", task_one.TaskID, task_one.Index)
+		}
+	}
+
+	target, err := w.Provisioner.Target(ctx, job.Request, task_one.Repository)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to get Elasticsearch to restore index %s", task_one.Index)
+		return err
+	}
+	if job.OnTarget != nil {
+		job.OnTarget(ctx, target)
+	}
+	es_client := target.ES
+	w.stage(job, utils.StagRestoreIndex)
+	w.Notifier.NodeReady(ctx, job.TaskID, job.Request.Name, target.Endpoint)
+
+	throttle_id := fmt.Sprintf("%p", job)
+	applied, err := w.Throttle.Acquire(ctx, es_client, target.Endpoint, task_one.Repository, throttle_id, throttle.Defaults(job.Throttle))
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to throttle restore of index %s", task_one.Index)
+	}
+	defer w.Throttle.Release(w.ctx, target.Endpoint, throttle_id)
+	if settings, err := json.Marshal(applied); err != nil {
+		log.Error().Err(err).Msgf("failed to marshal throttle of index %s", task_one.Index)
+	} else if err := w.DBClient.Model(&task_one).Update("Throttle", utils.PtrToAny(string(settings))).Error; err != nil {
+		log.Error().Err(err).Msgf("failed to update throttle for task id %s of index %s", task_one.TaskID, task_one.Index)
+	}
+
+	restored_index := elastic.RestoredIndexName(config.GlobalConfig.ES.RestoreKey, target.AttrValue, task_one.Index)
+
+	policy := config.GlobalConfig.Retry
+	for attempt := task_one.Attempts + 1; ; attempt++ {
+		err := w.attempt(ctx, job, target, task_one, restored_index, attempt)
+		if err == nil {
+			log.Info().Msgf("restore of index %s completed successfully", task_one.Index)
+			if err := w.DBClient.Model(&task_one).Where("status <> ?", string(utils.TaskCanceled)).Updates(map[string]any{
+				"Status":     string(utils.TaskSuccess),
+				"Progress":   100,
+				"FinishedAt": time.Now(),
+			}).Error; err != nil {
+				log.Error().Err(err).Msgf("failed to update status for task id %s of index %s when task success", task_one.TaskID, task_one.Index)
+			}
+			w.publish(cache.Event{
+				TaskID:   task_one.TaskID,
+				Type:     cache.EventStatus,
+				Index:    task_one.Index,
+				Snapshot: task_one.Snapshot,
+				NodeName: job.Request.Name,
+				Status:   string(utils.TaskSuccess),
+				Progress: 100,
+				Attempt:  attempt,
+			})
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return err
+		}
+
+		if !retryable(err) || attempt >= policy.MaxAttempts {
+			status := utils.TaskFailed
+			if errors.Is(err, errTimeout) {
+				status = utils.TaskTimeout
+			}
+			log.Error().Err(err).Msgf("restore of index %s failed after %d attempts", task_one.Index, attempt)
+			if err := w.DBClient.Model(&task_one).Where("status <> ?", string(utils.TaskCanceled)).Updates(map[string]any{
+				"Status":       string(status),
+				"ErrorMessage": utils.PtrToAny(err.Error()),
+				"FinishedAt":   time.Now(),
+			}).Error; err != nil {
+				log.Error().Err(err).Msgf("failed to update status and error_message for task id %s of index %s", task_one.TaskID, task_one.Index)
+			}
+			w.publish(cache.Event{
+				TaskID:   task_one.TaskID,
+				Type:     cache.EventStatus,
+				Index:    task_one.Index,
+				Snapshot: task_one.Snapshot,
+				NodeName: job.Request.Name,
+				Status:   string(status),
+				Attempt:  attempt,
+				Message:  err.Error(),
+			})
+			return err
+		}
+
+		backoff := Backoff(attempt + 1)
+		log.Warn().Err(err).Msgf("attempt %d to restore index %s failed, retry in %s", attempt, task_one.Index, backoff)
+		if err := w.DBClient.Model(&task_one).Update("ErrorMessage", utils.PtrToAny(err.Error())).Error; err != nil {
+			log.Error().Err(err).Msgf("failed to update error_message for task id %s of index %s", task_one.TaskID, task_one.Index)
+		}
+		w.publish(cache.Event{
+			TaskID:   task_one.TaskID,
+			Type:     cache.EventRetry,
+			Index:    task_one.Index,
+			Snapshot: task_one.Snapshot,
+			NodeName: job.Request.Name,
+			Attempt:  attempt,
+			Message:  fmt.Sprintf("retry in %s: %s", backoff, err.Error()),
+		})
+
+		// a half restored index makes the next restore fail as it already exists
+		if err := es_client.DeleteIndices(ctx, []string{restored_index}); err != nil {
+			log.Error().Err(err).Msgf("failed to delete half restored index %s", restored_index)
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// attempt restores the index of task_one once and waits for its recovery, the attempt is recorded as a TaskAttempt
+func (w *Worker) attempt(ctx context.Context, job *Job, target *provisioner.Target, task_one db.Task, restored_index string, attempt int) error {
+	record := db.TaskAttempt{
+		TaskID:    task_one.TaskID,
+		Index:     task_one.Index,
+		Attempt:   attempt,
+		Status:    string(utils.TaskRunning),
+		StartedAt: time.Now(),
+	}
+	if err := db.CreateRecords(w.DBClient, &[]db.TaskAttempt{record}); err != nil {
+		log.Error().Err(err).Msgf("failed to record attempt %d of task id %s of index %s", attempt, task_one.TaskID, task_one.Index)
+		return err
+	}
+	if err := w.DBClient.Model(&task_one).Updates(map[string]any{"Attempts": attempt, "Progress": 0}).Error; err != nil {
+		log.Error().Err(err).Msgf("failed to update attempts of task id %s of index %s", task_one.TaskID, task_one.Index)
+	}
+	w.publish(cache.Event{
+		TaskID:   task_one.TaskID,
+		Type:     cache.EventStatus,
+		Index:    task_one.Index,
+		Snapshot: task_one.Snapshot,
+		NodeName: job.Request.Name,
+		Status:   string(utils.TaskRunning),
+		Attempt:  attempt,
+	})
+
+	err := w.restoreIndex(ctx, job, target, task_one, restored_index, attempt)
+
+	updates := map[string]any{
+		"Status":     string(utils.TaskSuccess),
+		"FinishedAt": time.Now(),
+	}
+	switch {
+	case err == nil:
+	case ctx.Err() != nil:
+		updates["Status"] = string(utils.TaskCanceled)
+	case errors.Is(err, errTimeout):
+		updates["Status"] = string(utils.TaskTimeout)
+	default:
+		updates["Status"] = string(utils.TaskFailed)
+	}
+	if err != nil {
+		updates["ErrorMessage"] = utils.PtrToAny(err.Error())
+		updates["Retryable"] = retryable(err)
+	}
+	if dberr := w.DBClient.Model(&db.TaskAttempt{}).
+		Where("task_id = ? AND `index` = ? AND attempt = ?", task_one.TaskID, task_one.Index, attempt).
+		Updates(updates).Error; dberr != nil {
+		log.Error().Err(dberr).Msgf("failed to update attempt %d of task id %s of index %s", attempt, task_one.TaskID, task_one.Index)
+	}
+
+	return err
+}
+
+func (w *Worker) restoreIndex(ctx context.Context, job *Job, target *provisioner.Target, task_one db.Task, restored_index string, attempt int) error {
+	es_client := target.ES
+
+	log.Info().Msgf("restoring index %s from snapshot %s as %s, attempt %d", task_one.Index, task_one.Snapshot, restored_index, attempt)
+	if err := es_client.Restore(
+		ctx,
+		task_one.Repository,
+		task_one.Snapshot,
+		config.GlobalConfig.ES.RestoreKey,
+		config.GlobalConfig.ES.RestoreKey,
+		target.AttrValue,
+		job.Replicas,
+		[]string{task_one.Index},
+	); err != nil {
+		log.Error().Err(err).Msgf("failed to restore index %s from snapshot %s", task_one.Index, task_one.Snapshot)
+		return err
+	}
+
+	// every attempt restores the index again, so its pause is applied again too
+	w.started(ctx, job, target, restored_index, task_one.Status)
+
+	restoreTimeout := time.Duration(config.GlobalConfig.ES.Timeout) * time.Minute
+	pollInterval := time.Duration(config.GlobalConfig.ES.Interval) * time.Second
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	// the timeout doesn't run while the job is paused
+	deadline := time.Now().Add(restoreTimeout)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-ticker.C:
+			if w.isPaused(job) {
+				deadline = deadline.Add(pollInterval)
+				continue
+			}
+
+			if time.Now().After(deadline) {
+				return fmt.Errorf("%w: restore of index %s after %s", errTimeout, task_one.Index, restoreTimeout)
+			}
+
+			if err := es_client.CheckRestoredShards(ctx, restored_index); errors.Is(err, elastic.ErrPartialShardFailure) {
+				return err
+			} else if err != nil {
+				log.Error().Err(err).Msgf("failed to check the shards of restore index %s", restored_index)
+			}
+
+			res, err := es_client.GetRestoreIndexProcess([]string{restored_index})
+			if err != nil {
+				log.Error().Err(err).Msgf("failed to check the recovery process of restore index %s from snapshot %s", task_one.Index, task_one.Snapshot)
+				continue
+			}
+
+			if len(res) == 0 {
+				log.Warn().Msgf("no recovery info found for index %s, retrying...", task_one.Index)
+				continue
+			}
+
+			progress := recoveredPercent(res)
+			log.Info().Msgf("restore progress of index %s: %.1f%%", task_one.Index, progress)
+
+			if progress != task_one.Progress {
+				task_one.Progress = progress
+				if err := w.DBClient.Model(&task_one).Update("Progress", progress).Error; err != nil {
+					log.Error().Err(err).Msgf("failed to update progress of task id %s of index %s", task_one.TaskID, task_one.Index)
+				}
+				w.publish(cache.Event{
+					TaskID:   task_one.TaskID,
+					Type:     cache.EventProgress,
+					Index:    task_one.Index,
+					Snapshot: task_one.Snapshot,
+					NodeName: job.Request.Name,
+					Progress: progress,
+					Attempt:  attempt,
+				})
+			}
+
+			if recovered(res) {
+				return nil
+			}
+		}
+	}
+}
+
+// recovered reports whether every shard of res finished its recovery, not only the first one
+func recovered(res []elastic.Recovery) bool {
+	for _, r := range res {
+		if !strings.EqualFold(r.Stage, "done") {
+			return false
+		}
+	}
+	return len(res) > 0
+}
+
+// recoveredPercent is the mean recovered percent of the shards of res
+func recoveredPercent(res []elastic.Recovery) float64 {
+	var sum float64
+	for _, r := range res {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(r.RecoveredPercent, "%"), 64)
+		if err != nil {
+			log.Warn().Err(err).Msgf("invalid recovered percent %s of shard %s of index %s", r.RecoveredPercent, r.Shard, r.Index)
+			continue
+		}
+		sum += percent
+	}
+	return math.Round(sum/float64(len(res))*10) / 10
+}
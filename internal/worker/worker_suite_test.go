@@ -0,0 +1,93 @@
+package worker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.uber.org/fx/fxtest"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/404LifeFound/es-snapshot-restore/internal/audit"
+	"github.com/404LifeFound/es-snapshot-restore/internal/budget"
+	"github.com/404LifeFound/es-snapshot-restore/internal/cache"
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/404LifeFound/es-snapshot-restore/internal/elastic"
+	"github.com/404LifeFound/es-snapshot-restore/internal/notify"
+	"github.com/404LifeFound/es-snapshot-restore/internal/pool"
+	"github.com/404LifeFound/es-snapshot-restore/internal/provisioner"
+	"github.com/404LifeFound/es-snapshot-restore/internal/throttle"
+)
+
+func TestWorker(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "Worker Suite")
+}
+
+// newTestDB opens a sqlite db of the tasks and restore nodes, removed after the spec
+func newTestDB() *gorm.DB {
+	db_client, err := gorm.Open(sqlite.Open(filepath.Join(GinkgoT().TempDir(), "worker.db")), &gorm.Config{
+		Logger: logger.Discard,
+	})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(db_client.AutoMigrate(&db.Task{}, &db.TaskAttempt{}, &db.RestoreNode{}, &db.ThrottleSetting{})).To(Succeed())
+	return db_client
+}
+
+// fakeES records the requests of an Elasticsearch client and replies to them with reply
+type fakeES struct {
+	mu       sync.Mutex
+	requests []string
+	reply    func(r *http.Request) (int, string)
+}
+
+// Requests returns the method and path of the requests received so far
+func (f *fakeES) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+// newFakeES serves an Elasticsearch client with f, which replies an empty json object unless reply is set
+func newFakeES(f *fakeES) *elastic.ES {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+		f.mu.Unlock()
+
+		status, body := http.StatusOK, "{}"
+		if f.reply != nil {
+			status, body = f.reply(r)
+		}
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	DeferCleanup(srv.Close)
+
+	es, err := elastic.NewES(elastic.NewESConfig(elastic.WithAddr([]string{srv.URL})))
+	Expect(err).NotTo(HaveOccurred())
+	return es
+}
+
+// newTestWorker returns a worker restoring into the static node pool of es, its jobs are run by the spec
+func newTestWorker(es *elastic.ES) *Worker {
+	db_client := newTestDB()
+	lc := fxtest.NewLifecycle(GinkgoT())
+
+	b, err := budget.NewBudget(db_client)
+	Expect(err).NotTo(HaveOccurred())
+	notifier, err := notify.NewNotifier(lc, db_client)
+	Expect(err).NotTo(HaveOccurred())
+	p := provisioner.NewStatic(es)
+
+	return NewWorker(lc, es, db_client, p, pool.NewPool(es, db_client, p, b, audit.NewAuditor(db_client)), throttle.NewManager(lc, es, db_client), cache.NewBroker(lc), notifier)
+}
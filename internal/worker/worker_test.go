@@ -0,0 +1,257 @@
+package worker
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/404LifeFound/es-snapshot-restore/config"
+	restorev1 "github.com/404LifeFound/es-snapshot-restore/internal/controller/api/v1"
+	"github.com/404LifeFound/es-snapshot-restore/internal/db"
+	"github.com/404LifeFound/es-snapshot-restore/internal/provisioner"
+	"github.com/404LifeFound/es-snapshot-restore/internal/utils"
+)
+
+// recoveryDone is the recovery of a restored index whose only shard is recovered
+const recoveryDone = `[{"index":"restore_static_logs","shard":"0","stage":"done","bytes_percent":"100.0%"}]`
+
+// count is how many of requests are request
+func count(requests []string, request string) int {
+	n := 0
+	for _, r := range requests {
+		if r == request {
+			n++
+		}
+	}
+	return n
+}
+
+var _ = Describe("Worker", func() {
+	var (
+		es *fakeES
+		w  *Worker
+	)
+
+	BeforeEach(func() {
+		saved := config.GlobalConfig
+		DeferCleanup(func() { config.GlobalConfig = saved })
+		config.GlobalConfig.ES.RestoreKey = "restore"
+		config.GlobalConfig.ES.Interval = 1
+		config.GlobalConfig.ES.Timeout = 1
+		config.GlobalConfig.ES.MaxTasks = 4
+		config.GlobalConfig.ES.Concurrency = 1
+		config.GlobalConfig.Provisioner.StaticAttrValue = "static"
+		config.GlobalConfig.Budget.RetryInterval = 30
+		config.GlobalConfig.Pause.RecoveryRate = "1mb"
+		config.GlobalConfig.Retry = config.Retry{
+			MaxAttempts: 3,
+			StatusCodes: []int{http.StatusTooManyRequests},
+		}
+
+		es = &fakeES{}
+		w = newTestWorker(newFakeES(es))
+	})
+
+	Describe("restoreIndices", func() {
+		DescribeTable("retries the failed restores of the retry policy",
+			func(failures, status int, expected utils.TaskStatus, attempts []string, deletes int) {
+				restores := 0
+				es.reply = func(r *http.Request) (int, string) {
+					switch {
+					case strings.HasSuffix(r.URL.Path, "/_restore"):
+						restores++
+						if restores <= failures {
+							return status, `{"error":{"type":"unavailable_shards_exception"}}`
+						}
+						return http.StatusOK, `{"accepted":true}`
+					case strings.HasPrefix(r.URL.Path, "/_cat/shards"):
+						return http.StatusOK, `[]`
+					case strings.HasPrefix(r.URL.Path, "/_cat/recovery"):
+						return http.StatusOK, recoveryDone
+					}
+					return http.StatusOK, `{}`
+				}
+				Expect(db.CreateRecords(w.DBClient, &[]db.Task{
+					{TaskID: "task", Index: "logs", Repository: "repo", Snapshot: "snap", Status: string(utils.TaskRunning), Node: "static"},
+				})).To(Succeed())
+
+				err := w.restoreIndices(context.Background(), &Job{
+					TaskID:  "task",
+					Index:   []string{"logs"},
+					Request: provisioner.NewRequest("static", "10Gi"),
+				})
+				if expected == utils.TaskSuccess {
+					Expect(err).NotTo(HaveOccurred())
+				} else {
+					Expect(err).To(HaveOccurred())
+				}
+
+				tasks, err := db.QueryAll[db.Task](w.DBClient, "", 0, "task_id = ?", "task")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(tasks).To(HaveLen(1))
+				Expect(tasks[0].Status).To(Equal(string(expected)))
+
+				recorded, err := db.QueryAll[db.TaskAttempt](w.DBClient, "attempt", 0, "task_id = ?", "task")
+				Expect(err).NotTo(HaveOccurred())
+				var statuses []string
+				for _, a := range recorded {
+					statuses = append(statuses, a.Status)
+				}
+				Expect(statuses).To(Equal(attempts))
+
+				// the half restored index is deleted before each retry
+				Expect(count(es.Requests(), "DELETE /restore_static_logs")).To(Equal(deletes))
+			},
+			Entry("a restore done at the first attempt", 0, http.StatusTooManyRequests, utils.TaskSuccess, []string{"SUCCESS"}, 0),
+			Entry("a retryable failure restored again", 1, http.StatusTooManyRequests, utils.TaskSuccess, []string{"FAILED", "SUCCESS"}, 1),
+			Entry("a retryable failure up to retry.maxattempts", 3, http.StatusTooManyRequests, utils.TaskFailed, []string{"FAILED", "FAILED", "FAILED"}, 2),
+			Entry("a failure which isn't retryable", 1, http.StatusBadRequest, utils.TaskFailed, []string{"FAILED"}, 0),
+		)
+	})
+
+	Describe("Pause and Resume", func() {
+		BeforeEach(func() {
+			Expect(db.CreateRecords(w.DBClient, &[]db.Task{
+				{TaskID: "task", Index: "placed", Status: string(utils.TaskRunning), Node: "static"},
+				{TaskID: "task", Index: "queued", Status: string(utils.TaskQueued)},
+				{TaskID: "task", Index: "done", Status: string(utils.TaskSuccess), Node: "static"},
+			})).To(Succeed())
+		})
+
+		statuses := func() map[string]string {
+			tasks, err := db.QueryAll[db.Task](w.DBClient, "", 0, "task_id = ?", "task")
+			Expect(err).NotTo(HaveOccurred())
+			statuses := make(map[string]string)
+			for _, t := range tasks {
+				statuses[t.Index] = t.Status
+			}
+			return statuses
+		}
+
+		It("pauses the unfinished indices and resumes them placed or queued", func() {
+			Expect(w.Pause(context.Background(), "task", "")).To(Succeed())
+			Expect(statuses()).To(Equal(map[string]string{"placed": "PAUSED", "queued": "PAUSED", "done": "SUCCESS"}))
+
+			Expect(w.Resume(context.Background(), "task")).To(Succeed())
+			Expect(statuses()).To(Equal(map[string]string{"placed": "RUNNING", "queued": "QUEUED", "done": "SUCCESS"}))
+		})
+
+		It("pauses a job once its restore starts", func() {
+			job := &Job{TaskID: "task", Index: []string{"placed"}}
+			Expect(w.Enqueue(job)).To(Succeed())
+			Expect(w.Pause(context.Background(), "task", restorev1.PauseClose)).To(Succeed())
+			Expect(w.isPaused(job)).To(BeTrue())
+			Expect(es.Requests()).To(BeEmpty())
+
+			target := &provisioner.Target{ES: w.ESClient, Endpoint: "static"}
+			w.started(context.Background(), job, target, "restore_static_placed", string(utils.TaskPaused))
+			Expect(es.Requests()).To(ConsistOf("POST /restore_static_placed/_close"))
+
+			Expect(w.Resume(context.Background(), "task")).To(Succeed())
+			Expect(w.isPaused(job)).To(BeFalse())
+			Expect(es.Requests()).To(ConsistOf("POST /restore_static_placed/_close", "POST /restore_static_placed/_open"))
+		})
+
+		DescribeTable("pauses a running job with mode",
+			func(mode restorev1.PauseMode, paused, resumed []string) {
+				job := &Job{TaskID: "task", Index: []string{"placed"}}
+				Expect(w.Enqueue(job)).To(Succeed())
+				target := &provisioner.Target{ES: w.ESClient, Endpoint: "static"}
+				w.started(context.Background(), job, target, "restore_static_placed", string(utils.TaskRunning))
+				Expect(w.isPaused(job)).To(BeFalse())
+
+				Expect(w.Pause(context.Background(), "task", mode)).To(Succeed())
+				Expect(w.isPaused(job)).To(BeTrue())
+				Expect(es.Requests()).To(ContainElements(paused))
+
+				Expect(w.Resume(context.Background(), "task")).To(Succeed())
+				Expect(w.isPaused(job)).To(BeFalse())
+				Expect(es.Requests()).To(ContainElements(resumed))
+			},
+			Entry("closing its index", restorev1.PauseClose, []string{"POST /restore_static_placed/_close"}, []string{"POST /restore_static_placed/_open"}),
+			Entry("throttling its recovery", restorev1.PauseThrottle, []string{"PUT /_cluster/settings"}, []string{"PUT /_cluster/settings"}),
+		)
+	})
+
+	Describe("Cancel", func() {
+		BeforeEach(func() {
+			Expect(db.CreateRecords(w.DBClient, &[]db.RestoreNode{
+				{Name: "node-1", StoreSize: "10Gi", Status: string(utils.NodeActive), ActiveTasks: 1},
+			})).To(Succeed())
+			Expect(db.CreateRecords(w.DBClient, &[]db.Task{
+				{TaskID: "task", Index: "logs", Repository: "repo", Status: string(utils.TaskRunning), Node: "node-1"},
+			})).To(Succeed())
+		})
+
+		activeTasks := func() int {
+			nodes, err := db.QueryAll[db.RestoreNode](w.DBClient, "", 0, "name = ?", "node-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(nodes).To(HaveLen(1))
+			return nodes[0].ActiveTasks
+		}
+
+		It("releases the node of a task no job holds and deletes its index on the target of the node", func() {
+			Expect(w.Cancel(context.Background(), "task", false)).To(Succeed())
+
+			tasks, err := db.QueryAll[db.Task](w.DBClient, "", 0, "task_id = ?", "task")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tasks[0].Status).To(Equal(string(utils.TaskCanceled)))
+			Expect(activeTasks()).To(Equal(0))
+			Expect(es.Requests()).To(ConsistOf("DELETE /restore_static_logs"))
+		})
+
+		It("leaves the node of a queued job to the job", func() {
+			Expect(w.Enqueue(&Job{TaskID: "task", Index: []string{"logs"}, Request: provisioner.NewRequest("node-1", "10Gi")})).To(Succeed())
+			Expect(w.Cancel(context.Background(), "task", false)).To(Succeed())
+
+			Expect(activeTasks()).To(Equal(1))
+			Expect(es.Requests()).To(BeEmpty())
+		})
+	})
+
+	Describe("Recover", func() {
+		It("queues the interrupted tasks with a payload again and fails the others", func() {
+			Expect(db.CreateRecords(w.DBClient, &[]db.RestoreNode{
+				{Name: "node-1", StoreSize: "10Gi", Status: string(utils.NodeActive), ActiveTasks: 2},
+			})).To(Succeed())
+			Expect(db.CreateRecords(w.DBClient, &[]db.Task{
+				{TaskID: "task", Index: "requeued", Status: string(utils.TaskRunning), Node: "node-1", Attempts: 1, Payload: utils.PtrToAny(`{"group":"group","store_size":"10Gi"}`)},
+				{TaskID: "task", Index: "failed", Status: string(utils.TaskRunning), Node: "node-1", Attempts: 1},
+				{TaskID: "task", Index: "done", Status: string(utils.TaskSuccess), Node: "node-1"},
+			})).To(Succeed())
+			Expect(db.CreateRecords(w.DBClient, &[]db.TaskAttempt{
+				{TaskID: "task", Index: "requeued", Attempt: 1, Status: string(utils.TaskRunning)},
+				{TaskID: "task", Index: "failed", Attempt: 1, Status: string(utils.TaskRunning)},
+			})).To(Succeed())
+
+			Expect(w.Recover(context.Background())).To(Succeed())
+
+			tasks, err := db.QueryAll[db.Task](w.DBClient, "", 0, "task_id = ?", "task")
+			Expect(err).NotTo(HaveOccurred())
+			recovered := make(map[string]db.Task)
+			for _, t := range tasks {
+				recovered[t.Index] = t
+			}
+			Expect(recovered["requeued"].Status).To(Equal(string(utils.TaskQueued)))
+			Expect(recovered["requeued"].Node).To(BeEmpty())
+			Expect(recovered["failed"].Status).To(Equal(string(utils.TaskFailed)))
+			Expect(recovered["failed"].ErrorMessage).To(HaveValue(Equal(errInterrupted.Error())))
+			Expect(recovered["done"].Status).To(Equal(string(utils.TaskSuccess)))
+
+			attempts, err := db.QueryAll[db.TaskAttempt](w.DBClient, "", 0, "task_id = ?", "task")
+			Expect(err).NotTo(HaveOccurred())
+			for _, a := range attempts {
+				Expect(a.Status).To(Equal(string(utils.TaskFailed)))
+				Expect(a.Retryable).To(Equal(a.Index == "requeued"))
+			}
+
+			nodes, err := db.QueryAll[db.RestoreNode](w.DBClient, "", 0, "name = ?", "node-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(nodes[0].ActiveTasks).To(Equal(0))
+			Expect(es.Requests()).To(ConsistOf("DELETE /restore_static_requeued", "DELETE /restore_static_failed"))
+		})
+	})
+})